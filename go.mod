@@ -1,16 +1,22 @@
 module github.com/aigic8/gosyn
 
-go 1.19
+go 1.24.0
 
 require (
 	github.com/cespare/xxhash v1.1.0
 	github.com/gorilla/mux v1.8.0
+	github.com/quic-go/quic-go v0.59.1
 	go.uber.org/zap v1.23.0
+	golang.org/x/text v0.30.0
 	gotest.tools/v3 v3.4.0
 )
 
 require (
 	github.com/google/go-cmp v0.5.5 // indirect
+	github.com/quic-go/qpack v0.6.0 // indirect
 	go.uber.org/atomic v1.10.0 // indirect
 	go.uber.org/multierr v1.8.0 // indirect
+	golang.org/x/crypto v0.43.0 // indirect
+	golang.org/x/net v0.46.0 // indirect
+	golang.org/x/sys v0.37.0 // indirect
 )
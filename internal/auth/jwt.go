@@ -0,0 +1,280 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256" // hashes of HS and RS algorithms
+	_ "crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+// JWT_NAME_PREFIX starts the names of JWT tokens, which are 'jwt:<iss>/<sub>'
+// so a JWT never gets the name of a stored token or of a subject of another
+// issuer. Stored tokens can not have names with the prefix.
+const JWT_NAME_PREFIX = "jwt:"
+
+// JWTVerifier verifies JWTs minted by someone else, like an SSO gateway. Grants
+// of a JWT are in its 'scope' claim as space separated grants (see ParseGrant).
+type JWTVerifier struct {
+	// Secret verifies HS256, HS384 and HS512 tokens
+	Secret []byte
+	// Keys verify EdDSA and RS256, RS384 and RS512 tokens. Tokens with a 'kid'
+	// header are only verified with the key with the same id or keys without id.
+	Keys     []JWTKey
+	Issuer   string
+	Audience string
+	// Leeway is the allowed clock difference for 'exp' and 'nbf' claims
+	Leeway time.Duration
+}
+
+type JWTKey struct {
+	ID  string
+	Key crypto.PublicKey
+}
+
+type (
+	jwtHeader struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+
+	jwtClaims struct {
+		ID        string      `json:"jti"`
+		Subject   string      `json:"sub"`
+		Issuer    string      `json:"iss"`
+		Audience  jwtAudience `json:"aud"`
+		ExpiresAt *int64      `json:"exp"`
+		NotBefore *int64      `json:"nbf"`
+		IssuedAt  *int64      `json:"iat"`
+		Scope     string      `json:"scope"`
+	}
+
+	// jwtAudience can be a string or a list of strings
+	jwtAudience []string
+)
+
+func (aud *jwtAudience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*aud = jwtAudience{single}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(aud))
+}
+
+// IsJWT reports whether a raw bearer token looks like a JWT and not a stored token
+func IsJWT(rawToken string) bool {
+	return strings.Count(rawToken, ".") == 2
+}
+
+// Verify checks the signature and claims of a JWT and returns it as a token.
+// JWTs must expire, so gosyn never accepts a token forever.
+func (verifier *JWTVerifier) Verify(rawToken string) (Token, error) {
+	parts := strings.Split(rawToken, ".")
+	if len(parts) != 3 {
+		return Token{}, ErrInvalidToken
+	}
+
+	header := jwtHeader{}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return Token{}, ErrInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Token{}, ErrInvalidToken
+	}
+	if !verifier.verifySignature(header, []byte(parts[0]+"."+parts[1]), signature) {
+		return Token{}, ErrInvalidToken
+	}
+
+	claims := jwtClaims{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return Token{}, ErrInvalidToken
+	}
+
+	now := time.Now()
+	if claims.ExpiresAt == nil {
+		return Token{}, ErrInvalidToken
+	}
+	expiresAt := time.Unix(*claims.ExpiresAt, 0)
+	if now.After(expiresAt.Add(verifier.Leeway)) {
+		return Token{}, ErrExpiredToken
+	}
+	if claims.NotBefore != nil && now.Add(verifier.Leeway).Before(time.Unix(*claims.NotBefore, 0)) {
+		return Token{}, ErrInvalidToken
+	}
+	if verifier.Issuer != "" && claims.Issuer != verifier.Issuer {
+		return Token{}, ErrInvalidToken
+	}
+	if verifier.Audience != "" && !claims.Audience.contains(verifier.Audience) {
+		return Token{}, ErrInvalidToken
+	}
+
+	token := Token{ID: claims.ID, Name: JWT_NAME_PREFIX + claims.Issuer + "/" + claims.Subject, ExpiresAt: &expiresAt}
+	if claims.IssuedAt != nil {
+		token.CreatedAt = time.Unix(*claims.IssuedAt, 0)
+	}
+	for _, rawGrant := range strings.Fields(claims.Scope) {
+		grant, err := ParseGrant(rawGrant)
+		// scopes of other services can be in the same token
+		if err != nil {
+			continue
+		}
+		token.Grants = append(token.Grants, grant)
+	}
+	return token, nil
+}
+
+func (verifier *JWTVerifier) verifySignature(header jwtHeader, signed []byte, signature []byte) bool {
+	switch header.Alg {
+	case "HS256", "HS384", "HS512":
+		if len(verifier.Secret) == 0 {
+			return false
+		}
+		mac := hmac.New(jwtHash(header.Alg).New, verifier.Secret)
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), signature)
+	case "EdDSA":
+		for _, key := range verifier.keys(header.Kid) {
+			if edKey, ok := key.(ed25519.PublicKey); ok && ed25519.Verify(edKey, signed, signature) {
+				return true
+			}
+		}
+	case "RS256", "RS384", "RS512":
+		hashType := jwtHash(header.Alg)
+		digest := hashSum(hashType.New(), signed)
+		for _, key := range verifier.keys(header.Kid) {
+			if rsaKey, ok := key.(*rsa.PublicKey); ok && rsa.VerifyPKCS1v15(rsaKey, hashType, digest, signature) == nil {
+				return true
+			}
+		}
+	}
+	// 'none' and unknown algorithms are never accepted
+	return false
+}
+
+func (verifier *JWTVerifier) keys(kid string) []crypto.PublicKey {
+	keys := []crypto.PublicKey{}
+	for _, key := range verifier.Keys {
+		if kid == "" || key.ID == "" || key.ID == kid {
+			keys = append(keys, key.Key)
+		}
+	}
+	return keys
+}
+
+func (aud jwtAudience) contains(audience string) bool {
+	for _, item := range aud {
+		if item == audience {
+			return true
+		}
+	}
+	return false
+}
+
+func jwtHash(alg string) crypto.Hash {
+	switch alg[2:] {
+	case "384":
+		return crypto.SHA384
+	case "512":
+		return crypto.SHA512
+	}
+	return crypto.SHA256
+}
+
+func hashSum(h hash.Hash, data []byte) []byte {
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// LoadPublicKeyFile reads a PEM encoded Ed25519 or RSA public key
+func LoadPublicKeyFile(filePath string) (crypto.PublicKey, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	if block.Type == "RSA PUBLIC KEY" {
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch key.(type) {
+	case ed25519.PublicKey, *rsa.PublicKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported public key type %T", key)
+}
+
+// LoadJWKSFile reads the Ed25519 (OKP) and RSA keys of a JWKS file, other keys are skipped
+func LoadJWKSFile(filePath string) ([]JWTKey, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	jwks := struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}{}
+	if err = json.Unmarshal(data, &jwks); err != nil {
+		return nil, err
+	}
+
+	keys := make([]JWTKey, 0, len(jwks.Keys))
+	for _, jwk := range jwks.Keys {
+		switch {
+		case jwk.Kty == "OKP" && jwk.Crv == "Ed25519":
+			x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+			if err != nil || len(x) != ed25519.PublicKeySize {
+				return nil, fmt.Errorf("bad Ed25519 key '%s'", jwk.Kid)
+			}
+			keys = append(keys, JWTKey{ID: jwk.Kid, Key: ed25519.PublicKey(x)})
+		case jwk.Kty == "RSA":
+			n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+			if err != nil {
+				return nil, fmt.Errorf("bad RSA key '%s'", jwk.Kid)
+			}
+			e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+			if err != nil || len(e) == 0 || len(e) > 4 {
+				return nil, fmt.Errorf("bad RSA key '%s'", jwk.Kid)
+			}
+			exponent := int(new(big.Int).SetBytes(e).Int64())
+			keys = append(keys, JWTKey{ID: jwk.Kid, Key: &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exponent}})
+		}
+	}
+	return keys, nil
+}
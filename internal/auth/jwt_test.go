@@ -0,0 +1,135 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+type jwtTestCase struct {
+	Name   string
+	Token  string
+	Err    error
+	Grants []Grant
+}
+
+func TestJWTVerifier(t *testing.T) {
+	secret := []byte("the great gig in the sky")
+	edPublic, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+
+	jwksFile := path.Join(t.TempDir(), "jwks.json")
+	jwks := map[string]any{"keys": []map[string]string{
+		{"kty": "OKP", "crv": "Ed25519", "kid": "ed", "x": base64.RawURLEncoding.EncodeToString(edPublic)},
+		{"kty": "RSA", "kid": "rsa", "n": base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes()), "e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kty": "EC", "kid": "ec"},
+	}}
+	jwksData, err := json.Marshal(jwks)
+	if err != nil {
+		panic(err)
+	}
+	if err = os.WriteFile(jwksFile, jwksData, 0644); err != nil {
+		panic(err)
+	}
+	keys, err := LoadJWKSFile(jwksFile)
+	assert.NilError(t, err)
+	assert.Equal(t, 2, len(keys))
+
+	verifier := &JWTVerifier{Secret: secret, Keys: keys, Issuer: "sso", Audience: "gosyn"}
+
+	now := time.Now().Unix()
+	claims := func(changes map[string]any) map[string]any {
+		c := map[string]any{"sub": "roger", "iss": "sso", "aud": []string{"gosyn", "other"}, "exp": now + 60, "scope": "songs:read:pink-floyd openid"}
+		for key, value := range changes {
+			if value == nil {
+				delete(c, key)
+				continue
+			}
+			c[key] = value
+		}
+		return c
+	}
+	sign := func(header map[string]any, claims map[string]any) string {
+		signed := encodePart(header) + "." + encodePart(claims)
+		var signature []byte
+		switch header["alg"] {
+		case "HS256":
+			mac := hmac.New(sha256.New, secret)
+			mac.Write([]byte(signed))
+			signature = mac.Sum(nil)
+		case "EdDSA":
+			signature = ed25519.Sign(edPrivate, []byte(signed))
+		case "RS256":
+			digest := sha256.Sum256([]byte(signed))
+			if signature, err = rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest[:]); err != nil {
+				panic(err)
+			}
+		}
+		return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+	}
+
+	// tamper keeps the signature of a token but changes its claims
+	tamper := func(token string, claims map[string]any) string {
+		parts := strings.Split(token, ".")
+		return parts[0] + "." + encodePart(claims) + "." + parts[2]
+	}
+
+	hs := map[string]any{"alg": "HS256"}
+	floydGrants := []Grant{{Endpoint: "songs", Permissions: []Permission{PermRead}, Paths: []string{"pink-floyd"}}}
+	testCases := []jwtTestCase{
+		{Name: "HS256", Token: sign(hs, claims(nil)), Grants: floydGrants},
+		{Name: "EdDSA", Token: sign(map[string]any{"alg": "EdDSA", "kid": "ed"}, claims(nil)), Grants: floydGrants},
+		{Name: "RS256", Token: sign(map[string]any{"alg": "RS256", "kid": "rsa"}, claims(nil)), Grants: floydGrants},
+		{Name: "RS256 without kid", Token: sign(map[string]any{"alg": "RS256"}, claims(nil)), Grants: floydGrants},
+		{Name: "wrong kid", Token: sign(map[string]any{"alg": "EdDSA", "kid": "rsa"}, claims(nil)), Err: ErrInvalidToken},
+		{Name: "alg none", Token: encodePart(map[string]any{"alg": "none"}) + "." + encodePart(claims(nil)) + ".", Err: ErrInvalidToken},
+		{Name: "tampered", Token: tamper(sign(hs, claims(nil)), claims(map[string]any{"scope": "*:admin"})), Err: ErrInvalidToken},
+		{Name: "expired", Token: sign(hs, claims(map[string]any{"exp": now - 60})), Err: ErrExpiredToken},
+		{Name: "no expiry", Token: sign(hs, claims(map[string]any{"exp": nil})), Err: ErrInvalidToken},
+		{Name: "not yet valid", Token: sign(hs, claims(map[string]any{"nbf": now + 60})), Err: ErrInvalidToken},
+		{Name: "other issuer", Token: sign(hs, claims(map[string]any{"iss": "evil"})), Err: ErrInvalidToken},
+		{Name: "other audience", Token: sign(hs, claims(map[string]any{"aud": "other"})), Err: ErrInvalidToken},
+		{Name: "single audience", Token: sign(hs, claims(map[string]any{"aud": "gosyn", "scope": nil}))},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			token, err := verifier.Verify(tc.Token)
+			if tc.Err != nil {
+				assert.ErrorIs(t, err, tc.Err)
+				return
+			}
+			assert.NilError(t, err)
+			assert.Equal(t, "jwt:sso/roger", token.Name)
+			assert.DeepEqual(t, tc.Grants, token.Grants)
+			assert.Equal(t, now+60, token.ExpiresAt.Unix())
+		})
+	}
+}
+
+func encodePart(v any) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
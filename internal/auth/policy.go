@@ -0,0 +1,168 @@
+package auth
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+type Permission string
+
+const (
+	PermList   Permission = "list"
+	PermRead   Permission = "read"
+	PermWrite  Permission = "write"
+	PermDelete Permission = "delete"
+	// PermAdmin allows everything, including managing snapshots
+	PermAdmin Permission = "admin"
+)
+
+// ALL_ENDPOINTS is the endpoint of grants for every endpoint
+const ALL_ENDPOINTS = "*"
+
+// Grant gives permissions on an endpoint. If Paths is not empty, only files
+// under those paths can be accessed and operations on the whole endpoint are
+// not allowed, except listings which only show what the grant can see.
+type Grant struct {
+	Endpoint    string       `json:"endpoint"`
+	Permissions []Permission `json:"permissions"`
+	Paths       []string     `json:"paths,omitempty"`
+}
+
+// ParseGrant parses grants written as 'endpoint:perm,perm[:path,path]', like
+// 'songs:read,write:pink-floyd' or '*:admin'.
+func ParseGrant(raw string) (Grant, error) {
+	parts := strings.Split(raw, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return Grant{}, fmt.Errorf("grant '%s' is not in form of endpoint:permissions[:paths]", raw)
+	}
+
+	grant := Grant{Endpoint: strings.TrimSpace(parts[0])}
+	if grant.Endpoint == "" {
+		return Grant{}, fmt.Errorf("grant '%s' has no endpoint", raw)
+	}
+
+	for _, rawPerm := range strings.Split(parts[1], ",") {
+		perm := Permission(strings.TrimSpace(rawPerm))
+		switch perm {
+		case PermList, PermRead, PermWrite, PermDelete, PermAdmin:
+			grant.Permissions = append(grant.Permissions, perm)
+		default:
+			return Grant{}, fmt.Errorf("unknown permission '%s' in grant '%s'", perm, raw)
+		}
+	}
+
+	if len(parts) == 3 {
+		for _, rawPath := range strings.Split(parts[2], ",") {
+			grantPath := cleanGrantPath(rawPath)
+			if grantPath == "" {
+				return Grant{}, fmt.Errorf("bad path '%s' in grant '%s'", rawPath, raw)
+			}
+			grant.Paths = append(grant.Paths, grantPath)
+		}
+	}
+
+	return grant, nil
+}
+
+func (grant Grant) String() string {
+	perms := make([]string, 0, len(grant.Permissions))
+	for _, perm := range grant.Permissions {
+		perms = append(perms, string(perm))
+	}
+	str := grant.Endpoint + ":" + strings.Join(perms, ",")
+	if len(grant.Paths) > 0 {
+		str += ":" + strings.Join(grant.Paths, ",")
+	}
+	return str
+}
+
+// Allows reports whether a permission on a file is granted. Empty filePath is
+// the whole endpoint.
+func (grant Grant) Allows(endpoint string, filePath string, perm Permission) bool {
+	if !grant.grants(endpoint, perm) {
+		return false
+	}
+
+	if len(grant.Paths) == 0 {
+		return true
+	}
+	filePath = cleanGrantPath(filePath)
+	if filePath == "" {
+		return false
+	}
+	for _, grantPath := range grant.Paths {
+		if filePath == grantPath || strings.HasPrefix(filePath, grantPath+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// CanSee reports whether a file is shown in listings of the whole endpoint
+// which need perm. Those are files under the grant paths and directories
+// leading to them. Empty filePath is the endpoint root.
+func (grant Grant) CanSee(endpoint string, filePath string, perm Permission) bool {
+	if !grant.grants(endpoint, perm) {
+		return false
+	}
+
+	filePath = cleanGrantPath(filePath)
+	if len(grant.Paths) == 0 || filePath == "" {
+		return true
+	}
+	for _, grantPath := range grant.Paths {
+		if filePath == grantPath || strings.HasPrefix(filePath, grantPath+"/") || strings.HasPrefix(grantPath, filePath+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// grants reports whether the grant has a permission on an endpoint
+func (grant Grant) grants(endpoint string, perm Permission) bool {
+	if grant.Endpoint != ALL_ENDPOINTS && grant.Endpoint != endpoint {
+		return false
+	}
+	for _, grantPerm := range grant.Permissions {
+		if grantPerm == perm || grantPerm == PermAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// Allows reports whether any grant of the token allows a permission on a file
+func (token *Token) Allows(endpoint string, filePath string, perm Permission) bool {
+	for _, grant := range token.Grants {
+		if grant.Allows(endpoint, filePath, perm) {
+			return true
+		}
+	}
+	return false
+}
+
+// CanSee reports whether the token has any access to an endpoint
+func (token *Token) CanSee(endpoint string) bool {
+	for _, grant := range token.Grants {
+		if grant.Endpoint == ALL_ENDPOINTS || grant.Endpoint == endpoint {
+			return true
+		}
+	}
+	return false
+}
+
+// CanSeeFile reports whether any grant of the token shows a file in listings
+// of the whole endpoint, see Grant.CanSee
+func (token *Token) CanSeeFile(endpoint string, filePath string, perm Permission) bool {
+	for _, grant := range token.Grants {
+		if grant.CanSee(endpoint, filePath, perm) {
+			return true
+		}
+	}
+	return false
+}
+
+func cleanGrantPath(filePath string) string {
+	return strings.Trim(path.Clean("/"+strings.TrimSpace(filePath)), "/")
+}
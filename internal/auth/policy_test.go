@@ -0,0 +1,67 @@
+package auth
+
+import (
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+type grantTestCase struct {
+	Name     string
+	Grant    string
+	Endpoint string
+	Path     string
+	Perm     Permission
+	Allowed  bool
+}
+
+func TestGrantAllows(t *testing.T) {
+	testCases := []grantTestCase{
+		{Name: "admin on all", Grant: "*:admin", Endpoint: "songs", Path: "time.txt", Perm: PermDelete, Allowed: true},
+		{Name: "admin on endpoint", Grant: "*:admin", Endpoint: "songs", Perm: PermList, Allowed: true},
+		{Name: "granted permission", Grant: "songs:read,write", Endpoint: "songs", Path: "time.txt", Perm: PermWrite, Allowed: true},
+		{Name: "other permission", Grant: "songs:read,write", Endpoint: "songs", Path: "time.txt", Perm: PermDelete, Allowed: false},
+		{Name: "other endpoint", Grant: "songs:read", Endpoint: "photos", Path: "time.txt", Perm: PermRead, Allowed: false},
+		{Name: "in path", Grant: "songs:read:pink-floyd", Endpoint: "songs", Path: "pink-floyd/time.txt", Perm: PermRead, Allowed: true},
+		{Name: "the path itself", Grant: "songs:read:/pink-floyd/", Endpoint: "songs", Path: "pink-floyd", Perm: PermRead, Allowed: true},
+		{Name: "path with same prefix", Grant: "songs:read:pink-floyd", Endpoint: "songs", Path: "pink-floyd-live/time.txt", Perm: PermRead, Allowed: false},
+		{Name: "path escaping", Grant: "songs:read:pink-floyd", Endpoint: "songs", Path: "pink-floyd/../queen/time.txt", Perm: PermRead, Allowed: false},
+		{Name: "whole endpoint with paths", Grant: "songs:read:pink-floyd", Endpoint: "songs", Perm: PermRead, Allowed: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			grant, err := ParseGrant(tc.Grant)
+			assert.NilError(t, err)
+			assert.Equal(t, tc.Allowed, grant.Allows(tc.Endpoint, tc.Path, tc.Perm))
+		})
+	}
+}
+
+func TestGrantCanSee(t *testing.T) {
+	testCases := []grantTestCase{
+		{Name: "root without paths", Grant: "songs:list", Endpoint: "songs", Perm: PermList, Allowed: true},
+		{Name: "root with paths", Grant: "songs:list:pink-floyd/dark", Endpoint: "songs", Perm: PermList, Allowed: true},
+		{Name: "dir leading to path", Grant: "songs:list:pink-floyd/dark", Endpoint: "songs", Path: "pink-floyd", Perm: PermList, Allowed: true},
+		{Name: "in path", Grant: "songs:list:pink-floyd/dark", Endpoint: "songs", Path: "pink-floyd/dark/time.txt", Perm: PermList, Allowed: true},
+		{Name: "sibling of path", Grant: "songs:list:pink-floyd/dark", Endpoint: "songs", Path: "pink-floyd/wall", Perm: PermList, Allowed: false},
+		{Name: "path with same prefix", Grant: "songs:list:pink-floyd", Endpoint: "songs", Path: "pink-floyd-live", Perm: PermList, Allowed: false},
+		{Name: "other permission", Grant: "songs:read:pink-floyd", Endpoint: "songs", Perm: PermList, Allowed: false},
+		{Name: "other endpoint", Grant: "songs:list:pink-floyd", Endpoint: "photos", Perm: PermList, Allowed: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			grant, err := ParseGrant(tc.Grant)
+			assert.NilError(t, err)
+			assert.Equal(t, tc.Allowed, grant.CanSee(tc.Endpoint, tc.Path, tc.Perm))
+		})
+	}
+}
+
+func TestParseGrantErrors(t *testing.T) {
+	for _, raw := range []string{"songs", ":read", "songs:sing", "songs:read:/", "songs:read:a:b"} {
+		_, err := ParseGrant(raw)
+		assert.Assert(t, err != nil, raw)
+	}
+}
@@ -0,0 +1,287 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidShare = errors.New("share link is invalid")
+	ErrExpiredShare = errors.New("share link is expired")
+	ErrRevokedShare = errors.New("share link is revoked")
+	ErrShareUsedUp  = errors.New("share link has no downloads left")
+)
+
+// ShareClaims is what a share link gives access to. Links carry their claims
+// and are signed with the server share key, so they are checked without a
+// lookup. Only revoked links and download counts are stored.
+type ShareClaims struct {
+	ID string `json:"id"`
+	// File is the shared file or directory as 'endpoint/path', or the
+	// endpoint of upload links
+	File         string `json:"file"`
+	ExpiresAt    int64  `json:"exp"`
+	MaxDownloads int    `json:"max,omitempty"`
+	// Upload links can only upload to drop boxes, MaxDownloads limits
+	// their uploads
+	Upload bool `json:"upload,omitempty"`
+	// Password is a MAC of the password, it can not be guessed offline
+	// without the share key.
+	Password string `json:"pw,omitempty"`
+}
+
+func (claims *ShareClaims) Expiry() time.Time {
+	return time.Unix(claims.ExpiresAt, 0)
+}
+
+func (claims *ShareClaims) HasPassword() bool {
+	return claims.Password != ""
+}
+
+// ShareStore signs and verifies share links. The state file has the download
+// counts of links with MaxDownloads and the revocation list, links are dropped
+// from it once they expire.
+type ShareStore struct {
+	key      []byte
+	filePath string
+	mu       sync.Mutex
+	links    map[string]shareRecord
+}
+
+type shareRecord struct {
+	ExpiresAt int64 `json:"exp"`
+	Downloads int   `json:"downloads,omitempty"`
+	Revoked   bool  `json:"revoked,omitempty"`
+}
+
+// OpenShareStore reads the share key and state files. A missing key file is
+// created with a random key, missing state file is an empty state.
+func OpenShareStore(keyFile string, stateFile string) (*ShareStore, error) {
+	key, err := loadShareKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &ShareStore{key: key, filePath: stateFile, links: map[string]shareRecord{}}
+	data, err := os.ReadFile(stateFile)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return store, nil
+		}
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &store.links); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Sign returns the link token of the claims, as '<claims>.<signature>'. A
+// random ID is set and the password is replaced with its MAC.
+func (store *ShareStore) Sign(claims ShareClaims, password string) (ShareClaims, string, error) {
+	id, err := randomHex(8)
+	if err != nil {
+		return ShareClaims{}, "", err
+	}
+	claims.ID = id
+	claims.Password = ""
+	if password != "" {
+		claims.Password = store.passwordMAC(id, password)
+	}
+
+	data, err := json.Marshal(&claims)
+	if err != nil {
+		return ShareClaims{}, "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return claims, payload + "." + store.sign(payload), nil
+}
+
+// Verify checks the signature, expiry and revocation of a link token. Claims
+// of expired and revoked links are returned with their error.
+func (store *ShareStore) Verify(rawLink string) (ShareClaims, error) {
+	payload, signature, found := strings.Cut(rawLink, ".")
+	if !found {
+		return ShareClaims{}, ErrInvalidShare
+	}
+	if subtle.ConstantTimeCompare([]byte(store.sign(payload)), []byte(signature)) != 1 {
+		return ShareClaims{}, ErrInvalidShare
+	}
+
+	claims, err := DecodeShareClaims(rawLink)
+	if err != nil {
+		return ShareClaims{}, ErrInvalidShare
+	}
+	if !time.Now().Before(claims.Expiry()) {
+		return claims, ErrExpiredShare
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.links[claims.ID].Revoked {
+		return claims, ErrRevokedShare
+	}
+	return claims, nil
+}
+
+// CheckPassword reports whether password is the password of the link, links
+// without password accept any password.
+func (store *ShareStore) CheckPassword(claims ShareClaims, password string) bool {
+	if !claims.HasPassword() {
+		return true
+	}
+	return hmac.Equal([]byte(store.passwordMAC(claims.ID, password)), []byte(claims.Password))
+}
+
+// UseDownload counts a download (or upload of upload links) of a verified
+// link, ErrShareUsedUp is returned if it has no downloads left.
+func (store *ShareStore) UseDownload(claims ShareClaims) error {
+	if claims.MaxDownloads <= 0 {
+		return nil
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	record := store.links[claims.ID]
+	if record.Revoked {
+		return ErrRevokedShare
+	}
+	if record.Downloads >= claims.MaxDownloads {
+		return ErrShareUsedUp
+	}
+	record.ExpiresAt = claims.ExpiresAt
+	record.Downloads++
+	store.links[claims.ID] = record
+	return store.save()
+}
+
+// RefundDownload gives back a download counted by UseDownload, for uploads of
+// upload links which failed after the link was used
+func (store *ShareStore) RefundDownload(claims ShareClaims) error {
+	if claims.MaxDownloads <= 0 {
+		return nil
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	record, ok := store.links[claims.ID]
+	if !ok || record.Downloads == 0 {
+		return nil
+	}
+	record.Downloads--
+	store.links[claims.ID] = record
+	return store.save()
+}
+
+// Revoke adds a verified link to the revocation list
+func (store *ShareStore) Revoke(claims ShareClaims) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	record := store.links[claims.ID]
+	record.ExpiresAt = claims.ExpiresAt
+	record.Revoked = true
+	store.links[claims.ID] = record
+	return store.save()
+}
+
+// DecodeShareClaims returns the claims of a link token WITHOUT verifying it
+func DecodeShareClaims(rawLink string) (ShareClaims, error) {
+	payload, _, _ := strings.Cut(rawLink, ".")
+	claims := ShareClaims{}
+	if err := decodeJWTPart(payload, &claims); err != nil {
+		return ShareClaims{}, err
+	}
+	if claims.ID == "" || claims.File == "" {
+		return ShareClaims{}, ErrInvalidShare
+	}
+	return claims, nil
+}
+
+func (store *ShareStore) sign(payload string) string {
+	mac := hmac.New(sha256.New, store.key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (store *ShareStore) passwordMAC(id string, password string) string {
+	mac := hmac.New(sha256.New, store.key)
+	mac.Write([]byte("password:" + id + ":" + password))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// save writes the state file, records of expired links are dropped since
+// expired links are rejected anyway.
+func (store *ShareStore) save() error {
+	now := time.Now().Unix()
+	for id, record := range store.links {
+		if record.ExpiresAt <= now {
+			delete(store.links, id)
+		}
+	}
+
+	data, err := json.MarshalIndent(store.links, "", "  ")
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(store.filePath); dir != "" {
+		if err = os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	}
+
+	tmpPath := store.filePath + ".tmp"
+	if err = os.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, store.filePath)
+}
+
+func loadShareKey(keyFile string) ([]byte, error) {
+	data, err := os.ReadFile(keyFile)
+	if err == nil {
+		key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(key) < 32 {
+			return nil, errors.New("share key must be at least 32 hex encoded bytes")
+		}
+		return key, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	rawKey, err := randomHex(32)
+	if err != nil {
+		return nil, err
+	}
+	if dir := filepath.Dir(keyFile); dir != "" {
+		if err = os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+	}
+	// O_EXCL, so two servers starting together do not use different keys
+	file, err := os.OpenFile(keyFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return loadShareKey(keyFile)
+		}
+		return nil, err
+	}
+	defer file.Close()
+	if _, err = file.WriteString(rawKey + "\n"); err != nil {
+		return nil, err
+	}
+	return hex.DecodeString(rawKey)
+}
@@ -0,0 +1,118 @@
+package auth
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestShareStore(t *testing.T) {
+	base := t.TempDir()
+	keyFile, stateFile := path.Join(base, "share.key"), path.Join(base, "shares.json")
+	store, err := OpenShareStore(keyFile, stateFile)
+	assert.NilError(t, err)
+
+	expiresAt := time.Now().Add(time.Hour).Unix()
+	claims, link, err := store.Sign(ShareClaims{File: "songs/time.txt", ExpiresAt: expiresAt, MaxDownloads: 2}, "breathe")
+	assert.NilError(t, err)
+	assert.Assert(t, claims.ID != "")
+	assert.Assert(t, !strings.Contains(link, "breathe"))
+
+	t.Run("verify", func(t *testing.T) {
+		verified, err := store.Verify(link)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, claims, verified)
+
+		payload, signature, _ := strings.Cut(link, ".")
+		_, err = store.Verify(payload + "." + signature[1:])
+		assert.ErrorIs(t, err, ErrInvalidShare)
+		_, err = store.Verify(payload)
+		assert.ErrorIs(t, err, ErrInvalidShare)
+
+		_, otherLink, err := store.Sign(ShareClaims{File: "songs/money.txt", ExpiresAt: expiresAt}, "")
+		if err != nil {
+			panic(err)
+		}
+		_, otherSignature, _ := strings.Cut(otherLink, ".")
+		_, err = store.Verify(payload + "." + otherSignature)
+		assert.ErrorIs(t, err, ErrInvalidShare)
+	})
+
+	t.Run("key is kept", func(t *testing.T) {
+		keyStat, err := os.Stat(keyFile)
+		if err != nil {
+			panic(err)
+		}
+		assert.Equal(t, os.FileMode(0600), keyStat.Mode().Perm())
+
+		reopened, err := OpenShareStore(keyFile, stateFile)
+		assert.NilError(t, err)
+		_, err = reopened.Verify(link)
+		assert.NilError(t, err)
+
+		otherStore, err := OpenShareStore(path.Join(base, "other.key"), path.Join(base, "other.json"))
+		if err != nil {
+			panic(err)
+		}
+		_, err = otherStore.Verify(link)
+		assert.ErrorIs(t, err, ErrInvalidShare)
+	})
+
+	t.Run("password", func(t *testing.T) {
+		assert.Assert(t, store.CheckPassword(claims, "breathe"))
+		assert.Assert(t, !store.CheckPassword(claims, "speak to me"))
+		assert.Assert(t, !store.CheckPassword(claims, ""))
+
+		noPassword, _, err := store.Sign(ShareClaims{File: "songs/time.txt", ExpiresAt: expiresAt}, "")
+		if err != nil {
+			panic(err)
+		}
+		assert.Assert(t, store.CheckPassword(noPassword, ""))
+	})
+
+	t.Run("max downloads", func(t *testing.T) {
+		assert.NilError(t, store.UseDownload(claims))
+
+		// counts are kept after restart
+		reopened, err := OpenShareStore(keyFile, stateFile)
+		if err != nil {
+			panic(err)
+		}
+		assert.NilError(t, reopened.UseDownload(claims))
+		assert.ErrorIs(t, reopened.UseDownload(claims), ErrShareUsedUp)
+
+		assert.NilError(t, reopened.RefundDownload(claims))
+		assert.NilError(t, reopened.UseDownload(claims))
+		assert.ErrorIs(t, reopened.UseDownload(claims), ErrShareUsedUp)
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		_, expiredLink, err := store.Sign(ShareClaims{File: "songs/time.txt", ExpiresAt: time.Now().Add(-time.Second).Unix()}, "")
+		if err != nil {
+			panic(err)
+		}
+		_, err = store.Verify(expiredLink)
+		assert.ErrorIs(t, err, ErrExpiredShare)
+	})
+
+	t.Run("revoke", func(t *testing.T) {
+		revoked, revokedLink, err := store.Sign(ShareClaims{File: "songs/time.txt", ExpiresAt: expiresAt}, "")
+		if err != nil {
+			panic(err)
+		}
+		assert.NilError(t, store.Revoke(revoked))
+		_, err = store.Verify(revokedLink)
+		assert.ErrorIs(t, err, ErrRevokedShare)
+
+		reopened, err := OpenShareStore(keyFile, stateFile)
+		if err != nil {
+			panic(err)
+		}
+		_, err = reopened.Verify(revokedLink)
+		assert.ErrorIs(t, err, ErrRevokedShare)
+	})
+}
@@ -0,0 +1,266 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LAST_USED_RESOLUTION is how often last use of a token is written to the token file
+const LAST_USED_RESOLUTION = time.Minute
+
+var (
+	ErrInvalidToken  = errors.New("token is invalid")
+	ErrExpiredToken  = errors.New("token is expired")
+	ErrTokenNotFound = errors.New("token not found")
+	ErrReservedName  = errors.New("token names starting with '" + JWT_NAME_PREFIX + "' are reserved for JWTs")
+)
+
+// Token is a stored token. The secret part of the token is only kept as a
+// salted sha256 hash, tokens are random so a slow hash is not needed. A token
+// can only do what its grants allow.
+type Token struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Grants     []Grant    `json:"grants"`
+	Salt       string     `json:"salt"`
+	Hash       string     `json:"hash"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+}
+
+// Expired reports whether the token is expired at t
+func (token *Token) Expired(t time.Time) bool {
+	return token.ExpiresAt != nil && !t.Before(*token.ExpiresAt)
+}
+
+// TokenStore keeps tokens in a json file. Tokens are given to users as
+// '<id>.<secret>'. The file is reloaded when it changes, so tokens created or
+// revoked with the CLI apply to a running server.
+type TokenStore struct {
+	filePath string
+	mu       sync.Mutex
+	tokens   []Token
+	modTime  time.Time
+}
+
+// OpenTokenStore reads the token file, a missing file is an empty store
+func OpenTokenStore(filePath string) (*TokenStore, error) {
+	store := &TokenStore{filePath: filePath}
+	if err := store.reload(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Create makes a new token and returns it with the raw token, which is not
+// stored and can not be shown again. Zero ttl means the token never expires.
+func (store *TokenStore) Create(name string, ttl time.Duration, grants []Grant) (Token, string, error) {
+	if strings.HasPrefix(name, JWT_NAME_PREFIX) {
+		return Token{}, "", ErrReservedName
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if err := store.reload(); err != nil {
+		return Token{}, "", err
+	}
+
+	id, err := randomHex(8)
+	if err != nil {
+		return Token{}, "", err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return Token{}, "", err
+	}
+	salt, err := randomHex(16)
+	if err != nil {
+		return Token{}, "", err
+	}
+
+	token := Token{ID: id, Name: name, Grants: grants, Salt: salt, Hash: hashSecret(salt, secret), CreatedAt: time.Now()}
+	if ttl > 0 {
+		expiresAt := token.CreatedAt.Add(ttl)
+		token.ExpiresAt = &expiresAt
+	}
+
+	store.tokens = append(store.tokens, token)
+	if err = store.save(); err != nil {
+		return Token{}, "", err
+	}
+	return token, id + "." + secret, nil
+}
+
+// List returns stored tokens, oldest first
+func (store *TokenStore) List() ([]Token, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if err := store.reload(); err != nil {
+		return nil, err
+	}
+	tokens := make([]Token, len(store.tokens))
+	copy(tokens, store.tokens)
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].CreatedAt.Before(tokens[j].CreatedAt) })
+	return tokens, nil
+}
+
+// Revoke removes the tokens with the id or name, ErrTokenNotFound is returned
+// if there is none.
+func (store *TokenStore) Revoke(idOrName string) ([]Token, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if err := store.reload(); err != nil {
+		return nil, err
+	}
+
+	remaining := make([]Token, 0, len(store.tokens))
+	revoked := []Token{}
+	for _, token := range store.tokens {
+		if token.ID == idOrName || token.Name == idOrName {
+			revoked = append(revoked, token)
+			continue
+		}
+		remaining = append(remaining, token)
+	}
+	if len(revoked) == 0 {
+		return nil, ErrTokenNotFound
+	}
+
+	store.tokens = remaining
+	return revoked, store.save()
+}
+
+// Len returns the number of stored tokens
+func (store *TokenStore) Len() (int, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if err := store.reload(); err != nil {
+		return 0, err
+	}
+	return len(store.tokens), nil
+}
+
+// Authenticate returns the token matching a raw token. Its last use is updated,
+// at most once in LAST_USED_RESOLUTION.
+func (store *TokenStore) Authenticate(rawToken string) (Token, error) {
+	id, secret, found := strings.Cut(rawToken, ".")
+	if !found || id == "" || secret == "" {
+		return Token{}, ErrInvalidToken
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if err := store.reload(); err != nil {
+		return Token{}, err
+	}
+
+	for i := range store.tokens {
+		token := &store.tokens[i]
+		if token.ID != id {
+			continue
+		}
+
+		if subtle.ConstantTimeCompare([]byte(hashSecret(token.Salt, secret)), []byte(token.Hash)) != 1 {
+			return Token{}, ErrInvalidToken
+		}
+
+		now := time.Now()
+		if token.Expired(now) {
+			return Token{}, ErrExpiredToken
+		}
+
+		if token.LastUsedAt == nil || now.Sub(*token.LastUsedAt) >= LAST_USED_RESOLUTION {
+			token.LastUsedAt = &now
+			if err := store.save(); err != nil {
+				return Token{}, err
+			}
+		}
+		return *token, nil
+	}
+
+	return Token{}, ErrInvalidToken
+}
+
+// reload reads the token file if it has changed since it was last read
+func (store *TokenStore) reload() error {
+	stat, err := os.Stat(store.filePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			store.tokens, store.modTime = []Token{}, time.Time{}
+			return nil
+		}
+		return err
+	}
+	if stat.ModTime().Equal(store.modTime) && store.tokens != nil {
+		return nil
+	}
+
+	data, err := os.ReadFile(store.filePath)
+	if err != nil {
+		return err
+	}
+	tokens := []Token{}
+	if err = json.Unmarshal(data, &tokens); err != nil {
+		return err
+	}
+	store.tokens, store.modTime = tokens, stat.ModTime()
+	return nil
+}
+
+func (store *TokenStore) save() error {
+	data, err := json.MarshalIndent(store.tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if dir := filepath.Dir(store.filePath); dir != "" {
+		if err = os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	}
+
+	// hashes are not secrets, but nobody else needs to read them
+	tmpPath := store.filePath + ".tmp"
+	if err = os.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpPath, store.filePath); err != nil {
+		return err
+	}
+
+	stat, err := os.Stat(store.filePath)
+	if err != nil {
+		return err
+	}
+	store.modTime = stat.ModTime()
+	return nil
+}
+
+func hashSecret(salt string, secret string) string {
+	hash := sha256.Sum256([]byte(salt + secret))
+	return hex.EncodeToString(hash[:])
+}
+
+func randomHex(n int) (string, error) {
+	data := make([]byte, n)
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(data), nil
+}
@@ -0,0 +1,72 @@
+package auth
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+var adminGrants = []Grant{{Endpoint: ALL_ENDPOINTS, Permissions: []Permission{PermAdmin}}}
+
+func TestTokenStore(t *testing.T) {
+	tokenFile := path.Join(t.TempDir(), "tokens.json")
+	store, err := OpenTokenStore(tokenFile)
+	assert.NilError(t, err)
+
+	token, rawToken, err := store.Create("echoes", 0, adminGrants)
+	assert.NilError(t, err)
+	assert.Assert(t, strings.HasPrefix(rawToken, token.ID+"."))
+	assert.Assert(t, token.ExpiresAt == nil)
+
+	fileData, err := os.ReadFile(tokenFile)
+	if err != nil {
+		panic(err)
+	}
+	secret := strings.Split(rawToken, ".")[1]
+	assert.Assert(t, !strings.Contains(string(fileData), secret))
+
+	_, _, err = store.Create("jwt:sso/roger", 0, adminGrants)
+	assert.ErrorIs(t, err, ErrReservedName)
+
+	t.Run("authenticate", func(t *testing.T) {
+		authed, err := store.Authenticate(rawToken)
+		assert.NilError(t, err)
+		assert.Equal(t, token.ID, authed.ID)
+		assert.Assert(t, authed.LastUsedAt != nil)
+
+		_, err = store.Authenticate(token.ID + ".0000")
+		assert.ErrorIs(t, err, ErrInvalidToken)
+		_, err = store.Authenticate("no-dot")
+		assert.ErrorIs(t, err, ErrInvalidToken)
+	})
+
+	t.Run("other store instances see changes", func(t *testing.T) {
+		otherStore, err := OpenTokenStore(tokenFile)
+		if err != nil {
+			panic(err)
+		}
+		tokens, err := otherStore.List()
+		assert.NilError(t, err)
+		assert.Equal(t, 1, len(tokens))
+		assert.Assert(t, tokens[0].LastUsedAt != nil)
+
+		_, err = otherStore.Revoke("echoes")
+		assert.NilError(t, err)
+		_, err = store.Authenticate(rawToken)
+		assert.ErrorIs(t, err, ErrInvalidToken)
+
+		_, err = otherStore.Revoke("echoes")
+		assert.ErrorIs(t, err, ErrTokenNotFound)
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		_, rawToken, err := store.Create("time", time.Nanosecond, adminGrants)
+		assert.NilError(t, err)
+		_, err = store.Authenticate(rawToken)
+		assert.ErrorIs(t, err, ErrExpiredToken)
+	})
+}
@@ -0,0 +1,538 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aigic8/gosyn/internal/ignore"
+)
+
+const (
+	DEFAULT_ADDRESS       = ":8080"
+	DEFAULT_TOKEN_FILE    = "gosyn-tokens.json"
+	DEFAULT_MAX_VERSIONS  = 10
+	DEFAULT_TRASH_MAX_AGE = Duration(30 * 24 * time.Hour)
+	DEFAULT_SHARE_KEY     = "gosyn-share.key"
+	DEFAULT_SHARE_STATE   = "gosyn-shares.json"
+	DEFAULT_SHARE_MAX_AGE = Duration(30 * 24 * time.Hour)
+	// DEFAULT_DROPBOX_MAX_FILE_SIZE is the max size of files uploaded to drop boxes
+	DEFAULT_DROPBOX_MAX_FILE_SIZE int64 = 100 * 1024 * 1024 // 100 MB
+	// DEFAULT_UNIX_SOCKET_MODE lets the owner and group of the socket connect
+	DEFAULT_UNIX_SOCKET_MODE = FileMode(0660)
+	// CLOCK_LAYOUT is the layout of times of day in limit schedules
+	CLOCK_LAYOUT = "15:04"
+)
+
+// Duration is a time.Duration written like "72h" in json
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var rawDuration string
+	if err := json.Unmarshal(data, &rawDuration); err != nil {
+		return err
+	}
+
+	duration, err := time.ParseDuration(rawDuration)
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// FileMode is an os.FileMode written in octal like "0660" in json
+type FileMode os.FileMode
+
+func (m *FileMode) UnmarshalJSON(data []byte) error {
+	var rawMode string
+	if err := json.Unmarshal(data, &rawMode); err != nil {
+		return err
+	}
+
+	mode, err := strconv.ParseUint(rawMode, 8, 32)
+	if err != nil || mode > 0777 {
+		return fmt.Errorf("bad file mode '%s'", rawMode)
+	}
+	*m = FileMode(mode)
+	return nil
+}
+
+func (m FileMode) MarshalJSON() ([]byte, error) {
+	return json.Marshal(fmt.Sprintf("%04o", uint32(m)))
+}
+
+// EndpointMode decides what clients can do with an endpoint
+type EndpointMode string
+
+const (
+	// ModeNormal allows every change, an empty mode is defaulted to it by Load
+	ModeNormal EndpointMode = "normal"
+	// ModeDropBox only collects uploads, see DropBoxConfig
+	ModeDropBox EndpointMode = "dropbox"
+	// ModeReadOnly allows no changes to files
+	ModeReadOnly EndpointMode = "read-only"
+	// ModeWriteOnce allows creating files but never changing or deleting
+	// them, like for audit archives
+	ModeWriteOnce EndpointMode = "write-once"
+	// ModeAppendOnly is ModeWriteOnce which also allows appending to files,
+	// the new content of a file must start with its old content
+	ModeAppendOnly EndpointMode = "append-only"
+)
+
+// SymlinkPolicy decides how symlinks in an endpoint are treated
+type SymlinkPolicy string
+
+const (
+	// SymlinksIgnore hides symlinks and refuses paths going through them
+	SymlinksIgnore SymlinkPolicy = "ignore"
+	// SymlinksFollowWithin follows symlinks which resolve to a path in the
+	// endpoint and hides others, an empty policy is defaulted to it by Load
+	SymlinksFollowWithin SymlinkPolicy = "follow-within-endpoint"
+	// SymlinksFollowAny follows every symlink, even out of the endpoint
+	SymlinksFollowAny SymlinkPolicy = "follow-any"
+	// SymlinksAsLink never follows symlinks, they are listed with their
+	// targets and synced as links
+	SymlinksAsLink SymlinkPolicy = "sync-as-link"
+)
+
+// NamesPolicy decides how new file names which break other platforms are
+// treated, like names which differ only in case from a sibling, names reserved
+// on Windows or names which are not in Unicode NFC form
+type NamesPolicy string
+
+const (
+	// NamesAllow accepts any name, an empty policy is defaulted to it by Load
+	NamesAllow NamesPolicy = "allow"
+	// NamesReject refuses names which are not portable
+	NamesReject NamesPolicy = "reject"
+	// NamesNormalize rewrites names to a portable form, names differing only
+	// in case from a sibling are still refused
+	NamesNormalize NamesPolicy = "normalize"
+)
+
+// ConflictPolicy decides what happens when a client writes a file which was
+// changed by someone else since the client last saw it.
+type ConflictPolicy string
+
+const (
+	// ConflictManual rejects the write and leaves the conflict to the user
+	ConflictManual     ConflictPolicy = ""
+	ConflictServerWins ConflictPolicy = "server-wins"
+	ConflictClientWins ConflictPolicy = "client-wins"
+	ConflictNewestWins ConflictPolicy = "newest-wins"
+	// ConflictKeepBoth keeps the server file and writes the client version to a conflict copy
+	ConflictKeepBoth ConflictPolicy = "keep-both"
+)
+
+type (
+	Config struct {
+		Server ServerConfig `json:"server"`
+	}
+
+	ServerConfig struct {
+		Address     string                    `json:"address"`
+		Endpoints   map[string]EndpointConfig `json:"endpoints"`
+		MaxHashSize int64                     `json:"maxHashSize"`
+		TokenFile   string                    `json:"tokenFile"`
+		Auth        AuthConfig                `json:"auth"`
+		JWT         *JWTConfig                `json:"jwt"`
+		Shares      ShareConfig               `json:"shares"`
+		TLS         *TLSConfig                `json:"tls"`
+		// H2C serves cleartext HTTP/2 besides HTTP/1.1 on servers without TLS
+		H2C        bool              `json:"h2c"`
+		UnixSocket *UnixSocketConfig `json:"unixSocket"`
+		Limits     LimitsConfig      `json:"limits"`
+		// DiskReserve is the free disk space in bytes uploads can not use
+		DiskReserve int64 `json:"diskReserve"`
+	}
+
+	// LimitsConfig limits the request rate and bandwidth of all clients
+	// together (Global), of each token (PerToken) and of each client IP
+	// (PerIP). While a schedule is active its limits are used instead, the
+	// first active schedule wins.
+	LimitsConfig struct {
+		Global    RateLimitConfig       `json:"global"`
+		PerToken  RateLimitConfig       `json:"perToken"`
+		PerIP     RateLimitConfig       `json:"perIP"`
+		Schedules []LimitScheduleConfig `json:"schedules"`
+	}
+
+	// LimitScheduleConfig is active between From and To (like "09:00" and
+	// "17:00" in the server local time) of Days (like "mon", every day if
+	// empty). A To before From ends on the next day.
+	LimitScheduleConfig struct {
+		Days     []string        `json:"days"`
+		From     string          `json:"from"`
+		To       string          `json:"to"`
+		Global   RateLimitConfig `json:"global"`
+		PerToken RateLimitConfig `json:"perToken"`
+		PerIP    RateLimitConfig `json:"perIP"`
+	}
+
+	// RateLimitConfig is a set of token bucket limits, zero values mean no
+	// limit. Burst is how many requests can be sent at once, zero is
+	// defaulted to RequestsPerSecond rounded up. Bandwidth bursts are one
+	// second of bandwidth.
+	RateLimitConfig struct {
+		RequestsPerSecond      float64 `json:"requestsPerSecond"`
+		Burst                  int     `json:"burst"`
+		UploadBytesPerSecond   int64   `json:"uploadBytesPerSecond"`
+		DownloadBytesPerSecond int64   `json:"downloadBytesPerSecond"`
+	}
+
+	// UnixSocketConfig serves the API on a unix socket too, without TLS. Who
+	// can connect is decided by Mode (defaulted to DEFAULT_UNIX_SOCKET_MODE
+	// by Load) and Group of the socket file. Requests over the socket have
+	// Grants without a token.
+	UnixSocketConfig struct {
+		Path   string   `json:"path"`
+		Mode   FileMode `json:"mode"`
+		Group  string   `json:"group"`
+		Grants []string `json:"grants"`
+	}
+
+	// TLSConfig enables https. The cert and key files are reloaded when they
+	// change, so rotated certs apply without a restart. If ClientCAFile is set
+	// clients can authenticate with certs signed by it (mutual TLS), Clients
+	// maps the subject of client certs (its common name or the full subject,
+	// like "CN=office,O=Acme") to grants (see auth.ParseGrant). HTTP3 also
+	// serves HTTP/3 over QUIC on the UDP port of the server address, in builds
+	// with the 'http3' build tag.
+	TLSConfig struct {
+		CertFile          string              `json:"certFile"`
+		KeyFile           string              `json:"keyFile"`
+		ClientCAFile      string              `json:"clientCAFile"`
+		RequireClientCert bool                `json:"requireClientCert"`
+		Clients           map[string][]string `json:"clients"`
+		HTTP3             bool                `json:"http3"`
+	}
+
+	// AuthConfig can disable authentication, which is otherwise always on.
+	// Without tokens, jwt, client cert or unix socket grants every request is
+	// denied until a token is created.
+	AuthConfig struct {
+		Disabled bool `json:"disabled"`
+	}
+
+	// JWTConfig enables authentication with JWTs minted by others. HS* tokens
+	// are verified with Secret, EdDSA and RS* tokens with PEM public keys of
+	// PublicKeyFiles and keys of JWKSFile.
+	JWTConfig struct {
+		Secret         string   `json:"secret"`
+		PublicKeyFiles []string `json:"publicKeyFiles"`
+		JWKSFile       string   `json:"jwksFile"`
+		Issuer         string   `json:"issuer"`
+		Audience       string   `json:"audience"`
+		Leeway         Duration `json:"leeway"`
+	}
+
+	// ShareConfig is where share links keep their signing key and the state of
+	// links (download counts and revocations). MaxAge is the longest a link can
+	// be valid.
+	ShareConfig struct {
+		KeyFile   string   `json:"keyFile"`
+		StateFile string   `json:"stateFile"`
+		MaxAge    Duration `json:"maxAge"`
+	}
+
+	// EndpointConfig can be written as an object or just as the path of the endpoint
+	EndpointConfig struct {
+		Path           string         `json:"path"`
+		Mode           EndpointMode   `json:"mode"`
+		Symlinks       SymlinkPolicy  `json:"symlinks"`
+		Names          NamesPolicy    `json:"names"`
+		ConflictPolicy ConflictPolicy `json:"conflictPolicy"`
+		Versions       VersionsConfig `json:"versions"`
+		Trash          TrashConfig    `json:"trash"`
+		DropBox        DropBoxConfig  `json:"dropBox"`
+		Quota          QuotaConfig    `json:"quota"`
+		Uploads        UploadsConfig  `json:"uploads"`
+		// Ignore are gitignore style patterns applied from the endpoint root,
+		// they win over rules of .gosynignore files
+		Ignore []string `json:"ignore"`
+	}
+
+	// UploadsConfig limits files uploaded to an endpoint, zero values mean no
+	// limit. Extensions are like ".exe" and types are MIME types like
+	// "image/png" or "image/*" sniffed from the file content. Denied
+	// extensions and types win over allowed ones, empty allowed lists allow
+	// all. MaxDirFiles limits entries of each directory.
+	UploadsConfig struct {
+		MaxFileSize       int64    `json:"maxFileSize"`
+		MaxDirFiles       int      `json:"maxDirFiles"`
+		AllowedExtensions []string `json:"allowedExtensions"`
+		DeniedExtensions  []string `json:"deniedExtensions"`
+		AllowedTypes      []string `json:"allowedTypes"`
+		DeniedTypes       []string `json:"deniedTypes"`
+	}
+
+	// QuotaConfig limits the total size in bytes of files of an endpoint
+	// (MaxSize) and of files uploaded by each user (UserMaxSize), users are
+	// token names ('jwt:<iss>/<sub>' for JWTs). Users overrides UserMaxSize for
+	// some users. Zero values mean no limit.
+	QuotaConfig struct {
+		MaxSize     int64            `json:"maxSize"`
+		UserMaxSize int64            `json:"userMaxSize"`
+		Users       map[string]int64 `json:"users"`
+	}
+
+	// DropBoxConfig is the config of endpoints in dropbox mode. Uploaders
+	// without a token (anonymous or with an upload link) can only upload new
+	// files, taken names get a unique name instead of being overwritten.
+	// Zero MaxFileSize is defaulted to DEFAULT_DROPBOX_MAX_FILE_SIZE by Load,
+	// negative is no limit.
+	DropBoxConfig struct {
+		// Anonymous allows uploads without a token or an upload link
+		Anonymous   bool  `json:"anonymous"`
+		MaxFileSize int64 `json:"maxFileSize"`
+	}
+
+	// VersionsConfig is the retention of replaced file versions. Zero or
+	// negative MaxCount keeps any number of versions (Load defaults 0 to
+	// DEFAULT_MAX_VERSIONS), zero MaxAge keeps versions forever.
+	VersionsConfig struct {
+		Disabled bool     `json:"disabled"`
+		MaxCount int      `json:"maxCount"`
+		MaxAge   Duration `json:"maxAge"`
+	}
+
+	// TrashConfig is the retention of deleted files. Oldest items are purged
+	// first when the trash is larger than MaxSize bytes, zero values mean no
+	// limit (Load defaults zero MaxAge to DEFAULT_TRASH_MAX_AGE).
+	TrashConfig struct {
+		Disabled bool     `json:"disabled"`
+		MaxAge   Duration `json:"maxAge"`
+		MaxSize  int64    `json:"maxSize"`
+	}
+)
+
+func (ec *EndpointConfig) UnmarshalJSON(data []byte) error {
+	var endpointPath string
+	if err := json.Unmarshal(data, &endpointPath); err == nil {
+		*ec = EndpointConfig{Path: endpointPath}
+		return nil
+	}
+
+	// a different type prevents infinite recursion
+	type endpointConfig EndpointConfig
+	return json.Unmarshal(data, (*endpointConfig)(ec))
+}
+
+// Load reads a json config file and fills the defaults
+func Load(configPath string) (*Config, error) {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	config := Config{}
+	if err = json.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+
+	if strings.TrimSpace(config.Server.Address) == "" {
+		config.Server.Address = DEFAULT_ADDRESS
+	}
+	if strings.TrimSpace(config.Server.TokenFile) == "" {
+		config.Server.TokenFile = DEFAULT_TOKEN_FILE
+	}
+	if strings.TrimSpace(config.Server.Shares.KeyFile) == "" {
+		config.Server.Shares.KeyFile = DEFAULT_SHARE_KEY
+	}
+	if strings.TrimSpace(config.Server.Shares.StateFile) == "" {
+		config.Server.Shares.StateFile = DEFAULT_SHARE_STATE
+	}
+	if config.Server.Shares.MaxAge <= 0 {
+		config.Server.Shares.MaxAge = DEFAULT_SHARE_MAX_AGE
+	}
+
+	if len(config.Server.Endpoints) == 0 {
+		return nil, errors.New("no endpoints are defined")
+	}
+
+	if jwt := config.Server.JWT; jwt != nil && jwt.Secret == "" && len(jwt.PublicKeyFiles) == 0 && jwt.JWKSFile == "" {
+		return nil, errors.New("jwt: no secret or public keys are defined")
+	}
+
+	if tlsConfig := config.Server.TLS; tlsConfig != nil {
+		if tlsConfig.CertFile == "" || tlsConfig.KeyFile == "" {
+			return nil, errors.New("tls: certFile and keyFile are required")
+		}
+		if tlsConfig.ClientCAFile == "" && (tlsConfig.RequireClientCert || len(tlsConfig.Clients) > 0) {
+			return nil, errors.New("tls: client certs need clientCAFile")
+		}
+		if config.Server.H2C {
+			return nil, errors.New("h2c is only for servers without tls, HTTP/2 is always served over tls")
+		}
+	}
+
+	if unixSocket := config.Server.UnixSocket; unixSocket != nil {
+		if strings.TrimSpace(unixSocket.Path) == "" {
+			return nil, errors.New("unixSocket: path is empty")
+		}
+		if unixSocket.Mode == 0 {
+			unixSocket.Mode = DEFAULT_UNIX_SOCKET_MODE
+		}
+	}
+
+	if err = config.Server.Limits.validate(); err != nil {
+		return nil, fmt.Errorf("limits: %w", err)
+	}
+
+	for name, endpoint := range config.Server.Endpoints {
+		if err = endpoint.validate(); err != nil {
+			return nil, fmt.Errorf("endpoint '%s': %w", name, err)
+		}
+
+		if endpoint.Mode == "" {
+			endpoint.Mode = ModeNormal
+		}
+		if endpoint.Symlinks == "" {
+			endpoint.Symlinks = SymlinksFollowWithin
+		}
+		if endpoint.Names == "" {
+			endpoint.Names = NamesAllow
+		}
+		if endpoint.Versions.MaxCount == 0 {
+			endpoint.Versions.MaxCount = DEFAULT_MAX_VERSIONS
+		}
+		if endpoint.Trash.MaxAge == 0 {
+			endpoint.Trash.MaxAge = DEFAULT_TRASH_MAX_AGE
+		}
+		if endpoint.Mode == ModeDropBox && endpoint.DropBox.MaxFileSize == 0 {
+			endpoint.DropBox.MaxFileSize = DEFAULT_DROPBOX_MAX_FILE_SIZE
+		}
+		endpoint.Uploads.AllowedExtensions = normalizeExtensions(endpoint.Uploads.AllowedExtensions)
+		endpoint.Uploads.DeniedExtensions = normalizeExtensions(endpoint.Uploads.DeniedExtensions)
+		config.Server.Endpoints[name] = endpoint
+	}
+
+	return &config, nil
+}
+
+func (ec *EndpointConfig) validate() error {
+	if strings.TrimSpace(ec.Path) == "" {
+		return errors.New("path is empty")
+	}
+
+	switch ec.Mode {
+	case "", ModeNormal, ModeDropBox, ModeReadOnly, ModeWriteOnce, ModeAppendOnly:
+	default:
+		return fmt.Errorf("unknown mode '%s'", ec.Mode)
+	}
+
+	switch ec.Symlinks {
+	case "", SymlinksIgnore, SymlinksFollowWithin, SymlinksFollowAny, SymlinksAsLink:
+	default:
+		return fmt.Errorf("unknown symlink policy '%s'", ec.Symlinks)
+	}
+
+	switch ec.Names {
+	case "", NamesAllow, NamesReject, NamesNormalize:
+	default:
+		return fmt.Errorf("unknown names policy '%s'", ec.Names)
+	}
+
+	for _, fileType := range slices.Concat(ec.Uploads.AllowedTypes, ec.Uploads.DeniedTypes) {
+		if _, _, err := mime.ParseMediaType(fileType); err != nil || !strings.Contains(fileType, "/") {
+			return fmt.Errorf("bad upload type '%s'", fileType)
+		}
+	}
+
+	if err := ignore.Validate(ec.Ignore); err != nil {
+		return err
+	}
+
+	switch ec.ConflictPolicy {
+	case ConflictManual, ConflictServerWins, ConflictClientWins, ConflictNewestWins, ConflictKeepBoth:
+	default:
+		return fmt.Errorf("unknown conflict policy '%s'", ec.ConflictPolicy)
+	}
+
+	return nil
+}
+
+// normalizeExtensions writes extensions in lower case with a leading dot
+func normalizeExtensions(extensions []string) []string {
+	for i, extension := range extensions {
+		extension = strings.ToLower(strings.TrimSpace(extension))
+		if !strings.HasPrefix(extension, ".") {
+			extension = "." + extension
+		}
+		extensions[i] = extension
+	}
+	return extensions
+}
+
+func (lc *LimitsConfig) validate() error {
+	for i, schedule := range lc.Schedules {
+		for _, day := range schedule.Days {
+			if _, ok := weekdays[strings.ToLower(day)]; !ok {
+				return fmt.Errorf("schedule %d: unknown day '%s'", i, day)
+			}
+		}
+		if _, err := time.Parse(CLOCK_LAYOUT, schedule.From); err != nil {
+			return fmt.Errorf("schedule %d: bad from '%s'", i, schedule.From)
+		}
+		if _, err := time.Parse(CLOCK_LAYOUT, schedule.To); err != nil {
+			return fmt.Errorf("schedule %d: bad to '%s'", i, schedule.To)
+		}
+	}
+	return nil
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Active reports whether the schedule is active at t, in the location of t
+func (sc *LimitScheduleConfig) Active(t time.Time) bool {
+	from, errFrom := time.Parse(CLOCK_LAYOUT, sc.From)
+	to, errTo := time.Parse(CLOCK_LAYOUT, sc.To)
+	if errFrom != nil || errTo != nil {
+		return false
+	}
+	fromMinute, toMinute := from.Hour()*60+from.Minute(), to.Hour()*60+to.Minute()
+	minute := t.Hour()*60 + t.Minute()
+
+	// the part of a schedule after midnight belongs to the day it started
+	day := t.Weekday()
+	switch {
+	case fromMinute <= toMinute:
+		if minute < fromMinute || minute >= toMinute {
+			return false
+		}
+	case minute >= fromMinute:
+	case minute < toMinute:
+		day = (day + 6) % 7
+	default:
+		return false
+	}
+
+	if len(sc.Days) == 0 {
+		return true
+	}
+	for _, rawDay := range sc.Days {
+		if weekdays[strings.ToLower(rawDay)] == day {
+			return true
+		}
+	}
+	return false
+}
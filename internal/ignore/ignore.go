@@ -0,0 +1,269 @@
+// Package ignore matches paths against gitignore style rules, read from
+// .gosynignore files of a directory tree and from config patterns.
+package ignore
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// FILE_NAME is the name of ignore files, rules of an ignore file apply to
+// paths under its directory
+const FILE_NAME = ".gosynignore"
+
+type rule struct {
+	// base is the directory of the ignore file, relative to the root
+	base    string
+	negate  bool
+	dirOnly bool
+	re      *regexp.Regexp
+}
+
+// Matcher matches paths relative to a root directory. Ignore files are read
+// lazily, once per directory, so a Matcher should not outlive the request or
+// sync run which made it.
+type Matcher struct {
+	root    string
+	configs []rule
+
+	mu   sync.Mutex
+	dirs map[string][]rule
+}
+
+// NewMatcher returns a matcher for the tree at root. Patterns are applied
+// from the root and win over rules of ignore files.
+func NewMatcher(root string, patterns []string) (*Matcher, error) {
+	configs := make([]rule, 0, len(patterns))
+	for _, pattern := range patterns {
+		r, ok, err := parseRule("", pattern)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			configs = append(configs, r)
+		}
+	}
+	return &Matcher{root: root, configs: configs, dirs: map[string][]rule{}}, nil
+}
+
+// Validate returns an error if any of the patterns is malformed
+func Validate(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, _, err := parseRule("", pattern); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Ignored reports whether filePath, relative to the root, is ignored. Like
+// git, paths under an ignored directory are ignored and can not be
+// re-included.
+func (m *Matcher) Ignored(filePath string, isDir bool) (bool, error) {
+	if m == nil {
+		return false, nil
+	}
+	filePath = strings.Trim(path.Clean("/"+filePath), "/")
+	if filePath == "" {
+		return false, nil
+	}
+
+	parts := strings.Split(filePath, "/")
+	for i := range parts {
+		subPath := strings.Join(parts[:i+1], "/")
+		ignored, err := m.match(subPath, isDir || i < len(parts)-1)
+		if err != nil || ignored {
+			return ignored, err
+		}
+	}
+	return false, nil
+}
+
+// match checks a single path against rules of ignore files of its parents
+// and config patterns, the last matching rule decides
+func (m *Matcher) match(filePath string, isDir bool) (bool, error) {
+	ignored := false
+	dir := ""
+	for {
+		rules, err := m.dirRules(dir)
+		if err != nil {
+			return false, err
+		}
+		for _, r := range rules {
+			if r.matches(filePath, isDir) {
+				ignored = !r.negate
+			}
+		}
+
+		rest := strings.TrimPrefix(filePath, dir)
+		rest = strings.TrimPrefix(rest, "/")
+		name, _, isParent := strings.Cut(rest, "/")
+		if !isParent {
+			break
+		}
+		dir = path.Join(dir, name)
+	}
+
+	for _, r := range m.configs {
+		if r.matches(filePath, isDir) {
+			ignored = !r.negate
+		}
+	}
+	return ignored, nil
+}
+
+// dirRules returns rules of the ignore file of dir, relative to the root
+func (m *Matcher) dirRules(dir string) ([]rule, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if rules, ok := m.dirs[dir]; ok {
+		return rules, nil
+	}
+
+	rules, err := readRules(path.Join(m.root, dir, FILE_NAME), dir)
+	if err != nil {
+		return nil, err
+	}
+	m.dirs[dir] = rules
+	return rules, nil
+}
+
+// readRules reads rules of an ignore file, malformed lines are skipped like
+// git does
+func readRules(filePath string, base string) ([]rule, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	rules := []rule{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		r, ok, err := parseRule(base, scanner.Text())
+		if err == nil && ok {
+			rules = append(rules, r)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// parseRule parses a line of an ignore file. ok is false for blank lines and
+// comments.
+func parseRule(base string, line string) (r rule, ok bool, err error) {
+	line = strings.TrimSuffix(line, "\r")
+	if !strings.HasSuffix(line, "\\ ") {
+		line = strings.TrimRight(line, " ")
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return rule{}, false, nil
+	}
+
+	r.base = base
+	if strings.HasPrefix(line, "!") {
+		r.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, "\\!") || strings.HasPrefix(line, "\\#") {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		r.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return rule{}, false, nil
+	}
+
+	// patterns with a slash before their end are relative to the ignore file,
+	// others match names at any depth
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+
+	expr, err := globToRegexp(line)
+	if err != nil {
+		return rule{}, false, err
+	}
+	if !anchored {
+		expr = "(?:.*/)?" + expr
+	}
+	r.re, err = regexp.Compile("^" + expr + "$")
+	if err != nil {
+		return rule{}, false, fmt.Errorf("bad ignore pattern '%s': %v", line, err)
+	}
+	return r, true, nil
+}
+
+func (r rule) matches(filePath string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	if r.base != "" {
+		rest, ok := strings.CutPrefix(filePath, r.base+"/")
+		if !ok {
+			return false
+		}
+		filePath = rest
+	}
+	return r.re.MatchString(filePath)
+}
+
+// globToRegexp converts a gitignore glob to a regular expression
+func globToRegexp(glob string) (string, error) {
+	var expr strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch c {
+		case '*':
+			if !strings.HasPrefix(glob[i:], "**") {
+				expr.WriteString("[^/]*")
+				continue
+			}
+			leading := i == 0 || glob[i-1] == '/'
+			i++
+			switch {
+			case leading && strings.HasPrefix(glob[i+1:], "/"):
+				// '**/' matches zero or more directories
+				expr.WriteString("(?:.*/)?")
+				i++
+			case leading && i+1 == len(glob):
+				expr.WriteString(".*")
+			default:
+				expr.WriteString("[^/]*")
+			}
+		case '?':
+			expr.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				return "", fmt.Errorf("bad ignore pattern '%s': unclosed '['", glob)
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr.WriteString("[" + strings.ReplaceAll(class, "\\", "\\\\") + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				c = glob[i]
+			}
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return expr.String(), nil
+}
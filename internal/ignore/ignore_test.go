@@ -0,0 +1,69 @@
+package ignore
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+type ignoreTestCase struct {
+	Name    string
+	Path    string
+	IsDir   bool
+	Ignored bool
+}
+
+func TestMatcher(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(path.Join(root, "pink-floyd/live"), 0755); err != nil {
+		panic(err)
+	}
+	if err := os.WriteFile(path.Join(root, FILE_NAME), []byte(
+		"# editor files\n*.swp\n*~\n\nnode_modules/\n/build\ndocs/**/*.pdf\n*.log\n!keep.log\n"), 0644); err != nil {
+		panic(err)
+	}
+	if err := os.WriteFile(path.Join(root, "pink-floyd", FILE_NAME), []byte("live/*.wav\n!important.swp\n"), 0644); err != nil {
+		panic(err)
+	}
+
+	matcher, err := NewMatcher(root, []string{".git/", "*.tmp"})
+	if err != nil {
+		panic(err)
+	}
+
+	testCases := []ignoreTestCase{
+		{Name: "not matched", Path: "pink-floyd/time.txt", Ignored: false},
+		{Name: "name at any depth", Path: "pink-floyd/live/time.swp", Ignored: true},
+		{Name: "backup files", Path: "time.txt~", Ignored: true},
+		{Name: "dir only pattern on dir", Path: "app/node_modules", IsDir: true, Ignored: true},
+		{Name: "dir only pattern on file", Path: "app/node_modules", Ignored: false},
+		{Name: "under ignored dir", Path: "app/node_modules/left-pad/index.js", Ignored: true},
+		{Name: "anchored", Path: "build/out.bin", Ignored: true},
+		{Name: "anchored in sub dir", Path: "app/build/out.bin", Ignored: false},
+		{Name: "double star", Path: "docs/a/b/guide.pdf", Ignored: true},
+		{Name: "double star with no dirs", Path: "docs/guide.pdf", Ignored: true},
+		{Name: "negated", Path: "logs/keep.log", Ignored: false},
+		{Name: "before negation", Path: "logs/server.log", Ignored: true},
+		{Name: "nested ignore file", Path: "pink-floyd/live/time.wav", Ignored: true},
+		{Name: "nested ignore file out of its dir", Path: "queen/live/time.wav", Ignored: false},
+		{Name: "nested ignore file overrides parent", Path: "pink-floyd/important.swp", Ignored: false},
+		{Name: "config pattern", Path: ".git/HEAD", Ignored: true},
+		{Name: "config file pattern", Path: "pink-floyd/upload.tmp", Ignored: true},
+		{Name: "ignore file itself", Path: FILE_NAME, Ignored: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			ignored, err := matcher.Ignored(tc.Path, tc.IsDir)
+			assert.NilError(t, err)
+			assert.Equal(t, tc.Ignored, ignored)
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	assert.NilError(t, Validate([]string{"*.log", "!keep.log", "# comment", "[a-z]*.txt"}))
+	assert.ErrorContains(t, Validate([]string{"[abc"}), "unclosed")
+}
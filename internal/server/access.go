@@ -0,0 +1,256 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/aigic8/gosyn/internal/auth"
+	"github.com/aigic8/gosyn/internal/config"
+	"github.com/aigic8/gosyn/internal/server/utils"
+	"github.com/gorilla/mux"
+)
+
+// route names, access of each route is checked by its name
+const (
+	ROUTE_ENDPOINTS_LIST       = "endpoints.list"
+	ROUTE_ENDPOINT_GET         = "endpoints.get"
+	ROUTE_ENDPOINT_DIGEST      = "endpoints.digest"
+	ROUTE_ENDPOINT_USAGE       = "endpoints.usage"
+	ROUTE_CONFLICTS_LIST       = "conflicts.list"
+	ROUTE_CONFLICT_RESOLVE     = "conflicts.resolve"
+	ROUTE_TRASH_LIST           = "trash.list"
+	ROUTE_TRASH_EMPTY          = "trash.empty"
+	ROUTE_TRASH_RESTORE        = "trash.restore"
+	ROUTE_TRASH_DELETE         = "trash.delete"
+	ROUTE_SNAPSHOTS_LIST       = "snapshots.list"
+	ROUTE_SNAPSHOT_CREATE      = "snapshots.create"
+	ROUTE_SNAPSHOT_DELETE      = "snapshots.delete"
+	ROUTE_SNAPSHOT_RESTORE     = "snapshots.restore"
+	ROUTE_UPLOAD_LINK_CREATE   = "uploadLinks.create"
+	ROUTE_FILE_NEW             = "files.new"
+	ROUTE_FILE_HASH            = "files.hash"
+	ROUTE_FILE_MOVE            = "files.move"
+	ROUTE_FILE_VERSIONS        = "files.versions"
+	ROUTE_FILE_VERSION_GET     = "files.versions.get"
+	ROUTE_FILE_VERSION_RESTORE = "files.versions.restore"
+	ROUTE_FILE_GET             = "files.get"
+	ROUTE_FILE_ARCHIVE         = "files.archive"
+	ROUTE_FILE_DELETE          = "files.delete"
+	ROUTE_FILE_SHARE           = "files.share"
+	ROUTE_SHARE_GET            = "share.get"
+	ROUTE_SHARE_REVOKE         = "share.revoke"
+)
+
+// accessTarget is a file (or whole endpoint if Path is empty) a request
+// accesses. New is set for files the request creates or moves to, whose new
+// names are checked against the endpoint names policy.
+type accessTarget struct {
+	Endpoint string
+	Path     string
+	New      bool
+}
+
+// routeAccess is the permission a route needs on each of its targets. Public
+// routes need no token, they check access themselves. Filtered routes list
+// the whole endpoint and leave out what the token can not see, their targets
+// only need to be seen (see auth.Grant.CanSee).
+type routeAccess struct {
+	Permission auth.Permission
+	Targets    func(r *http.Request) []accessTarget
+	Public     bool
+	Filtered   bool
+}
+
+var routeAccesses = map[string]routeAccess{
+	// listing is filtered by the handler, every token can see its own endpoints
+	ROUTE_ENDPOINTS_LIST:       {Permission: auth.PermList, Targets: noTargets},
+	ROUTE_ENDPOINT_GET:         {Permission: auth.PermList, Targets: endpointTarget, Filtered: true},
+	ROUTE_ENDPOINT_DIGEST:      {Permission: auth.PermList, Targets: digestTargets, Filtered: true},
+	ROUTE_ENDPOINT_USAGE:       {Permission: auth.PermList, Targets: endpointTarget},
+	ROUTE_CONFLICTS_LIST:       {Permission: auth.PermRead, Targets: endpointTarget},
+	ROUTE_CONFLICT_RESOLVE:     {Permission: auth.PermWrite, Targets: endpointTarget},
+	ROUTE_TRASH_LIST:           {Permission: auth.PermRead, Targets: endpointTarget},
+	ROUTE_TRASH_EMPTY:          {Permission: auth.PermDelete, Targets: endpointTarget},
+	ROUTE_TRASH_RESTORE:        {Permission: auth.PermWrite, Targets: endpointTarget},
+	ROUTE_TRASH_DELETE:         {Permission: auth.PermDelete, Targets: endpointTarget},
+	ROUTE_SNAPSHOTS_LIST:       {Permission: auth.PermRead, Targets: endpointTarget},
+	ROUTE_SNAPSHOT_CREATE:      {Permission: auth.PermAdmin, Targets: endpointTarget},
+	ROUTE_SNAPSHOT_DELETE:      {Permission: auth.PermAdmin, Targets: endpointTarget},
+	ROUTE_SNAPSHOT_RESTORE:     {Permission: auth.PermAdmin, Targets: endpointTarget},
+	ROUTE_UPLOAD_LINK_CREATE:   {Permission: auth.PermWrite, Targets: endpointTarget},
+	ROUTE_FILE_NEW:             {Permission: auth.PermWrite, Targets: newFileTarget("x-file-path")},
+	ROUTE_FILE_HASH:            {Permission: auth.PermRead, Targets: fileTarget},
+	ROUTE_FILE_MOVE:            {Permission: auth.PermWrite, Targets: moveTargets},
+	ROUTE_FILE_VERSIONS:        {Permission: auth.PermRead, Targets: fileTarget},
+	ROUTE_FILE_VERSION_GET:     {Permission: auth.PermRead, Targets: fileTarget},
+	ROUTE_FILE_VERSION_RESTORE: {Permission: auth.PermWrite, Targets: fileTarget},
+	ROUTE_FILE_GET:             {Permission: auth.PermRead, Targets: fileTarget},
+	ROUTE_FILE_ARCHIVE:         {Permission: auth.PermRead, Targets: fileTarget},
+	ROUTE_FILE_DELETE:          {Permission: auth.PermDelete, Targets: fileTarget},
+	// anyone who can read a file can share it, revoking links of others needs write
+	ROUTE_FILE_SHARE:   {Permission: auth.PermRead, Targets: fileTarget},
+	ROUTE_SHARE_GET:    {Public: true},
+	ROUTE_SHARE_REVOKE: {Permission: auth.PermWrite, Targets: shareTarget},
+}
+
+type tokenContextKey struct{}
+
+// RequestToken returns the token which authenticated the request, ok is
+// false if authentication is disabled.
+func RequestToken(r *http.Request) (auth.Token, bool) {
+	token, ok := r.Context().Value(tokenContextKey{}).(auth.Token)
+	return token, ok
+}
+
+func withToken(r *http.Request, token auth.Token) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), tokenContextKey{}, token))
+}
+
+// allowed reports whether the token can do what the matched route does, routes
+// without a known name are never allowed. Targets are checked at the paths
+// they resolve to in configs, see resolveTarget.
+func allowed(r *http.Request, token auth.Token, configs map[string]config.EndpointConfig) bool {
+	access, ok := routeAccesses[routeName(r)]
+	if !ok {
+		return false
+	}
+
+	for _, target := range access.Targets(r) {
+		for _, filePath := range resolveTarget(configs, target) {
+			if access.Filtered && token.CanSeeFile(target.Endpoint, filePath, access.Permission) {
+				continue
+			}
+			if !token.Allows(target.Endpoint, filePath, access.Permission) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// resolveTarget returns the paths of the endpoint a target is checked at,
+// which are its path, with new names checked against the names policy of the
+// endpoint for new targets, and, if it goes through followed symlinks, the
+// path it resolves to. Paths which can not be resolved, or resolve out of the endpoint, are
+// checked as the whole endpoint and get their error from the handler.
+func resolveTarget(configs map[string]config.EndpointConfig, target accessTarget) []string {
+	endpointConfig, endpointExists := configs[target.Endpoint]
+	if target.Path == "" || !endpointExists {
+		return []string{target.Path}
+	}
+
+	endpointPath := endpointConfig.Path
+	fullPath := path.Join(endpointPath, target.Path)
+	isSubPath, err := utils.IsSubPath(endpointPath, fullPath)
+	if err != nil || !isSubPath {
+		return []string{""}
+	}
+	filePath := strings.TrimPrefix(strings.TrimPrefix(fullPath, path.Clean(endpointPath)), "/")
+	if target.New {
+		if filePath, err = utils.CheckNames(endpointPath, filePath, endpointConfig.Names); err != nil {
+			return []string{""}
+		}
+	}
+
+	links, err := utils.NewLinks(endpointPath, endpointConfig.Symlinks)
+	if err != nil {
+		return []string{""}
+	}
+	resolved, _, err := links.Resolve(path.Join(endpointPath, filePath))
+	if err != nil {
+		return []string{""}
+	}
+	resolvedPath, inEndpoint, err := links.Rel(resolved)
+	if err != nil || !inEndpoint {
+		return []string{""}
+	}
+	if resolvedPath == filePath {
+		return []string{filePath}
+	}
+	return []string{filePath, resolvedPath}
+}
+
+// isPublic reports whether the matched route needs no authentication
+func isPublic(r *http.Request) bool {
+	return routeAccesses[routeName(r)].Public
+}
+
+// routeName returns the name of the matched route, or an empty string
+func routeName(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return ""
+	}
+	return route.GetName()
+}
+
+func noTargets(r *http.Request) []accessTarget {
+	return nil
+}
+
+func endpointTarget(r *http.Request) []accessTarget {
+	return []accessTarget{{Endpoint: mux.Vars(r)["endpoint"]}}
+}
+
+func digestTargets(r *http.Request) []accessTarget {
+	endpoint := mux.Vars(r)["endpoint"]
+	dirPaths := r.URL.Query()["path"]
+	if len(dirPaths) == 0 {
+		return []accessTarget{{Endpoint: endpoint}}
+	}
+
+	targets := make([]accessTarget, 0, len(dirPaths))
+	for _, dirPath := range dirPaths {
+		targets = append(targets, accessTarget{Endpoint: endpoint, Path: dirPath})
+	}
+	return targets
+}
+
+func fileTarget(r *http.Request) []accessTarget {
+	return []accessTarget{rawFileTarget(mux.Vars(r)["file"])}
+}
+
+func moveTargets(r *http.Request) []accessTarget {
+	return []accessTarget{
+		rawFileTarget(mux.Vars(r)["file"]),
+		newTarget(rawFileTarget(r.Header.Get("x-destination"))),
+	}
+}
+
+// shareTarget is the file of a share link, or the endpoint of an upload
+// link. The link is verified by the handler.
+func shareTarget(r *http.Request) []accessTarget {
+	claims, err := auth.DecodeShareClaims(mux.Vars(r)["link"])
+	if err != nil {
+		return []accessTarget{{}}
+	}
+	if claims.Upload {
+		return []accessTarget{{Endpoint: claims.File}}
+	}
+	return []accessTarget{rawFileTarget(claims.File)}
+}
+
+// newFileTarget is the file a request creates at the path in header
+func newFileTarget(header string) func(r *http.Request) []accessTarget {
+	return func(r *http.Request) []accessTarget {
+		return []accessTarget{newTarget(rawFileTarget(r.Header.Get(header)))}
+	}
+}
+
+func newTarget(target accessTarget) accessTarget {
+	target.New = true
+	return target
+}
+
+// rawFileTarget is the target of an 'endpoint/file' path. Bad paths target the
+// whole endpoint, so they are only allowed for tokens which could access any
+// file and get their error from the handler.
+func rawFileTarget(rawPath string) accessTarget {
+	endpoint, filePath, err := utils.SplitEndpointAndFile(strings.TrimSpace(rawPath))
+	if err != nil {
+		return accessTarget{Endpoint: endpoint}
+	}
+	return accessTarget{Endpoint: endpoint, Path: filePath}
+}
@@ -0,0 +1,211 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/aigic8/gosyn/internal/auth"
+	"github.com/aigic8/gosyn/internal/config"
+	"github.com/aigic8/gosyn/internal/server/log"
+)
+
+const AUTH_REALM = "gosyn"
+
+// AuthMiddleware authenticates requests with bearer tokens (RFC 6750), client
+// certs or the unix socket they came from, and checks the token grants allow
+// the matched route. Uploads to drop boxes can also be authenticated with
+// upload links, or need nothing for anonymous drop boxes.
+type AuthMiddleware struct {
+	Tokens *auth.TokenStore
+	JWT    *auth.JWTVerifier
+	Shares *auth.ShareStore
+	// ClientGrants are grants of client cert subjects, see TLSOptions
+	ClientGrants map[string][]auth.Grant
+	// UnixGrants are grants of requests over the unix socket
+	UnixGrants []auth.Grant
+	Configs    map[string]config.EndpointConfig
+	logger     *log.Logger
+}
+
+func (mid *AuthMiddleware) AuthMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isPublic(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		errh := log.NewAPIErrHandler(mid.logger, r, w)
+		authHeader := strings.TrimSpace(r.Header.Get("Authorization"))
+
+		if rawLink := strings.TrimSpace(r.Header.Get(UPLOAD_LINK_HEADER)); rawLink != "" && authHeader == "" {
+			linkToken, claims, err := mid.authenticateUploadLink(r, rawLink)
+			if err != nil {
+				writeShareErr(errh, "", err)
+				return
+			}
+			// the upload is counted before it is made, so concurrent uploads can
+			// not use the link more than allowed, and given back if it fails
+			sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+			h.ServeHTTP(sw, withToken(r, linkToken))
+			if sw.status >= http.StatusMultipleChoices {
+				if err = mid.Shares.RefundDownload(claims); err != nil {
+					mid.logger.Logger.Errorw("error refunding upload link", "link", claims.ID, "error", err.Error())
+				}
+			}
+			return
+		}
+
+		if authHeader == "" && mid.isAnonymousUpload(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		// a bearer token is preferred over the identity of the connection
+		if connToken, ok := mid.connectionToken(r); ok && authHeader == "" {
+			if !allowed(r, connToken, mid.Configs) {
+				errh.Warn(log.ErrForbidden(connToken.Name))
+				return
+			}
+			h.ServeHTTP(w, withToken(r, connToken))
+			return
+		}
+
+		// requests without credentials only get the challenge, without an error code
+		if authHeader == "" {
+			setAuthChallenge(w, "")
+			errh.Warn(log.ErrUnauthorized())
+			return
+		}
+
+		scheme, token, found := strings.Cut(authHeader, " ")
+		token = strings.TrimSpace(token)
+		if !found || token == "" {
+			setAuthChallenge(w, "invalid_request")
+			errh.Warn(log.ErrBadAuth("expected 'Bearer <token>'"))
+			return
+		}
+
+		// auth schemes are case insensitive
+		if !strings.EqualFold(scheme, "Bearer") {
+			setAuthChallenge(w, "invalid_request")
+			errh.Warn(log.ErrBadAuth("only the Bearer scheme is supported"))
+			return
+		}
+
+		authToken, err := mid.authenticate(token)
+		if err != nil {
+			switch {
+			case errors.Is(err, auth.ErrInvalidToken):
+				setAuthChallenge(w, "invalid_token")
+				errh.Warn(log.ErrInvalidToken())
+			case errors.Is(err, auth.ErrExpiredToken):
+				setAuthChallenge(w, "invalid_token")
+				errh.Warn(log.ErrExpiredToken())
+			default:
+				errh.Err(log.ErrUnknown("error authenticating: " + err.Error()))
+			}
+			return
+		}
+
+		if !allowed(r, authToken, mid.Configs) {
+			setAuthChallenge(w, "insufficient_scope")
+			errh.Warn(log.ErrForbidden(authToken.Name))
+			return
+		}
+
+		h.ServeHTTP(w, withToken(r, authToken))
+	})
+}
+
+// authenticate verifies JWTs with the JWT verifier and other tokens with the
+// token store, either of them can be nil.
+func (mid *AuthMiddleware) authenticate(rawToken string) (auth.Token, error) {
+	if auth.IsJWT(rawToken) {
+		if mid.JWT == nil {
+			return auth.Token{}, auth.ErrInvalidToken
+		}
+		return mid.JWT.Verify(rawToken)
+	}
+
+	if mid.Tokens == nil {
+		return auth.Token{}, auth.ErrInvalidToken
+	}
+	return mid.Tokens.Authenticate(rawToken)
+}
+
+// connectionToken returns the token of the client cert or the unix socket
+// of the request connection.
+func (mid *AuthMiddleware) connectionToken(r *http.Request) (auth.Token, bool) {
+	if token, ok := clientCertToken(r, mid.ClientGrants); ok {
+		return token, true
+	}
+	return unixSocketToken(r, mid.UnixGrants)
+}
+
+// authenticateUploadLink returns the token of an upload link, which can only
+// upload to the drop box of the link. Each use of the link is counted.
+func (mid *AuthMiddleware) authenticateUploadLink(r *http.Request, rawLink string) (auth.Token, auth.ShareClaims, error) {
+	if mid.Shares == nil || routeName(r) != ROUTE_FILE_NEW {
+		return auth.Token{}, auth.ShareClaims{}, auth.ErrInvalidShare
+	}
+
+	claims, err := mid.Shares.Verify(rawLink)
+	if err != nil {
+		return auth.Token{}, auth.ShareClaims{}, err
+	}
+	if !claims.Upload || mid.Configs[claims.File].Mode != config.ModeDropBox {
+		return auth.Token{}, auth.ShareClaims{}, auth.ErrInvalidShare
+	}
+	for _, target := range routeAccesses[ROUTE_FILE_NEW].Targets(r) {
+		if target.Endpoint != claims.File {
+			return auth.Token{}, auth.ShareClaims{}, auth.ErrInvalidShare
+		}
+	}
+
+	if err = mid.Shares.UseDownload(claims); err != nil {
+		return auth.Token{}, auth.ShareClaims{}, err
+	}
+	expiresAt := claims.Expiry()
+	return auth.Token{
+		ID:        claims.ID,
+		Name:      "upload link " + claims.ID,
+		Grants:    []auth.Grant{{Endpoint: claims.File, Permissions: []auth.Permission{auth.PermWrite}}},
+		ExpiresAt: &expiresAt,
+	}, claims, nil
+}
+
+// isAnonymousUpload reports whether the request is an upload to a drop box
+// which allows anonymous uploads.
+func (mid *AuthMiddleware) isAnonymousUpload(r *http.Request) bool {
+	if routeName(r) != ROUTE_FILE_NEW {
+		return false
+	}
+	for _, target := range routeAccesses[ROUTE_FILE_NEW].Targets(r) {
+		endpointConfig, ok := mid.Configs[target.Endpoint]
+		if !ok || endpointConfig.Mode != config.ModeDropBox || !endpointConfig.DropBox.Anonymous {
+			return false
+		}
+	}
+	return true
+}
+
+// statusWriter keeps the status code of a response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	sw.status = status
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+// setAuthChallenge sets the 'WWW-Authenticate' header of error responses
+func setAuthChallenge(w http.ResponseWriter, errCode string) {
+	challenge := `Bearer realm="` + AUTH_REALM + `"`
+	if errCode != "" {
+		challenge += `, error="` + errCode + `"`
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+}
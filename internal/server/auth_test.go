@@ -0,0 +1,319 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aigic8/gosyn/internal/auth"
+	"github.com/aigic8/gosyn/internal/config"
+	"github.com/aigic8/gosyn/internal/server/log"
+	"github.com/gorilla/mux"
+	"gotest.tools/v3/assert"
+)
+
+type authTestCase struct {
+	Name      string
+	Header    string
+	Status    int
+	Challenge string
+}
+
+var adminGrants = []auth.Grant{{Endpoint: auth.ALL_ENDPOINTS, Permissions: []auth.Permission{auth.PermAdmin}}}
+
+func TestAuthMiddleware(t *testing.T) {
+	tokens, err := auth.OpenTokenStore(path.Join(t.TempDir(), "tokens.json"))
+	if err != nil {
+		panic(err)
+	}
+	_, wishToken, err := tokens.Create("wish", 0, adminGrants)
+	if err != nil {
+		panic(err)
+	}
+	_, shineToken, err := tokens.Create("shine", 0, adminGrants)
+	if err != nil {
+		panic(err)
+	}
+	_, expiredToken, err := tokens.Create("expired", time.Nanosecond, adminGrants)
+	if err != nil {
+		panic(err)
+	}
+	wishID := strings.Split(wishToken, ".")[0]
+
+	testCases := []authTestCase{
+		{Name: "valid token", Header: "Bearer " + wishToken, Status: http.StatusOK},
+		{Name: "second valid token", Header: "Bearer " + shineToken, Status: http.StatusOK},
+		{Name: "case insensitive scheme", Header: "bearer " + wishToken, Status: http.StatusOK},
+		{Name: "no header", Header: "", Status: http.StatusUnauthorized, Challenge: `Bearer realm="gosyn"`},
+		{Name: "invalid token", Header: "Bearer wish-you-were-here", Status: http.StatusUnauthorized, Challenge: `Bearer realm="gosyn", error="invalid_token"`},
+		{Name: "invalid secret", Header: "Bearer " + wishID + ".1234", Status: http.StatusUnauthorized, Challenge: `Bearer realm="gosyn", error="invalid_token"`},
+		{Name: "expired token", Header: "Bearer " + expiredToken, Status: http.StatusUnauthorized, Challenge: `Bearer realm="gosyn", error="invalid_token"`},
+		{Name: "no token", Header: "Bearer", Status: http.StatusBadRequest, Challenge: `Bearer realm="gosyn", error="invalid_request"`},
+		{Name: "empty token", Header: "Bearer   ", Status: http.StatusBadRequest, Challenge: `Bearer realm="gosyn", error="invalid_request"`},
+		{Name: "other scheme", Header: "Basic d2lzaDp5b3U=", Status: http.StatusBadRequest, Challenge: `Bearer realm="gosyn", error="invalid_request"`},
+		{Name: "misspelled scheme", Header: "Berear " + wishToken, Status: http.StatusBadRequest, Challenge: `Bearer realm="gosyn", error="invalid_request"`},
+	}
+
+	logger, err := log.NewLogger()
+	if err != nil {
+		panic(err)
+	}
+	mid := AuthMiddleware{Tokens: tokens, logger: logger}
+	handler := mux.NewRouter()
+	handler.Use(mid.AuthMiddleware)
+	handler.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("welcome to the machine"))
+	}).Name(ROUTE_ENDPOINTS_LIST)
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tc.Header != "" {
+				r.Header.Set("Authorization", tc.Header)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			res := w.Result()
+			assert.Equal(t, tc.Status, res.StatusCode)
+			assert.Equal(t, tc.Challenge, res.Header.Get("WWW-Authenticate"))
+		})
+	}
+}
+
+func TestAuthMiddlewareJWT(t *testing.T) {
+	logger, err := log.NewLogger()
+	if err != nil {
+		panic(err)
+	}
+	secret := []byte("us and them")
+	mid := AuthMiddleware{JWT: &auth.JWTVerifier{Secret: secret}, logger: logger}
+	handler := mux.NewRouter()
+	handler.Use(mid.AuthMiddleware)
+	handler.HandleFunc("/files/{file:.+}", func(w http.ResponseWriter, r *http.Request) {}).Name(ROUTE_FILE_GET)
+
+	sign := func(scope string) string {
+		header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+		claims := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"sub":"nick","exp":%d,"scope":"%s"}`, time.Now().Add(time.Minute).Unix(), scope)))
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(header + "." + claims))
+		return header + "." + claims + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	}
+
+	get := func(target string, token string) int {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Result().StatusCode
+	}
+
+	assert.Equal(t, http.StatusOK, get("/files/songs/time.txt", sign("songs:read")))
+	assert.Equal(t, http.StatusForbidden, get("/files/photos/moon.png", sign("songs:read")))
+	assert.Equal(t, http.StatusUnauthorized, get("/files/songs/time.txt", sign("songs:read")+"x"))
+	// stored tokens are not accepted without a token store
+	assert.Equal(t, http.StatusUnauthorized, get("/files/songs/time.txt", "1234.5678"))
+}
+
+func TestServerAuth(t *testing.T) {
+	logger, err := log.NewLogger()
+	if err != nil {
+		panic(err)
+	}
+
+	endpoints := map[string]config.EndpointConfig{"songs": {Path: t.TempDir()}}
+	get := func(srv *Server, token string) int {
+		r := httptest.NewRequest(http.MethodGet, "/endpoints/list", nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(w, r)
+		return w.Result().StatusCode
+	}
+
+	t.Run("no way of authentication", func(t *testing.T) {
+		srv := NewServer("", endpoints, logger)
+		assert.Equal(t, http.StatusUnauthorized, get(srv, ""))
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		srv := NewServer("", endpoints, logger)
+		srv.AuthDisabled = true
+		assert.Equal(t, http.StatusOK, get(srv, ""))
+	})
+
+	t.Run("with tokens", func(t *testing.T) {
+		tokens, err := auth.OpenTokenStore(path.Join(t.TempDir(), "tokens.json"))
+		if err != nil {
+			panic(err)
+		}
+		srv := NewServer("", endpoints, logger)
+		srv.Tokens = tokens
+		assert.Equal(t, http.StatusUnauthorized, get(srv, ""))
+
+		// tokens created after the server started are accepted
+		_, rawToken, err := tokens.Create("numb", 0, adminGrants)
+		if err != nil {
+			panic(err)
+		}
+		assert.Equal(t, http.StatusUnauthorized, get(srv, ""))
+		assert.Equal(t, http.StatusUnauthorized, get(srv, "comfortably-numb"))
+		assert.Equal(t, http.StatusOK, get(srv, rawToken))
+
+		if _, err = tokens.Revoke("numb"); err != nil {
+			panic(err)
+		}
+		assert.Equal(t, http.StatusUnauthorized, get(srv, rawToken))
+	})
+}
+
+type accessTestCase struct {
+	Name   string
+	Method string
+	Target string
+	Header map[string]string
+	Status int
+}
+
+func TestServerAccess(t *testing.T) {
+	base := t.TempDir()
+	if err := mkDirs(base, []string{"songs", "songs/pink-floyd", "songs/queen", "photos"}); err != nil {
+		panic(err)
+	}
+	if err := mkFiles(path.Join(base, "songs"), []fileInfo{
+		{Path: "pink-floyd/time.txt", Data: []byte("Ticking away the moments")},
+		{Path: "queen/bohemian.txt", Data: []byte("Is this the real life?")},
+	}); err != nil {
+		panic(err)
+	}
+
+	logger, err := log.NewLogger()
+	if err != nil {
+		panic(err)
+	}
+	tokens, err := auth.OpenTokenStore(path.Join(base, "tokens.json"))
+	if err != nil {
+		panic(err)
+	}
+	_, rawToken, err := tokens.Create("floyd-fan", 0, []auth.Grant{
+		{Endpoint: "songs", Permissions: []auth.Permission{auth.PermRead, auth.PermWrite}, Paths: []string{"pink-floyd"}},
+		{Endpoint: "photos", Permissions: []auth.Permission{auth.PermList}},
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	_, listToken, err := tokens.Create("floyd-lister", 0, []auth.Grant{
+		{Endpoint: "songs", Permissions: []auth.Permission{auth.PermList}, Paths: []string{"pink-floyd"}},
+	})
+	if err != nil {
+		panic(err)
+	}
+	if err := os.Symlink("../queen/bohemian.txt", path.Join(base, "songs/pink-floyd/bohemian.txt")); err != nil {
+		panic(err)
+	}
+
+	srv := NewServer("", map[string]config.EndpointConfig{
+		"songs":  {Path: path.Join(base, "songs")},
+		"photos": {Path: path.Join(base, "photos")},
+		"movies": {Path: base},
+	}, logger)
+	srv.Tokens = tokens
+	handler := srv.Handler()
+
+	testCases := []accessTestCase{
+		{Name: "read granted file", Method: http.MethodGet, Target: "/files/songs/pink-floyd/time.txt", Status: http.StatusOK},
+		{Name: "read file out of granted paths", Method: http.MethodGet, Target: "/files/songs/queen/bohemian.txt", Status: http.StatusForbidden},
+		{Name: "read symlink out of granted paths", Method: http.MethodGet, Target: "/files/songs/pink-floyd/bohemian.txt", Status: http.StatusForbidden},
+		{Name: "delete without permission", Method: http.MethodDelete, Target: "/files/songs/pink-floyd/time.txt", Status: http.StatusForbidden},
+		{Name: "write granted file", Method: http.MethodPut, Target: "/files/new", Header: map[string]string{"x-file-path": "songs/pink-floyd/money.txt"}, Status: http.StatusOK},
+		{Name: "write out of granted paths", Method: http.MethodPut, Target: "/files/new", Header: map[string]string{"x-file-path": "songs/queen/money.txt"}, Status: http.StatusForbidden},
+		{Name: "move out of granted paths", Method: http.MethodPost, Target: "/files/songs/pink-floyd/money.txt/move", Header: map[string]string{"x-destination": "songs/queen/money.txt"}, Status: http.StatusForbidden},
+		{Name: "whole endpoint with path grant", Method: http.MethodGet, Target: "/endpoints/songs", Status: http.StatusForbidden},
+		{Name: "digest without list permission", Method: http.MethodGet, Target: "/endpoints/songs/digest?path=pink-floyd", Status: http.StatusForbidden},
+		{Name: "list granted endpoint", Method: http.MethodGet, Target: "/endpoints/photos", Status: http.StatusOK},
+		{Name: "read with only list", Method: http.MethodGet, Target: "/endpoints/photos/trash", Status: http.StatusForbidden},
+		{Name: "not granted endpoint", Method: http.MethodGet, Target: "/endpoints/movies", Status: http.StatusForbidden},
+		{Name: "snapshot without admin", Method: http.MethodPut, Target: "/endpoints/photos/snapshots/today", Status: http.StatusForbidden},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			r := httptest.NewRequest(tc.Method, tc.Target, strings.NewReader("Money, it's a gas"))
+			r.Header.Set("Authorization", "Bearer "+rawToken)
+			for key, value := range tc.Header {
+				r.Header.Set(key, value)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			assert.Equal(t, tc.Status, w.Result().StatusCode)
+		})
+	}
+
+	listWithPathGrant := func(target string) (int, []byte) {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		r.Header.Set("Authorization", "Bearer "+listToken)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		data, err := io.ReadAll(w.Result().Body)
+		if err != nil {
+			panic(err)
+		}
+		return w.Result().StatusCode, data
+	}
+
+	t.Run("endpoint tree is filtered", func(t *testing.T) {
+		status, data := listWithPathGrant("/endpoints/songs")
+		assert.Equal(t, http.StatusOK, status)
+		resData := APIResponse[EndpointGetResponse]{}
+		if err := json.Unmarshal(data, &resData); err != nil {
+			panic(err)
+		}
+		children := resData.Data.Tree["songs"].Children
+		assert.Equal(t, 1, len(children))
+		_, hasTime := children["pink-floyd"].Children["time.txt"]
+		assert.Assert(t, hasTime)
+	})
+
+	t.Run("endpoint digest is filtered", func(t *testing.T) {
+		status, data := listWithPathGrant("/endpoints/songs/digest")
+		assert.Equal(t, http.StatusOK, status)
+		resData := APIResponse[EndpointGetDigestResponse]{}
+		if err := json.Unmarshal(data, &resData); err != nil {
+			panic(err)
+		}
+		assert.Equal(t, 1, len(resData.Data.Digests[0].Children))
+		assert.Equal(t, "pink-floyd", resData.Data.Digests[0].Children[0].Name)
+
+		status, _ = listWithPathGrant("/endpoints/songs/digest?path=pink-floyd")
+		assert.Equal(t, http.StatusOK, status)
+		status, _ = listWithPathGrant("/endpoints/songs/digest?path=queen")
+		assert.Equal(t, http.StatusForbidden, status)
+	})
+
+	t.Run("endpoints list is filtered", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/endpoints/list", nil)
+		r.Header.Set("Authorization", "Bearer "+rawToken)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		resData := APIResponse[EndpointGetAllResponse]{}
+		if err := json.NewDecoder(w.Result().Body).Decode(&resData); err != nil {
+			panic(err)
+		}
+		sort.Strings(resData.Data.Endpoints)
+		assert.DeepEqual(t, []string{"photos", "songs"}, resData.Data.Endpoints)
+	})
+}
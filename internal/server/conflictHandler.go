@@ -0,0 +1,293 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aigic8/gosyn/internal/config"
+	"github.com/aigic8/gosyn/internal/server/log"
+	"github.com/aigic8/gosyn/internal/server/utils"
+	"github.com/gorilla/mux"
+)
+
+const (
+	CONFLICTS_FILE = "conflicts.json"
+	// MAX_CONFLICT_HOST_LEN is the most characters of the client host in names
+	// of conflict copies
+	MAX_CONFLICT_HOST_LEN = 64
+)
+
+type ConflictResolution string
+
+const (
+	// ResolutionNone means the write was rejected and the user should resolve the conflict
+	ResolutionNone          ConflictResolution = ""
+	ResolutionServerVersion ConflictResolution = "server-version"
+	ResolutionClientVersion ConflictResolution = "client-version"
+	ResolutionKeptBoth      ConflictResolution = "kept-both"
+)
+
+// Conflict is a write which was based on an outdated version of a file.
+// File and CopyFile are paths inside the endpoint.
+type Conflict struct {
+	ID         string                `json:"id"`
+	File       string                `json:"file"`
+	CopyFile   string                `json:"copyFile,omitempty"`
+	Policy     config.ConflictPolicy `json:"policy"`
+	Resolution ConflictResolution    `json:"resolution"`
+	Host       string                `json:"host"`
+	Time       time.Time             `json:"time"`
+}
+
+type ConflictListResponse struct {
+	Conflicts []Conflict `json:"conflicts"`
+}
+
+// conflictStore keeps conflicts of each endpoint in its meta directory
+type conflictStore struct {
+	mu sync.Mutex
+}
+
+func (store *conflictStore) List(endpointPath string) ([]Conflict, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.read(endpointPath)
+}
+
+func (store *conflictStore) Add(endpointPath string, conflict Conflict) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	conflicts, err := store.read(endpointPath)
+	if err != nil {
+		return err
+	}
+	return store.write(endpointPath, append(conflicts, conflict))
+}
+
+// Remove deletes a conflict, found is false if there is no conflict with the id
+func (store *conflictStore) Remove(endpointPath string, id string) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	conflicts, err := store.read(endpointPath)
+	if err != nil {
+		return false, err
+	}
+
+	remaining := make([]Conflict, 0, len(conflicts))
+	for _, conflict := range conflicts {
+		if conflict.ID != id {
+			remaining = append(remaining, conflict)
+		}
+	}
+	if len(remaining) == len(conflicts) {
+		return false, nil
+	}
+	return true, store.write(endpointPath, remaining)
+}
+
+func (store *conflictStore) read(endpointPath string) ([]Conflict, error) {
+	data, err := os.ReadFile(utils.MetaPath(endpointPath, CONFLICTS_FILE))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return []Conflict{}, nil
+		}
+		return nil, err
+	}
+
+	conflicts := []Conflict{}
+	if err = json.Unmarshal(data, &conflicts); err != nil {
+		return nil, err
+	}
+	return conflicts, nil
+}
+
+func (store *conflictStore) write(endpointPath string, conflicts []Conflict) error {
+	data, err := json.Marshal(conflicts)
+	if err != nil {
+		return err
+	}
+
+	conflictsPath := utils.MetaPath(endpointPath, CONFLICTS_FILE)
+	if err = os.MkdirAll(path.Dir(conflictsPath), 0777); err != nil {
+		return err
+	}
+
+	tmpPath := conflictsPath + ".tmp"
+	if err = os.WriteFile(tmpPath, data, 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, conflictsPath)
+}
+
+type conflictHandler struct {
+	Endpoints map[string]string
+	Conflicts *conflictStore
+	logger    *log.Logger
+}
+
+func (cHandler *conflictHandler) List(w http.ResponseWriter, r *http.Request) {
+	errh := log.NewAPIErrHandler(cHandler.logger, r, w)
+
+	vars := mux.Vars(r)
+	endpoint := strings.TrimSpace(vars["endpoint"])
+	if endpoint == "" {
+		errh.Warn(log.ErrVarNotFound("endpoint"))
+		return
+	}
+
+	endpointPath, endpointExists := cHandler.Endpoints[endpoint]
+	if !endpointExists {
+		errh.Warn(log.ErrEndpointNotFound(endpoint))
+		return
+	}
+
+	conflicts, err := cHandler.Conflicts.List(endpointPath)
+	if err != nil {
+		errh.Err(log.ErrUnknown("error reading conflicts: " + err.Error()))
+		return
+	}
+
+	jsonData, err := wrapAPIResponse(ConflictListResponse{Conflicts: conflicts})
+	if err != nil {
+		errh.Err(log.ErrUnknown("error marshaling json: " + err.Error()))
+		return
+	}
+
+	w.Write(jsonData)
+}
+
+// Resolve removes a conflict from the list after the user has dealt with it
+func (cHandler *conflictHandler) Resolve(w http.ResponseWriter, r *http.Request) {
+	errh := log.NewAPIErrHandler(cHandler.logger, r, w)
+
+	vars := mux.Vars(r)
+	endpoint := strings.TrimSpace(vars["endpoint"])
+	if endpoint == "" {
+		errh.Warn(log.ErrVarNotFound("endpoint"))
+		return
+	}
+
+	id := strings.TrimSpace(vars["id"])
+	if id == "" {
+		errh.Warn(log.ErrVarNotFound("id"))
+		return
+	}
+
+	endpointPath, endpointExists := cHandler.Endpoints[endpoint]
+	if !endpointExists {
+		errh.Warn(log.ErrEndpointNotFound(endpoint))
+		return
+	}
+
+	found, err := cHandler.Conflicts.Remove(endpointPath, id)
+	if err != nil {
+		errh.Err(log.ErrUnknown("error removing conflict: " + err.Error()))
+		return
+	}
+	if !found {
+		errh.Warn(log.ErrConflictNotFound(id))
+		return
+	}
+
+	jsonData, err := wrapAPIResponse(map[string]string{})
+	if err != nil {
+		errh.Err(log.ErrUnknown("error marshaling json: " + err.Error()))
+		return
+	}
+
+	w.Write(jsonData)
+}
+
+// resolveWriteConflict decides what happens to a write conflicting with the current file
+func resolveWriteConflict(policy config.ConflictPolicy, r *http.Request, current *FileMeta) ConflictResolution {
+	switch policy {
+	case config.ConflictServerWins:
+		return ResolutionServerVersion
+	case config.ConflictClientWins:
+		return ResolutionClientVersion
+	case config.ConflictNewestWins:
+		if !current.Exists {
+			return ResolutionClientVersion
+		}
+		clientModTime, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(r.Header.Get("x-mtime")))
+		if err != nil || !clientModTime.After(current.LastMod) {
+			return ResolutionServerVersion
+		}
+		return ResolutionClientVersion
+	case config.ConflictKeepBoth:
+		if !current.Exists {
+			return ResolutionClientVersion
+		}
+		return ResolutionKeptBoth
+	}
+	return ResolutionNone
+}
+
+// resolveDeleteConflict decides what happens to a delete of a file which has changed.
+// Changes are only thrown away if the client always wins.
+func resolveDeleteConflict(policy config.ConflictPolicy) ConflictResolution {
+	switch policy {
+	case config.ConflictManual:
+		return ResolutionNone
+	case config.ConflictClientWins:
+		return ResolutionClientVersion
+	}
+	return ResolutionServerVersion
+}
+
+func newConflict(r *http.Request, filePath string, policy config.ConflictPolicy) (*Conflict, error) {
+	idBytes := make([]byte, 8)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, err
+	}
+
+	host := strings.TrimSpace(r.Header.Get("x-client-host"))
+	if host == "" {
+		host, _, _ = net.SplitHostPort(r.RemoteAddr)
+	}
+
+	return &Conflict{
+		ID:     hex.EncodeToString(idBytes),
+		File:   filePath,
+		Policy: policy,
+		Host:   host,
+		Time:   time.Now(),
+	}, nil
+}
+
+// conflictCopyPath returns the path of a conflict copy like 'dir/name (conflict from host 2006-01-02 150405).ext'
+func conflictCopyPath(filePath string, host string, t time.Time) string {
+	dir, name := path.Split(filePath)
+	ext := path.Ext(name)
+	if ext == name {
+		ext = ""
+	}
+	stem := strings.TrimSuffix(name, ext)
+
+	// hosts are sent by clients, they are kept to a short portable name
+	host = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == '/' || strings.ContainsRune(utils.BAD_NAME_CHARS, r) {
+			return '-'
+		}
+		return r
+	}, host)
+	if hostRunes := []rune(host); len(hostRunes) > MAX_CONFLICT_HOST_LEN {
+		host = string(hostRunes[:MAX_CONFLICT_HOST_LEN])
+	}
+	if host = strings.TrimSpace(host); host == "" {
+		host = "unknown"
+	}
+
+	return dir + stem + " (conflict from " + host + " " + t.Format("2006-01-02 150405") + ")" + ext
+}
@@ -0,0 +1,243 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aigic8/gosyn/internal/config"
+	"github.com/aigic8/gosyn/internal/server/log"
+	"github.com/gorilla/mux"
+	"gotest.tools/v3/assert"
+)
+
+type conflictPolicyTestCase struct {
+	Name       string
+	Policy     config.ConflictPolicy
+	ModTime    time.Time
+	Status     int
+	Resolution ConflictResolution
+	FileData   string
+}
+
+func TestFileHandlerAddNewConflictPolicies(t *testing.T) {
+	base := t.TempDir()
+	oldData, newData := "Hello darkness, my old friend", "I've come to talk with you again"
+
+	testCases := []conflictPolicyTestCase{
+		{Name: "manual", Policy: config.ConflictManual, Status: http.StatusPreconditionFailed, Resolution: ResolutionNone, FileData: oldData},
+		{Name: "server wins", Policy: config.ConflictServerWins, Status: http.StatusPreconditionFailed, Resolution: ResolutionServerVersion, FileData: oldData},
+		{Name: "client wins", Policy: config.ConflictClientWins, Status: http.StatusOK, Resolution: ResolutionClientVersion, FileData: newData},
+		{Name: "newest wins old", Policy: config.ConflictNewestWins, ModTime: time.Now().Add(-time.Hour), Status: http.StatusPreconditionFailed, Resolution: ResolutionServerVersion, FileData: oldData},
+		{Name: "newest wins new", Policy: config.ConflictNewestWins, ModTime: time.Now().Add(time.Hour), Status: http.StatusOK, Resolution: ResolutionClientVersion, FileData: newData},
+		{Name: "keep both", Policy: config.ConflictKeepBoth, Status: http.StatusOK, Resolution: ResolutionKeptBoth, FileData: oldData},
+	}
+
+	logger, err := log.NewLogger()
+	if err != nil {
+		panic(err)
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			endpointPath := path.Join(base, tc.Name)
+			if err := mkDirs(endpointPath, []string{""}); err != nil {
+				panic(err)
+			}
+			if err := mkFiles(endpointPath, []fileInfo{{Path: "song.txt", Data: []byte(oldData)}}); err != nil {
+				panic(err)
+			}
+
+			fHandler := fileHandler{
+				Endpoints: map[string]string{"songs": endpointPath},
+				Configs:   map[string]config.EndpointConfig{"songs": {Path: endpointPath, ConflictPolicy: tc.Policy}},
+				Conflicts: &conflictStore{},
+				logger:    logger,
+			}
+
+			r := httptest.NewRequest(http.MethodPut, "/", strings.NewReader(newData))
+			r.Header.Set("x-file-path", "songs/song.txt")
+			r.Header.Set("x-client-host", "simon")
+			r.Header.Set("If-Match", `"1234"`)
+			if !tc.ModTime.IsZero() {
+				r.Header.Set("x-mtime", tc.ModTime.Format(time.RFC3339Nano))
+			}
+			w := httptest.NewRecorder()
+
+			fHandler.AddNew(w, r)
+			res := w.Result()
+			defer res.Body.Close()
+			assert.Equal(t, tc.Status, res.StatusCode)
+
+			resBody, err := io.ReadAll(res.Body)
+			if err != nil {
+				panic(err)
+			}
+			meta := FileMeta{}
+			if tc.Status == http.StatusOK {
+				resData := APIResponse[*FileMeta]{Data: &meta}
+				err = json.Unmarshal(resBody, &resData)
+			} else {
+				err = json.Unmarshal(resBody, &log.HTTPErrResponse{Data: &meta})
+			}
+			if err != nil {
+				panic(err)
+			}
+
+			assert.Assert(t, meta.Conflict != nil)
+			assert.Equal(t, tc.Resolution, meta.Conflict.Resolution)
+			assert.Equal(t, "song.txt", meta.Conflict.File)
+
+			fileData, err := os.ReadFile(path.Join(endpointPath, "song.txt"))
+			if err != nil {
+				panic(err)
+			}
+			assert.Equal(t, tc.FileData, string(fileData))
+
+			if tc.Resolution == ResolutionKeptBoth {
+				assert.Assert(t, strings.HasPrefix(meta.Conflict.CopyFile, "song (conflict from simon "))
+				copyData, err := os.ReadFile(path.Join(endpointPath, meta.Conflict.CopyFile))
+				if err != nil {
+					panic(err)
+				}
+				assert.Equal(t, newData, string(copyData))
+			}
+
+			conflicts, err := fHandler.Conflicts.List(endpointPath)
+			if err != nil {
+				panic(err)
+			}
+			assert.Equal(t, 1, len(conflicts))
+		})
+	}
+}
+
+type conflictCopyTestCase struct {
+	Name   string
+	Host   string
+	Config config.EndpointConfig
+	Status int
+}
+
+func TestFileHandlerAddNewConflictCopy(t *testing.T) {
+	base := t.TempDir()
+
+	testCases := []conflictCopyTestCase{
+		{Name: "host is sanitized", Host: "simon<pc>|1", Status: http.StatusOK},
+		{Name: "not portable copy name", Host: "cafe\u0301", Config: config.EndpointConfig{Names: config.NamesReject}, Status: http.StatusBadRequest},
+		{Name: "ignored copy", Host: "simon", Config: config.EndpointConfig{Ignore: []string{"*(conflict from *"}}, Status: http.StatusForbidden},
+		{Name: "failed write", Host: "simon", Config: config.EndpointConfig{Uploads: config.UploadsConfig{MaxDirFiles: 1}}, Status: http.StatusRequestEntityTooLarge},
+	}
+
+	logger, err := log.NewLogger()
+	if err != nil {
+		panic(err)
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			endpointPath := path.Join(base, tc.Name)
+			if err := mkDirs(endpointPath, []string{""}); err != nil {
+				panic(err)
+			}
+			if err := mkFiles(endpointPath, []fileInfo{{Path: "song.txt", Data: []byte("Hello darkness, my old friend")}}); err != nil {
+				panic(err)
+			}
+
+			endpointConfig := tc.Config
+			endpointConfig.Path, endpointConfig.ConflictPolicy = endpointPath, config.ConflictKeepBoth
+			fHandler := fileHandler{
+				Endpoints: map[string]string{"songs": endpointPath},
+				Configs:   map[string]config.EndpointConfig{"songs": endpointConfig},
+				Conflicts: &conflictStore{},
+				logger:    logger,
+			}
+
+			r := httptest.NewRequest(http.MethodPut, "/", strings.NewReader("I've come to talk with you again"))
+			r.Header.Set("x-file-path", "songs/song.txt")
+			r.Header.Set("x-client-host", tc.Host)
+			r.Header.Set("If-Match", `"1234"`)
+			w := httptest.NewRecorder()
+			fHandler.AddNew(w, r)
+			res := w.Result()
+			defer res.Body.Close()
+			assert.Equal(t, tc.Status, res.StatusCode)
+
+			conflicts, err := fHandler.Conflicts.List(endpointPath)
+			if err != nil {
+				panic(err)
+			}
+			if tc.Status != http.StatusOK {
+				assert.Equal(t, 0, len(conflicts))
+				return
+			}
+			assert.Equal(t, 1, len(conflicts))
+			assert.Assert(t, strings.HasPrefix(conflicts[0].CopyFile, "song (conflict from simon-pc--1 "))
+			_, err = os.Stat(path.Join(endpointPath, conflicts[0].CopyFile))
+			assert.NilError(t, err)
+		})
+	}
+}
+
+func TestConflictHandler(t *testing.T) {
+	base := t.TempDir()
+	endpoints := map[string]string{"songs": base}
+
+	store := &conflictStore{}
+	for _, file := range []string{"a.txt", "b.txt"} {
+		if err := store.Add(base, Conflict{ID: file, File: file}); err != nil {
+			panic(err)
+		}
+	}
+
+	logger, err := log.NewLogger()
+	if err != nil {
+		panic(err)
+	}
+	cHandler := conflictHandler{Endpoints: endpoints, Conflicts: store, logger: logger}
+
+	list := func(endpoint string) (int, []Conflict) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r = mux.SetURLVars(r, map[string]string{"endpoint": endpoint})
+		w := httptest.NewRecorder()
+		cHandler.List(w, r)
+
+		res := w.Result()
+		defer res.Body.Close()
+		resData := APIResponse[ConflictListResponse]{}
+		if res.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(res.Body).Decode(&resData); err != nil {
+				panic(err)
+			}
+		}
+		return res.StatusCode, resData.Data.Conflicts
+	}
+
+	resolve := func(endpoint string, id string) int {
+		r := httptest.NewRequest(http.MethodDelete, "/", nil)
+		r = mux.SetURLVars(r, map[string]string{"endpoint": endpoint, "id": id})
+		w := httptest.NewRecorder()
+		cHandler.Resolve(w, r)
+		return w.Result().StatusCode
+	}
+
+	status, conflicts := list("songs")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, 2, len(conflicts))
+
+	status, _ = list("not-songs")
+	assert.Equal(t, http.StatusNotFound, status)
+
+	assert.Equal(t, http.StatusOK, resolve("songs", "a.txt"))
+	assert.Equal(t, http.StatusNotFound, resolve("songs", "a.txt"))
+	assert.Equal(t, http.StatusNotFound, resolve("not-songs", "b.txt"))
+
+	_, conflicts = list("songs")
+	assert.DeepEqual(t, []Conflict{{ID: "b.txt", File: "b.txt"}}, conflicts)
+}
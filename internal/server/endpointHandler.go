@@ -1,12 +1,16 @@
 package server
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
 	"path"
 	"strings"
 
+	"github.com/aigic8/gosyn/internal/auth"
+	"github.com/aigic8/gosyn/internal/config"
+	"github.com/aigic8/gosyn/internal/ignore"
 	"github.com/aigic8/gosyn/internal/server/log"
 	"github.com/aigic8/gosyn/internal/server/utils"
 	"github.com/gorilla/mux"
@@ -14,17 +18,32 @@ import (
 
 type endpointHanlder struct {
 	Endpoints map[string]string
+	Configs   map[string]config.EndpointConfig
+	Digests   *utils.DigestCache
+	Snapshots *snapshotStore
 	logger    *log.Logger
 }
 
 type (
+	// EndpointGetAllResponse lists endpoints and the mode of each of them
 	EndpointGetAllResponse struct {
-		Endpoints []string `json:"endpoints"`
+		Endpoints []string                       `json:"endpoints"`
+		Modes     map[string]config.EndpointMode `json:"modes"`
 	}
 
 	EndpointGetResponse struct {
 		Tree map[string]utils.TreePath `json:"tree"`
 	}
+
+	DirDigest struct {
+		Path     string              `json:"path"`
+		Digest   string              `json:"digest"`
+		Children []utils.DigestEntry `json:"children"`
+	}
+
+	EndpointGetDigestResponse struct {
+		Digests []DirDigest `json:"digests"`
+	}
 )
 
 func (eHandler *endpointHanlder) Get(w http.ResponseWriter, r *http.Request) {
@@ -44,7 +63,12 @@ func (eHandler *endpointHanlder) Get(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	stat, err := os.Stat(endpointPath)
+	root, ok := snapshotRoot(errh, eHandler.Snapshots, endpointPath, r)
+	if !ok {
+		return
+	}
+
+	stat, err := os.Stat(root)
 	if err != nil {
 		errh.Warn(log.ErrUnknown("error stating endpoint: " + err.Error()))
 		return
@@ -55,23 +79,45 @@ func (eHandler *endpointHanlder) Get(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	base, dirName := path.Split(endpointPath)
+	_, dirName := path.Split(endpointPath)
+	base, rootName := path.Split(root)
 
 	tree := map[string]utils.TreePath{
 		dirName: {
-			Name:     dirName,
+			Name:     rootName,
 			IsDir:    true,
 			Size:     0,
 			Children: map[string]utils.TreePath{},
 		},
 	}
 
+	matcher, err := ignore.NewMatcher(root, eHandler.Configs[endpoint].Ignore)
+	if err != nil {
+		errh.Err(log.ErrUnknown("error reading ignore rules: " + err.Error()))
+		return
+	}
+
+	links, err := utils.NewLinks(root, eHandler.Configs[endpoint].Symlinks)
+	if err != nil {
+		errh.Err(log.ErrUnknown("error resolving symlinks: " + err.Error()))
+		return
+	}
+
 	// TODO can be too expensive is the tree is too big? maybe add something like depth to it?
-	if err := utils.MakeTree(base, tree); err != nil {
+	if err := utils.MakeTree(base, tree, matcher, links); err != nil {
 		errh.Err(log.ErrUnknown("error making tree: " + err.Error()))
 		return
 	}
 
+	// snapshot trees look like the endpoint itself
+	rootTree := tree[dirName]
+	rootTree.Name = dirName
+	tree[dirName] = rootTree
+
+	if token, authenticated := RequestToken(r); authenticated && !token.Allows(endpoint, "", auth.PermList) {
+		filterTree(rootTree, "", func(filePath string) bool { return token.CanSeeFile(endpoint, filePath, auth.PermList) })
+	}
+
 	jsonData, err := wrapAPIResponse(EndpointGetResponse{Tree: tree})
 	if err != nil {
 		errh.Err(log.ErrUnknown("error marshaling json: " + err.Error()))
@@ -81,14 +127,151 @@ func (eHandler *endpointHanlder) Get(w http.ResponseWriter, r *http.Request) {
 	w.Write(jsonData)
 }
 
+// filterTree removes paths which canSee returns false for from the children
+// of tree, relPath is the path of tree in the endpoint
+func filterTree(tree utils.TreePath, relPath string, canSee func(filePath string) bool) {
+	for name, child := range tree.Children {
+		childPath := path.Join(relPath, name)
+		if !canSee(childPath) {
+			delete(tree.Children, name)
+			continue
+		}
+		filterTree(child, childPath, canSee)
+	}
+}
+
 func (eHandler *endpointHanlder) GetAll(w http.ResponseWriter, r *http.Request) {
 	errh := log.NewAPIErrHandler(eHandler.logger, r, w)
 
+	token, authenticated := RequestToken(r)
 	endpoints := make([]string, 0, len(eHandler.Endpoints))
+	modes := make(map[string]config.EndpointMode, len(eHandler.Endpoints))
 	for endpoint := range eHandler.Endpoints {
+		if authenticated && !token.CanSee(endpoint) {
+			continue
+		}
 		endpoints = append(endpoints, endpoint)
+		modes[endpoint] = eHandler.Configs[endpoint].Mode
+		if modes[endpoint] == "" {
+			modes[endpoint] = config.ModeNormal
+		}
 	}
-	jsonData, err := wrapAPIResponse(EndpointGetAllResponse{Endpoints: endpoints})
+	jsonData, err := wrapAPIResponse(EndpointGetAllResponse{Endpoints: endpoints, Modes: modes})
+	if err != nil {
+		errh.Err(log.ErrUnknown("error marshaling json: " + err.Error()))
+		return
+	}
+
+	w.Write(jsonData)
+}
+
+// GetDigest returns merkle digests of the directories requested with the 'path'
+// query param (endpoint root if not set) and of their direct children.
+// Clients can compare digests level by level and only descend into
+// directories which differ.
+func (eHandler *endpointHanlder) GetDigest(w http.ResponseWriter, r *http.Request) {
+	errh := log.NewAPIErrHandler(eHandler.logger, r, w)
+
+	vars := mux.Vars(r)
+	endpoint := strings.TrimSpace(vars["endpoint"])
+	if endpoint == "" {
+		errh.Warn(log.ErrVarNotFound("endpoint"))
+		return
+	}
+
+	endpointPath, endpointExists := eHandler.Endpoints[endpoint]
+	if !endpointExists {
+		errh.Warn(log.ErrEndpointNotFound(endpoint))
+		return
+	}
+
+	root, ok := snapshotRoot(errh, eHandler.Snapshots, endpointPath, r)
+	if !ok {
+		return
+	}
+
+	dirPaths := r.URL.Query()["path"]
+	if len(dirPaths) == 0 {
+		dirPaths = []string{""}
+	}
+
+	matcher, err := ignore.NewMatcher(root, eHandler.Configs[endpoint].Ignore)
+	if err != nil {
+		errh.Err(log.ErrUnknown("error reading ignore rules: " + err.Error()))
+		return
+	}
+
+	links, err := utils.NewLinks(root, eHandler.Configs[endpoint].Symlinks)
+	if err != nil {
+		errh.Err(log.ErrUnknown("error resolving symlinks: " + err.Error()))
+		return
+	}
+
+	// tokens with path grants only get digests of what they can see
+	var visible utils.Visibility
+	if token, authenticated := RequestToken(r); authenticated {
+		visible = func(filePath string) (bool, bool) {
+			return token.CanSeeFile(endpoint, filePath, auth.PermList), token.Allows(endpoint, filePath, auth.PermList)
+		}
+	}
+
+	digests := make([]DirDigest, 0, len(dirPaths))
+	for _, dirPath := range dirPaths {
+		fullPath := path.Join(root, dirPath)
+
+		isSubPath, err := utils.IsSubPath(root, fullPath)
+		if err != nil {
+			errh.Err(log.ErrUnknown("error checking subpath: " + err.Error()))
+			return
+		}
+		if !isSubPath {
+			errh.Warn(log.ErrOutOfEndpoint(dirPath, endpoint))
+			return
+		}
+		if utils.HasMetaPart(path.Clean(dirPath)) {
+			errh.Warn(log.ErrReservedPath(dirPath))
+			return
+		}
+
+		fullPath, isLink, err := links.Resolve(fullPath)
+		if err != nil {
+			if errors.Is(err, utils.ErrSymlinkDenied) {
+				errh.Warn(log.ErrSymlinkDenied(dirPath))
+				return
+			}
+			errh.Err(log.ErrUnknown("error resolving symlinks: " + err.Error()))
+			return
+		}
+		if isLink {
+			errh.Warn(log.ErrPathIsSymlink(dirPath))
+			return
+		}
+
+		stat, err := os.Stat(fullPath)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				errh.Warn(log.ErrFileNotFound(dirPath))
+				return
+			}
+			errh.Err(log.ErrUnknown("error stating dir: " + err.Error()))
+			return
+		}
+
+		if !stat.IsDir() {
+			errh.Warn(log.ErrPathIsNotDir(dirPath))
+			return
+		}
+
+		digest, children, err := utils.DigestDir(fullPath, dirPath, eHandler.Digests, matcher, links, visible)
+		if err != nil {
+			errh.Err(log.ErrUnknown("error making digest: " + err.Error()))
+			return
+		}
+
+		digests = append(digests, DirDigest{Path: dirPath, Digest: digest, Children: children})
+	}
+
+	jsonData, err := wrapAPIResponse(EndpointGetDigestResponse{Digests: digests})
 	if err != nil {
 		errh.Err(log.ErrUnknown("error marshaling json: " + err.Error()))
 		return
@@ -7,8 +7,11 @@ import (
 	"net/http/httptest"
 	"os"
 	"path"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/aigic8/gosyn/internal/config"
 	"github.com/aigic8/gosyn/internal/server/log"
 	"github.com/aigic8/gosyn/internal/server/utils"
 	"github.com/gorilla/mux"
@@ -54,7 +57,7 @@ func TestEndpointGet(t *testing.T) {
 		panic(err)
 	}
 
-	infos, err := getInfos(base, []string{"seether/truth.txt", "pink-floyd/freq/time.txt", "pink-floyd/wish-you-where-here.txt"})
+	infos, err := getInfos(base, []string{"seether/truth.txt", "pink-floyd/freq/time.txt", "pink-floyd/wish-you-where-here.txt", "pink-floyd/freq"})
 	if err != nil {
 		panic(err)
 	}
@@ -62,6 +65,7 @@ func TestEndpointGet(t *testing.T) {
 	truthInfo := infos["seether/truth.txt"]
 	timeInfo := infos["pink-floyd/freq/time.txt"]
 	wereHereInfo := infos["pink-floyd/wish-you-where-here.txt"]
+	freqInfo := infos["pink-floyd/freq"]
 
 	endpoints := map[string]string{
 		"seether": path.Join(base, "seether"),
@@ -76,18 +80,20 @@ func TestEndpointGet(t *testing.T) {
 				IsDir:    false,
 				Size:     truthInfo.Size(),
 				LastMod:  truthInfo.ModTime(),
+				Mode:     config.FileMode(truthInfo.Mode().Perm()),
 				Children: map[string]utils.TreePath{},
 			},
 		}},
 	}
 	recursiveTree := map[string]utils.TreePath{
 		"pink-floyd": {Name: "pink-floyd", IsDir: true, Children: map[string]utils.TreePath{
-			"freq": {Name: "freq", IsDir: true, Children: map[string]utils.TreePath{
+			"freq": {Name: "freq", IsDir: true, Mode: config.FileMode(freqInfo.Mode().Perm()), Children: map[string]utils.TreePath{
 				"time.txt": {
 					Name:     "time.txt",
 					IsDir:    false,
 					Size:     timeInfo.Size(),
 					LastMod:  timeInfo.ModTime(),
+					Mode:     config.FileMode(timeInfo.Mode().Perm()),
 					Children: map[string]utils.TreePath{}},
 			}},
 			"wish-you-where-here.txt": {
@@ -95,6 +101,7 @@ func TestEndpointGet(t *testing.T) {
 				IsDir:    false,
 				Size:     wereHereInfo.Size(),
 				LastMod:  wereHereInfo.ModTime(),
+				Mode:     config.FileMode(wereHereInfo.Mode().Perm()),
 				Children: map[string]utils.TreePath{},
 			},
 		}},
@@ -178,6 +185,177 @@ func TestEndpointGetAll(t *testing.T) {
 	assert.Equal(t, true, arrsAreEqual(expectedEndpoints, resData.Data.Endpoints))
 }
 
+type endpointGetDigestTestCase struct {
+	Name     string
+	Endpoint string
+	Paths    []string
+	Status   int
+}
+
+func TestEndpointGetDigest(t *testing.T) {
+	base := t.TempDir()
+
+	err := mkDirs(base, []string{"a/lyrics/old", "b/lyrics/old", "c/lyrics/old"})
+	if err != nil {
+		panic(err)
+	}
+
+	files := []fileInfo{}
+	for _, endpoint := range []string{"a", "b", "c"} {
+		files = append(files,
+			fileInfo{Path: endpoint + "/lyrics/old/time.txt", Data: []byte("Ticking away the moments that make up a dull day")},
+			fileInfo{Path: endpoint + "/readme.txt", Data: []byte("songs")},
+		)
+	}
+	files = append(files, fileInfo{Path: "c/lyrics/old/time.txt", Data: []byte("Fritter and waste the hours in an offhand way")})
+	if err = mkFiles(base, files); err != nil {
+		panic(err)
+	}
+
+	endpoints := map[string]string{
+		"a": path.Join(base, "a"),
+		"b": path.Join(base, "b"),
+		"c": path.Join(base, "c"),
+	}
+
+	logger, err := log.NewLogger()
+	if err != nil {
+		panic(err)
+	}
+	eHandler := endpointHanlder{Endpoints: endpoints, Digests: utils.NewDigestCache(), logger: logger}
+
+	getDigests := func(endpoint string, paths []string) (int, []DirDigest) {
+		target := "/"
+		if len(paths) > 0 {
+			target += "?path=" + strings.Join(paths, "&path=")
+		}
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		w := httptest.NewRecorder()
+		r = mux.SetURLVars(r, map[string]string{"endpoint": endpoint})
+		eHandler.GetDigest(w, r)
+
+		res := w.Result()
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return res.StatusCode, nil
+		}
+
+		resBody, err := io.ReadAll(res.Body)
+		if err != nil {
+			panic(err)
+		}
+		resData := APIResponse[EndpointGetDigestResponse]{}
+		if err = json.Unmarshal(resBody, &resData); err != nil {
+			panic(err)
+		}
+		return res.StatusCode, resData.Data.Digests
+	}
+
+	cases := []endpointGetDigestTestCase{
+		{Name: "root", Endpoint: "a", Status: http.StatusOK},
+		{Name: "multiple paths", Endpoint: "a", Paths: []string{"lyrics", "lyrics/old"}, Status: http.StatusOK},
+		{Name: "endpoint not exist", Endpoint: "lalaland", Status: http.StatusNotFound},
+		{Name: "path not exist", Endpoint: "a", Paths: []string{"notexist"}, Status: http.StatusNotFound},
+		{Name: "path is file", Endpoint: "a", Paths: []string{"readme.txt"}, Status: http.StatusBadRequest},
+		{Name: "out of endpoint", Endpoint: "a", Paths: []string{"../b"}, Status: http.StatusBadRequest},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			status, digests := getDigests(tc.Endpoint, tc.Paths)
+			assert.Equal(t, tc.Status, status)
+			if tc.Status == http.StatusOK {
+				expectedLen := len(tc.Paths)
+				if expectedLen == 0 {
+					expectedLen = 1
+				}
+				assert.Equal(t, expectedLen, len(digests))
+			}
+		})
+	}
+
+	t.Run("same trees", func(t *testing.T) {
+		_, aDigests := getDigests("a", nil)
+		_, bDigests := getDigests("b", nil)
+		assert.DeepEqual(t, aDigests, bDigests)
+	})
+
+	t.Run("different trees", func(t *testing.T) {
+		_, aDigests := getDigests("a", []string{"", "lyrics", "lyrics/old"})
+		_, cDigests := getDigests("c", []string{"", "lyrics", "lyrics/old"})
+		for i := range aDigests {
+			assert.Assert(t, aDigests[i].Digest != cDigests[i].Digest)
+		}
+
+		aChildren := map[string]string{}
+		for _, child := range aDigests[0].Children {
+			aChildren[child.Name] = child.Digest
+		}
+		for _, child := range cDigests[0].Children {
+			if child.Name == "readme.txt" {
+				assert.Equal(t, aChildren[child.Name], child.Digest)
+			} else {
+				assert.Assert(t, aChildren[child.Name] != child.Digest)
+			}
+		}
+	})
+
+	t.Run("written file with the same size and mtime", func(t *testing.T) {
+		_, before := getDigests("b", nil)
+
+		filePath := path.Join(endpoints["b"], "lyrics/old/time.txt")
+		stat, err := os.Stat(filePath)
+		if err != nil {
+			panic(err)
+		}
+		if err = os.WriteFile(filePath, []byte("Kicking around on a piece of ground in your hometown"[:stat.Size()]), 0777); err != nil {
+			panic(err)
+		}
+		if err = os.Chtimes(filePath, time.Time{}, stat.ModTime()); err != nil {
+			panic(err)
+		}
+		eHandler.Digests.Invalidate(filePath)
+
+		_, after := getDigests("b", nil)
+		assert.Assert(t, before[0].Digest != after[0].Digest)
+	})
+
+	t.Run("grandchild written outside the server", func(t *testing.T) {
+		_, cDigests := getDigests("c", nil)
+		_, before := getDigests("a", nil)
+		assert.Assert(t, before[0].Digest != cDigests[0].Digest)
+
+		// replaced the way editors save files, without Invalidate
+		tmpPath := path.Join(endpoints["a"], "lyrics/old/.time.txt.tmp")
+		if err := os.WriteFile(tmpPath, []byte("Fritter and waste the hours in an offhand way"), 0777); err != nil {
+			panic(err)
+		}
+		if err := os.Rename(tmpPath, path.Join(endpoints["a"], "lyrics/old/time.txt")); err != nil {
+			panic(err)
+		}
+
+		_, after := getDigests("a", nil)
+		assert.Equal(t, cDigests[0].Digest, after[0].Digest)
+	})
+
+	t.Run("removed dir", func(t *testing.T) {
+		if err := os.RemoveAll(path.Join(endpoints["b"], "lyrics")); err != nil {
+			panic(err)
+		}
+		_, digests := getDigests("b", nil)
+		assert.Equal(t, 1, len(digests[0].Children))
+		assert.Equal(t, "readme.txt", digests[0].Children[0].Name)
+	})
+}
+
+// newOpenServer is NewServer with authentication disabled, for tests which
+// are not about access
+func newOpenServer(address string, configs map[string]config.EndpointConfig, logger *log.Logger) *Server {
+	srv := NewServer(address, configs, logger)
+	srv.AuthDisabled = true
+	return srv
+}
+
 func mkDirs(base string, dirs []string) error {
 	for _, dir := range dirs {
 		err := os.MkdirAll(path.Join(base, dir), 0777)
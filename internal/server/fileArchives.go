@@ -0,0 +1,268 @@
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/aigic8/gosyn/internal/ignore"
+	"github.com/aigic8/gosyn/internal/server/log"
+	"github.com/aigic8/gosyn/internal/server/utils"
+	"github.com/gorilla/mux"
+)
+
+const (
+	ARCHIVE_FORMAT_PARAM  = "format"
+	ARCHIVE_FORMAT_TAR_GZ = "tar.gz"
+	ARCHIVE_FORMAT_ZIP    = "zip"
+)
+
+var archiveTypes = map[string]string{
+	ARCHIVE_FORMAT_TAR_GZ: "application/gzip",
+	ARCHIVE_FORMAT_ZIP:    "application/zip",
+}
+
+// archiveWriter writes entries of an archive, names are slash separated paths
+// relative to the archived directory
+type archiveWriter interface {
+	WriteDir(name string, info fs.FileInfo) error
+	WriteFile(name string, info fs.FileInfo, fullPath string) error
+	WriteLink(name string, info fs.FileInfo, target string) error
+	Close() error
+}
+
+// GetArchive streams a directory as an archive in the format of the 'format'
+// query param, 'tar.gz' (the default) or 'zip'. Ignored paths are left out,
+// symlinks are followed by the endpoint symlink policy and symlinks synced as
+// links are archived as links. Like Get, the 'snapshot' query param reads the
+// directory from a snapshot.
+func (fHandler *fileHandler) GetArchive(w http.ResponseWriter, r *http.Request) {
+	errh := log.NewAPIErrHandler(fHandler.logger, r, w)
+	fileVar := strings.TrimSpace(mux.Vars(r)["file"])
+	if fileVar == "" {
+		errh.Warn(log.ErrVarNotFound("file"))
+		return
+	}
+
+	format := strings.TrimSpace(r.URL.Query().Get(ARCHIVE_FORMAT_PARAM))
+	if format == "" {
+		format = ARCHIVE_FORMAT_TAR_GZ
+	}
+	contentType, formatExists := archiveTypes[format]
+	if !formatExists {
+		errh.Warn(log.ErrBadArchiveFormat(format, []string{ARCHIVE_FORMAT_TAR_GZ, ARCHIVE_FORMAT_ZIP}))
+		return
+	}
+
+	endpoint, filePath, fullPath, ok := fHandler.resolveFile(errh, fileVar)
+	if !ok {
+		return
+	}
+	endpointPath := fHandler.Endpoints[endpoint]
+	root, ok := snapshotRoot(errh, fHandler.Snapshots, endpointPath, r)
+	if !ok {
+		return
+	}
+	if root != endpointPath {
+		fullPath = path.Join(root, filePath)
+	}
+
+	stat, err := os.Stat(fullPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			errh.Warn(log.ErrFileNotFound(fileVar))
+			return
+		}
+		errh.Err(log.ErrUnknown("err stating file: " + err.Error()))
+		return
+	}
+	if !stat.IsDir() {
+		errh.Warn(log.ErrPathIsNotDir(fileVar))
+		return
+	}
+
+	endpointConfig := fHandler.Configs[endpoint]
+	matcher, err := ignore.NewMatcher(root, endpointConfig.Ignore)
+	if err != nil {
+		errh.Err(log.ErrUnknown("err reading ignore rules: " + err.Error()))
+		return
+	}
+	links, err := utils.NewLinks(root, endpointConfig.Symlinks)
+	if err != nil {
+		errh.Err(log.ErrUnknown("error resolving symlinks: " + err.Error()))
+		return
+	}
+
+	name := endpoint
+	if filePath != "" {
+		name = path.Base(filePath)
+	}
+	setAttachment(w, name+"."+format)
+	w.Header().Set("Content-Type", contentType)
+
+	var archive archiveWriter
+	if format == ARCHIVE_FORMAT_ZIP {
+		archive = &zipArchive{zipWriter: zip.NewWriter(w)}
+	} else {
+		gzipWriter := gzip.NewWriter(w)
+		archive = &tarGzArchive{gzipWriter: gzipWriter, tarWriter: tar.NewWriter(gzipWriter)}
+	}
+
+	err = writeArchive(archive, fullPath, "", filePath, matcher, links, map[string]bool{})
+	if err == nil {
+		err = archive.Close()
+	}
+	if err != nil {
+		// headers are already sent, the client gets a broken archive
+		fHandler.logger.Logger.Errorw("error writing archive", "dir", fileVar, "error", err.Error())
+	}
+}
+
+// writeArchive adds entries of dirPath, which is at archivePath of the archive
+// and at filePath of the endpoint, to the archive and recurses into
+// directories. Like utils.MakeTree, directories being written are kept in
+// visiting so symlink loops are not followed.
+func writeArchive(archive archiveWriter, dirPath string, archivePath string, filePath string, matcher *ignore.Matcher, links *utils.Links, visiting map[string]bool) error {
+	visiting[dirPath] = true
+	defer delete(visiting, dirPath)
+
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if utils.IsMetaName(entry.Name()) {
+			continue
+		}
+		linkEntry, err := links.Entry(path.Join(dirPath, entry.Name()), entry)
+		if err != nil {
+			return err
+		}
+		if linkEntry == nil {
+			continue
+		}
+		isDir := linkEntry.Info.IsDir()
+
+		entryFilePath := path.Join(filePath, entry.Name())
+		ignored, err := matcher.Ignored(entryFilePath, isDir)
+		if err != nil {
+			return err
+		}
+		if ignored {
+			continue
+		}
+
+		name := path.Join(archivePath, entry.Name())
+		switch {
+		case linkEntry.Info.Mode()&os.ModeSymlink != 0:
+			err = archive.WriteLink(name, linkEntry.Info, linkEntry.Target)
+		case isDir:
+			if err = archive.WriteDir(name, linkEntry.Info); err == nil && !visiting[linkEntry.Real] {
+				err = writeArchive(archive, linkEntry.Real, name, entryFilePath, matcher, links, visiting)
+			}
+		case linkEntry.Info.Mode().IsRegular():
+			err = archive.WriteFile(name, linkEntry.Info, linkEntry.Real)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type tarGzArchive struct {
+	gzipWriter *gzip.Writer
+	tarWriter  *tar.Writer
+}
+
+func (archive *tarGzArchive) WriteDir(name string, info fs.FileInfo) error {
+	return archive.writeHeader(name+"/", info, "")
+}
+
+func (archive *tarGzArchive) WriteFile(name string, info fs.FileInfo, fullPath string) error {
+	if err := archive.writeHeader(name, info, ""); err != nil {
+		return err
+	}
+	return copyFile(archive.tarWriter, fullPath)
+}
+
+func (archive *tarGzArchive) WriteLink(name string, info fs.FileInfo, target string) error {
+	return archive.writeHeader(name, info, target)
+}
+
+func (archive *tarGzArchive) writeHeader(name string, info fs.FileInfo, target string) error {
+	header, err := tar.FileInfoHeader(info, target)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	return archive.tarWriter.WriteHeader(header)
+}
+
+func (archive *tarGzArchive) Close() error {
+	if err := archive.tarWriter.Close(); err != nil {
+		return err
+	}
+	return archive.gzipWriter.Close()
+}
+
+type zipArchive struct {
+	zipWriter *zip.Writer
+}
+
+func (archive *zipArchive) WriteDir(name string, info fs.FileInfo) error {
+	_, err := archive.create(name+"/", info, zip.Store)
+	return err
+}
+
+func (archive *zipArchive) WriteFile(name string, info fs.FileInfo, fullPath string) error {
+	entry, err := archive.create(name, info, zip.Deflate)
+	if err != nil {
+		return err
+	}
+	return copyFile(entry, fullPath)
+}
+
+// WriteLink writes a symlink entry, like the zip command zip links hold their
+// target as content
+func (archive *zipArchive) WriteLink(name string, info fs.FileInfo, target string) error {
+	entry, err := archive.create(name, info, zip.Store)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(entry, target)
+	return err
+}
+
+func (archive *zipArchive) create(name string, info fs.FileInfo, method uint16) (io.Writer, error) {
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return nil, err
+	}
+	header.Name = name
+	header.Method = method
+	return archive.zipWriter.CreateHeader(header)
+}
+
+func (archive *zipArchive) Close() error {
+	return archive.zipWriter.Close()
+}
+
+func copyFile(w io.Writer, fullPath string) error {
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(w, file)
+	return err
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/aigic8/gosyn/internal/config"
+	"github.com/aigic8/gosyn/internal/ignore"
+	"github.com/aigic8/gosyn/internal/server/log"
+	"gotest.tools/v3/assert"
+)
+
+func TestGetArchive(t *testing.T) {
+	base := t.TempDir()
+	songsPath := path.Join(base, "songs")
+	if err := mkDirs(songsPath, []string{"pink-floyd/live", "pink-floyd/node_modules"}); err != nil {
+		panic(err)
+	}
+	if err := mkFiles(songsPath, []fileInfo{
+		{Path: "pink-floyd/" + ignore.FILE_NAME, Data: []byte("*.swp\n")},
+		{Path: "pink-floyd/time.txt", Data: []byte("Ticking away the moments")},
+		{Path: "pink-floyd/time.swp", Data: []byte("Ticking away")},
+		{Path: "pink-floyd/node_modules/index.js", Data: []byte("module.exports = leftPad")},
+		{Path: "queen.txt", Data: []byte("Is this the real life?")},
+	}); err != nil {
+		panic(err)
+	}
+	if err := os.Symlink("time.txt", path.Join(songsPath, "pink-floyd/money.txt")); err != nil {
+		panic(err)
+	}
+
+	logger, err := log.NewLogger()
+	if err != nil {
+		panic(err)
+	}
+	get := func(policy config.SymlinkPolicy, url string) *http.Response {
+		srv := newOpenServer("", map[string]config.EndpointConfig{"songs": {Path: songsPath, Symlinks: policy, Ignore: []string{"node_modules/"}}}, logger)
+		w := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+		return w.Result()
+	}
+
+	followed := map[string]string{
+		ignore.FILE_NAME: "*.swp\n",
+		"live/":          "",
+		"money.txt":      "Ticking away the moments",
+		"time.txt":       "Ticking away the moments",
+	}
+	asLinks := map[string]string{
+		ignore.FILE_NAME: "*.swp\n",
+		"live/":          "",
+		"money.txt":      "-> time.txt",
+		"time.txt":       "Ticking away the moments",
+	}
+
+	t.Run("tar.gz", func(t *testing.T) {
+		res := get("", "/files/songs/pink-floyd/archive")
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, "application/gzip", res.Header.Get("Content-Type"))
+		assert.Equal(t, `attachment; filename=pink-floyd.tar.gz`, res.Header.Get("Content-Disposition"))
+		assert.DeepEqual(t, followed, readTarGz(res.Body))
+
+		res = get(config.SymlinksAsLink, "/files/songs/pink-floyd/archive?format=tar.gz")
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.DeepEqual(t, asLinks, readTarGz(res.Body))
+	})
+
+	t.Run("zip", func(t *testing.T) {
+		res := get("", "/files/songs/pink-floyd/archive?format=zip")
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, "application/zip", res.Header.Get("Content-Type"))
+		assert.DeepEqual(t, followed, readZip(res.Body))
+
+		res = get(config.SymlinksAsLink, "/files/songs/pink-floyd/archive?format=zip")
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.DeepEqual(t, asLinks, readZip(res.Body))
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, get("", "/files/songs/pink-floyd/archive?format=rar").StatusCode)
+		assert.Equal(t, http.StatusBadRequest, get("", "/files/songs/queen.txt/archive").StatusCode)
+		assert.Equal(t, http.StatusNotFound, get("", "/files/songs/queen/archive").StatusCode)
+	})
+}
+
+// readTarGz returns contents of archive entries by their names, symlinks are
+// written as '-> target'
+func readTarGz(r io.Reader) map[string]string {
+	gzipReader, err := gzip.NewReader(r)
+	if err != nil {
+		panic(err)
+	}
+	tarReader := tar.NewReader(gzipReader)
+
+	entries := map[string]string{}
+	for {
+		header, err := tarReader.Next()
+		if errors.Is(err, io.EOF) {
+			return entries
+		}
+		if err != nil {
+			panic(err)
+		}
+		if header.Typeflag == tar.TypeSymlink {
+			entries[header.Name] = "-> " + header.Linkname
+			continue
+		}
+		data, err := io.ReadAll(tarReader)
+		if err != nil {
+			panic(err)
+		}
+		entries[header.Name] = string(data)
+	}
+}
+
+func readZip(r io.Reader) map[string]string {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		panic(err)
+	}
+	zipReader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		panic(err)
+	}
+
+	entries := map[string]string{}
+	for _, file := range zipReader.File {
+		entry, err := file.Open()
+		if err != nil {
+			panic(err)
+		}
+		content, err := io.ReadAll(entry)
+		entry.Close()
+		if err != nil {
+			panic(err)
+		}
+		if file.Mode()&os.ModeSymlink != 0 {
+			entries[file.Name] = "-> " + string(content)
+			continue
+		}
+		entries[file.Name] = string(content)
+	}
+	return entries
+}
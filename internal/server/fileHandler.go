@@ -1,28 +1,64 @@
 package server
 
 import (
+	"encoding/hex"
 	"errors"
 	"io"
 	"net/http"
 	"os"
 	"path"
 	"strings"
+	"syscall"
+	"time"
 
+	"github.com/aigic8/gosyn/internal/auth"
+	"github.com/aigic8/gosyn/internal/config"
 	"github.com/aigic8/gosyn/internal/server/log"
 	"github.com/aigic8/gosyn/internal/server/utils"
+	"github.com/cespare/xxhash"
 	"github.com/gorilla/mux"
 )
 
+// DEFAULT_FILE_MODE is the mode of new uploaded files
+const DEFAULT_FILE_MODE os.FileMode = 0644
+
 type fileHandler struct {
 	Endpoints   map[string]string
+	Configs     map[string]config.EndpointConfig
 	MaxHashSize int64
+	Digests     *utils.DigestCache
+	Conflicts   *conflictStore
+	Versions    *versionStore
+	Trash       *trashStore
+	Snapshots   *snapshotStore
+	Shares      *auth.ShareStore
+	ShareMaxAge time.Duration
+	Usage       *usageStore
+	DiskReserve int64
 	logger      *log.Logger
+	locks       utils.KeyedMutex
 }
 
-type FileGetHashResponse struct {
-	Hash string `json:"hash"`
-	File string `json:"file"`
-}
+type (
+	FileGetHashResponse struct {
+		Hash string `json:"hash"`
+		File string `json:"file"`
+	}
+
+	// FileMeta is the current state of a file. It is returned after mutations
+	// and sent with conflict errors so clients can decide what to do. Conflict
+	// is set if the request conflicted with a concurrent change.
+	FileMeta struct {
+		File     string            `json:"file"`
+		Exists   bool              `json:"exists"`
+		Hash     string            `json:"hash,omitempty"`
+		Size     int64             `json:"size"`
+		LastMod  time.Time         `json:"lastModification"`
+		Mode     config.FileMode   `json:"mode,omitempty"`
+		Xattrs   map[string][]byte `json:"xattrs,omitempty"`
+		Conflict *Conflict         `json:"conflict,omitempty"`
+	}
+)
 
 func (fHandler *fileHandler) Get(w http.ResponseWriter, r *http.Request) {
 	errh := log.NewAPIErrHandler(fHandler.logger, r, w)
@@ -33,27 +69,8 @@ func (fHandler *fileHandler) Get(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	endpoint, filePath, err := utils.SplitEndpointAndFile(fileVar)
-	if err != nil {
-		errh.Warn(log.ErrBadFileDesc(fileVar, err))
-		return
-	}
-
-	endpointPath, endpointExists := fHandler.Endpoints[endpoint]
-	if !endpointExists {
-		errh.Warn(log.ErrEndpointNotFound(endpoint))
-		return
-	}
-
-	fullPath := path.Join(endpointPath, filePath)
-
-	isSubPath, err := utils.IsSubPath(endpointPath, fullPath)
-	if err != nil {
-		errh.Err(log.ErrUnknown("error checking subpath: " + err.Error()))
-		return
-	}
-	if !isSubPath {
-		errh.Err(log.ErrOutOfEndpoint(fileVar, endpoint))
+	fullPath, ok := fHandler.resolveReadFile(errh, r, fileVar)
+	if !ok {
 		return
 	}
 
@@ -77,6 +94,17 @@ func (fHandler *fileHandler) Get(w http.ResponseWriter, r *http.Request) {
 		errh.Err(log.ErrUnknown("err opening file: " + err.Error()))
 		return
 	}
+	defer file.Close()
+
+	if fHandler.MaxHashSize <= 0 || stat.Size() <= fHandler.MaxHashSize {
+		if hash, err := fHandler.Digests.FileDigest(fullPath, stat); err == nil {
+			w.Header().Set("ETag", utils.ETag(hash))
+		}
+	}
+	if err = setMetadataHeaders(w, fullPath, stat); err != nil {
+		errh.Err(log.ErrUnknown("err reading file metadata: " + err.Error()))
+		return
+	}
 
 	// TODO use brotli or gzip for text files
 	io.Copy(w, file)
@@ -84,7 +112,6 @@ func (fHandler *fileHandler) Get(w http.ResponseWriter, r *http.Request) {
 
 // TODO is it useful?
 func (fHandler *fileHandler) GetHash(w http.ResponseWriter, r *http.Request) {
-	// TODO get hash is very similar to GetFile should export similar functions
 	errh := log.NewAPIErrHandler(fHandler.logger, r, w)
 	vars := mux.Vars(r)
 	fileVar := strings.TrimSpace(vars["file"])
@@ -94,27 +121,8 @@ func (fHandler *fileHandler) GetHash(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	endpoint, filePath, err := utils.SplitEndpointAndFile(fileVar)
-	if err != nil {
-		errh.Warn(log.ErrBadFileDesc(fileVar, err))
-		return
-	}
-
-	endpointPath, endpointExists := fHandler.Endpoints[endpoint]
-	if !endpointExists {
-		errh.Warn(log.ErrEndpointNotFound(endpoint))
-		return
-	}
-
-	fullPath := path.Join(endpointPath, filePath)
-
-	isSubPath, err := utils.IsSubPath(endpointPath, fullPath)
-	if err != nil {
-		errh.Err(log.ErrUnknown("error checking subpath: " + err.Error()))
-		return
-	}
-	if !isSubPath {
-		errh.Err(log.ErrOutOfEndpoint(fileVar, endpoint))
+	fullPath, ok := fHandler.resolveReadFile(errh, r, fileVar)
+	if !ok {
 		return
 	}
 
@@ -138,7 +146,7 @@ func (fHandler *fileHandler) GetHash(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	hash, err := utils.HashFile(fullPath)
+	hash, err := fHandler.Digests.FileDigest(fullPath, fileInfo)
 	if err != nil {
 		errh.Err(log.ErrUnknown("err hashing file: " + err.Error()))
 		return
@@ -147,11 +155,21 @@ func (fHandler *fileHandler) GetHash(w http.ResponseWriter, r *http.Request) {
 	respJson, err := wrapAPIResponse(FileGetHashResponse{Hash: hash, File: fileVar})
 	if err != nil {
 		errh.Err(log.ErrUnknown("error marshaling json: " + err.Error()))
+		return
 	}
 
+	w.Header().Set("ETag", utils.ETag(hash))
 	w.Write(respJson)
 }
 
+// AddNew creates or overwrites a file. Clients can send 'If-Match' with the
+// hash of the version they based their changes on, or 'If-None-Match: *' to
+// only create the file, and get 412 with the current file state on mismatch.
+// Drop boxes never overwrite files, uploads with a taken name are written to
+// a unique name, and only take the name and content of uploads. Uploads are checked against the upload rules and quotas of
+// the endpoint before they are written. With 'x-symlink-target' a symlink is
+// made instead, see addLink. Modification time, mode and extended attributes
+// of the file can be sent in 'x-mtime', 'x-mode' and 'x-xattr' headers.
 func (fHandler *fileHandler) AddNew(w http.ResponseWriter, r *http.Request) {
 	errh := log.NewAPIErrHandler(fHandler.logger, r, w)
 	rawPath := strings.TrimSpace(r.Header.Get("x-file-path"))
@@ -167,75 +185,376 @@ func (fHandler *fileHandler) AddNew(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	endpoint, filePath, err := utils.SplitEndpointAndFile(rawPath)
-	if err != nil {
-		errh.Warn(log.ErrBadFileDesc(rawPath, err))
+	if target := r.Header.Get("x-symlink-target"); target != "" {
+		fHandler.addLink(w, r, errh, rawPath, target)
 		return
 	}
 
-	endpointPath, endpointExists := fHandler.Endpoints[endpoint]
-	if !endpointExists {
-		errh.Warn(log.ErrEndpointNotFound(endpoint))
+	endpoint, filePath, fullPath, ok := fHandler.resolveNewFile(errh, rawPath)
+	if !ok || !fHandler.checkMode(errh, endpoint, changeCreate) || !fHandler.checkIgnored(errh, endpoint, filePath, rawPath) {
 		return
 	}
 
-	fullPath := path.Join(endpointPath, filePath)
+	endpointConfig := fHandler.Configs[endpoint]
+	dropBox := endpointConfig.Mode == config.ModeDropBox
+	// drop boxes only take the name and content of uploads, uploaders can not
+	// make directories or set metadata of files
+	var metadata fileMetadata
+	if dropBox {
+		recursive = false
+	} else if metadata, ok = parseFileMetadata(errh, r); !ok {
+		return
+	}
 
-	isSubPath, err := utils.IsSubPath(endpointPath, fullPath)
-	if err != nil {
-		errh.Err(log.ErrUnknown("error checking subpath: " + err.Error()))
+	uploads := endpointConfig.Uploads
+	if !extensionAllowed(uploads, filePath) {
+		errh.Warn(log.ErrFileTypeNotAllowed(rawPath, path.Ext(filePath)))
 		return
 	}
-	if !isSubPath {
-		errh.Err(log.ErrOutOfEndpoint(rawPath, endpoint))
+
+	var body io.Reader = r.Body
+	maxSize := uploadMaxSize(endpointConfig)
+	if maxSize >= 0 {
+		if r.ContentLength > maxSize {
+			errh.Warn(log.ErrFileTooLarge(rawPath, maxSize))
+			return
+		}
+		// one more byte is read to know the body is too large
+		body = io.LimitReader(r.Body, maxSize+1)
+	}
+
+	unlock := fHandler.locks.Lock(fullPath)
+	defer unlock()
+
+	var meta *FileMeta
+	matched := true
+	writePath := fullPath
+	// files written through symlinks are counted at their target
+	writeFilePath, err := fHandler.targetPath(endpoint, filePath, fullPath)
+	if err != nil {
+		errh.Err(log.ErrUnknown("err finding target path: " + err.Error()))
 		return
 	}
+	if dropBox {
+		force = false
+		if writeFilePath, writePath, err = fHandler.uniqueFilePath(endpoint, filePath); err != nil {
+			errh.Err(log.ErrUnknown("err finding unique path: " + err.Error()))
+			return
+		}
+	} else {
+		if meta, matched, err = fHandler.checkPreconditions(r, rawPath, fullPath); err != nil {
+			errh.Err(log.ErrUnknown("err checking preconditions: " + err.Error()))
+			return
+		}
+	}
 
-	fileStat, err := os.Stat(fullPath)
-	if errors.Is(err, os.ErrNotExist) {
-		dir := path.Dir(fullPath)
-		if recursive {
-			if err = os.MkdirAll(dir, 0777); err != nil {
-				errh.Warn(log.ErrUnknown("err making dir: " + err.Error()))
+	// the client has changed an outdated version of the file, endpoint policy decides what happens
+	var conflict *Conflict
+	if !matched {
+		policy := endpointConfig.ConflictPolicy
+		if conflict, err = newConflict(r, filePath, policy); err != nil {
+			errh.Err(log.ErrUnknown("err making conflict: " + err.Error()))
+			return
+		}
+		conflict.Resolution = resolveWriteConflict(policy, r, meta)
+
+		switch conflict.Resolution {
+		case ResolutionClientVersion:
+			force = true
+		case ResolutionKeptBoth:
+			// the copy is a new name, it is checked like the path of the upload
+			copyFilePath, ok := fHandler.checkNames(errh, endpoint, conflictCopyPath(filePath, conflict.Host, conflict.Time), rawPath)
+			if !ok {
 				return
 			}
-		}
-		dirStat, err := os.Stat(dir)
-		if err != nil {
-			if errors.Is(err, os.ErrNotExist) {
-				errh.Warn(log.ErrDirNotExist(dir))
+			if writeFilePath, writePath, err = fHandler.uniqueFilePath(endpoint, copyFilePath); err != nil {
+				errh.Err(log.ErrUnknown("err finding conflict copy path: " + err.Error()))
+				return
+			}
+			conflict.CopyFile = writeFilePath
+			if !fHandler.checkIgnored(errh, endpoint, conflict.CopyFile, endpoint+"/"+conflict.CopyFile) {
+				return
+			}
+		case ResolutionNone, ResolutionServerVersion:
+			if err = fHandler.addConflict(endpoint, conflict); err != nil {
+				errh.Err(log.ErrUnknown("err saving conflict: " + err.Error()))
 				return
 			}
-			errh.Err(log.ErrUnknown("err getting dir stat: " + err.Error()))
+			meta.Conflict = conflict
+			errh.Warn(log.ErrPreconditionFailed(rawPath, meta))
+			return
+		}
+	}
+
+	fileMode := DEFAULT_FILE_MODE
+	mustAppend := false
+	var newDirs []string
+	fileStat, err := os.Stat(writePath)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) && !errors.Is(err, syscall.ENOTDIR) {
+			errh.Err(log.ErrUnknown("err stating file: " + err.Error()))
 			return
 		}
-		if !dirStat.IsDir() {
-			errh.Err(log.ErrUnknown("err making dir: " + err.Error()))
+		if newDirs, ok = fHandler.checkNewEntry(errh, endpoint, writePath, rawPath, recursive); !ok {
+			return
+		}
+	} else {
+		if fileStat.IsDir() {
+			errh.Warn(log.ErrPathIsDir(rawPath))
+			return
+		}
+		// the upload is checked to be an append after it is written
+		if !modeAllows(endpointConfig.Mode, changeOverwrite) {
+			if !fHandler.checkMode(errh, endpoint, changeAppend) {
+				return
+			}
+			mustAppend = true
+		}
+		fileMode = fileStat.Mode().Perm()
+		// a matched If-Match is an explicit permission to overwrite
+		if !force && r.Header.Get("If-Match") == "" {
+			if meta == nil {
+				if meta, err = fHandler.fileMeta(rawPath, fullPath); err != nil {
+					errh.Err(log.ErrUnknown("err getting file meta: " + err.Error()))
+					return
+				}
+			}
+			errh.Warn(log.ErrFileExist(rawPath, meta))
 			return
 		}
 	}
 
-	if fileStat.IsDir() {
-		errh.Warn(log.ErrPathIsDir(rawPath))
+	owner := requestOwner(r)
+	space, quotaLimit, err := fHandler.uploadSpace(endpoint, writeFilePath, owner)
+	if err != nil {
+		errh.Err(log.ErrUnknown("err checking quota: " + err.Error()))
 		return
 	}
-	if !force {
-		errh.Warn(log.ErrFileExist(rawPath))
+	if space >= 0 {
+		if r.ContentLength > space {
+			errh.Warn(log.ErrQuotaExceeded(rawPath, quotaLimit))
+			return
+		}
+		if maxSize < 0 || space < maxSize {
+			body = io.LimitReader(r.Body, space+1)
+		}
+	}
+
+	if len(uploads.AllowedTypes) > 0 || len(uploads.DeniedTypes) > 0 {
+		var fileType string
+		if fileType, body, err = sniffType(body); err != nil {
+			errh.Err(log.ErrUnknown("err reading file type: " + err.Error()))
+			return
+		}
+		if !typeAllowed(uploads, fileType) {
+			errh.Warn(log.ErrFileTypeNotAllowed(rawPath, fileType))
+			return
+		}
+	}
+
+	// missing directories are made once every check before the write passed,
+	// and removed again if the upload fails
+	undoDirs, err := makeDirs(newDirs)
+	if err != nil {
+		errh.Err(log.ErrUnknown("err making dir: " + err.Error()))
 		return
 	}
+	renamed := false
+	defer func() {
+		if !renamed {
+			undoDirs()
+		}
+	}()
 
+	// the new content is written to a temp file and renamed in place, so failed
+	// uploads never leave a half written file behind
 	// TODO maybe use smart transfer like rsync?
-	file, err := os.Create(fullPath)
+	tmpFile, err := os.CreateTemp(path.Dir(writePath), utils.META_DIR+"-upload-*")
 	if err != nil {
 		errh.Err(log.ErrUnknown("error creating file: " + err.Error()))
 		return
 	}
+	defer os.Remove(tmpFile.Name())
 
 	defer r.Body.Close()
-	if _, err = io.Copy(file, r.Body); err != nil {
+	hashWriter := xxhash.New()
+	written, err := io.Copy(io.MultiWriter(tmpFile, hashWriter), body)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
 		errh.Err(log.ErrUnknown("error writing to file: " + err.Error()))
 		return
 	}
+	if maxSize >= 0 && written > maxSize {
+		errh.Warn(log.ErrFileTooLarge(rawPath, maxSize))
+		return
+	}
+	if space >= 0 && written > space {
+		errh.Warn(log.ErrQuotaExceeded(rawPath, quotaLimit))
+		return
+	}
+	// the written size is checked again and counted at once, so concurrent
+	// uploads can not pass the quotas together
+	release, quotaLimit, fits, err := fHandler.reserveSpace(endpoint, writeFilePath, owner, written)
+	if err != nil {
+		errh.Err(log.ErrUnknown("err checking quota: " + err.Error()))
+		return
+	}
+	if !fits {
+		errh.Warn(log.ErrQuotaExceeded(rawPath, quotaLimit))
+		return
+	}
+	defer release()
+	if mustAppend {
+		appended, err := isAppend(writePath, tmpFile.Name())
+		if err != nil {
+			errh.Err(log.ErrUnknown("err comparing file content: " + err.Error()))
+			return
+		}
+		if !appended {
+			errh.Warn(log.ErrModeForbids(endpoint, string(endpointConfig.Mode), string(changeOverwrite)))
+			return
+		}
+	}
+
+	if metadata.Mode != 0 {
+		fileMode = metadata.Mode
+	}
+	if err = os.Chmod(tmpFile.Name(), fileMode); err != nil {
+		errh.Err(log.ErrUnknown("error changing file mode: " + err.Error()))
+		return
+	}
+	if err = metadata.apply(tmpFile.Name()); err != nil {
+		if errors.Is(err, utils.ErrXattrsNotSupported) {
+			errh.Warn(log.ErrXattrsNotSupported(rawPath))
+			return
+		}
+		errh.Err(log.ErrUnknown("error setting file metadata: " + err.Error()))
+		return
+	}
+
+	if writePath == fullPath {
+		if err = fHandler.saveVersion(endpoint, filePath, fullPath); err != nil {
+			errh.Err(log.ErrUnknown("error saving version: " + err.Error()))
+			return
+		}
+	}
+
+	if err = os.Rename(tmpFile.Name(), writePath); err != nil {
+		errh.Err(log.ErrUnknown("error renaming file: " + err.Error()))
+		return
+	}
+	renamed = true
+	fHandler.fileChanged(endpoint, writePath)
+
+	fHandler.setOwner(endpoint, writeFilePath, rawPath, owner)
+	release()
+	// conflicts resolved by writing are recorded once the write is done
+	if conflict != nil {
+		if err = fHandler.addConflict(endpoint, conflict); err != nil {
+			fHandler.logger.Logger.Errorw("error saving conflict", "file", rawPath, "error", err.Error())
+		}
+	}
+
+	// new names of conflict copies and drop boxes and normalized names are
+	// reported, writes through symlinks keep the path of the request
+	writtenFile := rawPath
+	if _, rawFilePath, _ := utils.SplitEndpointAndFile(rawPath); writePath != fullPath {
+		writtenFile = endpoint + "/" + writeFilePath
+	} else if filePath != rawFilePath {
+		writtenFile = endpoint + "/" + filePath
+	}
+	newMeta, err := fHandler.fileMeta(writtenFile, writePath)
+	if err != nil {
+		errh.Err(log.ErrUnknown("err getting file meta: " + err.Error()))
+		return
+	}
+	newMeta.Hash = hex.EncodeToString(hashWriter.Sum(nil))
+	newMeta.Conflict = conflict
+
+	respJson, err := wrapAPIResponse(newMeta)
+	if err != nil {
+		errh.Err(log.ErrUnknown("error marshaling json: " + err.Error()))
+		return
+	}
+	w.Header().Set("ETag", utils.ETag(newMeta.Hash))
+	w.Write(respJson)
+}
+
+// Delete moves a file to the trash of its endpoint. 'If-Match' is checked
+// against the current file hash. Symlinks synced as links are removed.
+func (fHandler *fileHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	errh := log.NewAPIErrHandler(fHandler.logger, r, w)
+	vars := mux.Vars(r)
+	fileVar := strings.TrimSpace(vars["file"])
+	if fileVar == "" {
+		errh.Warn(log.ErrVarNotFound("file"))
+		return
+	}
+
+	endpoint, filePath, fullPath, isLink, ok := fHandler.resolveLink(errh, fileVar)
+	if !ok {
+		return
+	}
+	if isLink {
+		fHandler.deleteLink(w, r, errh, fileVar, endpoint, fullPath)
+		return
+	}
+	if !fHandler.checkMode(errh, endpoint, changeDelete) {
+		return
+	}
+
+	unlock := fHandler.locks.Lock(fullPath)
+	defer unlock()
+
+	meta, matched, err := fHandler.checkPreconditions(r, fileVar, fullPath)
+	if err != nil {
+		errh.Err(log.ErrUnknown("err checking preconditions: " + err.Error()))
+		return
+	}
+
+	if !matched {
+		policy := fHandler.Configs[endpoint].ConflictPolicy
+		conflict, err := newConflict(r, filePath, policy)
+		if err != nil {
+			errh.Err(log.ErrUnknown("err making conflict: " + err.Error()))
+			return
+		}
+		conflict.Resolution = resolveDeleteConflict(policy)
+
+		if err = fHandler.addConflict(endpoint, conflict); err != nil {
+			errh.Err(log.ErrUnknown("err saving conflict: " + err.Error()))
+			return
+		}
+
+		if conflict.Resolution != ResolutionClientVersion {
+			meta.Conflict = conflict
+			errh.Warn(log.ErrPreconditionFailed(fileVar, meta))
+			return
+		}
+	}
+
+	stat, err := os.Stat(fullPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			errh.Warn(log.ErrFileNotFound(fileVar))
+			return
+		}
+		errh.Err(log.ErrUnknown("err stating file: " + err.Error()))
+		return
+	}
+
+	// deleting whole directories is too dangerous for now, clients should delete files one by one
+	if stat.IsDir() {
+		errh.Warn(log.ErrPathIsDir(fileVar))
+		return
+	}
+
+	if err = fHandler.trashFile(endpoint, filePath, fullPath, TrashReasonDeleted); err != nil {
+		errh.Err(log.ErrUnknown("err removing file: " + err.Error()))
+		return
+	}
 
 	respJson, err := wrapAPIResponse(map[string]string{})
 	if err != nil {
@@ -244,3 +563,398 @@ func (fHandler *fileHandler) AddNew(w http.ResponseWriter, r *http.Request) {
 	}
 	w.Write(respJson)
 }
+
+// Move renames a file to the path in 'x-destination' header inside the same
+// endpoint. 'If-Match' is checked against the source file hash.
+func (fHandler *fileHandler) Move(w http.ResponseWriter, r *http.Request) {
+	errh := log.NewAPIErrHandler(fHandler.logger, r, w)
+	vars := mux.Vars(r)
+	fileVar := strings.TrimSpace(vars["file"])
+	if fileVar == "" {
+		errh.Warn(log.ErrVarNotFound("file"))
+		return
+	}
+
+	rawDest := strings.TrimSpace(r.Header.Get("x-destination"))
+	if rawDest == "" {
+		errh.Warn(log.ErrHeaderNotFound("destination", "x-destination"))
+		return
+	}
+
+	recursive := strings.TrimSpace(r.Header.Get("x-recursive")) == "true"
+	force := strings.TrimSpace(r.Header.Get("x-force")) == "true"
+
+	endpoint, filePath, fullPath, ok := fHandler.resolveFile(errh, fileVar)
+	if !ok || !fHandler.checkMode(errh, endpoint, changeDelete) {
+		return
+	}
+
+	destEndpoint, destFilePath, destPath, ok := fHandler.resolveNewFile(errh, rawDest)
+	if !ok {
+		return
+	}
+	if destEndpoint != endpoint {
+		errh.Warn(log.ErrMoveAcrossEndpoints(fileVar, rawDest))
+		return
+	}
+	if !fHandler.checkIgnored(errh, destEndpoint, destFilePath, rawDest) {
+		return
+	}
+
+	// locking in a fixed order prevents deadlocks between opposite moves
+	firstLock, secondLock := fullPath, destPath
+	if secondLock < firstLock {
+		firstLock, secondLock = secondLock, firstLock
+	}
+	unlock := fHandler.locks.Lock(firstLock)
+	defer unlock()
+	if secondLock != firstLock {
+		unlockSecond := fHandler.locks.Lock(secondLock)
+		defer unlockSecond()
+	}
+
+	meta, matched, err := fHandler.checkPreconditions(r, fileVar, fullPath)
+	if err != nil {
+		errh.Err(log.ErrUnknown("err checking preconditions: " + err.Error()))
+		return
+	}
+	if !matched {
+		errh.Warn(log.ErrPreconditionFailed(fileVar, meta))
+		return
+	}
+
+	stat, err := os.Stat(fullPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			errh.Warn(log.ErrFileNotFound(fileVar))
+			return
+		}
+		errh.Err(log.ErrUnknown("err stating file: " + err.Error()))
+		return
+	}
+	if stat.IsDir() {
+		errh.Warn(log.ErrPathIsDir(fileVar))
+		return
+	}
+
+	var newDirs []string
+	destStat, err := os.Stat(destPath)
+	if err == nil {
+		if destStat.IsDir() {
+			errh.Warn(log.ErrPathIsDir(rawDest))
+			return
+		}
+		if !force {
+			destMeta, err := fHandler.fileMeta(rawDest, destPath)
+			if err != nil {
+				errh.Err(log.ErrUnknown("err getting file meta: " + err.Error()))
+				return
+			}
+			errh.Warn(log.ErrFileExist(rawDest, destMeta))
+			return
+		}
+	} else if errors.Is(err, os.ErrNotExist) || errors.Is(err, syscall.ENOTDIR) {
+		// renames in the same directory do not add an entry to it
+		if path.Dir(destPath) != path.Dir(fullPath) {
+			if newDirs, ok = fHandler.checkNewEntry(errh, destEndpoint, destPath, rawDest, recursive); !ok {
+				return
+			}
+		}
+	} else {
+		errh.Err(log.ErrUnknown("err stating file: " + err.Error()))
+		return
+	}
+	// the moved file is a new file at the destination for the upload rules
+	if !fHandler.checkFileRules(errh, destEndpoint, destFilePath, rawDest, fullPath) {
+		return
+	}
+
+	undoDirs, err := makeDirs(newDirs)
+	if err != nil {
+		errh.Err(log.ErrUnknown("err making dir: " + err.Error()))
+		return
+	}
+	if err = fHandler.saveVersion(destEndpoint, destFilePath, destPath); err != nil {
+		undoDirs()
+		errh.Err(log.ErrUnknown("error saving version: " + err.Error()))
+		return
+	}
+
+	if err = os.Rename(fullPath, destPath); err != nil {
+		undoDirs()
+		errh.Err(log.ErrUnknown("err moving file: " + err.Error()))
+		return
+	}
+	// the owner is moved before both paths are counted again
+	if fHandler.Usage != nil {
+		err = fHandler.moveOwner(endpoint, filePath, fullPath, destFilePath, destPath)
+		if err != nil {
+			fHandler.logger.Logger.Errorw("error moving file owner", "file", fileVar, "error", err.Error())
+		}
+	}
+	fHandler.fileChanged(endpoint, fullPath)
+	fHandler.fileChanged(endpoint, destPath)
+
+	destMeta, err := fHandler.fileMeta(rawDest, destPath)
+	if err != nil {
+		errh.Err(log.ErrUnknown("err getting file meta: " + err.Error()))
+		return
+	}
+
+	respJson, err := wrapAPIResponse(destMeta)
+	if err != nil {
+		errh.Err(log.ErrUnknown("error marshaling json: " + err.Error()))
+		return
+	}
+	w.Write(respJson)
+}
+
+// resolveFile splits a raw 'endpoint/file' path and returns the endpoint, the
+// clean path of the file inside the endpoint and its full path, in which
+// symlinks followed by the endpoint symlink policy are resolved. Symlinks
+// synced as links are refused, see resolveLink. Errors are sent to the client
+// and ok is false.
+func (fHandler *fileHandler) resolveFile(errh *log.APIERRHandler, rawPath string) (string, string, string, bool) {
+	return fHandler.resolveFileEntry(errh, rawPath, false)
+}
+
+// resolveNewFile is resolveFile for paths a request creates or moves to, new
+// names of the path are checked against the endpoint names policy.
+func (fHandler *fileHandler) resolveNewFile(errh *log.APIERRHandler, rawPath string) (string, string, string, bool) {
+	return fHandler.resolveFileEntry(errh, rawPath, true)
+}
+
+func (fHandler *fileHandler) resolveFileEntry(errh *log.APIERRHandler, rawPath string, isNew bool) (string, string, string, bool) {
+	endpoint, filePath, fullPath, isLink, ok := fHandler.resolveEntry(errh, rawPath, isNew)
+	if ok && isLink {
+		errh.Warn(log.ErrPathIsSymlink(rawPath))
+		return "", "", "", false
+	}
+	return endpoint, filePath, fullPath, ok
+}
+
+// resolveLink is resolveFile which also accepts symlinks synced as links,
+// their path is returned as is with isLink set.
+func (fHandler *fileHandler) resolveLink(errh *log.APIERRHandler, rawPath string) (string, string, string, bool, bool) {
+	return fHandler.resolveEntry(errh, rawPath, false)
+}
+
+// resolveNewLink is resolveNewFile which also accepts symlinks synced as links
+func (fHandler *fileHandler) resolveNewLink(errh *log.APIERRHandler, rawPath string) (string, string, string, bool, bool) {
+	return fHandler.resolveEntry(errh, rawPath, true)
+}
+
+// resolveEntry resolves rawPath for resolveLink and resolveNewLink, names of
+// the path are only checked if isNew is set, since it reads every parent.
+func (fHandler *fileHandler) resolveEntry(errh *log.APIERRHandler, rawPath string, isNew bool) (endpoint string, filePath string, fullPath string, isLink bool, ok bool) {
+	endpoint, filePath, err := utils.SplitEndpointAndFile(rawPath)
+	if err != nil {
+		errh.Warn(log.ErrBadFileDesc(rawPath, err))
+		return "", "", "", false, false
+	}
+
+	endpointPath, endpointExists := fHandler.Endpoints[endpoint]
+	if !endpointExists {
+		errh.Warn(log.ErrEndpointNotFound(endpoint))
+		return "", "", "", false, false
+	}
+
+	fullPath = path.Join(endpointPath, filePath)
+
+	isSubPath, err := utils.IsSubPath(endpointPath, fullPath)
+	if err != nil {
+		errh.Err(log.ErrUnknown("error checking subpath: " + err.Error()))
+		return "", "", "", false, false
+	}
+	if !isSubPath {
+		errh.Err(log.ErrOutOfEndpoint(rawPath, endpoint))
+		return "", "", "", false, false
+	}
+
+	filePath = strings.TrimPrefix(strings.TrimPrefix(fullPath, path.Clean(endpointPath)), "/")
+	if isNew {
+		if filePath, ok = fHandler.checkNames(errh, endpoint, filePath, rawPath); !ok {
+			return "", "", "", false, false
+		}
+		fullPath = path.Join(endpointPath, filePath)
+	}
+	if utils.HasMetaPart(filePath) {
+		errh.Warn(log.ErrReservedPath(rawPath))
+		return "", "", "", false, false
+	}
+
+	links, err := utils.NewLinks(endpointPath, fHandler.Configs[endpoint].Symlinks)
+	if err != nil {
+		errh.Err(log.ErrUnknown("error resolving symlinks: " + err.Error()))
+		return "", "", "", false, false
+	}
+	if fullPath, isLink, err = links.Resolve(fullPath); err != nil {
+		if errors.Is(err, utils.ErrSymlinkDenied) {
+			errh.Warn(log.ErrSymlinkDenied(rawPath))
+			return "", "", "", false, false
+		}
+		errh.Err(log.ErrUnknown("error resolving symlinks: " + err.Error()))
+		return "", "", "", false, false
+	}
+
+	return endpoint, filePath, fullPath, isLink, true
+}
+
+// resolvePath returns the full path of filePath, a clean path inside the
+// endpoint which does not come from a client, with symlinks resolved by the
+// endpoint symlink policy like resolveFile
+func (fHandler *fileHandler) resolvePath(endpoint string, filePath string) (string, error) {
+	endpointPath := fHandler.Endpoints[endpoint]
+	links, err := utils.NewLinks(endpointPath, fHandler.Configs[endpoint].Symlinks)
+	if err != nil {
+		return "", err
+	}
+	fullPath, _, err := links.Resolve(path.Join(endpointPath, filePath))
+	return fullPath, err
+}
+
+// targetPath returns the path in the endpoint of fullPath, the resolved path of
+// filePath. Targets out of the endpoint, reached through symlinks followed
+// anywhere, are kept at filePath.
+func (fHandler *fileHandler) targetPath(endpoint string, filePath string, fullPath string) (string, error) {
+	links, err := utils.NewLinks(fHandler.Endpoints[endpoint], fHandler.Configs[endpoint].Symlinks)
+	if err != nil {
+		return "", err
+	}
+	relPath, ok, err := links.Rel(fullPath)
+	if err != nil || !ok {
+		return filePath, err
+	}
+	return relPath, nil
+}
+
+// moveOwner moves the owner of a moved file, at the resolved paths of the
+// file and its destination
+func (fHandler *fileHandler) moveOwner(endpoint string, filePath string, fullPath string, destFilePath string, destPath string) error {
+	from, err := fHandler.targetPath(endpoint, filePath, fullPath)
+	if err != nil {
+		return err
+	}
+	to, err := fHandler.targetPath(endpoint, destFilePath, destPath)
+	if err != nil {
+		return err
+	}
+	return fHandler.Usage.Move(fHandler.Endpoints[endpoint], from, to)
+}
+
+// fileChanged updates the digest cache and the usage of an endpoint after
+// fullPath, a resolved path in it, is written, removed or renamed
+func (fHandler *fileHandler) fileChanged(endpoint string, fullPath string) {
+	fHandler.Digests.Invalidate(fullPath)
+	if fHandler.Usage == nil {
+		return
+	}
+	filePath, err := fHandler.targetPath(endpoint, "", fullPath)
+	if err == nil && filePath != "" {
+		err = fHandler.Usage.Update(fHandler.Endpoints[endpoint], filePath)
+	}
+	if err != nil {
+		// the file is changed, it is only counted again on the next rescan
+		fHandler.logger.Logger.Errorw("error updating usage", "endpoint", endpoint, "file", fullPath, "error", err.Error())
+	}
+}
+
+// uniqueFilePath returns a free path for a new file named like filePath in the
+// directory of filePath, as a path in the endpoint and a full path. A symlink
+// at filePath is not followed, the new file is made next to it.
+func (fHandler *fileHandler) uniqueFilePath(endpoint string, filePath string) (string, string, error) {
+	dirPath, err := fHandler.resolvePath(endpoint, path.Dir(filePath))
+	if err != nil {
+		return "", "", err
+	}
+	fullPath, err := utils.UniquePath(path.Join(dirPath, path.Base(filePath)))
+	if err != nil {
+		return "", "", err
+	}
+	return path.Join(path.Dir(filePath), path.Base(fullPath)), fullPath, nil
+}
+
+// resolveReadFile is resolveFile for reading files, the returned path is in
+// the snapshot selected with the 'snapshot' query param if it is set.
+func (fHandler *fileHandler) resolveReadFile(errh *log.APIERRHandler, r *http.Request, rawPath string) (string, bool) {
+	endpoint, filePath, fullPath, ok := fHandler.resolveFile(errh, rawPath)
+	if !ok {
+		return "", false
+	}
+
+	endpointPath := fHandler.Endpoints[endpoint]
+	root, ok := snapshotRoot(errh, fHandler.Snapshots, endpointPath, r)
+	if !ok {
+		return "", false
+	}
+	if root == endpointPath {
+		return fullPath, true
+	}
+	return path.Join(root, filePath), true
+}
+
+// checkPreconditions checks 'If-Match' and 'If-None-Match' headers against the
+// current file. The current file meta is returned if it was needed for checks.
+func (fHandler *fileHandler) checkPreconditions(r *http.Request, rawPath string, fullPath string) (*FileMeta, bool, error) {
+	ifMatch := strings.TrimSpace(r.Header.Get("If-Match"))
+	ifNoneMatch := strings.TrimSpace(r.Header.Get("If-None-Match"))
+	if ifMatch == "" && ifNoneMatch == "" {
+		return nil, true, nil
+	}
+
+	meta, err := fHandler.fileMeta(rawPath, fullPath)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if ifMatch != "" && !utils.MatchETag(ifMatch, meta.Hash, meta.Exists) {
+		return meta, false, nil
+	}
+	if ifNoneMatch != "" && utils.MatchETag(ifNoneMatch, meta.Hash, meta.Exists) {
+		return meta, false, nil
+	}
+
+	return meta, true, nil
+}
+
+// addConflict records a conflict in the endpoint conflict list
+func (fHandler *fileHandler) addConflict(endpoint string, conflict *Conflict) error {
+	if fHandler.Conflicts == nil {
+		return nil
+	}
+	return fHandler.Conflicts.Add(fHandler.Endpoints[endpoint], *conflict)
+}
+
+// fileMeta returns the state of the file at fullPath. fullPath is resolved by
+// resolveFile, so it is only a symlink if the endpoint syncs symlinks as links.
+func (fHandler *fileHandler) fileMeta(rawPath string, fullPath string) (*FileMeta, error) {
+	stat, err := os.Lstat(fullPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return &FileMeta{File: rawPath, Exists: false}, nil
+		}
+		return nil, err
+	}
+
+	meta := &FileMeta{File: rawPath, Exists: true, Size: stat.Size(), LastMod: stat.ModTime()}
+	if stat.IsDir() {
+		return meta, nil
+	}
+	if stat.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(fullPath)
+		if err != nil {
+			return nil, err
+		}
+		meta.Hash = utils.LinkDigest(target)
+		return meta, nil
+	}
+
+	if meta.Hash, err = fHandler.Digests.FileDigest(fullPath, stat); err != nil {
+		return nil, err
+	}
+	meta.Mode = config.FileMode(stat.Mode().Perm())
+	if meta.Xattrs, err = utils.ListXattrs(fullPath); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
@@ -7,10 +7,13 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"path"
+	"strings"
 	"testing"
 
 	"github.com/aigic8/gosyn/internal/server/log"
+	"github.com/aigic8/gosyn/internal/server/utils"
 	"github.com/cespare/xxhash"
 	"github.com/gorilla/mux"
 	"gotest.tools/v3/assert"
@@ -154,3 +157,249 @@ func TestFileGetHash(t *testing.T) {
 		})
 	}
 }
+
+type fileAddNewTestCase struct {
+	Name        string
+	FilePath    string
+	Recursive   bool
+	Force       bool
+	IfMatch     string
+	IfNoneMatch string
+	Status      int
+}
+
+func TestFileHandlerAddNew(t *testing.T) {
+	base := t.TempDir()
+	if err := mkDirs(base, []string{"normal/dir"}); err != nil {
+		panic(err)
+	}
+
+	err := mkFiles(base, []fileInfo{
+		{Path: "normal/exists.txt", Data: []byte("I was here first")},
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	endpoints := map[string]string{
+		"normal": path.Join(base, "normal"),
+	}
+
+	existsHash, err := utils.HashFile(path.Join(base, "normal/exists.txt"))
+	if err != nil {
+		panic(err)
+	}
+
+	testCases := []fileAddNewTestCase{
+		{Name: "new file", FilePath: "normal/new.txt", Status: http.StatusOK},
+		{Name: "exists", FilePath: "normal/exists.txt", Status: http.StatusConflict},
+		{Name: "exists if none match", FilePath: "normal/exists.txt", IfNoneMatch: "*", Status: http.StatusPreconditionFailed},
+		{Name: "exists if match other", FilePath: "normal/exists.txt", IfMatch: `"1234"`, Status: http.StatusPreconditionFailed},
+		{Name: "exists if match", FilePath: "normal/exists.txt", IfMatch: `"` + existsHash + `"`, Status: http.StatusOK},
+		{Name: "exists if match old", FilePath: "normal/exists.txt", IfMatch: `"` + existsHash + `"`, Status: http.StatusPreconditionFailed},
+		{Name: "not exists if match", FilePath: "normal/new2.txt", IfMatch: "*", Status: http.StatusPreconditionFailed},
+		{Name: "not exists if none match", FilePath: "normal/new2.txt", IfNoneMatch: "*", Status: http.StatusOK},
+		{Name: "exists with force", FilePath: "normal/exists.txt", Force: true, Status: http.StatusOK},
+		{Name: "dir not exist", FilePath: "normal/a/b/new.txt", Status: http.StatusBadRequest},
+		{Name: "dir not exist recursive", FilePath: "normal/a/b/new.txt", Recursive: true, Status: http.StatusOK},
+		{Name: "file is dir", FilePath: "normal/dir", Force: true, Status: http.StatusBadRequest},
+		{Name: "endpoint not exist", FilePath: "not-normal/new.txt", Status: http.StatusNotFound},
+		{Name: "out of endpoint", FilePath: "normal/../new.txt", Status: http.StatusBadRequest},
+		{Name: "reserved path", FilePath: "normal/.gosyn/conflicts.json", Recursive: true, Status: http.StatusBadRequest},
+	}
+
+	logger, err := log.NewLogger()
+	if err != nil {
+		panic(err)
+	}
+	fHandler := fileHandler{Endpoints: endpoints, MaxHashSize: 1000, logger: logger}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			data := "content of " + tc.Name
+			r := httptest.NewRequest(http.MethodPut, "/", strings.NewReader(data))
+			r.Header.Set("x-file-path", tc.FilePath)
+			if tc.Recursive {
+				r.Header.Set("x-recursive", "true")
+			}
+			if tc.Force {
+				r.Header.Set("x-force", "true")
+			}
+			if tc.IfMatch != "" {
+				r.Header.Set("If-Match", tc.IfMatch)
+			}
+			if tc.IfNoneMatch != "" {
+				r.Header.Set("If-None-Match", tc.IfNoneMatch)
+			}
+			w := httptest.NewRecorder()
+
+			fHandler.AddNew(w, r)
+			res := w.Result()
+
+			defer res.Body.Close()
+			assert.Equal(t, tc.Status, res.StatusCode)
+
+			resBody, err := io.ReadAll(res.Body)
+			if err != nil {
+				panic(err)
+			}
+
+			switch tc.Status {
+			case http.StatusOK:
+				fileData, err := os.ReadFile(path.Join(base, tc.FilePath))
+				if err != nil {
+					panic(err)
+				}
+				assert.Equal(t, data, string(fileData))
+
+				resData := APIResponse[FileMeta]{}
+				if err := json.Unmarshal(resBody, &resData); err != nil {
+					panic(err)
+				}
+				assert.Equal(t, utils.ETag(resData.Data.Hash), res.Header.Get("ETag"))
+			case http.StatusConflict, http.StatusPreconditionFailed:
+				resData := log.HTTPErrResponse{Data: &FileMeta{}}
+				if err := json.Unmarshal(resBody, &resData); err != nil {
+					panic(err)
+				}
+				assert.Equal(t, tc.FilePath, resData.Data.(*FileMeta).File)
+			}
+		})
+	}
+}
+
+type fileDeleteTestCase struct {
+	Name    string
+	File    string
+	IfMatch string
+	Status  int
+}
+
+func TestFileHandlerDelete(t *testing.T) {
+	base := t.TempDir()
+	if err := mkDirs(base, []string{"normal/not-a-file"}); err != nil {
+		panic(err)
+	}
+
+	err := mkFiles(base, []fileInfo{
+		{Path: "normal/file.txt", Data: []byte("delete me")},
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	endpoints := map[string]string{
+		"normal": path.Join(base, "normal"),
+	}
+
+	testCases := []fileDeleteTestCase{
+		{Name: "if match other", File: "normal/file.txt", IfMatch: `"1234"`, Status: http.StatusPreconditionFailed},
+		{Name: "normal", File: "normal/file.txt", Status: http.StatusOK},
+		{Name: "if match not exist", File: "normal/file.txt", IfMatch: "*", Status: http.StatusPreconditionFailed},
+		{Name: "file not exist", File: "normal/file.txt", Status: http.StatusNotFound},
+		{Name: "endpoint not exist", File: "not-normal/endpoint.txt", Status: http.StatusNotFound},
+		{Name: "file is dir", File: "normal/not-a-file", Status: http.StatusBadRequest},
+		{Name: "empty file name", File: "  ", Status: http.StatusBadRequest},
+		{Name: "out of endpoint", File: "normal/../sample.txt", Status: http.StatusBadRequest},
+	}
+
+	logger, err := log.NewLogger()
+	if err != nil {
+		panic(err)
+	}
+	fHandler := fileHandler{Endpoints: endpoints, MaxHashSize: 1000, logger: logger}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodDelete, "/", nil)
+			r = mux.SetURLVars(r, map[string]string{"file": tc.File})
+			if tc.IfMatch != "" {
+				r.Header.Set("If-Match", tc.IfMatch)
+			}
+			w := httptest.NewRecorder()
+
+			fHandler.Delete(w, r)
+			res := w.Result()
+
+			defer res.Body.Close()
+			assert.Equal(t, tc.Status, res.StatusCode)
+		})
+	}
+}
+
+type fileMoveTestCase struct {
+	Name        string
+	File        string
+	Destination string
+	Force       bool
+	IfMatch     string
+	Status      int
+}
+
+func TestFileHandlerMove(t *testing.T) {
+	base := t.TempDir()
+	if err := mkDirs(base, []string{"normal/not-a-file", "other"}); err != nil {
+		panic(err)
+	}
+
+	fileData := []byte("move me")
+	err := mkFiles(base, []fileInfo{
+		{Path: "normal/file.txt", Data: fileData},
+		{Path: "normal/exists.txt", Data: []byte("I was here first")},
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	endpoints := map[string]string{
+		"normal": path.Join(base, "normal"),
+		"other":  path.Join(base, "other"),
+	}
+
+	testCases := []fileMoveTestCase{
+		{Name: "if match other", File: "normal/file.txt", Destination: "normal/moved.txt", IfMatch: `"1234"`, Status: http.StatusPreconditionFailed},
+		{Name: "destination exists", File: "normal/file.txt", Destination: "normal/exists.txt", Status: http.StatusConflict},
+		{Name: "other endpoint", File: "normal/file.txt", Destination: "other/moved.txt", Status: http.StatusBadRequest},
+		{Name: "destination dir not exist", File: "normal/file.txt", Destination: "normal/a/moved.txt", Status: http.StatusBadRequest},
+		{Name: "normal", File: "normal/file.txt", Destination: "normal/moved.txt", Status: http.StatusOK},
+		{Name: "file not exist", File: "normal/file.txt", Destination: "normal/moved2.txt", Status: http.StatusNotFound},
+		{Name: "force", File: "normal/moved.txt", Destination: "normal/exists.txt", Force: true, Status: http.StatusOK},
+		{Name: "file is dir", File: "normal/not-a-file", Destination: "normal/moved.txt", Status: http.StatusBadRequest},
+		{Name: "out of endpoint", File: "normal/exists.txt", Destination: "normal/../moved.txt", Status: http.StatusBadRequest},
+	}
+
+	logger, err := log.NewLogger()
+	if err != nil {
+		panic(err)
+	}
+	fHandler := fileHandler{Endpoints: endpoints, MaxHashSize: 1000, logger: logger}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/", nil)
+			r = mux.SetURLVars(r, map[string]string{"file": tc.File})
+			r.Header.Set("x-destination", tc.Destination)
+			if tc.Force {
+				r.Header.Set("x-force", "true")
+			}
+			if tc.IfMatch != "" {
+				r.Header.Set("If-Match", tc.IfMatch)
+			}
+			w := httptest.NewRecorder()
+
+			fHandler.Move(w, r)
+			res := w.Result()
+
+			defer res.Body.Close()
+			assert.Equal(t, tc.Status, res.StatusCode)
+
+			if tc.Status == http.StatusOK {
+				movedData, err := os.ReadFile(path.Join(base, tc.Destination))
+				if err != nil {
+					panic(err)
+				}
+				assert.Equal(t, string(fileData), string(movedData))
+			}
+		})
+	}
+}
@@ -0,0 +1,26 @@
+package server
+
+import (
+	"github.com/aigic8/gosyn/internal/ignore"
+	"github.com/aigic8/gosyn/internal/server/log"
+)
+
+// checkIgnored sends an error to the client and returns false if filePath is
+// ignored by the ignore rules of the endpoint
+func (fHandler *fileHandler) checkIgnored(errh *log.APIERRHandler, endpoint string, filePath string, rawPath string) bool {
+	matcher, err := ignore.NewMatcher(fHandler.Endpoints[endpoint], fHandler.Configs[endpoint].Ignore)
+	if err != nil {
+		errh.Err(log.ErrUnknown("err reading ignore rules: " + err.Error()))
+		return false
+	}
+	ignored, err := matcher.Ignored(filePath, false)
+	if err != nil {
+		errh.Err(log.ErrUnknown("err reading ignore rules: " + err.Error()))
+		return false
+	}
+	if ignored {
+		errh.Warn(log.ErrIgnoredPath(rawPath))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/aigic8/gosyn/internal/config"
+	"github.com/aigic8/gosyn/internal/ignore"
+	"github.com/aigic8/gosyn/internal/server/log"
+	"gotest.tools/v3/assert"
+)
+
+func TestIgnoreRules(t *testing.T) {
+	base := t.TempDir()
+	songsPath := path.Join(base, "songs")
+	if err := mkDirs(songsPath, []string{"pink-floyd/.git", "node_modules/left-pad"}); err != nil {
+		panic(err)
+	}
+	if err := mkFiles(songsPath, []fileInfo{
+		{Path: ignore.FILE_NAME, Data: []byte("node_modules/\n*.swp\n")},
+		{Path: "pink-floyd/" + ignore.FILE_NAME, Data: []byte("!time.swp\n")},
+		{Path: "pink-floyd/time.txt", Data: []byte("Ticking away the moments")},
+		{Path: "pink-floyd/time.swp", Data: []byte("Ticking away")},
+		{Path: "pink-floyd/money.swp", Data: []byte("Money")},
+		{Path: "pink-floyd/.git/HEAD", Data: []byte("ref: refs/heads/main")},
+		{Path: "node_modules/left-pad/index.js", Data: []byte("module.exports = leftPad")},
+	}); err != nil {
+		panic(err)
+	}
+
+	logger, err := log.NewLogger()
+	if err != nil {
+		panic(err)
+	}
+	srv := newOpenServer("", map[string]config.EndpointConfig{"songs": {Path: songsPath, Ignore: []string{".git/"}}}, logger)
+	handler := srv.Handler()
+
+	do := func(r *http.Request) *http.Response {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Result()
+	}
+
+	t.Run("tree", func(t *testing.T) {
+		res := do(httptest.NewRequest(http.MethodGet, "/endpoints/songs", nil))
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		var resp APIResponse[EndpointGetResponse]
+		if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+			panic(err)
+		}
+
+		root := resp.Data.Tree["songs"]
+		assert.DeepEqual(t, []string{ignore.FILE_NAME, "pink-floyd"}, slices.Sorted(maps.Keys(root.Children)))
+		assert.DeepEqual(t, []string{ignore.FILE_NAME, "time.swp", "time.txt"}, slices.Sorted(maps.Keys(root.Children["pink-floyd"].Children)))
+	})
+
+	t.Run("digests", func(t *testing.T) {
+		res := do(httptest.NewRequest(http.MethodGet, "/endpoints/songs/digest?path=pink-floyd", nil))
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		var resp APIResponse[EndpointGetDigestResponse]
+		if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+			panic(err)
+		}
+
+		names := []string{}
+		for _, child := range resp.Data.Digests[0].Children {
+			names = append(names, child.Name)
+		}
+		assert.DeepEqual(t, []string{ignore.FILE_NAME, "time.swp", "time.txt"}, names)
+	})
+
+	t.Run("uploads", func(t *testing.T) {
+		upload := func(file string) int {
+			r := httptest.NewRequest(http.MethodPut, "/files/new", strings.NewReader("Money, it's a gas"))
+			r.Header.Set("x-file-path", "songs/"+file)
+			r.Header.Set("x-recursive", "true")
+			return do(r).StatusCode
+		}
+		assert.Equal(t, http.StatusForbidden, upload("pink-floyd/echoes.swp"))
+		assert.Equal(t, http.StatusForbidden, upload("node_modules/is-even/index.js"))
+		assert.Equal(t, http.StatusForbidden, upload(".git/config"))
+		assert.Equal(t, http.StatusOK, upload("pink-floyd/money.txt"))
+	})
+
+	t.Run("moves", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/files/songs/pink-floyd/money.txt/move", nil)
+		r.Header.Set("x-destination", "songs/pink-floyd/money.txt.swp")
+		assert.Equal(t, http.StatusForbidden, do(r).StatusCode)
+	})
+}
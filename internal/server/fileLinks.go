@@ -0,0 +1,205 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/aigic8/gosyn/internal/config"
+	"github.com/aigic8/gosyn/internal/server/log"
+	"github.com/aigic8/gosyn/internal/server/utils"
+)
+
+// LINK_TYPE is the MIME type symlinks are checked against upload type rules with
+const LINK_TYPE = "inode/symlink"
+
+// addLink makes rawPath a symlink to target, for endpoints which sync symlinks
+// as links. Like files, existing paths are only replaced with 'x-force' or a
+// matching 'If-Match'. Conflict policies do not apply to links, a mismatched
+// precondition is always rejected. Links are checked against the upload rules
+// and quotas of the endpoint with the length of their target as their size,
+// drop boxes do not accept links.
+func (fHandler *fileHandler) addLink(w http.ResponseWriter, r *http.Request, errh *log.APIERRHandler, rawPath string, target string) {
+	endpoint, filePath, fullPath, _, ok := fHandler.resolveNewLink(errh, rawPath)
+	if !ok || !fHandler.checkIgnored(errh, endpoint, filePath, rawPath) {
+		return
+	}
+	endpointConfig := fHandler.Configs[endpoint]
+	if endpointConfig.Mode == config.ModeDropBox {
+		errh.Warn(log.ErrModeForbids(endpoint, string(endpointConfig.Mode), "symlink"))
+		return
+	}
+	if endpointConfig.Symlinks != config.SymlinksAsLink {
+		errh.Warn(log.ErrLinksNotSynced(endpoint))
+		return
+	}
+
+	uploads := endpointConfig.Uploads
+	if !extensionAllowed(uploads, filePath) {
+		errh.Warn(log.ErrFileTypeNotAllowed(rawPath, path.Ext(filePath)))
+		return
+	}
+	if !typeAllowed(uploads, LINK_TYPE) {
+		errh.Warn(log.ErrFileTypeNotAllowed(rawPath, LINK_TYPE))
+		return
+	}
+	linkSize := int64(len(target))
+	if maxSize := uploadMaxSize(endpointConfig); maxSize >= 0 && linkSize > maxSize {
+		errh.Warn(log.ErrFileTooLarge(rawPath, maxSize))
+		return
+	}
+
+	unlock := fHandler.locks.Lock(fullPath)
+	defer unlock()
+
+	meta, matched, err := fHandler.checkPreconditions(r, rawPath, fullPath)
+	if err != nil {
+		errh.Err(log.ErrUnknown("err checking preconditions: " + err.Error()))
+		return
+	}
+	if !matched {
+		errh.Warn(log.ErrPreconditionFailed(rawPath, meta))
+		return
+	}
+
+	dir := path.Dir(fullPath)
+	change := changeCreate
+	var newDirs []string
+	stat, err := os.Lstat(fullPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		errh.Err(log.ErrUnknown("err stating file: " + err.Error()))
+		return
+	}
+	if err == nil {
+		if stat.IsDir() {
+			errh.Warn(log.ErrPathIsDir(rawPath))
+			return
+		}
+		force := strings.TrimSpace(r.Header.Get("x-force")) == "true"
+		if !force && r.Header.Get("If-Match") == "" {
+			if meta, err = fHandler.fileMeta(rawPath, fullPath); err != nil {
+				errh.Err(log.ErrUnknown("err getting file meta: " + err.Error()))
+				return
+			}
+			errh.Warn(log.ErrFileExist(rawPath, meta))
+			return
+		}
+		change = changeOverwrite
+	}
+	if !fHandler.checkMode(errh, endpoint, change) {
+		return
+	}
+
+	if change == changeCreate {
+		recursive := strings.TrimSpace(r.Header.Get("x-recursive")) == "true"
+		if newDirs, ok = fHandler.checkNewEntry(errh, endpoint, fullPath, rawPath, recursive); !ok {
+			return
+		}
+	}
+
+	owner := requestOwner(r)
+	release, ok := fHandler.checkSpace(errh, endpoint, filePath, rawPath, owner, linkSize)
+	if !ok {
+		return
+	}
+	defer release()
+
+	undoDirs, err := makeDirs(newDirs)
+	if err != nil {
+		errh.Err(log.ErrUnknown("err making dir: " + err.Error()))
+		return
+	}
+	renamed := false
+	defer func() {
+		if !renamed {
+			undoDirs()
+		}
+	}()
+
+	// like files, the link is made aside and renamed in place
+	tmpFile, err := os.CreateTemp(dir, utils.META_DIR+"-link-*")
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			errh.Warn(log.ErrDirNotExist(dir))
+			return
+		}
+		errh.Err(log.ErrUnknown("error creating link: " + err.Error()))
+		return
+	}
+	tmpFile.Close()
+	os.Remove(tmpFile.Name())
+	if err = os.Symlink(target, tmpFile.Name()); err != nil {
+		errh.Err(log.ErrUnknown("error creating link: " + err.Error()))
+		return
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if stat != nil && stat.Mode().IsRegular() {
+		if err = fHandler.saveVersion(endpoint, filePath, fullPath); err != nil {
+			errh.Err(log.ErrUnknown("error saving version: " + err.Error()))
+			return
+		}
+	}
+	if err = os.Rename(tmpFile.Name(), fullPath); err != nil {
+		errh.Err(log.ErrUnknown("error renaming link: " + err.Error()))
+		return
+	}
+	renamed = true
+	fHandler.fileChanged(endpoint, fullPath)
+
+	fHandler.setOwner(endpoint, filePath, rawPath, owner)
+	release()
+
+	newMeta, err := fHandler.fileMeta(rawPath, fullPath)
+	if err != nil {
+		errh.Err(log.ErrUnknown("err getting file meta: " + err.Error()))
+		return
+	}
+	respJson, err := wrapAPIResponse(newMeta)
+	if err != nil {
+		errh.Err(log.ErrUnknown("error marshaling json: " + err.Error()))
+		return
+	}
+	w.Header().Set("ETag", utils.ETag(newMeta.Hash))
+	w.Write(respJson)
+}
+
+// deleteLink removes a symlink synced as a link. Links are not kept in the
+// trash, there is no content to restore.
+func (fHandler *fileHandler) deleteLink(w http.ResponseWriter, r *http.Request, errh *log.APIERRHandler, rawPath string, endpoint string, fullPath string) {
+	if !fHandler.checkMode(errh, endpoint, changeDelete) {
+		return
+	}
+
+	unlock := fHandler.locks.Lock(fullPath)
+	defer unlock()
+
+	meta, matched, err := fHandler.checkPreconditions(r, rawPath, fullPath)
+	if err != nil {
+		errh.Err(log.ErrUnknown("err checking preconditions: " + err.Error()))
+		return
+	}
+	if !matched {
+		errh.Warn(log.ErrPreconditionFailed(rawPath, meta))
+		return
+	}
+
+	if err = os.Remove(fullPath); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			errh.Warn(log.ErrFileNotFound(rawPath))
+			return
+		}
+		errh.Err(log.ErrUnknown("err removing link: " + err.Error()))
+		return
+	}
+	fHandler.fileChanged(endpoint, fullPath)
+
+	respJson, err := wrapAPIResponse(map[string]string{})
+	if err != nil {
+		errh.Err(log.ErrUnknown("error marshaling json: " + err.Error()))
+		return
+	}
+	w.Write(respJson)
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/aigic8/gosyn/internal/config"
+	"github.com/aigic8/gosyn/internal/server/log"
+	"github.com/aigic8/gosyn/internal/server/utils"
+	"gotest.tools/v3/assert"
+)
+
+type symlinkTestCase struct {
+	Name       string
+	Policy     config.SymlinkPolicy
+	Tree       []string
+	InsideFile int
+	OutsideDir int
+}
+
+func TestSymlinkPolicies(t *testing.T) {
+	base := t.TempDir()
+	if err := mkDirs(base, []string{"etc", "songs/pink-floyd"}); err != nil {
+		panic(err)
+	}
+	if err := mkFiles(base, []fileInfo{
+		{Path: "etc/passwd", Data: []byte("root:x:0:0")},
+		{Path: "songs/pink-floyd/time.txt", Data: []byte("Ticking away the moments")},
+	}); err != nil {
+		panic(err)
+	}
+	songsPath := path.Join(base, "songs")
+	for link, target := range map[string]string{
+		"time.txt": "pink-floyd/time.txt",
+		"etc":      path.Join(base, "etc"),
+		"loop":     ".",
+		"dangling": "nothing.txt",
+	} {
+		if err := os.Symlink(target, path.Join(songsPath, link)); err != nil {
+			panic(err)
+		}
+	}
+
+	logger, err := log.NewLogger()
+	if err != nil {
+		panic(err)
+	}
+
+	testCases := []symlinkTestCase{
+		{Name: "ignore", Policy: config.SymlinksIgnore, Tree: []string{"pink-floyd"}, InsideFile: http.StatusForbidden, OutsideDir: http.StatusForbidden},
+		{Name: "follow within endpoint", Policy: config.SymlinksFollowWithin, Tree: []string{"loop", "pink-floyd", "time.txt"}, InsideFile: http.StatusOK, OutsideDir: http.StatusForbidden},
+		{Name: "follow any", Policy: config.SymlinksFollowAny, Tree: []string{"etc", "loop", "pink-floyd", "time.txt"}, InsideFile: http.StatusOK, OutsideDir: http.StatusOK},
+		{Name: "sync as link", Policy: config.SymlinksAsLink, Tree: []string{"dangling", "etc", "loop", "pink-floyd", "time.txt"}, InsideFile: http.StatusBadRequest, OutsideDir: http.StatusForbidden},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			srv := newOpenServer("", map[string]config.EndpointConfig{"songs": {Path: songsPath, Symlinks: tc.Policy}}, logger)
+			handler := srv.Handler()
+			do := func(r *http.Request) *http.Response {
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, r)
+				return w.Result()
+			}
+
+			res := do(httptest.NewRequest(http.MethodGet, "/endpoints/songs", nil))
+			assert.Equal(t, http.StatusOK, res.StatusCode)
+			var resp APIResponse[EndpointGetResponse]
+			if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+				panic(err)
+			}
+			children := resp.Data.Tree["songs"].Children
+			assert.DeepEqual(t, tc.Tree, slices.Sorted(maps.Keys(children)))
+			if link, ok := children["time.txt"]; ok {
+				assert.Equal(t, "pink-floyd/time.txt", link.Symlink)
+			}
+
+			assert.Equal(t, tc.InsideFile, do(httptest.NewRequest(http.MethodGet, "/files/songs/time.txt", nil)).StatusCode)
+			assert.Equal(t, tc.OutsideDir, do(httptest.NewRequest(http.MethodGet, "/files/songs/etc/passwd", nil)).StatusCode)
+
+			if tc.OutsideDir != http.StatusOK {
+				r := httptest.NewRequest(http.MethodPut, "/files/new", strings.NewReader("root::0:0"))
+				r.Header.Set("x-file-path", "songs/etc/shadow")
+				assert.Equal(t, tc.OutsideDir, do(r).StatusCode)
+				_, err := os.Stat(path.Join(base, "etc/shadow"))
+				assert.Assert(t, os.IsNotExist(err))
+			}
+		})
+	}
+
+	t.Run("links are synced as links", func(t *testing.T) {
+		srv := newOpenServer("", map[string]config.EndpointConfig{"songs": {Path: songsPath, Symlinks: config.SymlinksAsLink}}, logger)
+		handler := srv.Handler()
+		do := func(r *http.Request) int {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			return w.Result().StatusCode
+		}
+		addLink := func(file string, target string) int {
+			r := httptest.NewRequest(http.MethodPut, "/files/new", nil)
+			r.Header.Set("x-file-path", "songs/"+file)
+			r.Header.Set("x-symlink-target", target)
+			return do(r)
+		}
+
+		assert.Equal(t, http.StatusOK, addLink("money.txt", "pink-floyd/money.txt"))
+		target, err := os.Readlink(path.Join(songsPath, "money.txt"))
+		assert.NilError(t, err)
+		assert.Equal(t, "pink-floyd/money.txt", target)
+		assert.Equal(t, http.StatusConflict, addLink("money.txt", "pink-floyd/time.txt"))
+
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/endpoints/songs/digest", nil))
+		var resp APIResponse[EndpointGetDigestResponse]
+		if err := json.NewDecoder(res.Result().Body).Decode(&resp); err != nil {
+			panic(err)
+		}
+		linkDigests := map[string]string{}
+		for _, child := range resp.Data.Digests[0].Children {
+			if child.Symlink != "" {
+				linkDigests[child.Name] = child.Digest
+			}
+		}
+		assert.Equal(t, utils.LinkDigest("pink-floyd/money.txt"), linkDigests["money.txt"])
+
+		assert.Equal(t, http.StatusOK, do(httptest.NewRequest(http.MethodDelete, "/files/songs/money.txt", nil)))
+		_, err = os.Lstat(path.Join(songsPath, "money.txt"))
+		assert.Assert(t, os.IsNotExist(err))
+
+		otherSrv := newOpenServer("", map[string]config.EndpointConfig{"songs": {Path: songsPath}}, logger)
+		r := httptest.NewRequest(http.MethodPut, "/files/new", nil)
+		r.Header.Set("x-file-path", "songs/money.txt")
+		r.Header.Set("x-symlink-target", "pink-floyd/money.txt")
+		w := httptest.NewRecorder()
+		otherSrv.Handler().ServeHTTP(w, r)
+		assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+	})
+	t.Run("links follow endpoint rules", func(t *testing.T) {
+		rulesPath := path.Join(base, "rules")
+		if err := mkDirs(rulesPath, []string{"full"}); err != nil {
+			panic(err)
+		}
+		if err := mkFiles(rulesPath, []fileInfo{
+			{Path: "time.txt", Data: []byte("Ticking away the moments")},
+			{Path: "full/money.txt", Data: []byte("Money")},
+		}); err != nil {
+			panic(err)
+		}
+
+		addLink := func(endpointConfig config.EndpointConfig, file string) int {
+			endpointConfig.Path = rulesPath
+			endpointConfig.Symlinks = config.SymlinksAsLink
+			srv := newOpenServer("", map[string]config.EndpointConfig{"rules": endpointConfig}, logger)
+			r := httptest.NewRequest(http.MethodPut, "/files/new", nil)
+			r.Header.Set("x-file-path", "rules/"+file)
+			r.Header.Set("x-symlink-target", "/etc/passwd")
+			r.Header.Set("x-force", "true")
+			w := httptest.NewRecorder()
+			srv.Handler().ServeHTTP(w, r)
+			return w.Result().StatusCode
+		}
+
+		assert.Equal(t, http.StatusForbidden, addLink(config.EndpointConfig{Mode: config.ModeDropBox}, "time.txt"))
+		stat, err := os.Lstat(path.Join(rulesPath, "time.txt"))
+		assert.NilError(t, err)
+		assert.Assert(t, stat.Mode().IsRegular())
+
+		assert.Equal(t, http.StatusUnsupportedMediaType, addLink(config.EndpointConfig{Uploads: config.UploadsConfig{DeniedTypes: []string{LINK_TYPE}}}, "passwd"))
+		assert.Equal(t, http.StatusUnsupportedMediaType, addLink(config.EndpointConfig{Uploads: config.UploadsConfig{AllowedExtensions: []string{".txt"}}}, "passwd"))
+		assert.Equal(t, http.StatusRequestEntityTooLarge, addLink(config.EndpointConfig{Uploads: config.UploadsConfig{MaxFileSize: 4}}, "passwd"))
+		assert.Equal(t, http.StatusRequestEntityTooLarge, addLink(config.EndpointConfig{Uploads: config.UploadsConfig{MaxDirFiles: 1}}, "full/passwd"))
+		assert.Equal(t, http.StatusInsufficientStorage, addLink(config.EndpointConfig{Quota: config.QuotaConfig{MaxSize: 30}}, "passwd"))
+		_, err = os.Lstat(path.Join(rulesPath, "passwd"))
+		assert.Assert(t, os.IsNotExist(err))
+
+		assert.Equal(t, http.StatusOK, addLink(config.EndpointConfig{Quota: config.QuotaConfig{MaxSize: 1024}}, "passwd"))
+	})
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aigic8/gosyn/internal/server/log"
+	"github.com/aigic8/gosyn/internal/server/utils"
+)
+
+// fileMetadata is metadata of an upload sent in 'x-mtime', 'x-mode' and
+// 'x-xattr' headers, zero fields are left to the server
+type fileMetadata struct {
+	ModTime time.Time
+	Mode    os.FileMode
+	Xattrs  map[string][]byte
+}
+
+// parseFileMetadata reads metadata headers of an upload. Modes are octal like
+// '0644' and must let the owner, which is the server, read and write the file.
+// Errors are sent to the client and ok is false.
+func parseFileMetadata(errh *log.APIERRHandler, r *http.Request) (metadata fileMetadata, ok bool) {
+	if rawModTime := strings.TrimSpace(r.Header.Get("x-mtime")); rawModTime != "" {
+		modTime, err := time.Parse(time.RFC3339Nano, rawModTime)
+		if err != nil {
+			errh.Warn(log.ErrBadHeader("x-mtime", rawModTime))
+			return metadata, false
+		}
+		metadata.ModTime = modTime
+	}
+
+	if rawMode := strings.TrimSpace(r.Header.Get("x-mode")); rawMode != "" {
+		mode, err := strconv.ParseUint(rawMode, 8, 32)
+		if err != nil || mode > 0777 || mode&0600 != 0600 {
+			errh.Warn(log.ErrBadHeader("x-mode", rawMode))
+			return metadata, false
+		}
+		metadata.Mode = os.FileMode(mode)
+	}
+
+	for _, rawXattr := range r.Header.Values("x-xattr") {
+		name, value, err := utils.DecodeXattr(rawXattr)
+		if err != nil {
+			errh.Warn(log.ErrBadHeader("x-xattr", rawXattr))
+			return metadata, false
+		}
+		if metadata.Xattrs == nil {
+			metadata.Xattrs = map[string][]byte{}
+		}
+		metadata.Xattrs[name] = value
+	}
+
+	return metadata, true
+}
+
+// apply sets extended attributes and the modification time of a file, the
+// mode is applied with the default mode of uploads
+func (metadata fileMetadata) apply(filePath string) error {
+	if err := utils.SetXattrs(filePath, metadata.Xattrs); err != nil {
+		return err
+	}
+	if !metadata.ModTime.IsZero() {
+		return os.Chtimes(filePath, time.Time{}, metadata.ModTime)
+	}
+	return nil
+}
+
+// setMetadataHeaders sends metadata of a downloaded file in the same headers
+// uploads use, so clients can restore it
+func setMetadataHeaders(w http.ResponseWriter, fullPath string, stat os.FileInfo) error {
+	xattrs, err := utils.ListXattrs(fullPath)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Last-Modified", stat.ModTime().UTC().Format(http.TimeFormat))
+	w.Header().Set("x-mtime", stat.ModTime().UTC().Format(time.RFC3339Nano))
+	w.Header().Set("x-mode", fmt.Sprintf("%04o", stat.Mode().Perm()))
+	for name, value := range xattrs {
+		w.Header().Add("x-xattr", utils.EncodeXattr(name, value))
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aigic8/gosyn/internal/config"
+	"github.com/aigic8/gosyn/internal/server/log"
+	"github.com/aigic8/gosyn/internal/server/utils"
+	"gotest.tools/v3/assert"
+)
+
+func TestFileMetadata(t *testing.T) {
+	base := t.TempDir()
+	songsPath := path.Join(base, "songs")
+	if err := mkDirs(base, []string{"songs"}); err != nil {
+		panic(err)
+	}
+
+	// extended attributes are only checked if the test file system has them
+	probePath := path.Join(base, "probe")
+	if err := os.WriteFile(probePath, nil, 0644); err != nil {
+		panic(err)
+	}
+	xattrs := map[string][]byte{"user.artist": []byte("Pink Floyd")}
+	if err := utils.SetXattrs(probePath, xattrs); err != nil {
+		if !errors.Is(err, utils.ErrXattrsNotSupported) {
+			panic(err)
+		}
+		xattrs = nil
+	}
+
+	logger, err := log.NewLogger()
+	if err != nil {
+		panic(err)
+	}
+	srv := newOpenServer("", map[string]config.EndpointConfig{"songs": {Path: songsPath}}, logger)
+	handler := srv.Handler()
+	upload := func(file string, headers map[string]string) *http.Response {
+		r := httptest.NewRequest(http.MethodPut, "/files/new", strings.NewReader("Ticking away the moments"))
+		r.Header.Set("x-file-path", "songs/"+file)
+		for key, value := range headers {
+			r.Header.Set(key, value)
+		}
+		for name, value := range xattrs {
+			r.Header.Add("x-xattr", utils.EncodeXattr(name, value))
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Result()
+	}
+
+	modTime := time.Date(1973, 3, 1, 12, 30, 0, 0, time.UTC)
+	res := upload("time.sh", map[string]string{"x-mtime": modTime.Format(time.RFC3339Nano), "x-mode": "0750"})
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	stat, err := os.Stat(path.Join(songsPath, "time.sh"))
+	assert.NilError(t, err)
+	assert.Equal(t, os.FileMode(0750), stat.Mode().Perm())
+	assert.Assert(t, stat.ModTime().Equal(modTime))
+	stored, err := utils.ListXattrs(path.Join(songsPath, "time.sh"))
+	assert.NilError(t, err)
+	assert.DeepEqual(t, xattrs, stored)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/files/songs/time.sh", nil))
+	res = w.Result()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, modTime.Format(time.RFC3339Nano), res.Header.Get("x-mtime"))
+	assert.Equal(t, "0750", res.Header.Get("x-mode"))
+	assert.Equal(t, len(xattrs), len(res.Header.Values("x-xattr")))
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/endpoints/songs", nil))
+	var resp APIResponse[EndpointGetResponse]
+	if err := json.NewDecoder(w.Result().Body).Decode(&resp); err != nil {
+		panic(err)
+	}
+	tree := resp.Data.Tree["songs"].Children["time.sh"]
+	assert.Equal(t, config.FileMode(0750), tree.Mode)
+	assert.DeepEqual(t, xattrs, tree.Xattrs)
+
+	for _, mode := range []string{"0400", "1777", "rwx"} {
+		assert.Equal(t, http.StatusBadRequest, upload("money.sh", map[string]string{"x-mode": mode}).StatusCode)
+	}
+	assert.Equal(t, http.StatusBadRequest, upload("money.sh", map[string]string{"x-mtime": "yesterday"}).StatusCode)
+	_, err = os.Stat(path.Join(songsPath, "money.sh"))
+	assert.Assert(t, os.IsNotExist(err))
+}
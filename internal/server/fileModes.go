@@ -0,0 +1,85 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/aigic8/gosyn/internal/config"
+	"github.com/aigic8/gosyn/internal/server/log"
+)
+
+// fileChange is a kind of change to files of an endpoint, the endpoint mode
+// decides which changes are allowed
+type fileChange string
+
+const (
+	changeCreate    fileChange = "create"
+	changeOverwrite fileChange = "overwrite"
+	changeAppend    fileChange = "append"
+	changeDelete    fileChange = "delete"
+)
+
+// modeAllows reports whether an endpoint mode allows a change. Appends are
+// overwrites which keep the old content of the file, see isAppend.
+func modeAllows(mode config.EndpointMode, change fileChange) bool {
+	switch mode {
+	case config.ModeReadOnly:
+		return false
+	case config.ModeWriteOnce:
+		return change == changeCreate
+	case config.ModeAppendOnly:
+		return change == changeCreate || change == changeAppend
+	default:
+		return true
+	}
+}
+
+// checkMode sends an error to the client and returns false if the mode of
+// the endpoint does not allow the change
+func (fHandler *fileHandler) checkMode(errh *log.APIERRHandler, endpoint string, change fileChange) bool {
+	mode := fHandler.Configs[endpoint].Mode
+	if !modeAllows(mode, change) {
+		errh.Warn(log.ErrModeForbids(endpoint, string(mode), string(change)))
+		return false
+	}
+	return true
+}
+
+// isAppend reports whether the content of newPath starts with the whole
+// content of oldPath
+func isAppend(oldPath string, newPath string) (bool, error) {
+	oldFile, err := os.Open(oldPath)
+	if err != nil {
+		return false, err
+	}
+	defer oldFile.Close()
+	newFile, err := os.Open(newPath)
+	if err != nil {
+		return false, err
+	}
+	defer newFile.Close()
+
+	oldBuf, newBuf := make([]byte, 32*1024), make([]byte, 32*1024)
+	for {
+		n, err := io.ReadFull(oldFile, oldBuf)
+		if n > 0 {
+			if _, newErr := io.ReadFull(newFile, newBuf[:n]); newErr != nil {
+				if errors.Is(newErr, io.EOF) || errors.Is(newErr, io.ErrUnexpectedEOF) {
+					return false, nil
+				}
+				return false, newErr
+			}
+			if !bytes.Equal(oldBuf[:n], newBuf[:n]) {
+				return false, nil
+			}
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+}
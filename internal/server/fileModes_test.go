@@ -0,0 +1,112 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/aigic8/gosyn/internal/config"
+	"github.com/aigic8/gosyn/internal/server/log"
+	"gotest.tools/v3/assert"
+)
+
+func TestEndpointModes(t *testing.T) {
+	base := t.TempDir()
+	if err := mkDirs(base, []string{"songs", "audit", "logs"}); err != nil {
+		panic(err)
+	}
+	if err := mkFiles(base, []fileInfo{
+		{Path: "songs/time.txt", Data: []byte("Ticking away the moments")},
+		{Path: "audit/2022.txt", Data: []byte("nothing happened")},
+		{Path: "logs/server.log", Data: []byte("started\n")},
+	}); err != nil {
+		panic(err)
+	}
+
+	logger, err := log.NewLogger()
+	if err != nil {
+		panic(err)
+	}
+	srv := newOpenServer("", map[string]config.EndpointConfig{
+		"songs": {Path: path.Join(base, "songs"), Mode: config.ModeReadOnly},
+		"audit": {Path: path.Join(base, "audit"), Mode: config.ModeWriteOnce},
+		"logs":  {Path: path.Join(base, "logs"), Mode: config.ModeAppendOnly},
+	}, logger)
+	handler := srv.Handler()
+
+	do := func(r *http.Request) int {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Result().StatusCode
+	}
+	upload := func(file string, data string) int {
+		r := httptest.NewRequest(http.MethodPut, "/files/new", strings.NewReader(data))
+		r.Header.Set("x-file-path", file)
+		r.Header.Set("x-force", "true")
+		return do(r)
+	}
+	move := func(file string, dest string) int {
+		r := httptest.NewRequest(http.MethodPost, "/files/"+file+"/move", nil)
+		r.Header.Set("x-destination", dest)
+		return do(r)
+	}
+	remove := func(file string) int {
+		return do(httptest.NewRequest(http.MethodDelete, "/files/"+file, nil))
+	}
+
+	t.Run("read only", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, do(httptest.NewRequest(http.MethodGet, "/files/songs/time.txt", nil)))
+		assert.Equal(t, http.StatusForbidden, upload("songs/money.txt", "Money, it's a gas"))
+		assert.Equal(t, http.StatusForbidden, upload("songs/time.txt", "Ticking away"))
+		assert.Equal(t, http.StatusForbidden, move("songs/time.txt", "songs/money.txt"))
+		assert.Equal(t, http.StatusForbidden, remove("songs/time.txt"))
+		assert.Equal(t, http.StatusForbidden, do(httptest.NewRequest(http.MethodDelete, "/endpoints/songs/trash", nil)))
+	})
+
+	t.Run("write once", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, upload("audit/2023.txt", "everything happened"))
+		assert.Equal(t, http.StatusForbidden, upload("audit/2022.txt", "something happened"))
+		assert.Equal(t, http.StatusForbidden, move("audit/2022.txt", "audit/2021.txt"))
+		assert.Equal(t, http.StatusForbidden, remove("audit/2022.txt"))
+
+		data, err := os.ReadFile(path.Join(base, "audit/2022.txt"))
+		if err != nil {
+			panic(err)
+		}
+		assert.Equal(t, "nothing happened", string(data))
+	})
+
+	t.Run("append only", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, upload("logs/client.log", "connected\n"))
+		assert.Equal(t, http.StatusOK, upload("logs/server.log", "started\nstopped\n"))
+		assert.Equal(t, http.StatusForbidden, upload("logs/server.log", "started\n"))
+		assert.Equal(t, http.StatusForbidden, upload("logs/server.log", "restarted\nstopped\nfailed\n"))
+		assert.Equal(t, http.StatusForbidden, remove("logs/server.log"))
+
+		data, err := os.ReadFile(path.Join(base, "logs/server.log"))
+		if err != nil {
+			panic(err)
+		}
+		assert.Equal(t, "started\nstopped\n", string(data))
+	})
+
+	t.Run("modes are listed", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/endpoints/list", nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		resData := APIResponse[EndpointGetAllResponse]{}
+		if err := json.NewDecoder(w.Result().Body).Decode(&resData); err != nil {
+			panic(err)
+		}
+		assert.DeepEqual(t, map[string]config.EndpointMode{
+			"songs": config.ModeReadOnly,
+			"audit": config.ModeWriteOnce,
+			"logs":  config.ModeAppendOnly,
+		}, resData.Data.Modes)
+	})
+}
@@ -0,0 +1,26 @@
+package server
+
+import (
+	"errors"
+
+	"github.com/aigic8/gosyn/internal/server/log"
+	"github.com/aigic8/gosyn/internal/server/utils"
+)
+
+// checkNames checks new names of filePath against the names policy of the
+// endpoint and returns the path to use, ok is false if the error is sent
+func (fHandler *fileHandler) checkNames(errh *log.APIERRHandler, endpoint string, filePath string, rawPath string) (string, bool) {
+	filePath, err := utils.CheckNames(fHandler.Endpoints[endpoint], filePath, fHandler.Configs[endpoint].Names)
+	if err != nil {
+		switch {
+		case errors.Is(err, utils.ErrNameNotPortable):
+			errh.Warn(log.ErrNameNotPortable(rawPath, err))
+		case errors.Is(err, utils.ErrNameCollision):
+			errh.Warn(log.ErrNameCollision(rawPath, err))
+		default:
+			errh.Err(log.ErrUnknown("error checking names: " + err.Error()))
+		}
+		return "", false
+	}
+	return filePath, true
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/aigic8/gosyn/internal/config"
+	"github.com/aigic8/gosyn/internal/server/log"
+	"gotest.tools/v3/assert"
+)
+
+type namesTestCase struct {
+	Name   string
+	File   string
+	Status int
+	// Written is the path the file is written to, empty if it is not written
+	Written string
+}
+
+func TestNamesPolicies(t *testing.T) {
+	logger, err := log.NewLogger()
+	if err != nil {
+		panic(err)
+	}
+
+	testCases := map[config.NamesPolicy][]namesTestCase{
+		config.NamesAllow: {
+			{Name: "case collision", File: "time.txt", Status: http.StatusOK, Written: "time.txt"},
+			{Name: "reserved name", File: "CON.txt", Status: http.StatusOK, Written: "CON.txt"},
+		},
+		config.NamesReject: {
+			{Name: "portable", File: "money.txt", Status: http.StatusOK, Written: "money.txt"},
+			{Name: "case collision", File: "time.txt", Status: http.StatusConflict},
+			{Name: "case collision of dir", File: "PINK-FLOYD/money.txt", Status: http.StatusConflict},
+			{Name: "reserved name", File: "CON.txt", Status: http.StatusBadRequest},
+			{Name: "bad char", File: "time:remastered.txt", Status: http.StatusBadRequest},
+			{Name: "trailing dot", File: "time.", Status: http.StatusBadRequest},
+			{Name: "nfd", File: "cafe\u0301/menu.txt", Status: http.StatusBadRequest},
+			{Name: "existing name", File: "old:name.txt", Status: http.StatusOK, Written: "old:name.txt"},
+		},
+		config.NamesNormalize: {
+			{Name: "case collision", File: "time.txt", Status: http.StatusConflict},
+			{Name: "reserved name", File: "CON.txt", Status: http.StatusOK, Written: "CON_.txt"},
+			{Name: "bad char", File: "time:remastered.txt", Status: http.StatusOK, Written: "time_remastered.txt"},
+			{Name: "trailing dot", File: "time.", Status: http.StatusOK, Written: "time"},
+			{Name: "nfd", File: "cafe\u0301/menu.txt", Status: http.StatusOK, Written: "café/menu.txt"},
+			{Name: "meta dir", File: ".gosyn./time.txt", Status: http.StatusBadRequest},
+		},
+	}
+
+	for policy, cases := range testCases {
+		for _, tc := range cases {
+			t.Run(string(policy)+" "+tc.Name, func(t *testing.T) {
+				songsPath := path.Join(t.TempDir(), "songs")
+				if err := mkDirs(songsPath, []string{"pink-floyd", "café"}); err != nil {
+					panic(err)
+				}
+				if err := mkFiles(songsPath, []fileInfo{
+					{Path: "Time.txt", Data: []byte("Ticking away the moments")},
+					{Path: "old:name.txt", Data: []byte("made before the policy")},
+				}); err != nil {
+					panic(err)
+				}
+
+				srv := newOpenServer("", map[string]config.EndpointConfig{"songs": {Path: songsPath, Names: policy}}, logger)
+				r := httptest.NewRequest(http.MethodPut, "/files/new", strings.NewReader("Money, get away"))
+				r.Header.Set("x-file-path", "songs/"+tc.File)
+				r.Header.Set("x-force", "true")
+				w := httptest.NewRecorder()
+				srv.Handler().ServeHTTP(w, r)
+				res := w.Result()
+				assert.Equal(t, tc.Status, res.StatusCode)
+				if tc.Written == "" {
+					return
+				}
+
+				var resp APIResponse[FileMeta]
+				if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+					panic(err)
+				}
+				assert.Equal(t, "songs/"+tc.Written, resp.Data.File)
+				data, err := os.ReadFile(path.Join(songsPath, tc.Written))
+				assert.NilError(t, err)
+				assert.Equal(t, "Money, get away", string(data))
+			})
+		}
+	}
+}
+
+func TestNamesPolicyTargets(t *testing.T) {
+	logger, err := log.NewLogger()
+	if err != nil {
+		panic(err)
+	}
+	songsPath := path.Join(t.TempDir(), "songs")
+	if err := mkDirs(songsPath, []string{"pink-floyd"}); err != nil {
+		panic(err)
+	}
+	if err := mkFiles(songsPath, []fileInfo{{Path: "pink-floyd/time.txt", Data: []byte("Ticking away the moments")}}); err != nil {
+		panic(err)
+	}
+
+	srv := newOpenServer("", map[string]config.EndpointConfig{"songs": {Path: songsPath, Names: config.NamesNormalize}}, logger)
+	handler := srv.Handler()
+	do := func(method string, target string, header map[string]string) *http.Response {
+		r := httptest.NewRequest(method, target, nil)
+		for key, value := range header {
+			r.Header.Set(key, value)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Result()
+	}
+
+	t.Run("reads are not checked", func(t *testing.T) {
+		assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/files/songs/pink-floyd/time:remastered.txt", nil).StatusCode)
+		assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/files/songs/PINK-FLOYD/time.txt", nil).StatusCode)
+	})
+
+	t.Run("move destinations are checked", func(t *testing.T) {
+		res := do(http.MethodPost, "/files/songs/pink-floyd/time.txt/move", map[string]string{"x-destination": "songs/pink-floyd/time:remastered.txt"})
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		data, err := os.ReadFile(path.Join(songsPath, "pink-floyd/time_remastered.txt"))
+		assert.NilError(t, err)
+		assert.Equal(t, "Ticking away the moments", string(data))
+
+		res = do(http.MethodPost, "/files/songs/pink-floyd/time_remastered.txt/move", map[string]string{"x-destination": "songs/PINK-FLOYD/time.txt"})
+		assert.Equal(t, http.StatusConflict, res.StatusCode)
+	})
+}
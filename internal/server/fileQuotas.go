@@ -0,0 +1,538 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/aigic8/gosyn/internal/config"
+	"github.com/aigic8/gosyn/internal/server/log"
+	"github.com/aigic8/gosyn/internal/server/utils"
+	"github.com/gorilla/mux"
+)
+
+// USAGE_INDEX_FILE keeps who uploaded each file, in the meta directory of endpoints
+const USAGE_INDEX_FILE = "usage.json"
+
+type (
+	// UserUsage is the size of files uploaded by a user, MaxSize is zero if
+	// the user has no quota.
+	UserUsage struct {
+		User    string `json:"user"`
+		Size    int64  `json:"size"`
+		Files   int    `json:"files"`
+		MaxSize int64  `json:"maxSize,omitempty"`
+	}
+
+	// UsageResponse is the size of files of an endpoint. Files uploaded
+	// without a token are only counted for the endpoint. DiskFree is -1 if
+	// the free disk space is not known.
+	UsageResponse struct {
+		Endpoint    string      `json:"endpoint"`
+		Size        int64       `json:"size"`
+		Files       int         `json:"files"`
+		MaxSize     int64       `json:"maxSize,omitempty"`
+		DiskFree    int64       `json:"diskFree"`
+		DiskReserve int64       `json:"diskReserve,omitempty"`
+		Users       []UserUsage `json:"users"`
+	}
+)
+
+// usageIndex maps files of an endpoint to the user who uploaded them
+type usageIndex struct {
+	Owners map[string]string `json:"owners"`
+}
+
+// endpointUsage is the size of files of an endpoint and of files of each owner.
+// reserved is the size of writes in progress, which is counted against quotas
+// until they are done.
+type endpointUsage struct {
+	mu           sync.Mutex
+	loaded       bool
+	size         int64
+	files        int
+	users        map[string]*UserUsage
+	owners       map[string]string
+	sizes        map[string]int64
+	reserved     int64
+	userReserved map[string]int64
+}
+
+// usageStore keeps the usage index of endpoints in their meta directory and
+// the size of their files in memory. Endpoints are scanned once when they are
+// first used and kept up to date by Update, which is called after files are
+// changed by the server. Files changed outside of the server are counted once
+// the endpoint is scanned again with Rescan.
+type usageStore struct {
+	mu        sync.Mutex
+	endpoints map[string]*endpointUsage
+}
+
+// lock returns the usage of an endpoint locked, scanning it if it was not
+// scanned yet. Endpoints are locked on their own so they do not wait for
+// each other.
+func (store *usageStore) lock(endpointPath string) (*endpointUsage, error) {
+	store.mu.Lock()
+	if store.endpoints == nil {
+		store.endpoints = map[string]*endpointUsage{}
+	}
+	usage, ok := store.endpoints[endpointPath]
+	if !ok {
+		usage = &endpointUsage{userReserved: map[string]int64{}}
+		store.endpoints[endpointPath] = usage
+	}
+	store.mu.Unlock()
+
+	usage.mu.Lock()
+	if !usage.loaded {
+		if err := store.scan(endpointPath, usage); err != nil {
+			usage.mu.Unlock()
+			return nil, err
+		}
+	}
+	return usage, nil
+}
+
+// scan sums the sizes of files of an endpoint. Files which are not found are
+// dropped from the index. Reserved sizes are kept.
+func (store *usageStore) scan(endpointPath string, usage *endpointUsage) error {
+	index, err := store.load(endpointPath)
+	if err != nil {
+		return err
+	}
+
+	usage.size, usage.files = 0, 0
+	usage.users, usage.owners, usage.sizes = map[string]*UserUsage{}, map[string]string{}, map[string]int64{}
+	// symlinks synced as links count with the length of their target
+	err = walkEntries(endpointPath, true, func(filePath string, info fs.FileInfo) error {
+		usage.set(filePath, info.Size(), index.Owners[filePath])
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(usage.owners) != len(index.Owners) {
+		if err = store.save(endpointPath, usageIndex{Owners: usage.owners}); err != nil {
+			return err
+		}
+	}
+	usage.loaded = true
+	return nil
+}
+
+// Rescan counts the files of an endpoint again, with changes made outside of
+// the server
+func (store *usageStore) Rescan(endpointPath string) error {
+	usage, err := store.lock(endpointPath)
+	if err != nil {
+		return err
+	}
+	defer usage.mu.Unlock()
+	return store.scan(endpointPath, usage)
+}
+
+// set replaces what a file counts for, a negative size removes the file. It
+// reports whether the owner of the file changed.
+func (usage *endpointUsage) set(filePath string, size int64, owner string) bool {
+	oldOwner, hadOwner := usage.owners[filePath]
+	if oldSize, ok := usage.sizes[filePath]; ok {
+		usage.size -= oldSize
+		usage.files--
+		if hadOwner {
+			userUsage := usage.users[oldOwner]
+			userUsage.Size -= oldSize
+			userUsage.Files--
+			if userUsage.Files == 0 {
+				delete(usage.users, oldOwner)
+			}
+		}
+	}
+	delete(usage.sizes, filePath)
+	delete(usage.owners, filePath)
+	if size < 0 {
+		return hadOwner
+	}
+
+	usage.sizes[filePath] = size
+	usage.size += size
+	usage.files++
+	if owner != "" {
+		usage.owners[filePath] = owner
+		userUsage, ok := usage.users[owner]
+		if !ok {
+			userUsage = &UserUsage{User: owner}
+			usage.users[owner] = userUsage
+		}
+		userUsage.Size += size
+		userUsage.Files++
+	}
+	return oldOwner != owner
+}
+
+// fileSize returns the size a file counts for, or -1 if it is not counted
+func fileSize(fullPath string) (int64, error) {
+	info, err := os.Lstat(fullPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) || errors.Is(err, syscall.ENOTDIR) {
+			return -1, nil
+		}
+		return 0, err
+	}
+	if !info.Mode().IsRegular() && info.Mode()&os.ModeSymlink == 0 {
+		return -1, nil
+	}
+	return info.Size(), nil
+}
+
+// Update counts a file again after it is written, removed or renamed. Removed
+// files are dropped from the index.
+func (store *usageStore) Update(endpointPath string, filePath string) error {
+	usage, err := store.lock(endpointPath)
+	if err != nil {
+		return err
+	}
+	defer usage.mu.Unlock()
+
+	size, err := fileSize(path.Join(endpointPath, filePath))
+	if err != nil {
+		return err
+	}
+	if !usage.set(filePath, size, usage.owners[filePath]) {
+		return nil
+	}
+	return store.save(endpointPath, usageIndex{Owners: usage.owners})
+}
+
+// SetOwner records the user who uploaded a file, an empty owner removes the file from the index
+func (store *usageStore) SetOwner(endpointPath string, filePath string, owner string) error {
+	usage, err := store.lock(endpointPath)
+	if err != nil {
+		return err
+	}
+	defer usage.mu.Unlock()
+
+	size, err := fileSize(path.Join(endpointPath, filePath))
+	if err != nil {
+		return err
+	}
+	if !usage.set(filePath, size, owner) {
+		return nil
+	}
+	return store.save(endpointPath, usageIndex{Owners: usage.owners})
+}
+
+// Move moves the owner of a moved file
+func (store *usageStore) Move(endpointPath string, from string, to string) error {
+	usage, err := store.lock(endpointPath)
+	if err != nil {
+		return err
+	}
+	defer usage.mu.Unlock()
+
+	owner, hadOwner := usage.owners[from]
+	size, ok := usage.sizes[from]
+	if !ok {
+		size = -1
+	}
+	changed := usage.set(to, size, owner)
+	changed = usage.set(from, -1, "") || changed
+	if !changed && !hadOwner {
+		return nil
+	}
+	return store.save(endpointPath, usageIndex{Owners: usage.owners})
+}
+
+// usageSummary is the size of files of an endpoint and of each owner
+type usageSummary struct {
+	Size  int64
+	Files int
+	Users []UserUsage
+}
+
+// Usage returns the size of files of an endpoint
+func (store *usageStore) Usage(endpointPath string) (usageSummary, error) {
+	usage, err := store.lock(endpointPath)
+	if err != nil {
+		return usageSummary{}, err
+	}
+	defer usage.mu.Unlock()
+
+	summary := usageSummary{Size: usage.size, Files: usage.files, Users: make([]UserUsage, 0, len(usage.users))}
+	for _, userUsage := range usage.users {
+		summary.Users = append(summary.Users, *userUsage)
+	}
+	return summary, nil
+}
+
+// space returns how many bytes owner can write to filePath under the quotas
+// of the endpoint, which is -1 if there is no limit, and the limit which
+// allows the least. A replaced file frees its size. usage must be locked.
+func (usage *endpointUsage) space(filePath string, owner string, quota config.QuotaConfig) (int64, string) {
+	userMaxSize := int64(0)
+	if owner != "" {
+		userMaxSize = userQuota(quota.UserMaxSize, quota.Users, owner)
+	}
+	replacedSize := max(usage.sizes[filePath], 0)
+
+	space, limit := int64(-1), ""
+	if quota.MaxSize > 0 {
+		space, limit = max(quota.MaxSize-usage.size-usage.reserved+replacedSize, 0), "endpoint quota"
+	}
+	if userMaxSize > 0 {
+		userSize := usage.userReserved[owner]
+		if userUsage, ok := usage.users[owner]; ok {
+			userSize += userUsage.Size
+		}
+		if usage.owners[filePath] == owner {
+			userSize -= replacedSize
+		}
+		if userSpace := max(userMaxSize-userSize, 0); space < 0 || userSpace < space {
+			space, limit = userSpace, "quota of user '"+owner+"'"
+		}
+	}
+	return space, limit
+}
+
+// Space returns how many bytes owner can write to filePath under the quotas
+// of the endpoint, see endpointUsage.space
+func (store *usageStore) Space(endpointPath string, filePath string, owner string, quota config.QuotaConfig) (int64, string, error) {
+	usage, err := store.lock(endpointPath)
+	if err != nil {
+		return 0, "", err
+	}
+	defer usage.mu.Unlock()
+	space, limit := usage.space(filePath, owner, quota)
+	return space, limit, nil
+}
+
+// Reserve counts size bytes written to filePath by owner against the quotas
+// of the endpoint until release is called, which should be once the file is
+// counted by Update or its write failed. Checking and reserving at once keeps
+// concurrent writes from passing the quotas together. ok is false with the
+// limit which does not allow the write.
+func (store *usageStore) Reserve(endpointPath string, filePath string, owner string, size int64, quota config.QuotaConfig) (release func(), limit string, ok bool, err error) {
+	usage, err := store.lock(endpointPath)
+	if err != nil {
+		return nil, "", false, err
+	}
+	defer usage.mu.Unlock()
+
+	space, limit := usage.space(filePath, owner, quota)
+	if space >= 0 && size > space {
+		return nil, limit, false, nil
+	}
+	usage.reserved += size
+	usage.userReserved[owner] += size
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			usage.mu.Lock()
+			defer usage.mu.Unlock()
+			usage.reserved -= size
+			if usage.userReserved[owner] -= size; usage.userReserved[owner] == 0 {
+				delete(usage.userReserved, owner)
+			}
+		})
+	}, "", true, nil
+}
+
+func (store *usageStore) load(endpointPath string) (usageIndex, error) {
+	index := usageIndex{Owners: map[string]string{}}
+	data, err := os.ReadFile(utils.MetaPath(endpointPath, USAGE_INDEX_FILE))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return index, nil
+		}
+		return usageIndex{}, err
+	}
+
+	if err = json.Unmarshal(data, &index); err != nil {
+		return usageIndex{}, err
+	}
+	if index.Owners == nil {
+		index.Owners = map[string]string{}
+	}
+	return index, nil
+}
+
+func (store *usageStore) save(endpointPath string, index usageIndex) error {
+	if err := os.MkdirAll(utils.MetaPath(endpointPath), 0777); err != nil {
+		return err
+	}
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+
+	// written to a temp file and renamed so a crash never leaves a broken index
+	tmpFile, err := os.CreateTemp(utils.MetaPath(endpointPath), USAGE_INDEX_FILE+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	_, err = tmpFile.Write(data)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), utils.MetaPath(endpointPath, USAGE_INDEX_FILE))
+}
+
+// GetUsage returns the size of files of an endpoint and each of its users.
+// With 'rescan=true' the endpoint is counted again first, with changes made
+// outside of the server.
+func (fHandler *fileHandler) GetUsage(w http.ResponseWriter, r *http.Request) {
+	errh := log.NewAPIErrHandler(fHandler.logger, r, w)
+	endpointPath, ok := fHandler.resolveEndpoint(errh, mux.Vars(r))
+	if !ok {
+		return
+	}
+	endpoint := strings.TrimSpace(mux.Vars(r)["endpoint"])
+	quota := fHandler.Configs[endpoint].Quota
+
+	if strings.TrimSpace(r.URL.Query().Get("rescan")) == "true" {
+		if err := fHandler.Usage.Rescan(endpointPath); err != nil {
+			errh.Err(log.ErrUnknown("err counting usage: " + err.Error()))
+			return
+		}
+	}
+	usage, err := fHandler.Usage.Usage(endpointPath)
+	if err != nil {
+		errh.Err(log.ErrUnknown("err getting usage: " + err.Error()))
+		return
+	}
+	diskFree, err := utils.FreeSpace(endpointPath)
+	if err != nil {
+		errh.Err(log.ErrUnknown("err getting free disk space: " + err.Error()))
+		return
+	}
+
+	users := usage.Users
+	for i := range users {
+		users[i].MaxSize = userQuota(quota.UserMaxSize, quota.Users, users[i].User)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].User < users[j].User })
+
+	respJson, err := wrapAPIResponse(UsageResponse{
+		Endpoint:    endpoint,
+		Size:        usage.Size,
+		Files:       usage.Files,
+		MaxSize:     quota.MaxSize,
+		DiskFree:    diskFree,
+		DiskReserve: fHandler.DiskReserve,
+		Users:       users,
+	})
+	if err != nil {
+		errh.Err(log.ErrUnknown("error marshaling json: " + err.Error()))
+		return
+	}
+	w.Write(respJson)
+}
+
+// hasQuota reports whether writes of owner to an endpoint are limited by quotas
+func hasQuota(quota config.QuotaConfig, owner string) bool {
+	return quota.MaxSize > 0 || (owner != "" && userQuota(quota.UserMaxSize, quota.Users, owner) > 0)
+}
+
+// uploadSpace returns how many bytes a user can upload to a file of an
+// endpoint, which is -1 if there is no limit, and the limit which allows
+// the least. A replaced file frees its size from quotas but not from disk,
+// since it is kept as a version. Quotas are not checked without a usage store.
+// The space is only a first check, writes are counted with reserveSpace.
+func (fHandler *fileHandler) uploadSpace(endpoint string, filePath string, owner string) (int64, string, error) {
+	endpointPath := fHandler.Endpoints[endpoint]
+	quota := fHandler.Configs[endpoint].Quota
+
+	space, limit := int64(-1), ""
+	if fHandler.Usage != nil && hasQuota(quota, owner) {
+		var err error
+		if space, limit, err = fHandler.Usage.Space(endpointPath, filePath, owner, quota); err != nil {
+			return 0, "", err
+		}
+	}
+
+	if fHandler.DiskReserve > 0 {
+		diskFree, err := utils.FreeSpace(endpointPath)
+		if err != nil {
+			return 0, "", err
+		}
+		if diskSpace := max(diskFree-fHandler.DiskReserve, 0); diskFree >= 0 && (space < 0 || diskSpace < space) {
+			space, limit = diskSpace, "disk space reserve"
+		}
+	}
+	return space, limit, nil
+}
+
+// reserveSpace counts size bytes written to a file of an endpoint by a user
+// against the quotas of the endpoint, see usageStore.Reserve. It should be
+// called with the file locked, right before the file is renamed in place.
+func (fHandler *fileHandler) reserveSpace(endpoint string, filePath string, owner string, size int64) (func(), string, bool, error) {
+	quota := fHandler.Configs[endpoint].Quota
+	if fHandler.Usage == nil || !hasQuota(quota, owner) {
+		return func() {}, "", true, nil
+	}
+	return fHandler.Usage.Reserve(fHandler.Endpoints[endpoint], filePath, owner, size, quota)
+}
+
+// checkSpace checks that size bytes written to a file of an endpoint by a
+// user fit its quotas and the disk space reserve, and reserves them until
+// release is called, see reserveSpace. Errors are sent to the client.
+func (fHandler *fileHandler) checkSpace(errh *log.APIERRHandler, endpoint string, filePath string, rawPath string, owner string, size int64) (func(), bool) {
+	space, quotaLimit, err := fHandler.uploadSpace(endpoint, filePath, owner)
+	if err != nil {
+		errh.Err(log.ErrUnknown("err checking quota: " + err.Error()))
+		return nil, false
+	}
+	if space >= 0 && size > space {
+		errh.Warn(log.ErrQuotaExceeded(rawPath, quotaLimit))
+		return nil, false
+	}
+	release, quotaLimit, fits, err := fHandler.reserveSpace(endpoint, filePath, owner, size)
+	if err != nil {
+		errh.Err(log.ErrUnknown("err checking quota: " + err.Error()))
+		return nil, false
+	}
+	if !fits {
+		errh.Warn(log.ErrQuotaExceeded(rawPath, quotaLimit))
+		return nil, false
+	}
+	return release, true
+}
+
+// requestOwner returns the name of the token of a request, which owns the
+// files it writes. It is empty if authentication is disabled.
+func requestOwner(r *http.Request) string {
+	if token, ok := RequestToken(r); ok {
+		return token.Name
+	}
+	return ""
+}
+
+// setOwner records owner as the owner of a written file of an endpoint
+func (fHandler *fileHandler) setOwner(endpoint string, filePath string, rawPath string, owner string) {
+	if fHandler.Usage == nil {
+		return
+	}
+	if err := fHandler.Usage.SetOwner(fHandler.Endpoints[endpoint], filePath, owner); err != nil {
+		// the file is written, it is only not counted for the quota of its user
+		fHandler.logger.Logger.Errorw("error recording file owner", "file", rawPath, "error", err.Error())
+	}
+}
+
+func userQuota(userMaxSize int64, users map[string]int64, user string) int64 {
+	if maxSize, ok := users[user]; ok {
+		return maxSize
+	}
+	return userMaxSize
+}
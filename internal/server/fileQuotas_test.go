@@ -0,0 +1,320 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aigic8/gosyn/internal/auth"
+	"github.com/aigic8/gosyn/internal/config"
+	"github.com/aigic8/gosyn/internal/server/log"
+	"gotest.tools/v3/assert"
+)
+
+func TestQuotas(t *testing.T) {
+	base := t.TempDir()
+	songsPath := path.Join(base, "songs")
+	if err := mkDirs(songsPath, []string{"pink-floyd"}); err != nil {
+		panic(err)
+	}
+	if err := mkFiles(songsPath, []fileInfo{{Path: "pink-floyd/time.txt", Data: []byte(strings.Repeat("t", 20))}}); err != nil {
+		panic(err)
+	}
+
+	logger, err := log.NewLogger()
+	if err != nil {
+		panic(err)
+	}
+	tokens, err := auth.OpenTokenStore(path.Join(base, "tokens.json"))
+	if err != nil {
+		panic(err)
+	}
+	_, wishToken, err := tokens.Create("wish", 0, adminGrants)
+	if err != nil {
+		panic(err)
+	}
+	_, shineToken, err := tokens.Create("shine", 0, adminGrants)
+	if err != nil {
+		panic(err)
+	}
+
+	srv := NewServer("", map[string]config.EndpointConfig{"songs": {
+		Path:  songsPath,
+		Quota: config.QuotaConfig{MaxSize: 100, UserMaxSize: 40, Users: map[string]int64{"shine": 70}},
+	}}, logger)
+	srv.Tokens = tokens
+	handler := srv.Handler()
+
+	do := func(r *http.Request, rawToken string) *http.Response {
+		r.Header.Set("Authorization", "Bearer "+rawToken)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Result()
+	}
+	upload := func(rawToken string, file string, body io.Reader) int {
+		r := httptest.NewRequest(http.MethodPut, "/files/new", body)
+		r.Header.Set("x-file-path", "songs/"+file)
+		r.Header.Set("x-force", "true")
+		return do(r, rawToken).StatusCode
+	}
+
+	assert.Equal(t, http.StatusOK, upload(wishToken, "pink-floyd/money.txt", strings.NewReader(strings.Repeat("m", 30))))
+	assert.Equal(t, http.StatusInsufficientStorage, upload(wishToken, "pink-floyd/echoes.txt", strings.NewReader(strings.Repeat("e", 20))))
+	// replaced files free their size
+	assert.Equal(t, http.StatusOK, upload(wishToken, "pink-floyd/money.txt", strings.NewReader(strings.Repeat("m", 35))))
+
+	t.Run("endpoint quota", func(t *testing.T) {
+		// 55 bytes are used, shine can upload 70 bytes but the endpoint has 45 bytes left
+		assert.Equal(t, http.StatusInsufficientStorage, upload(shineToken, "queen.txt", strings.NewReader(strings.Repeat("q", 50))))
+		assert.Equal(t, http.StatusOK, upload(shineToken, "queen.txt", strings.NewReader(strings.Repeat("q", 45))))
+	})
+
+	t.Run("bodies without length", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, upload(shineToken, "queen.txt", strings.NewReader("")))
+		body := io.MultiReader(strings.NewReader(strings.Repeat("q", 50)))
+		assert.Equal(t, http.StatusInsufficientStorage, upload(shineToken, "queen.txt", body))
+		stat, err := os.Stat(path.Join(songsPath, "queen.txt"))
+		if err != nil {
+			panic(err)
+		}
+		assert.Equal(t, int64(0), stat.Size())
+	})
+
+	t.Run("moved files keep their owner", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/files/songs/pink-floyd/money.txt/move", nil)
+		r.Header.Set("x-destination", "songs/money.txt")
+		assert.Equal(t, http.StatusOK, do(r, wishToken).StatusCode)
+
+		res := do(httptest.NewRequest(http.MethodGet, "/endpoints/songs/usage", nil), wishToken)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		var resp APIResponse[UsageResponse]
+		if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+			panic(err)
+		}
+		assert.Equal(t, int64(55), resp.Data.Size)
+		assert.Equal(t, 3, resp.Data.Files)
+		assert.Equal(t, int64(100), resp.Data.MaxSize)
+		assert.DeepEqual(t, []UserUsage{
+			{User: "shine", Size: 0, Files: 1, MaxSize: 70},
+			{User: "wish", Size: 35, Files: 1, MaxSize: 40},
+		}, resp.Data.Users)
+	})
+
+	t.Run("writes through symlinks are owned at the target", func(t *testing.T) {
+		if err := os.Symlink("pink-floyd/time.txt", path.Join(songsPath, "time-link.txt")); err != nil {
+			panic(err)
+		}
+		r := httptest.NewRequest(http.MethodPut, "/files/new", strings.NewReader(strings.Repeat("t", 5)))
+		r.Header.Set("x-file-path", "songs/time-link.txt")
+		r.Header.Set("x-force", "true")
+		res := do(r, wishToken)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		var fileResp APIResponse[FileMeta]
+		if err := json.NewDecoder(res.Body).Decode(&fileResp); err != nil {
+			panic(err)
+		}
+		assert.Equal(t, "songs/time-link.txt", fileResp.Data.File)
+
+		res = do(httptest.NewRequest(http.MethodGet, "/endpoints/songs/usage", nil), wishToken)
+		var resp APIResponse[UsageResponse]
+		if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+			panic(err)
+		}
+		assert.DeepEqual(t, UserUsage{User: "wish", Size: 40, Files: 2, MaxSize: 40}, resp.Data.Users[1])
+	})
+
+	t.Run("changes outside the server are counted on rescan", func(t *testing.T) {
+		getUsage := func(target string) UsageResponse {
+			res := do(httptest.NewRequest(http.MethodGet, target, nil), wishToken)
+			assert.Equal(t, http.StatusOK, res.StatusCode)
+			var resp APIResponse[UsageResponse]
+			if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+				panic(err)
+			}
+			return resp.Data
+		}
+		before := getUsage("/endpoints/songs/usage?rescan=true")
+		if err := mkFiles(songsPath, []fileInfo{{Path: "echoes.txt", Data: []byte(strings.Repeat("e", 10))}}); err != nil {
+			panic(err)
+		}
+		assert.Equal(t, before.Size, getUsage("/endpoints/songs/usage").Size)
+		assert.Equal(t, before.Size+10, getUsage("/endpoints/songs/usage?rescan=true").Size)
+		if err := os.Remove(path.Join(songsPath, "echoes.txt")); err != nil {
+			panic(err)
+		}
+		assert.Equal(t, before.Size, getUsage("/endpoints/songs/usage?rescan=true").Size)
+	})
+
+	t.Run("concurrent uploads do not pass the quota together", func(t *testing.T) {
+		racePath := path.Join(base, "race")
+		if err := mkDirs(base, []string{"race"}); err != nil {
+			panic(err)
+		}
+		raceSrv := newOpenServer("", map[string]config.EndpointConfig{"race": {Path: racePath, Quota: config.QuotaConfig{MaxSize: 50}}}, logger)
+		raceHandler := raceSrv.Handler()
+
+		var wg, checked sync.WaitGroup
+		statuses := make([]int, 10)
+		// every upload passes the first quota check before any is written
+		checked.Add(len(statuses))
+		for i := range statuses {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				body := &barrierReader{Reader: strings.NewReader(strings.Repeat("r", 10)), group: &checked}
+				r := httptest.NewRequest(http.MethodPut, "/files/new", body)
+				r.Header.Set("x-file-path", "race/"+strconv.Itoa(i)+".txt")
+				w := httptest.NewRecorder()
+				raceHandler.ServeHTTP(w, r)
+				statuses[i] = w.Result().StatusCode
+			}(i)
+		}
+		wg.Wait()
+
+		written := 0
+		for _, status := range statuses {
+			if status == http.StatusOK {
+				written++
+			} else {
+				assert.Equal(t, http.StatusInsufficientStorage, status)
+			}
+		}
+		assert.Equal(t, 5, written)
+	})
+
+	t.Run("disk reserve", func(t *testing.T) {
+		reservedSrv := newOpenServer("", map[string]config.EndpointConfig{"songs": {Path: songsPath}}, logger)
+		reservedSrv.DiskReserve = 1 << 62
+		r := httptest.NewRequest(http.MethodPut, "/files/new", strings.NewReader("wish you were here"))
+		r.Header.Set("x-file-path", "songs/wish.txt")
+		w := httptest.NewRecorder()
+		reservedSrv.Handler().ServeHTTP(w, r)
+		assert.Equal(t, http.StatusInsufficientStorage, w.Result().StatusCode)
+	})
+}
+
+// barrierReader waits for every reader of its group before it is first read
+type barrierReader struct {
+	io.Reader
+	group *sync.WaitGroup
+	once  sync.Once
+}
+
+func (reader *barrierReader) Read(p []byte) (int, error) {
+	reader.once.Do(func() {
+		reader.group.Done()
+		reader.group.Wait()
+	})
+	return reader.Reader.Read(p)
+}
+
+func TestRestoreChecks(t *testing.T) {
+	base := t.TempDir()
+	songsPath := path.Join(base, "songs")
+	if err := mkDirs(songsPath, []string{"pink-floyd"}); err != nil {
+		panic(err)
+	}
+	if err := mkFiles(songsPath, []fileInfo{{Path: "pink-floyd/time.txt", Data: []byte(strings.Repeat("t", 20))}}); err != nil {
+		panic(err)
+	}
+
+	logger, err := log.NewLogger()
+	if err != nil {
+		panic(err)
+	}
+	tokens, err := auth.OpenTokenStore(path.Join(base, "tokens.json"))
+	if err != nil {
+		panic(err)
+	}
+	_, wishToken, err := tokens.Create("wish", 0, adminGrants)
+	if err != nil {
+		panic(err)
+	}
+	_, shineToken, err := tokens.Create("shine", 0, adminGrants)
+	if err != nil {
+		panic(err)
+	}
+
+	srv := NewServer("", map[string]config.EndpointConfig{"songs": {
+		Path:    songsPath,
+		Quota:   config.QuotaConfig{UserMaxSize: 40},
+		Uploads: config.UploadsConfig{MaxDirFiles: 2},
+	}}, logger)
+	srv.Tokens = tokens
+	handler := srv.Handler()
+
+	do := func(method string, target string, rawToken string, body io.Reader, v any) int {
+		r := httptest.NewRequest(method, target, body)
+		r.Header.Set("Authorization", "Bearer "+rawToken)
+		r.Header.Set("x-force", "true")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		res := w.Result()
+		if v != nil && res.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+				panic(err)
+			}
+		}
+		return res.StatusCode
+	}
+	upload := func(rawToken string, file string, size int) int {
+		r := httptest.NewRequest(http.MethodPut, "/files/new", strings.NewReader(strings.Repeat("x", size)))
+		r.Header.Set("Authorization", "Bearer "+rawToken)
+		r.Header.Set("x-file-path", "songs/"+file)
+		r.Header.Set("x-force", "true")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Result().StatusCode
+	}
+	userUsage := func(user string) UserUsage {
+		var resp APIResponse[UsageResponse]
+		assert.Equal(t, http.StatusOK, do(http.MethodGet, "/endpoints/songs/usage", wishToken, nil, &resp))
+		for _, usage := range resp.Data.Users {
+			if usage.User == user {
+				return usage
+			}
+		}
+		return UserUsage{User: user}
+	}
+
+	t.Run("trash", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, upload(wishToken, "pink-floyd/money.txt", 30))
+		assert.Equal(t, http.StatusOK, do(http.MethodDelete, "/files/songs/pink-floyd/money.txt", wishToken, nil, nil))
+		assert.Equal(t, http.StatusOK, upload(wishToken, "pink-floyd/echoes.txt", 30))
+		var trashResp APIResponse[TrashListResponse]
+		assert.Equal(t, http.StatusOK, do(http.MethodGet, "/endpoints/songs/trash", wishToken, nil, &trashResp))
+		assert.Equal(t, 1, len(trashResp.Data.Items))
+		restorePath := "/endpoints/songs/trash/" + trashResp.Data.Items[0].ID + "/restore"
+
+		// the directory is full
+		assert.Equal(t, http.StatusRequestEntityTooLarge, do(http.MethodPost, restorePath, wishToken, nil, nil))
+		if err := os.Remove(path.Join(songsPath, "pink-floyd/time.txt")); err != nil {
+			panic(err)
+		}
+		// wish has 30 of 40 bytes
+		assert.Equal(t, http.StatusInsufficientStorage, do(http.MethodPost, restorePath, wishToken, nil, nil))
+		assert.Equal(t, http.StatusOK, do(http.MethodPost, restorePath, shineToken, nil, nil))
+		assert.DeepEqual(t, UserUsage{User: "shine", Size: 30, Files: 1, MaxSize: 40}, userUsage("shine"))
+	})
+
+	t.Run("versions", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, upload(shineToken, "pink-floyd/echoes.txt", 10))
+		var versionsResp APIResponse[FileVersionsResponse]
+		assert.Equal(t, http.StatusOK, do(http.MethodGet, "/files/songs/pink-floyd/echoes.txt/versions", wishToken, nil, &versionsResp))
+		assert.Equal(t, 1, len(versionsResp.Data.Versions))
+		restorePath := "/files/songs/pink-floyd/echoes.txt/versions/" + versionsResp.Data.Versions[0].ID + "/restore"
+
+		// shine has 40 of 40 bytes, the restored version replaces 10 of them
+		assert.Equal(t, http.StatusInsufficientStorage, do(http.MethodPost, restorePath, shineToken, nil, nil))
+		assert.Equal(t, http.StatusOK, do(http.MethodPost, restorePath, wishToken, nil, nil))
+		assert.DeepEqual(t, UserUsage{User: "wish", Size: 30, Files: 1, MaxSize: 40}, userUsage("wish"))
+		assert.DeepEqual(t, UserUsage{User: "shine", Size: 30, Files: 1, MaxSize: 40}, userUsage("shine"))
+	})
+}
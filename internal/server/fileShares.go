@@ -0,0 +1,311 @@
+package server
+
+import (
+	"archive/zip"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aigic8/gosyn/internal/auth"
+	"github.com/aigic8/gosyn/internal/config"
+	"github.com/aigic8/gosyn/internal/ignore"
+	"github.com/aigic8/gosyn/internal/server/log"
+	"github.com/aigic8/gosyn/internal/server/utils"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// DEFAULT_SHARE_TTL is how long share links are valid if 'x-expires' is not set
+	DEFAULT_SHARE_TTL     = 24 * time.Hour
+	SHARE_PASSWORD_HEADER = "x-share-password"
+	SHARE_PASSWORD_PARAM  = "password"
+	// UPLOAD_LINK_HEADER has the upload link of uploads to drop boxes
+	UPLOAD_LINK_HEADER = "x-upload-link"
+)
+
+// ShareLinkResponse is a minted share link, URL is relative to the server address
+type ShareLinkResponse struct {
+	ID           string    `json:"id"`
+	File         string    `json:"file"`
+	URL          string    `json:"url"`
+	IsDir        bool      `json:"isDir"`
+	ExpiresAt    time.Time `json:"expiresAt"`
+	MaxDownloads int       `json:"maxDownloads,omitempty"`
+	HasPassword  bool      `json:"hasPassword"`
+}
+
+// UploadLinkResponse is a minted upload link, uploaders send it in the
+// 'x-upload-link' header of 'files/new' requests.
+type UploadLinkResponse struct {
+	ID         string    `json:"id"`
+	Endpoint   string    `json:"endpoint"`
+	Link       string    `json:"link"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+	MaxUploads int       `json:"maxUploads,omitempty"`
+}
+
+// CreateShare mints a share link for a file or directory. Directories are
+// downloaded as zip files. The link expires after 'x-expires' (like "72h"),
+// can be downloaded 'x-max-downloads' times if set, and needs the password
+// of 'x-share-password' if set.
+func (fHandler *fileHandler) CreateShare(w http.ResponseWriter, r *http.Request) {
+	errh := log.NewAPIErrHandler(fHandler.logger, r, w)
+	fileVar := strings.TrimSpace(mux.Vars(r)["file"])
+	if fileVar == "" {
+		errh.Warn(log.ErrVarNotFound("file"))
+		return
+	}
+
+	endpoint, filePath, fullPath, ok := fHandler.resolveFile(errh, fileVar)
+	if !ok {
+		return
+	}
+
+	ttl, maxDownloads, ok := fHandler.linkLimits(errh, r, "x-max-downloads")
+	if !ok {
+		return
+	}
+
+	stat, err := os.Stat(fullPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			errh.Warn(log.ErrFileNotFound(fileVar))
+			return
+		}
+		errh.Err(log.ErrUnknown("err stating file: " + err.Error()))
+		return
+	}
+
+	claims, link, err := fHandler.Shares.Sign(auth.ShareClaims{
+		File:         endpoint + "/" + filePath,
+		ExpiresAt:    time.Now().Add(ttl).Unix(),
+		MaxDownloads: maxDownloads,
+	}, r.Header.Get(SHARE_PASSWORD_HEADER))
+	if err != nil {
+		errh.Err(log.ErrUnknown("err signing share link: " + err.Error()))
+		return
+	}
+
+	respJson, err := wrapAPIResponse(ShareLinkResponse{
+		ID:           claims.ID,
+		File:         claims.File,
+		URL:          "/share/" + link,
+		IsDir:        stat.IsDir(),
+		ExpiresAt:    claims.Expiry(),
+		MaxDownloads: claims.MaxDownloads,
+		HasPassword:  claims.HasPassword(),
+	})
+	if err != nil {
+		errh.Err(log.ErrUnknown("error marshaling json: " + err.Error()))
+		return
+	}
+	w.Write(respJson)
+}
+
+// CreateUploadLink mints a link to upload to a drop box without a token. The
+// link expires after 'x-expires' and can be used 'x-max-uploads' times if set.
+func (fHandler *fileHandler) CreateUploadLink(w http.ResponseWriter, r *http.Request) {
+	errh := log.NewAPIErrHandler(fHandler.logger, r, w)
+	if _, ok := fHandler.resolveEndpoint(errh, mux.Vars(r)); !ok {
+		return
+	}
+	endpoint := strings.TrimSpace(mux.Vars(r)["endpoint"])
+	if fHandler.Configs[endpoint].Mode != config.ModeDropBox {
+		errh.Warn(log.ErrNotDropBox(endpoint))
+		return
+	}
+
+	ttl, maxUploads, ok := fHandler.linkLimits(errh, r, "x-max-uploads")
+	if !ok {
+		return
+	}
+
+	claims, link, err := fHandler.Shares.Sign(auth.ShareClaims{
+		File:         endpoint,
+		ExpiresAt:    time.Now().Add(ttl).Unix(),
+		MaxDownloads: maxUploads,
+		Upload:       true,
+	}, "")
+	if err != nil {
+		errh.Err(log.ErrUnknown("err signing upload link: " + err.Error()))
+		return
+	}
+
+	respJson, err := wrapAPIResponse(UploadLinkResponse{
+		ID:         claims.ID,
+		Endpoint:   endpoint,
+		Link:       link,
+		ExpiresAt:  claims.Expiry(),
+		MaxUploads: claims.MaxDownloads,
+	})
+	if err != nil {
+		errh.Err(log.ErrUnknown("error marshaling json: " + err.Error()))
+		return
+	}
+	w.Write(respJson)
+}
+
+// GetShare downloads the file of a share link, it needs no token. Password of
+// the link is read from 'x-share-password' header or 'password' query param.
+func (fHandler *fileHandler) GetShare(w http.ResponseWriter, r *http.Request) {
+	errh := log.NewAPIErrHandler(fHandler.logger, r, w)
+	claims, ok := fHandler.verifyShare(errh, mux.Vars(r)["link"])
+	if !ok {
+		return
+	}
+	if claims.Upload {
+		errh.Warn(log.ErrInvalidShare())
+		return
+	}
+
+	password := r.Header.Get(SHARE_PASSWORD_HEADER)
+	if password == "" {
+		password = r.URL.Query().Get(SHARE_PASSWORD_PARAM)
+	}
+	if !fHandler.Shares.CheckPassword(claims, password) {
+		errh.Warn(log.ErrSharePassword(claims.ID))
+		return
+	}
+
+	endpoint, filePath, fullPath, ok := fHandler.resolveFile(errh, claims.File)
+	if !ok {
+		return
+	}
+	stat, err := os.Stat(fullPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			errh.Warn(log.ErrFileNotFound(claims.File))
+			return
+		}
+		errh.Err(log.ErrUnknown("err stating file: " + err.Error()))
+		return
+	}
+
+	// downloads are counted before sending, an interrupted download is still a download
+	if err = fHandler.Shares.UseDownload(claims); err != nil {
+		writeShareErr(errh, claims.ID, err)
+		return
+	}
+
+	if stat.IsDir() {
+		endpointPath := fHandler.Endpoints[endpoint]
+		endpointConfig := fHandler.Configs[endpoint]
+		matcher, err := ignore.NewMatcher(endpointPath, endpointConfig.Ignore)
+		if err != nil {
+			errh.Err(log.ErrUnknown("err reading ignore rules: " + err.Error()))
+			return
+		}
+		links, err := utils.NewLinks(endpointPath, endpointConfig.Symlinks)
+		if err != nil {
+			errh.Err(log.ErrUnknown("error resolving symlinks: " + err.Error()))
+			return
+		}
+
+		setAttachment(w, path.Base(fullPath)+".zip")
+		w.Header().Set("Content-Type", "application/zip")
+		archive := &zipArchive{zipWriter: zip.NewWriter(w)}
+		err = writeArchive(archive, fullPath, "", filePath, matcher, links, map[string]bool{})
+		if err == nil {
+			err = archive.Close()
+		}
+		if err != nil {
+			// headers are already sent, the client gets a broken zip file
+			fHandler.logger.Logger.Errorw("error writing shared directory", "share", claims.ID, "error", err.Error())
+		}
+		return
+	}
+
+	file, err := os.Open(fullPath)
+	if err != nil {
+		errh.Err(log.ErrUnknown("err opening file: " + err.Error()))
+		return
+	}
+	defer file.Close()
+
+	setAttachment(w, path.Base(fullPath))
+	w.Header().Set("Content-Length", strconv.FormatInt(stat.Size(), 10))
+	io.Copy(w, file)
+}
+
+// RevokeShare adds a share link to the revocation list
+func (fHandler *fileHandler) RevokeShare(w http.ResponseWriter, r *http.Request) {
+	errh := log.NewAPIErrHandler(fHandler.logger, r, w)
+	claims, ok := fHandler.verifyShare(errh, mux.Vars(r)["link"])
+	if !ok {
+		return
+	}
+
+	if err := fHandler.Shares.Revoke(claims); err != nil {
+		errh.Err(log.ErrUnknown("err revoking share link: " + err.Error()))
+		return
+	}
+
+	respJson, err := wrapAPIResponse(ShareLinkResponse{
+		ID:           claims.ID,
+		File:         claims.File,
+		ExpiresAt:    claims.Expiry(),
+		MaxDownloads: claims.MaxDownloads,
+		HasPassword:  claims.HasPassword(),
+	})
+	if err != nil {
+		errh.Err(log.ErrUnknown("error marshaling json: " + err.Error()))
+		return
+	}
+	w.Write(respJson)
+}
+
+func (fHandler *fileHandler) verifyShare(errh *log.APIERRHandler, link string) (auth.ShareClaims, bool) {
+	claims, err := fHandler.Shares.Verify(link)
+	if err != nil {
+		writeShareErr(errh, claims.ID, err)
+		return auth.ShareClaims{}, false
+	}
+	return claims, true
+}
+
+// linkLimits reads the expiry and max uses of new share and upload links
+func (fHandler *fileHandler) linkLimits(errh *log.APIERRHandler, r *http.Request, maxHeader string) (time.Duration, int, bool) {
+	ttl := DEFAULT_SHARE_TTL
+	if ttl > fHandler.ShareMaxAge {
+		ttl = fHandler.ShareMaxAge
+	}
+	if rawExpiry := strings.TrimSpace(r.Header.Get("x-expires")); rawExpiry != "" {
+		expiry, err := time.ParseDuration(rawExpiry)
+		if err != nil || expiry <= 0 || expiry > fHandler.ShareMaxAge {
+			errh.Warn(log.ErrBadShareExpiry(rawExpiry, fHandler.ShareMaxAge))
+			return 0, 0, false
+		}
+		ttl = expiry
+	}
+
+	maxUses := 0
+	if rawMax := strings.TrimSpace(r.Header.Get(maxHeader)); rawMax != "" {
+		var err error
+		if maxUses, err = strconv.Atoi(rawMax); err != nil || maxUses < 0 {
+			errh.Warn(log.ErrBadHeader(maxHeader, rawMax))
+			return 0, 0, false
+		}
+	}
+	return ttl, maxUses, true
+}
+
+func writeShareErr(errh *log.APIERRHandler, id string, err error) {
+	switch {
+	case errors.Is(err, auth.ErrInvalidShare):
+		errh.Warn(log.ErrInvalidShare())
+	case errors.Is(err, auth.ErrExpiredShare), errors.Is(err, auth.ErrRevokedShare), errors.Is(err, auth.ErrShareUsedUp):
+		errh.Warn(log.ErrShareGone(id, err.Error()))
+	default:
+		errh.Err(log.ErrUnknown("err checking share link: " + err.Error()))
+	}
+}
+
+func setAttachment(w http.ResponseWriter, fileName string) {
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": fileName}))
+}
@@ -0,0 +1,338 @@
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/aigic8/gosyn/internal/auth"
+	"github.com/aigic8/gosyn/internal/config"
+	"github.com/aigic8/gosyn/internal/server/log"
+	"gotest.tools/v3/assert"
+)
+
+func TestFileShares(t *testing.T) {
+	base := t.TempDir()
+	songsPath := path.Join(base, "songs")
+	if err := mkDirs(songsPath, []string{"pink-floyd", "queen", ".gosyn"}); err != nil {
+		panic(err)
+	}
+	if err := mkFiles(songsPath, []fileInfo{
+		{Path: "pink-floyd/time.txt", Data: []byte("Ticking away the moments")},
+		{Path: "pink-floyd/money.txt", Data: []byte("Money, it's a gas")},
+		{Path: "queen/bohemian.txt", Data: []byte("Is this the real life?")},
+	}); err != nil {
+		panic(err)
+	}
+
+	logger, err := log.NewLogger()
+	if err != nil {
+		panic(err)
+	}
+	tokens, err := auth.OpenTokenStore(path.Join(base, "tokens.json"))
+	if err != nil {
+		panic(err)
+	}
+	_, floydToken, err := tokens.Create("floyd-fan", 0, []auth.Grant{
+		{Endpoint: "songs", Permissions: []auth.Permission{auth.PermRead}, Paths: []string{"pink-floyd"}},
+	})
+	if err != nil {
+		panic(err)
+	}
+	_, floydEditorToken, err := tokens.Create("floyd-editor", 0, []auth.Grant{
+		{Endpoint: "songs", Permissions: []auth.Permission{auth.PermRead, auth.PermWrite}, Paths: []string{"pink-floyd"}},
+	})
+	if err != nil {
+		panic(err)
+	}
+	_, queenToken, err := tokens.Create("queen-fan", 0, []auth.Grant{
+		{Endpoint: "songs", Permissions: []auth.Permission{auth.PermRead}, Paths: []string{"queen"}},
+	})
+	if err != nil {
+		panic(err)
+	}
+	shares, err := auth.OpenShareStore(path.Join(base, "share.key"), path.Join(base, "shares.json"))
+	if err != nil {
+		panic(err)
+	}
+
+	srv := NewServer("", map[string]config.EndpointConfig{"songs": {Path: songsPath, Ignore: []string{"demos/"}}}, logger)
+	srv.Tokens = tokens
+	srv.Shares = shares
+	handler := srv.Handler()
+
+	do := func(method string, target string, rawToken string, header map[string]string) *http.Response {
+		r := httptest.NewRequest(method, target, nil)
+		if rawToken != "" {
+			r.Header.Set("Authorization", "Bearer "+rawToken)
+		}
+		for key, value := range header {
+			r.Header.Set(key, value)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Result()
+	}
+	mint := func(file string, header map[string]string) ShareLinkResponse {
+		res := do(http.MethodPost, "/files/songs/"+file+"/share", floydToken, header)
+		if res.StatusCode != http.StatusOK {
+			panic("minting share link failed with status " + res.Status)
+		}
+		resData := APIResponse[ShareLinkResponse]{}
+		if err := json.NewDecoder(res.Body).Decode(&resData); err != nil {
+			panic(err)
+		}
+		return resData.Data
+	}
+
+	t.Run("mint needs read access", func(t *testing.T) {
+		assert.Equal(t, http.StatusUnauthorized, do(http.MethodPost, "/files/songs/pink-floyd/time.txt/share", "", nil).StatusCode)
+		assert.Equal(t, http.StatusForbidden, do(http.MethodPost, "/files/songs/queen/bohemian.txt/share", floydToken, nil).StatusCode)
+		assert.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/files/songs/pink-floyd/time.txt/share", floydToken, map[string]string{"x-expires": "9999h"}).StatusCode)
+		assert.Equal(t, http.StatusNotFound, do(http.MethodPost, "/files/songs/pink-floyd/echoes.txt/share", floydToken, nil).StatusCode)
+	})
+
+	t.Run("download file without token", func(t *testing.T) {
+		link := mint("pink-floyd/time.txt", nil)
+		assert.Equal(t, "songs/pink-floyd/time.txt", link.File)
+		assert.Assert(t, !link.IsDir)
+
+		res := do(http.MethodGet, link.URL, "", nil)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, `attachment; filename=time.txt`, res.Header.Get("Content-Disposition"))
+		data, err := io.ReadAll(res.Body)
+		if err != nil {
+			panic(err)
+		}
+		assert.Equal(t, "Ticking away the moments", string(data))
+	})
+
+	t.Run("tampered link", func(t *testing.T) {
+		link := mint("pink-floyd/time.txt", nil)
+		res := do(http.MethodGet, link.URL+"A", "", nil)
+		assert.Equal(t, http.StatusNotFound, res.StatusCode)
+	})
+
+	t.Run("download directory as zip", func(t *testing.T) {
+		link := mint("pink-floyd", nil)
+		assert.Assert(t, link.IsDir)
+
+		res := do(http.MethodGet, link.URL, "", nil)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		data, err := io.ReadAll(res.Body)
+		if err != nil {
+			panic(err)
+		}
+		zipReader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		assert.NilError(t, err)
+		names := []string{}
+		for _, file := range zipReader.File {
+			names = append(names, file.Name)
+		}
+		sort.Strings(names)
+		assert.DeepEqual(t, []string{"money.txt", "time.txt"}, names)
+	})
+
+	t.Run("directory zip follows ignore rules and symlinks", func(t *testing.T) {
+		livePath := path.Join(songsPath, "pink-floyd/live")
+		if err := mkDirs(livePath, []string{"demos"}); err != nil {
+			panic(err)
+		}
+		if err := mkFiles(livePath, []fileInfo{
+			{Path: ".gosynignore", Data: []byte("*.bak\n")},
+			{Path: "echoes.txt", Data: []byte("Overhead the albatross")},
+			{Path: "echoes.bak", Data: []byte("Overhead")},
+			{Path: "demos/echoes.txt", Data: []byte("Overhead the")},
+		}); err != nil {
+			panic(err)
+		}
+		if err := os.Symlink("echoes.txt", path.Join(livePath, "wish.txt")); err != nil {
+			panic(err)
+		}
+
+		res := do(http.MethodGet, mint("pink-floyd/live", nil).URL, "", nil)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		data, err := io.ReadAll(res.Body)
+		if err != nil {
+			panic(err)
+		}
+		zipReader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		assert.NilError(t, err)
+		names := []string{}
+		for _, file := range zipReader.File {
+			names = append(names, file.Name)
+		}
+		sort.Strings(names)
+		assert.DeepEqual(t, []string{".gosynignore", "echoes.txt", "wish.txt"}, names)
+	})
+
+	t.Run("password", func(t *testing.T) {
+		link := mint("pink-floyd/money.txt", map[string]string{SHARE_PASSWORD_HEADER: "share it fairly"})
+		assert.Assert(t, link.HasPassword)
+
+		assert.Equal(t, http.StatusUnauthorized, do(http.MethodGet, link.URL, "", nil).StatusCode)
+		assert.Equal(t, http.StatusUnauthorized, do(http.MethodGet, link.URL, "", map[string]string{SHARE_PASSWORD_HEADER: "grab that cash"}).StatusCode)
+		assert.Equal(t, http.StatusOK, do(http.MethodGet, link.URL, "", map[string]string{SHARE_PASSWORD_HEADER: "share it fairly"}).StatusCode)
+		assert.Equal(t, http.StatusOK, do(http.MethodGet, link.URL+"?password=share+it+fairly", "", nil).StatusCode)
+	})
+
+	t.Run("max downloads", func(t *testing.T) {
+		link := mint("pink-floyd/time.txt", map[string]string{"x-max-downloads": "1"})
+		assert.Equal(t, http.StatusOK, do(http.MethodGet, link.URL, "", nil).StatusCode)
+		assert.Equal(t, http.StatusGone, do(http.MethodGet, link.URL, "", nil).StatusCode)
+	})
+
+	t.Run("revoke", func(t *testing.T) {
+		link := mint("pink-floyd/time.txt", nil)
+		assert.Equal(t, http.StatusUnauthorized, do(http.MethodDelete, link.URL, "", nil).StatusCode)
+		assert.Equal(t, http.StatusForbidden, do(http.MethodDelete, link.URL, queenToken, nil).StatusCode)
+		// readers can share files but not revoke links
+		assert.Equal(t, http.StatusForbidden, do(http.MethodDelete, link.URL, floydToken, nil).StatusCode)
+		assert.Equal(t, http.StatusOK, do(http.MethodDelete, link.URL, floydEditorToken, nil).StatusCode)
+		assert.Equal(t, http.StatusGone, do(http.MethodGet, link.URL, "", nil).StatusCode)
+	})
+}
+
+func TestDropBox(t *testing.T) {
+	base := t.TempDir()
+	if err := mkDirs(base, []string{"logs", "artifacts", "songs"}); err != nil {
+		panic(err)
+	}
+	if err := mkFiles(base, []fileInfo{{Path: "logs/boot.log", Data: []byte("kernel panic")}}); err != nil {
+		panic(err)
+	}
+
+	logger, err := log.NewLogger()
+	if err != nil {
+		panic(err)
+	}
+	tokens, err := auth.OpenTokenStore(path.Join(base, "tokens.json"))
+	if err != nil {
+		panic(err)
+	}
+	_, adminToken, err := tokens.Create("admin", 0, adminGrants)
+	if err != nil {
+		panic(err)
+	}
+	shares, err := auth.OpenShareStore(path.Join(base, "share.key"), path.Join(base, "shares.json"))
+	if err != nil {
+		panic(err)
+	}
+
+	srv := NewServer("", map[string]config.EndpointConfig{
+		"logs":      {Path: path.Join(base, "logs"), Mode: config.ModeDropBox, DropBox: config.DropBoxConfig{Anonymous: true, MaxFileSize: 16}},
+		"artifacts": {Path: path.Join(base, "artifacts"), Mode: config.ModeDropBox, DropBox: config.DropBoxConfig{MaxFileSize: -1}},
+		"songs":     {Path: path.Join(base, "songs")},
+	}, logger)
+	srv.Tokens = tokens
+	srv.Shares = shares
+	handler := srv.Handler()
+
+	do := func(method string, target string, body string, header map[string]string) *http.Response {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		for key, value := range header {
+			r.Header.Set(key, value)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Result()
+	}
+
+	t.Run("anonymous upload", func(t *testing.T) {
+		res := do(http.MethodPut, "/files/new", "kernel panic 2", map[string]string{"x-file-path": "logs/boot.log"})
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		resData := APIResponse[FileMeta]{}
+		if err := json.NewDecoder(res.Body).Decode(&resData); err != nil {
+			panic(err)
+		}
+		assert.Equal(t, "logs/boot 2.log", resData.Data.File)
+
+		data, err := os.ReadFile(path.Join(base, "logs/boot.log"))
+		if err != nil {
+			panic(err)
+		}
+		assert.Equal(t, "kernel panic", string(data))
+	})
+
+	t.Run("anonymous can only upload", func(t *testing.T) {
+		assert.Equal(t, http.StatusUnauthorized, do(http.MethodGet, "/files/logs/boot.log", "", nil).StatusCode)
+		assert.Equal(t, http.StatusUnauthorized, do(http.MethodGet, "/endpoints/logs", "", nil).StatusCode)
+		assert.Equal(t, http.StatusUnauthorized, do(http.MethodPut, "/files/new", "build", map[string]string{"x-file-path": "artifacts/build.txt"}).StatusCode)
+		assert.Equal(t, http.StatusUnauthorized, do(http.MethodPut, "/files/new", "money", map[string]string{"x-file-path": "songs/money.txt"}).StatusCode)
+	})
+
+	t.Run("uploads only set name and content", func(t *testing.T) {
+		res := do(http.MethodPut, "/files/new", "oops", map[string]string{
+			"x-file-path": "logs/crash/oops.log",
+			"x-recursive": "true",
+		})
+		assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+		_, err := os.Stat(path.Join(base, "logs/crash"))
+		assert.ErrorIs(t, err, os.ErrNotExist)
+
+		res = do(http.MethodPut, "/files/new", "oops", map[string]string{
+			"x-file-path": "logs/oops.log",
+			"x-mode":      "777",
+			"x-mtime":     "2001-09-09T01:46:40Z",
+		})
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		stat, err := os.Stat(path.Join(base, "logs/oops.log"))
+		assert.NilError(t, err)
+		assert.Equal(t, DEFAULT_FILE_MODE, stat.Mode().Perm())
+		assert.Assert(t, stat.ModTime().Year() > 2001)
+	})
+
+	t.Run("size limit", func(t *testing.T) {
+		res := do(http.MethodPut, "/files/new", "a log longer than sixteen bytes", map[string]string{"x-file-path": "logs/long.log"})
+		assert.Equal(t, http.StatusRequestEntityTooLarge, res.StatusCode)
+		_, err := os.Stat(path.Join(base, "logs/long.log"))
+		assert.ErrorIs(t, err, os.ErrNotExist)
+
+		// without Content-Length the limit is checked while streaming
+		r := httptest.NewRequest(http.MethodPut, "/files/new", io.MultiReader(strings.NewReader("a log longer than "), strings.NewReader("sixteen bytes")))
+		r.ContentLength = -1
+		r.Header.Set("x-file-path", "logs/long.log")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Result().StatusCode)
+		_, err = os.Stat(path.Join(base, "logs/long.log"))
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("upload link", func(t *testing.T) {
+		adminHeader := map[string]string{"Authorization": "Bearer " + adminToken, "x-max-uploads": "2"}
+		assert.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/endpoints/songs/upload-links", "", adminHeader).StatusCode)
+
+		res := do(http.MethodPost, "/endpoints/artifacts/upload-links", "", adminHeader)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		resData := APIResponse[UploadLinkResponse]{}
+		if err := json.NewDecoder(res.Body).Decode(&resData); err != nil {
+			panic(err)
+		}
+		link := resData.Data.Link
+
+		upload := func(filePath string) int {
+			return do(http.MethodPut, "/files/new", "build", map[string]string{"x-file-path": filePath, UPLOAD_LINK_HEADER: link}).StatusCode
+		}
+		assert.Equal(t, http.StatusNotFound, upload("songs/money.txt"))
+		// failed uploads do not use the link
+		assert.Equal(t, http.StatusBadRequest, upload("artifacts/missing/build.txt"))
+		assert.Equal(t, http.StatusOK, upload("artifacts/build.txt"))
+		assert.Equal(t, http.StatusOK, upload("artifacts/build.txt"))
+		assert.Equal(t, http.StatusGone, upload("artifacts/build.txt"))
+
+		assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/files/artifacts/build.txt", "", map[string]string{UPLOAD_LINK_HEADER: link}).StatusCode)
+		assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/share/"+link, "", nil).StatusCode)
+
+		_, err := os.Stat(path.Join(base, "artifacts/build 2.txt"))
+		assert.NilError(t, err)
+	})
+}
@@ -0,0 +1,537 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aigic8/gosyn/internal/server/log"
+	"github.com/aigic8/gosyn/internal/server/utils"
+	"github.com/gorilla/mux"
+)
+
+const (
+	SNAPSHOTS_DIR        = "snapshots"
+	SNAPSHOT_TREE_DIR    = "tree"
+	SNAPSHOT_META_FILE   = "meta.json"
+	SNAPSHOT_QUERY_PARAM = "snapshot"
+)
+
+var snapshotNameRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+var errSnapshotExists = errors.New("snapshot already exists")
+
+type (
+	// Snapshot is a read-only copy of a whole endpoint at CreatedAt
+	Snapshot struct {
+		Name      string    `json:"name"`
+		CreatedAt time.Time `json:"createdAt"`
+		Files     int       `json:"files"`
+		Size      int64     `json:"size"`
+	}
+
+	SnapshotListResponse struct {
+		Snapshots []Snapshot `json:"snapshots"`
+	}
+
+	// SnapshotRestoreResponse has the files restored from the snapshot and the
+	// files which did not exist in the snapshot and were moved to the trash.
+	SnapshotRestoreResponse struct {
+		Snapshot string   `json:"snapshot"`
+		Path     string   `json:"path"`
+		Restored []string `json:"restored"`
+		Removed  []string `json:"removed"`
+	}
+)
+
+// snapshotStore keeps snapshots in the meta directory of their endpoint, as
+// 'snapshots/<name>/tree' with the snapshot info in 'snapshots/<name>/meta.json'.
+// Files of snapshots are hard links of endpoint files when possible, which is
+// safe since the server never changes files in place.
+type snapshotStore struct{}
+
+// Create makes a snapshot of the current state of an endpoint
+func (store *snapshotStore) Create(endpointPath string, name string) (Snapshot, error) {
+	snapshotsDir := utils.MetaPath(endpointPath, SNAPSHOTS_DIR)
+	if err := os.MkdirAll(snapshotsDir, 0777); err != nil {
+		return Snapshot{}, err
+	}
+
+	snapshotDir := path.Join(snapshotsDir, name)
+	if err := os.Mkdir(snapshotDir, 0777); err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return Snapshot{}, errSnapshotExists
+		}
+		return Snapshot{}, err
+	}
+
+	snapshot := Snapshot{Name: name, CreatedAt: time.Now()}
+	treeDir := path.Join(snapshotDir, SNAPSHOT_TREE_DIR)
+	err := walkFiles(endpointPath, func(filePath string, info fs.FileInfo) error {
+		dst := path.Join(treeDir, filePath)
+		if err := os.MkdirAll(path.Dir(dst), 0777); err != nil {
+			return err
+		}
+		snapshot.Files++
+		snapshot.Size += info.Size()
+		return utils.LinkOrCopy(path.Join(endpointPath, filePath), dst)
+	})
+	if err == nil {
+		// empty endpoints still have a tree
+		err = os.MkdirAll(treeDir, 0777)
+	}
+
+	var data []byte
+	if err == nil {
+		data, err = json.Marshal(snapshot)
+	}
+	// the meta file is written last, so half made snapshots are never listed
+	if err == nil {
+		err = os.WriteFile(path.Join(snapshotDir, SNAPSHOT_META_FILE), data, 0666)
+	}
+	if err != nil {
+		os.RemoveAll(snapshotDir)
+		return Snapshot{}, err
+	}
+
+	return snapshot, nil
+}
+
+// List returns snapshots of an endpoint, newest first
+func (store *snapshotStore) List(endpointPath string) ([]Snapshot, error) {
+	entries, err := os.ReadDir(utils.MetaPath(endpointPath, SNAPSHOTS_DIR))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return []Snapshot{}, nil
+		}
+		return nil, err
+	}
+
+	snapshots := make([]Snapshot, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		snapshot, found, err := store.Get(endpointPath, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].CreatedAt.After(snapshots[j].CreatedAt) })
+	return snapshots, nil
+}
+
+// Get returns a snapshot, found is false if it does not exist
+func (store *snapshotStore) Get(endpointPath string, name string) (Snapshot, bool, error) {
+	if !snapshotNameRegex.MatchString(name) {
+		return Snapshot{}, false, nil
+	}
+
+	data, err := os.ReadFile(utils.MetaPath(endpointPath, SNAPSHOTS_DIR, name, SNAPSHOT_META_FILE))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return Snapshot{}, false, nil
+		}
+		return Snapshot{}, false, err
+	}
+
+	snapshot := Snapshot{}
+	if err = json.Unmarshal(data, &snapshot); err != nil {
+		return Snapshot{}, false, err
+	}
+	snapshot.Name = name
+	return snapshot, true, nil
+}
+
+// Root returns the directory of a snapshot which mirrors the endpoint
+func (store *snapshotStore) Root(endpointPath string, name string) string {
+	return utils.MetaPath(endpointPath, SNAPSHOTS_DIR, name, SNAPSHOT_TREE_DIR)
+}
+
+func (store *snapshotStore) Remove(endpointPath string, name string) error {
+	if !snapshotNameRegex.MatchString(name) {
+		return nil
+	}
+	return os.RemoveAll(utils.MetaPath(endpointPath, SNAPSHOTS_DIR, name))
+}
+
+// walkFiles calls fn with the slash separated path of every regular file
+// inside root, meta files are skipped.
+func walkFiles(root string, fn func(filePath string, info fs.FileInfo) error) error {
+	return walkEntries(root, false, fn)
+}
+
+// walkEntries is walkFiles which also calls fn with symlinks, which are not
+// followed, if withLinks is set
+func walkEntries(root string, withLinks bool, fn func(filePath string, info fs.FileInfo) error) error {
+	return filepath.WalkDir(root, func(fullPath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if fullPath == root && entry.IsDir() {
+			return nil
+		}
+		if utils.IsMetaName(entry.Name()) {
+			if entry.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		isLink := entry.Type()&fs.ModeSymlink != 0
+		if !entry.Type().IsRegular() && !(withLinks && isLink) {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		filePath, err := filepath.Rel(root, fullPath)
+		if err != nil {
+			return err
+		}
+		return fn(filepath.ToSlash(filePath), info)
+	})
+}
+
+// snapshotRoot returns the directory files of an endpoint are read from, which
+// is the root of the snapshot in the 'snapshot' query param if it is set.
+// Errors are sent to the client and ok is false.
+func snapshotRoot(errh *log.APIERRHandler, store *snapshotStore, endpointPath string, r *http.Request) (string, bool) {
+	name := strings.TrimSpace(r.URL.Query().Get(SNAPSHOT_QUERY_PARAM))
+	if name == "" {
+		return endpointPath, true
+	}
+
+	if store == nil {
+		errh.Warn(log.ErrSnapshotNotFound(name))
+		return "", false
+	}
+	_, found, err := store.Get(endpointPath, name)
+	if err != nil {
+		errh.Err(log.ErrUnknown("err reading snapshot: " + err.Error()))
+		return "", false
+	}
+	if !found {
+		errh.Warn(log.ErrSnapshotNotFound(name))
+		return "", false
+	}
+	return store.Root(endpointPath, name), true
+}
+
+func (fHandler *fileHandler) ListSnapshots(w http.ResponseWriter, r *http.Request) {
+	errh := log.NewAPIErrHandler(fHandler.logger, r, w)
+	endpointPath, ok := fHandler.resolveEndpoint(errh, mux.Vars(r))
+	if !ok {
+		return
+	}
+
+	snapshots, err := fHandler.Snapshots.List(endpointPath)
+	if err != nil {
+		errh.Err(log.ErrUnknown("err listing snapshots: " + err.Error()))
+		return
+	}
+
+	respJson, err := wrapAPIResponse(SnapshotListResponse{Snapshots: snapshots})
+	if err != nil {
+		errh.Err(log.ErrUnknown("error marshaling json: " + err.Error()))
+		return
+	}
+	w.Write(respJson)
+}
+
+func (fHandler *fileHandler) CreateSnapshot(w http.ResponseWriter, r *http.Request) {
+	errh := log.NewAPIErrHandler(fHandler.logger, r, w)
+	vars := mux.Vars(r)
+	endpointPath, ok := fHandler.resolveEndpoint(errh, vars)
+	if !ok {
+		return
+	}
+
+	name := strings.TrimSpace(vars["snapshot"])
+	if !snapshotNameRegex.MatchString(name) {
+		errh.Warn(log.ErrBadSnapshotName(name))
+		return
+	}
+
+	snapshot, err := fHandler.Snapshots.Create(endpointPath, name)
+	if err != nil {
+		if errors.Is(err, errSnapshotExists) {
+			errh.Warn(log.ErrSnapshotExist(name))
+			return
+		}
+		errh.Err(log.ErrUnknown("err making snapshot: " + err.Error()))
+		return
+	}
+
+	respJson, err := wrapAPIResponse(snapshot)
+	if err != nil {
+		errh.Err(log.ErrUnknown("error marshaling json: " + err.Error()))
+		return
+	}
+	w.Write(respJson)
+}
+
+func (fHandler *fileHandler) DeleteSnapshot(w http.ResponseWriter, r *http.Request) {
+	errh := log.NewAPIErrHandler(fHandler.logger, r, w)
+	vars := mux.Vars(r)
+	endpointPath, ok := fHandler.resolveEndpoint(errh, vars)
+	if !ok {
+		return
+	}
+
+	name := strings.TrimSpace(vars["snapshot"])
+	_, found, err := fHandler.Snapshots.Get(endpointPath, name)
+	if err != nil {
+		errh.Err(log.ErrUnknown("err reading snapshot: " + err.Error()))
+		return
+	}
+	if !found {
+		errh.Warn(log.ErrSnapshotNotFound(name))
+		return
+	}
+
+	if err = fHandler.Snapshots.Remove(endpointPath, name); err != nil {
+		errh.Err(log.ErrUnknown("err removing snapshot: " + err.Error()))
+		return
+	}
+
+	respJson, err := wrapAPIResponse(map[string]string{})
+	if err != nil {
+		errh.Err(log.ErrUnknown("error marshaling json: " + err.Error()))
+		return
+	}
+	w.Write(respJson)
+}
+
+// RestoreSnapshot makes the directory or file in the 'path' query param (the
+// whole endpoint if not set) the same as it was in a snapshot. Changed files
+// are kept as versions and files which did not exist in the snapshot are moved
+// to the trash, so restores can be undone.
+func (fHandler *fileHandler) RestoreSnapshot(w http.ResponseWriter, r *http.Request) {
+	errh := log.NewAPIErrHandler(fHandler.logger, r, w)
+	vars := mux.Vars(r)
+	endpoint := strings.TrimSpace(vars["endpoint"])
+	endpointPath, ok := fHandler.resolveEndpoint(errh, vars)
+	if !ok || !fHandler.checkMode(errh, endpoint, changeOverwrite) {
+		return
+	}
+
+	name := strings.TrimSpace(vars["snapshot"])
+	_, found, err := fHandler.Snapshots.Get(endpointPath, name)
+	if err != nil {
+		errh.Err(log.ErrUnknown("err reading snapshot: " + err.Error()))
+		return
+	}
+	if !found {
+		errh.Warn(log.ErrSnapshotNotFound(name))
+		return
+	}
+
+	subPath := strings.TrimSpace(r.URL.Query().Get("path"))
+	isSubPath, err := utils.IsSubPath(endpointPath, path.Join(endpointPath, subPath))
+	if err != nil {
+		errh.Err(log.ErrUnknown("error checking subpath: " + err.Error()))
+		return
+	}
+	if !isSubPath {
+		errh.Warn(log.ErrOutOfEndpoint(subPath, endpoint))
+		return
+	}
+	subPath = strings.TrimPrefix(path.Clean("/"+subPath), "/")
+	if utils.HasMetaPart(subPath) {
+		errh.Warn(log.ErrReservedPath(subPath))
+		return
+	}
+
+	snapshotRoot := fHandler.Snapshots.Root(endpointPath, name)
+	if _, err = os.Stat(path.Join(snapshotRoot, subPath)); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			errh.Warn(log.ErrFileNotFound(subPath))
+			return
+		}
+		errh.Err(log.ErrUnknown("err stating file: " + err.Error()))
+		return
+	}
+
+	snapshotFiles := map[string]bool{}
+	if err = collectFiles(path.Join(snapshotRoot, subPath), subPath, snapshotFiles); err != nil {
+		errh.Err(log.ErrUnknown("err reading snapshot: " + err.Error()))
+		return
+	}
+	liveRoot, ok := fHandler.resolveSnapshotPath(errh, endpoint, subPath)
+	if !ok {
+		return
+	}
+	liveFiles := map[string]bool{}
+	if err = collectFiles(liveRoot, subPath, liveFiles); err != nil {
+		errh.Err(log.ErrUnknown("err reading endpoint: " + err.Error()))
+		return
+	}
+
+	// files are only removed where the endpoint mode allows deletes, checked
+	// before anything is restored
+	var removed []string
+	for _, filePath := range sortedKeys(liveFiles) {
+		if !snapshotFiles[filePath] {
+			removed = append(removed, filePath)
+		}
+	}
+	if len(removed) > 0 && !fHandler.checkMode(errh, endpoint, changeDelete) {
+		return
+	}
+
+	resp := SnapshotRestoreResponse{Snapshot: name, Path: subPath, Restored: []string{}, Removed: []string{}}
+	for _, filePath := range sortedKeys(snapshotFiles) {
+		fullPath, ok := fHandler.resolveSnapshotPath(errh, endpoint, filePath)
+		if !ok {
+			return
+		}
+		restored, err := fHandler.restoreSnapshotFile(endpoint, filePath, fullPath, path.Join(snapshotRoot, filePath))
+		if err != nil {
+			errh.Err(log.ErrUnknown("err restoring '" + filePath + "': " + err.Error()))
+			return
+		}
+		if restored {
+			resp.Restored = append(resp.Restored, filePath)
+		}
+	}
+
+	for _, filePath := range removed {
+		fullPath, ok := fHandler.resolveSnapshotPath(errh, endpoint, filePath)
+		if !ok {
+			return
+		}
+		unlock := fHandler.locks.Lock(fullPath)
+		err := fHandler.trashFile(endpoint, filePath, fullPath, TrashReasonDeleted)
+		unlock()
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			errh.Err(log.ErrUnknown("err removing '" + filePath + "': " + err.Error()))
+			return
+		}
+		resp.Removed = append(resp.Removed, filePath)
+	}
+
+	respJson, err := wrapAPIResponse(resp)
+	if err != nil {
+		errh.Err(log.ErrUnknown("error marshaling json: " + err.Error()))
+		return
+	}
+	w.Write(respJson)
+}
+
+// restoreSnapshotFile copies a snapshot file to its endpoint if the content
+// differs, restored is false if it was already the same. fullPath is the
+// resolved path of the file, see resolveSnapshotPath.
+func (fHandler *fileHandler) restoreSnapshotFile(endpoint string, filePath string, fullPath string, snapshotPath string) (bool, error) {
+	unlock := fHandler.locks.Lock(fullPath)
+	defer unlock()
+
+	snapshotStat, err := os.Stat(snapshotPath)
+	if err != nil {
+		return false, err
+	}
+
+	stat, err := os.Stat(fullPath)
+	if err == nil {
+		if stat.IsDir() {
+			return false, errors.New("path is a directory")
+		}
+		if stat.Size() == snapshotStat.Size() {
+			hash, err := fHandler.Digests.FileDigest(fullPath, stat)
+			if err != nil {
+				return false, err
+			}
+			snapshotHash, err := fHandler.Digests.FileDigest(snapshotPath, snapshotStat)
+			if err != nil {
+				return false, err
+			}
+			if hash == snapshotHash {
+				return false, nil
+			}
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+
+	if err = os.MkdirAll(path.Dir(fullPath), 0777); err != nil {
+		return false, err
+	}
+
+	// snapshot files are copied, since restored files can be changed in place by others
+	tmpFile, err := os.CreateTemp(path.Dir(fullPath), utils.META_DIR+"-restore-*")
+	if err != nil {
+		return false, err
+	}
+	tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+
+	if err = utils.CopyFile(snapshotPath, tmpFile.Name()); err != nil {
+		return false, err
+	}
+	if err = fHandler.saveVersion(endpoint, filePath, fullPath); err != nil {
+		return false, err
+	}
+	if err = os.Rename(tmpFile.Name(), fullPath); err != nil {
+		return false, err
+	}
+	fHandler.fileChanged(endpoint, fullPath)
+	return true, nil
+}
+
+// resolveSnapshotPath resolves a path restored from a snapshot by the
+// endpoint symlink policy. Errors are sent to the client and ok is false.
+func (fHandler *fileHandler) resolveSnapshotPath(errh *log.APIERRHandler, endpoint string, filePath string) (string, bool) {
+	fullPath, err := fHandler.resolvePath(endpoint, filePath)
+	if err != nil {
+		if errors.Is(err, utils.ErrSymlinkDenied) {
+			errh.Warn(log.ErrSymlinkDenied(filePath))
+			return "", false
+		}
+		errh.Err(log.ErrUnknown("error resolving symlinks: " + err.Error()))
+		return "", false
+	}
+	return fullPath, true
+}
+
+// collectFiles adds the endpoint path of every file inside fullPath to files,
+// fullPath itself is added if it is a file.
+func collectFiles(fullPath string, filePath string, files map[string]bool) error {
+	stat, err := os.Stat(fullPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	if !stat.IsDir() {
+		files[filePath] = true
+		return nil
+	}
+
+	return walkFiles(fullPath, func(childPath string, _ fs.FileInfo) error {
+		files[path.Join(filePath, childPath)] = true
+		return nil
+	})
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/aigic8/gosyn/internal/config"
+	"github.com/aigic8/gosyn/internal/server/log"
+	"github.com/gorilla/mux"
+	"gotest.tools/v3/assert"
+)
+
+func TestFileSnapshots(t *testing.T) {
+	base := t.TempDir()
+	endpointPath := path.Join(base, "songs")
+	if err := mkDirs(base, []string{"songs", "songs/dark"}); err != nil {
+		panic(err)
+	}
+	if err := mkFiles(endpointPath, []fileInfo{
+		{Path: "dark/time.txt", Data: []byte("Ticking away the moments")},
+		{Path: "money.txt", Data: []byte("Money, it's a gas")},
+	}); err != nil {
+		panic(err)
+	}
+
+	logger, err := log.NewLogger()
+	if err != nil {
+		panic(err)
+	}
+	fHandler := fileHandler{
+		Endpoints: map[string]string{"songs": endpointPath},
+		Configs:   map[string]config.EndpointConfig{"songs": {Path: endpointPath}},
+		Versions:  &versionStore{},
+		Trash:     &trashStore{},
+		Snapshots: &snapshotStore{},
+		logger:    logger,
+	}
+	eHandler := endpointHanlder{Endpoints: fHandler.Endpoints, Snapshots: fHandler.Snapshots, logger: logger}
+
+	createSnapshot := func(name string) int {
+		r := httptest.NewRequest(http.MethodPut, "/", nil)
+		r = mux.SetURLVars(r, map[string]string{"endpoint": "songs", "snapshot": name})
+		w := httptest.NewRecorder()
+		fHandler.CreateSnapshot(w, r)
+		return w.Result().StatusCode
+	}
+
+	getFile := func(target string) (int, string) {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		r = mux.SetURLVars(r, map[string]string{"file": strings.Split(strings.TrimPrefix(target, "/files/"), "?")[0]})
+		w := httptest.NewRecorder()
+		fHandler.Get(w, r)
+
+		res := w.Result()
+		defer res.Body.Close()
+		data, err := io.ReadAll(res.Body)
+		if err != nil {
+			panic(err)
+		}
+		return res.StatusCode, string(data)
+	}
+
+	restoreSnapshot := func(target string, name string) (int, SnapshotRestoreResponse) {
+		r := httptest.NewRequest(http.MethodPost, target, nil)
+		r = mux.SetURLVars(r, map[string]string{"endpoint": "songs", "snapshot": name})
+		w := httptest.NewRecorder()
+		fHandler.RestoreSnapshot(w, r)
+
+		res := w.Result()
+		defer res.Body.Close()
+		resData := APIResponse[SnapshotRestoreResponse]{}
+		if res.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(res.Body).Decode(&resData); err != nil {
+				panic(err)
+			}
+		}
+		return res.StatusCode, resData.Data
+	}
+
+	writeFile := func(filePath string, data string) {
+		r := httptest.NewRequest(http.MethodPut, "/", strings.NewReader(data))
+		r.Header.Set("x-file-path", "songs/"+filePath)
+		r.Header.Set("x-force", "true")
+		r.Header.Set("x-recursive", "true")
+		w := httptest.NewRecorder()
+		fHandler.AddNew(w, r)
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	}
+
+	t.Run("create", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, createSnapshot("before-us"))
+		assert.Equal(t, http.StatusConflict, createSnapshot("before-us"))
+		assert.Equal(t, http.StatusBadRequest, createSnapshot(".gosyn"))
+		assert.Equal(t, http.StatusBadRequest, createSnapshot(".."))
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r = mux.SetURLVars(r, map[string]string{"endpoint": "songs"})
+		w := httptest.NewRecorder()
+		fHandler.ListSnapshots(w, r)
+		resData := APIResponse[SnapshotListResponse]{}
+		if err := json.NewDecoder(w.Result().Body).Decode(&resData); err != nil {
+			panic(err)
+		}
+		assert.Equal(t, 1, len(resData.Data.Snapshots))
+		assert.Equal(t, "before-us", resData.Data.Snapshots[0].Name)
+		assert.Equal(t, 2, resData.Data.Snapshots[0].Files)
+	})
+
+	writeFile("money.txt", "Grab that cash with both hands")
+	writeFile("dark/us.txt", "Us and them")
+
+	t.Run("browse", func(t *testing.T) {
+		status, data := getFile("/files/songs/money.txt?snapshot=before-us")
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "Money, it's a gas", data)
+
+		status, _ = getFile("/files/songs/dark/us.txt?snapshot=before-us")
+		assert.Equal(t, http.StatusNotFound, status)
+
+		status, _ = getFile("/files/songs/money.txt?snapshot=after-us")
+		assert.Equal(t, http.StatusNotFound, status)
+
+		r := httptest.NewRequest(http.MethodGet, "/endpoints/songs?snapshot=before-us", nil)
+		r = mux.SetURLVars(r, map[string]string{"endpoint": "songs"})
+		w := httptest.NewRecorder()
+		eHandler.Get(w, r)
+		resData := APIResponse[EndpointGetResponse]{}
+		if err := json.NewDecoder(w.Result().Body).Decode(&resData); err != nil {
+			panic(err)
+		}
+		root := resData.Data.Tree["songs"]
+		assert.Equal(t, "songs", root.Name)
+		assert.Equal(t, 1, len(root.Children["dark"].Children))
+		assert.Equal(t, int64(len("Money, it's a gas")), root.Children["money.txt"].Size)
+	})
+
+	t.Run("restore subtree", func(t *testing.T) {
+		status, resp := restoreSnapshot("/?path=dark", "before-us")
+		assert.Equal(t, http.StatusOK, status)
+		assert.DeepEqual(t, []string{}, resp.Restored)
+		assert.DeepEqual(t, []string{"dark/us.txt"}, resp.Removed)
+		_, err := os.Stat(path.Join(endpointPath, "dark/us.txt"))
+		assert.Assert(t, os.IsNotExist(err))
+
+		_, data := getFile("/files/songs/money.txt")
+		assert.Equal(t, "Grab that cash with both hands", data)
+	})
+
+	t.Run("restore endpoint", func(t *testing.T) {
+		status, resp := restoreSnapshot("/", "before-us")
+		assert.Equal(t, http.StatusOK, status)
+		assert.DeepEqual(t, []string{"money.txt"}, resp.Restored)
+		assert.DeepEqual(t, []string{}, resp.Removed)
+
+		_, data := getFile("/files/songs/money.txt")
+		assert.Equal(t, "Money, it's a gas", data)
+
+		versions, err := fHandler.Versions.List(endpointPath, "money.txt")
+		if err != nil {
+			panic(err)
+		}
+		assert.Equal(t, 2, len(versions))
+	})
+
+	t.Run("restore errors", func(t *testing.T) {
+		status, _ := restoreSnapshot("/", "after-us")
+		assert.Equal(t, http.StatusNotFound, status)
+		status, _ = restoreSnapshot("/?path=../..", "before-us")
+		assert.Equal(t, http.StatusBadRequest, status)
+		status, _ = restoreSnapshot("/?path=dark/us.txt", "before-us")
+		assert.Equal(t, http.StatusNotFound, status)
+	})
+
+	t.Run("snapshots are not changed by writes", func(t *testing.T) {
+		_, data := getFile("/files/songs/dark/time.txt?snapshot=before-us")
+		assert.Equal(t, "Ticking away the moments", data)
+	})
+}
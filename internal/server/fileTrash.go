@@ -0,0 +1,449 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aigic8/gosyn/internal/config"
+	"github.com/aigic8/gosyn/internal/server/log"
+	"github.com/aigic8/gosyn/internal/server/utils"
+	"github.com/gorilla/mux"
+)
+
+const (
+	TRASH_DIR            = "trash"
+	TRASH_META_FILE      = "meta.json"
+	TRASH_CONTENT_FILE   = "content"
+	TRASH_PURGE_INTERVAL = time.Hour
+)
+
+type TrashReason string
+
+const (
+	TrashReasonDeleted     TrashReason = "deleted"
+	TrashReasonOverwritten TrashReason = "overwritten"
+)
+
+type (
+	// TrashItem is a deleted or overwritten file. File is its path inside the endpoint.
+	TrashItem struct {
+		ID        string      `json:"id"`
+		File      string      `json:"file"`
+		Hash      string      `json:"hash"`
+		Size      int64       `json:"size"`
+		LastMod   time.Time   `json:"lastModification"`
+		Reason    TrashReason `json:"reason"`
+		DeletedAt time.Time   `json:"deletedAt"`
+	}
+
+	TrashListResponse struct {
+		Items []TrashItem `json:"items"`
+	}
+)
+
+// trashStore keeps deleted files in the meta directory of their endpoint, as
+// 'trash/<id>/content' with the item info in 'trash/<id>/meta.json'.
+type trashStore struct {
+	mu sync.Mutex
+}
+
+// Put moves a file at filePath of the endpoint to the trash, fullPath is where
+// the file is with symlinks resolved. If keep is true the file is linked
+// instead, for files which are going to be replaced right after.
+func (store *trashStore) Put(endpointPath string, filePath string, fullPath string, hash string, reason TrashReason, keep bool) (TrashItem, error) {
+	stat, err := os.Stat(fullPath)
+	if err != nil {
+		return TrashItem{}, err
+	}
+
+	idBytes := make([]byte, 4)
+	if _, err = rand.Read(idBytes); err != nil {
+		return TrashItem{}, err
+	}
+	item := TrashItem{
+		ID:        fmt.Sprintf("%019d-%s", time.Now().UnixNano(), hex.EncodeToString(idBytes)),
+		File:      filePath,
+		Hash:      hash,
+		Size:      stat.Size(),
+		LastMod:   stat.ModTime(),
+		Reason:    reason,
+		DeletedAt: time.Now(),
+	}
+
+	itemDir := store.dir(endpointPath, item.ID)
+	if err = os.MkdirAll(itemDir, 0777); err != nil {
+		return TrashItem{}, err
+	}
+
+	data, err := json.Marshal(item)
+	if err != nil {
+		return TrashItem{}, err
+	}
+	if err = os.WriteFile(path.Join(itemDir, TRASH_META_FILE), data, 0666); err != nil {
+		os.RemoveAll(itemDir)
+		return TrashItem{}, err
+	}
+
+	contentPath := path.Join(itemDir, TRASH_CONTENT_FILE)
+	if keep {
+		err = utils.LinkOrCopy(fullPath, contentPath)
+	} else {
+		err = os.Rename(fullPath, contentPath)
+	}
+	if err != nil {
+		os.RemoveAll(itemDir)
+		return TrashItem{}, err
+	}
+
+	return item, nil
+}
+
+// List returns the items in the trash, newest first
+func (store *trashStore) List(endpointPath string) ([]TrashItem, error) {
+	entries, err := os.ReadDir(utils.MetaPath(endpointPath, TRASH_DIR))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return []TrashItem{}, nil
+		}
+		return nil, err
+	}
+
+	items := make([]TrashItem, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		item, found, err := store.Get(endpointPath, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			items = append(items, item)
+		}
+	}
+
+	sort.Slice(items, func(i, j int) bool { return items[i].DeletedAt.After(items[j].DeletedAt) })
+	return items, nil
+}
+
+// Get returns an item of the trash, found is false if it does not exist
+func (store *trashStore) Get(endpointPath string, id string) (TrashItem, bool, error) {
+	if !isValidTrashID(id) {
+		return TrashItem{}, false, nil
+	}
+
+	data, err := os.ReadFile(path.Join(store.dir(endpointPath, id), TRASH_META_FILE))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return TrashItem{}, false, nil
+		}
+		return TrashItem{}, false, err
+	}
+
+	item := TrashItem{}
+	if err = json.Unmarshal(data, &item); err != nil {
+		return TrashItem{}, false, err
+	}
+	item.ID = id
+	return item, true, nil
+}
+
+// ContentPath returns the path of the content of a trash item
+func (store *trashStore) ContentPath(endpointPath string, id string) string {
+	return path.Join(store.dir(endpointPath, id), TRASH_CONTENT_FILE)
+}
+
+// Remove deletes an item from the trash for good
+func (store *trashStore) Remove(endpointPath string, id string) error {
+	if !isValidTrashID(id) {
+		return nil
+	}
+	return os.RemoveAll(store.dir(endpointPath, id))
+}
+
+// Empty deletes all items of the trash for good
+func (store *trashStore) Empty(endpointPath string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return os.RemoveAll(utils.MetaPath(endpointPath, TRASH_DIR))
+}
+
+// Purge deletes items older than the max age of retention, then the oldest
+// items until the trash is not bigger than its max size.
+func (store *trashStore) Purge(endpointPath string, retention config.TrashConfig) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	items, err := store.List(endpointPath)
+	if err != nil {
+		return err
+	}
+
+	maxAge := time.Duration(retention.MaxAge)
+	var totalSize int64
+	for _, item := range items {
+		tooOld := maxAge > 0 && time.Since(item.DeletedAt) > maxAge
+		tooBig := retention.MaxSize > 0 && totalSize+item.Size > retention.MaxSize
+		if !tooOld && !tooBig {
+			totalSize += item.Size
+			continue
+		}
+		if err = store.Remove(endpointPath, item.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (store *trashStore) dir(endpointPath string, id string) string {
+	return utils.MetaPath(endpointPath, TRASH_DIR, id)
+}
+
+func isValidTrashID(id string) bool {
+	return id != "" && id != "." && id != ".." && !strings.Contains(id, "/")
+}
+
+// trashFile moves a file to the trash of its endpoint, or removes it if the
+// trash is disabled. Overwritten files are kept in place to be replaced.
+// fullPath must be resolved by the endpoint symlink policy, see resolveFile.
+func (fHandler *fileHandler) trashFile(endpoint string, filePath string, fullPath string, reason TrashReason) error {
+	defer fHandler.fileChanged(endpoint, fullPath)
+
+	retention := fHandler.Configs[endpoint].Trash
+	if fHandler.Trash == nil || retention.Disabled {
+		if reason == TrashReasonOverwritten {
+			return nil
+		}
+		return os.Remove(fullPath)
+	}
+
+	stat, err := os.Stat(fullPath)
+	if err != nil {
+		return err
+	}
+	hash, err := fHandler.Digests.FileDigest(fullPath, stat)
+	if err != nil {
+		return err
+	}
+
+	endpointPath := fHandler.Endpoints[endpoint]
+	if _, err = fHandler.Trash.Put(endpointPath, filePath, fullPath, hash, reason, reason == TrashReasonOverwritten); err != nil {
+		return err
+	}
+	return fHandler.Trash.Purge(endpointPath, retention)
+}
+
+func (fHandler *fileHandler) ListTrash(w http.ResponseWriter, r *http.Request) {
+	errh := log.NewAPIErrHandler(fHandler.logger, r, w)
+	endpointPath, ok := fHandler.resolveEndpoint(errh, mux.Vars(r))
+	if !ok {
+		return
+	}
+
+	items, err := fHandler.Trash.List(endpointPath)
+	if err != nil {
+		errh.Err(log.ErrUnknown("err listing trash: " + err.Error()))
+		return
+	}
+
+	respJson, err := wrapAPIResponse(TrashListResponse{Items: items})
+	if err != nil {
+		errh.Err(log.ErrUnknown("error marshaling json: " + err.Error()))
+		return
+	}
+	w.Write(respJson)
+}
+
+// RestoreTrash moves a trash item back to its original path. Existing files
+// are only replaced with 'x-force: true', and are kept as a version then.
+func (fHandler *fileHandler) RestoreTrash(w http.ResponseWriter, r *http.Request) {
+	errh := log.NewAPIErrHandler(fHandler.logger, r, w)
+	vars := mux.Vars(r)
+	endpoint := strings.TrimSpace(vars["endpoint"])
+	endpointPath, ok := fHandler.resolveEndpoint(errh, vars)
+	if !ok || !fHandler.checkMode(errh, endpoint, changeOverwrite) {
+		return
+	}
+
+	id := strings.TrimSpace(vars["id"])
+	if id == "" {
+		errh.Warn(log.ErrVarNotFound("id"))
+		return
+	}
+	force := strings.TrimSpace(r.Header.Get("x-force")) == "true"
+
+	item, found, err := fHandler.Trash.Get(endpointPath, id)
+	if err != nil {
+		errh.Err(log.ErrUnknown("err reading trash item: " + err.Error()))
+		return
+	}
+	if !found {
+		errh.Warn(log.ErrTrashItemNotFound(id))
+		return
+	}
+
+	rawPath := endpoint + "/" + item.File
+	_, filePath, fullPath, ok := fHandler.resolveFile(errh, rawPath)
+	if !ok {
+		return
+	}
+
+	unlock := fHandler.locks.Lock(fullPath)
+	defer unlock()
+
+	if stat, err := os.Stat(fullPath); err == nil {
+		if stat.IsDir() {
+			errh.Warn(log.ErrPathIsDir(rawPath))
+			return
+		}
+		if !force {
+			meta, err := fHandler.fileMeta(rawPath, fullPath)
+			if err != nil {
+				errh.Err(log.ErrUnknown("err getting file meta: " + err.Error()))
+				return
+			}
+			errh.Warn(log.ErrFileExist(rawPath, meta))
+			return
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		errh.Err(log.ErrUnknown("err stating file: " + err.Error()))
+		return
+	}
+
+	contentPath := fHandler.Trash.ContentPath(endpointPath, id)
+	owner := requestOwner(r)
+	writeFilePath, newDirs, release, ok := fHandler.checkRestore(errh, endpoint, filePath, fullPath, rawPath, contentPath, owner)
+	if !ok {
+		return
+	}
+	defer release()
+	undoDirs, err := makeDirs(newDirs)
+	if err != nil {
+		errh.Err(log.ErrUnknown("err making dir: " + err.Error()))
+		return
+	}
+	restored := false
+	defer func() {
+		if !restored {
+			undoDirs()
+		}
+	}()
+
+	if err = fHandler.saveVersion(endpoint, filePath, fullPath); err != nil {
+		errh.Err(log.ErrUnknown("error saving version: " + err.Error()))
+		return
+	}
+
+	if err = os.Rename(contentPath, fullPath); err != nil {
+		errh.Err(log.ErrUnknown("error restoring file: " + err.Error()))
+		return
+	}
+	restored = true
+	fHandler.fileChanged(endpoint, fullPath)
+	fHandler.setOwner(endpoint, writeFilePath, rawPath, owner)
+	release()
+	if err = fHandler.Trash.Remove(endpointPath, id); err != nil {
+		errh.Err(log.ErrUnknown("error removing trash item: " + err.Error()))
+		return
+	}
+
+	meta, err := fHandler.fileMeta(rawPath, fullPath)
+	if err != nil {
+		errh.Err(log.ErrUnknown("err getting file meta: " + err.Error()))
+		return
+	}
+
+	respJson, err := wrapAPIResponse(meta)
+	if err != nil {
+		errh.Err(log.ErrUnknown("error marshaling json: " + err.Error()))
+		return
+	}
+	w.Header().Set("ETag", utils.ETag(meta.Hash))
+	w.Write(respJson)
+}
+
+// DeleteTrash deletes a trash item for good
+func (fHandler *fileHandler) DeleteTrash(w http.ResponseWriter, r *http.Request) {
+	errh := log.NewAPIErrHandler(fHandler.logger, r, w)
+	vars := mux.Vars(r)
+	endpointPath, ok := fHandler.resolveEndpoint(errh, vars)
+	if !ok || !fHandler.checkMode(errh, strings.TrimSpace(vars["endpoint"]), changeDelete) {
+		return
+	}
+
+	id := strings.TrimSpace(vars["id"])
+	if id == "" {
+		errh.Warn(log.ErrVarNotFound("id"))
+		return
+	}
+
+	_, found, err := fHandler.Trash.Get(endpointPath, id)
+	if err != nil {
+		errh.Err(log.ErrUnknown("err reading trash item: " + err.Error()))
+		return
+	}
+	if !found {
+		errh.Warn(log.ErrTrashItemNotFound(id))
+		return
+	}
+
+	if err = fHandler.Trash.Remove(endpointPath, id); err != nil {
+		errh.Err(log.ErrUnknown("error removing trash item: " + err.Error()))
+		return
+	}
+
+	respJson, err := wrapAPIResponse(map[string]string{})
+	if err != nil {
+		errh.Err(log.ErrUnknown("error marshaling json: " + err.Error()))
+		return
+	}
+	w.Write(respJson)
+}
+
+// EmptyTrash deletes all trash items of an endpoint for good
+func (fHandler *fileHandler) EmptyTrash(w http.ResponseWriter, r *http.Request) {
+	errh := log.NewAPIErrHandler(fHandler.logger, r, w)
+	endpointPath, ok := fHandler.resolveEndpoint(errh, mux.Vars(r))
+	if !ok || !fHandler.checkMode(errh, strings.TrimSpace(mux.Vars(r)["endpoint"]), changeDelete) {
+		return
+	}
+
+	if err := fHandler.Trash.Empty(endpointPath); err != nil {
+		errh.Err(log.ErrUnknown("error emptying trash: " + err.Error()))
+		return
+	}
+
+	respJson, err := wrapAPIResponse(map[string]string{})
+	if err != nil {
+		errh.Err(log.ErrUnknown("error marshaling json: " + err.Error()))
+		return
+	}
+	w.Write(respJson)
+}
+
+// resolveEndpoint returns the path of the endpoint in route vars. Errors are
+// sent to the client and ok is false.
+func (fHandler *fileHandler) resolveEndpoint(errh *log.APIERRHandler, vars map[string]string) (string, bool) {
+	endpoint := strings.TrimSpace(vars["endpoint"])
+	if endpoint == "" {
+		errh.Warn(log.ErrVarNotFound("endpoint"))
+		return "", false
+	}
+
+	endpointPath, endpointExists := fHandler.Endpoints[endpoint]
+	if !endpointExists {
+		errh.Warn(log.ErrEndpointNotFound(endpoint))
+		return "", false
+	}
+	return endpointPath, true
+}
@@ -0,0 +1,208 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aigic8/gosyn/internal/config"
+	"github.com/aigic8/gosyn/internal/server/log"
+	"github.com/gorilla/mux"
+	"gotest.tools/v3/assert"
+)
+
+func TestFileTrash(t *testing.T) {
+	base := t.TempDir()
+	endpointPath := path.Join(base, "songs")
+	if err := mkDirs(base, []string{"songs", "songs/dark"}); err != nil {
+		panic(err)
+	}
+	if err := mkFiles(endpointPath, []fileInfo{
+		{Path: "dark/time.txt", Data: []byte("Ticking away the moments")},
+		{Path: "money.txt", Data: []byte("Money, it's a gas")},
+	}); err != nil {
+		panic(err)
+	}
+
+	logger, err := log.NewLogger()
+	if err != nil {
+		panic(err)
+	}
+	fHandler := fileHandler{
+		Endpoints: map[string]string{"songs": endpointPath},
+		Configs:   map[string]config.EndpointConfig{"songs": {Path: endpointPath, Versions: config.VersionsConfig{Disabled: true}}},
+		Trash:     &trashStore{},
+		logger:    logger,
+	}
+
+	deleteFile := func(file string) int {
+		r := httptest.NewRequest(http.MethodDelete, "/", nil)
+		r = mux.SetURLVars(r, map[string]string{"file": file})
+		w := httptest.NewRecorder()
+		fHandler.Delete(w, r)
+		return w.Result().StatusCode
+	}
+
+	listTrash := func(endpoint string) (int, []TrashItem) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r = mux.SetURLVars(r, map[string]string{"endpoint": endpoint})
+		w := httptest.NewRecorder()
+		fHandler.ListTrash(w, r)
+
+		res := w.Result()
+		defer res.Body.Close()
+		resData := APIResponse[TrashListResponse]{}
+		if res.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(res.Body).Decode(&resData); err != nil {
+				panic(err)
+			}
+		}
+		return res.StatusCode, resData.Data.Items
+	}
+
+	restoreTrash := func(id string, force bool) int {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		r = mux.SetURLVars(r, map[string]string{"endpoint": "songs", "id": id})
+		if force {
+			r.Header.Set("x-force", "true")
+		}
+		w := httptest.NewRecorder()
+		fHandler.RestoreTrash(w, r)
+		return w.Result().StatusCode
+	}
+
+	deleteTrash := func(id string) int {
+		r := httptest.NewRequest(http.MethodDelete, "/", nil)
+		r = mux.SetURLVars(r, map[string]string{"endpoint": "songs", "id": id})
+		w := httptest.NewRecorder()
+		fHandler.DeleteTrash(w, r)
+		return w.Result().StatusCode
+	}
+
+	t.Run("delete moves to trash", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, deleteFile("songs/dark/time.txt"))
+		_, err := os.Stat(path.Join(endpointPath, "dark/time.txt"))
+		assert.Assert(t, os.IsNotExist(err))
+
+		status, items := listTrash("songs")
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, 1, len(items))
+		assert.Equal(t, "dark/time.txt", items[0].File)
+		assert.Equal(t, TrashReasonDeleted, items[0].Reason)
+		assert.Equal(t, int64(len("Ticking away the moments")), items[0].Size)
+	})
+
+	t.Run("overwrite moves to trash without versions", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPut, "/", strings.NewReader("Grab that cash with both hands"))
+		r.Header.Set("x-file-path", "songs/money.txt")
+		r.Header.Set("x-force", "true")
+		w := httptest.NewRecorder()
+		fHandler.AddNew(w, r)
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+		_, items := listTrash("songs")
+		assert.Equal(t, 2, len(items))
+		assert.Equal(t, "money.txt", items[0].File)
+		assert.Equal(t, TrashReasonOverwritten, items[0].Reason)
+	})
+
+	t.Run("unknown endpoint", func(t *testing.T) {
+		status, _ := listTrash("not-songs")
+		assert.Equal(t, http.StatusNotFound, status)
+	})
+
+	t.Run("restore", func(t *testing.T) {
+		_, items := listTrash("songs")
+		timeID, moneyID := items[1].ID, items[0].ID
+
+		assert.Equal(t, http.StatusOK, restoreTrash(timeID, false))
+		data, err := os.ReadFile(path.Join(endpointPath, "dark/time.txt"))
+		if err != nil {
+			panic(err)
+		}
+		assert.Equal(t, "Ticking away the moments", string(data))
+		assert.Equal(t, http.StatusNotFound, restoreTrash(timeID, false))
+
+		assert.Equal(t, http.StatusConflict, restoreTrash(moneyID, false))
+		assert.Equal(t, http.StatusOK, restoreTrash(moneyID, true))
+		data, err = os.ReadFile(path.Join(endpointPath, "money.txt"))
+		if err != nil {
+			panic(err)
+		}
+		assert.Equal(t, "Money, it's a gas", string(data))
+
+		// the replaced file goes to the trash, since versions are disabled
+		_, items = listTrash("songs")
+		assert.Equal(t, 1, len(items))
+		assert.Equal(t, "money.txt", items[0].File)
+	})
+
+	t.Run("delete item", func(t *testing.T) {
+		_, items := listTrash("songs")
+		assert.Equal(t, http.StatusOK, deleteTrash(items[0].ID))
+		assert.Equal(t, http.StatusNotFound, deleteTrash(items[0].ID))
+		assert.Equal(t, http.StatusNotFound, deleteTrash(".."))
+
+		_, items = listTrash("songs")
+		assert.Equal(t, 0, len(items))
+	})
+
+	t.Run("delete through symlink trashes the target", func(t *testing.T) {
+		if err := os.Symlink("dark/time.txt", path.Join(endpointPath, "time-link.txt")); err != nil {
+			panic(err)
+		}
+
+		assert.Equal(t, http.StatusOK, deleteFile("songs/time-link.txt"))
+		_, err := os.Stat(path.Join(endpointPath, "dark/time.txt"))
+		assert.Assert(t, os.IsNotExist(err))
+		stat, err := os.Lstat(path.Join(endpointPath, "time-link.txt"))
+		assert.NilError(t, err)
+		assert.Assert(t, stat.Mode()&os.ModeSymlink != 0)
+
+		_, items := listTrash("songs")
+		assert.Equal(t, 1, len(items))
+		assert.Equal(t, "time-link.txt", items[0].File)
+		assert.Equal(t, int64(len("Ticking away the moments")), items[0].Size)
+	})
+}
+
+func TestTrashStorePurge(t *testing.T) {
+	endpointPath := t.TempDir()
+	store := &trashStore{}
+
+	for _, file := range []fileInfo{
+		{Path: "a.txt", Data: []byte("1234")},
+		{Path: "b.txt", Data: []byte("12345678")},
+		{Path: "c.txt", Data: []byte("12")},
+	} {
+		if err := mkFiles(endpointPath, []fileInfo{file}); err != nil {
+			panic(err)
+		}
+		if _, err := store.Put(endpointPath, file.Path, path.Join(endpointPath, file.Path), "", TrashReasonDeleted, false); err != nil {
+			panic(err)
+		}
+	}
+
+	err := store.Purge(endpointPath, config.TrashConfig{MaxSize: 10})
+	assert.NilError(t, err)
+	items, err := store.List(endpointPath)
+	if err != nil {
+		panic(err)
+	}
+	assert.Equal(t, 2, len(items))
+	assert.Equal(t, "c.txt", items[0].File)
+	assert.Equal(t, "b.txt", items[1].File)
+
+	err = store.Purge(endpointPath, config.TrashConfig{MaxAge: config.Duration(time.Nanosecond)})
+	assert.NilError(t, err)
+	items, err = store.List(endpointPath)
+	if err != nil {
+		panic(err)
+	}
+	assert.Equal(t, 0, len(items))
+}
@@ -0,0 +1,250 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"syscall"
+
+	"github.com/aigic8/gosyn/internal/config"
+	"github.com/aigic8/gosyn/internal/server/log"
+	"github.com/aigic8/gosyn/internal/server/utils"
+)
+
+// SNIFF_SIZE is how many bytes of uploads are read to detect their type
+const SNIFF_SIZE = 512
+
+// uploadMaxSize returns the max size of files uploaded to an endpoint, or -1
+// if there is no limit. Drop boxes use the smaller of their limits.
+func uploadMaxSize(endpointConfig config.EndpointConfig) int64 {
+	maxSize := int64(-1)
+	if endpointConfig.Uploads.MaxFileSize > 0 {
+		maxSize = endpointConfig.Uploads.MaxFileSize
+	}
+	if dropBoxMax := endpointConfig.DropBox.MaxFileSize; endpointConfig.Mode == config.ModeDropBox && dropBoxMax >= 0 {
+		if maxSize < 0 || dropBoxMax < maxSize {
+			maxSize = dropBoxMax
+		}
+	}
+	return maxSize
+}
+
+// extensionAllowed reports whether files with the extension of filePath can
+// be uploaded
+func extensionAllowed(uploads config.UploadsConfig, filePath string) bool {
+	extension := strings.ToLower(path.Ext(filePath))
+	if slices.Contains(uploads.DeniedExtensions, extension) {
+		return false
+	}
+	return len(uploads.AllowedExtensions) == 0 || slices.Contains(uploads.AllowedExtensions, extension)
+}
+
+// sniffType detects the MIME type of an upload from its first bytes. The
+// returned reader reads the whole body, including the sniffed bytes.
+func sniffType(body io.Reader) (string, io.Reader, error) {
+	buffered := bufio.NewReaderSize(body, SNIFF_SIZE)
+	head, err := buffered.Peek(SNIFF_SIZE)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", nil, err
+	}
+
+	mediaType, _, err := mime.ParseMediaType(http.DetectContentType(head))
+	if err != nil {
+		return "", nil, err
+	}
+	return mediaType, buffered, nil
+}
+
+// typeAllowed reports whether files of a MIME type can be uploaded
+func typeAllowed(uploads config.UploadsConfig, mediaType string) bool {
+	if matchesType(uploads.DeniedTypes, mediaType) {
+		return false
+	}
+	return len(uploads.AllowedTypes) == 0 || matchesType(uploads.AllowedTypes, mediaType)
+}
+
+// matchesType reports whether a MIME type matches any of the patterns, like
+// "image/png" or "image/*".
+func matchesType(patterns []string, mediaType string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+			if strings.HasPrefix(mediaType, prefix+"/") {
+				return true
+			}
+		} else if pattern == mediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// dirFilesCount counts entries of a directory, meta files are not counted
+func dirFilesCount(dirPath string) (int, error) {
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, entry := range entries {
+		if !utils.IsMetaName(entry.Name()) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// checkFileRules checks srcPath, an existing file which is moved or restored
+// to filePath of an endpoint, against the upload rules of the endpoint like
+// an upload of its content. Errors are sent to the client.
+func (fHandler *fileHandler) checkFileRules(errh *log.APIERRHandler, endpoint string, filePath string, rawPath string, srcPath string) bool {
+	endpointConfig := fHandler.Configs[endpoint]
+	uploads := endpointConfig.Uploads
+	if !extensionAllowed(uploads, filePath) {
+		errh.Warn(log.ErrFileTypeNotAllowed(rawPath, path.Ext(filePath)))
+		return false
+	}
+
+	stat, err := os.Stat(srcPath)
+	if err != nil {
+		errh.Err(log.ErrUnknown("err stating file: " + err.Error()))
+		return false
+	}
+	if maxSize := uploadMaxSize(endpointConfig); maxSize >= 0 && stat.Size() > maxSize {
+		errh.Warn(log.ErrFileTooLarge(rawPath, maxSize))
+		return false
+	}
+
+	if len(uploads.AllowedTypes) == 0 && len(uploads.DeniedTypes) == 0 {
+		return true
+	}
+	file, err := os.Open(srcPath)
+	if err != nil {
+		errh.Err(log.ErrUnknown("err opening file: " + err.Error()))
+		return false
+	}
+	defer file.Close()
+	fileType, _, err := sniffType(file)
+	if err != nil {
+		errh.Err(log.ErrUnknown("err reading file type: " + err.Error()))
+		return false
+	}
+	if !typeAllowed(uploads, fileType) {
+		errh.Warn(log.ErrFileTypeNotAllowed(rawPath, fileType))
+		return false
+	}
+	return true
+}
+
+// checkNewEntry checks that a new file can be made at fullPath. Its directory
+// must exist, or recursive must be set to make it with its missing parents,
+// and the directory which gets a new entry must have room under the
+// MaxDirFiles upload rule. Made directories are new entries of their parent,
+// so the parent of the first missing directory is counted. Missing directories
+// are returned parents first, to be made by makeDirs once every other check
+// is done. Errors are sent to the client.
+func (fHandler *fileHandler) checkNewEntry(errh *log.APIERRHandler, endpoint string, fullPath string, rawPath string, recursive bool) ([]string, bool) {
+	var missing []string
+	dir, rawDir := path.Dir(fullPath), path.Dir(path.Clean(rawPath))
+	for {
+		stat, err := os.Stat(dir)
+		if err == nil {
+			if !stat.IsDir() {
+				errh.Warn(log.ErrPathIsNotDir(dir))
+				return nil, false
+			}
+			break
+		}
+		if errors.Is(err, syscall.ENOTDIR) {
+			errh.Warn(log.ErrPathIsNotDir(dir))
+			return nil, false
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			errh.Err(log.ErrUnknown("err getting dir stat: " + err.Error()))
+			return nil, false
+		}
+		if !recursive {
+			errh.Warn(log.ErrDirNotExist(dir))
+			return nil, false
+		}
+		missing = append([]string{dir}, missing...)
+		dir, rawDir = path.Dir(dir), path.Dir(rawDir)
+	}
+
+	if maxFiles := fHandler.Configs[endpoint].Uploads.MaxDirFiles; maxFiles > 0 {
+		count, err := dirFilesCount(dir)
+		if err != nil {
+			errh.Err(log.ErrUnknown("err counting dir files: " + err.Error()))
+			return nil, false
+		}
+		if count >= maxFiles {
+			errh.Warn(log.ErrTooManyDirFiles(rawDir, maxFiles))
+			return nil, false
+		}
+	}
+	return missing, true
+}
+
+// makeDirs makes the missing directories returned by checkNewEntry, undo
+// removes them again if what they are made for fails
+func makeDirs(dirs []string) (undo func(), err error) {
+	made := make([]string, 0, len(dirs))
+	undo = func() {
+		for i := len(made) - 1; i >= 0; i-- {
+			os.Remove(made[i])
+		}
+	}
+	for _, dir := range dirs {
+		if err = os.Mkdir(dir, 0777); err != nil {
+			if errors.Is(err, os.ErrExist) {
+				continue
+			}
+			undo()
+			return func() {}, err
+		}
+		made = append(made, dir)
+	}
+	return undo, nil
+}
+
+// checkRestore checks that srcPath, the content of a trash item or version,
+// can be restored to filePath of an endpoint by owner like an upload of it.
+// Missing directories of a new file are returned to be made by makeDirs, and
+// the size of the content is reserved at writeFilePath, the endpoint path the
+// file is written at, until release is called. Errors are sent to the client.
+func (fHandler *fileHandler) checkRestore(errh *log.APIERRHandler, endpoint string, filePath string, fullPath string, rawPath string, srcPath string, owner string) (writeFilePath string, newDirs []string, release func(), ok bool) {
+	if !fHandler.checkFileRules(errh, endpoint, filePath, rawPath, srcPath) {
+		return "", nil, nil, false
+	}
+
+	if _, err := os.Stat(fullPath); err != nil {
+		if !errors.Is(err, os.ErrNotExist) && !errors.Is(err, syscall.ENOTDIR) {
+			errh.Err(log.ErrUnknown("err stating file: " + err.Error()))
+			return "", nil, nil, false
+		}
+		if newDirs, ok = fHandler.checkNewEntry(errh, endpoint, fullPath, rawPath, true); !ok {
+			return "", nil, nil, false
+		}
+	}
+
+	writeFilePath, err := fHandler.targetPath(endpoint, filePath, fullPath)
+	if err != nil {
+		errh.Err(log.ErrUnknown("err finding target path: " + err.Error()))
+		return "", nil, nil, false
+	}
+	srcStat, err := os.Stat(srcPath)
+	if err != nil {
+		errh.Err(log.ErrUnknown("err stating file: " + err.Error()))
+		return "", nil, nil, false
+	}
+	if release, ok = fHandler.checkSpace(errh, endpoint, writeFilePath, rawPath, owner, srcStat.Size()); !ok {
+		return "", nil, nil, false
+	}
+	return writeFilePath, newDirs, release, true
+}
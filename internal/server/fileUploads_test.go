@@ -0,0 +1,138 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/aigic8/gosyn/internal/config"
+	"github.com/aigic8/gosyn/internal/server/log"
+	"gotest.tools/v3/assert"
+)
+
+func TestUploadRules(t *testing.T) {
+	base := t.TempDir()
+	if err := mkDirs(base, []string{"songs/pink-floyd", "photos"}); err != nil {
+		panic(err)
+	}
+	if err := mkFiles(base, []fileInfo{
+		{Path: "songs/pink-floyd/time.txt", Data: []byte("Ticking away the moments")},
+		{Path: "songs/pink-floyd/money.txt", Data: []byte("Money, it's a gas")},
+		{Path: "songs/pink-floyd/echoes.txt", Data: []byte("Overhead the albatross")},
+	}); err != nil {
+		panic(err)
+	}
+
+	logger, err := log.NewLogger()
+	if err != nil {
+		panic(err)
+	}
+	srv := newOpenServer("", map[string]config.EndpointConfig{
+		"songs": {Path: path.Join(base, "songs"), Uploads: config.UploadsConfig{
+			MaxFileSize:      32,
+			MaxDirFiles:      3,
+			DeniedExtensions: []string{".exe"},
+			DeniedTypes:      []string{"image/*"},
+		}},
+		"photos": {Path: path.Join(base, "photos"), Uploads: config.UploadsConfig{
+			AllowedExtensions: []string{".png", ".txt"},
+			AllowedTypes:      []string{"image/png"},
+		}},
+	}, logger)
+	handler := srv.Handler()
+
+	pngData := "\x89PNG\r\n\x1a\n" + strings.Repeat("\x00", 16)
+	testCases := []struct {
+		Name   string
+		File   string
+		Body   io.Reader
+		Status int
+	}{
+		{Name: "allowed", File: "songs/echoes.txt", Body: strings.NewReader("Overhead the albatross"), Status: http.StatusOK},
+		{Name: "too large", File: "songs/echoes.txt", Body: strings.NewReader(strings.Repeat("ping", 10)), Status: http.StatusRequestEntityTooLarge},
+		{Name: "too large without length", File: "songs/echoes.txt", Body: io.MultiReader(strings.NewReader(strings.Repeat("ping", 10))), Status: http.StatusRequestEntityTooLarge},
+		{Name: "denied extension", File: "songs/player.EXE", Body: strings.NewReader("MZ"), Status: http.StatusUnsupportedMediaType},
+		{Name: "denied type", File: "songs/cover.txt", Body: strings.NewReader(pngData), Status: http.StatusUnsupportedMediaType},
+		{Name: "full directory", File: "songs/pink-floyd/us-and-them.txt", Body: strings.NewReader("Us, and them"), Status: http.StatusRequestEntityTooLarge},
+		{Name: "overwrite in full directory", File: "songs/pink-floyd/time.txt", Body: strings.NewReader("Ticking away"), Status: http.StatusOK},
+		{Name: "allowed type", File: "photos/moon.png", Body: strings.NewReader(pngData), Status: http.StatusOK},
+		{Name: "not allowed type", File: "photos/moon.txt", Body: strings.NewReader("dark side"), Status: http.StatusUnsupportedMediaType},
+		{Name: "not allowed extension", File: "photos/moon.jpg", Body: strings.NewReader(pngData), Status: http.StatusUnsupportedMediaType},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPut, "/files/new", tc.Body)
+			r.Header.Set("x-file-path", tc.File)
+			r.Header.Set("x-force", "true")
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			assert.Equal(t, tc.Status, w.Result().StatusCode)
+		})
+	}
+
+	t.Run("moves are checked like uploads", func(t *testing.T) {
+		move := func(file string, dest string) int {
+			r := httptest.NewRequest(http.MethodPost, "/files/"+file+"/move", nil)
+			r.Header.Set("x-destination", dest)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			return w.Result().StatusCode
+		}
+		assert.Equal(t, http.StatusUnsupportedMediaType, move("songs/echoes.txt", "songs/echoes.exe"))
+		assert.Equal(t, http.StatusRequestEntityTooLarge, move("songs/echoes.txt", "songs/pink-floyd/echoes-live.txt"))
+		// files put in the endpoint outside the server are checked when moved
+		if err := mkFiles(base, []fileInfo{{Path: "songs/cover.txt", Data: []byte(pngData)}}); err != nil {
+			panic(err)
+		}
+		assert.Equal(t, http.StatusUnsupportedMediaType, move("songs/cover.txt", "songs/cover-art.txt"))
+		if err := os.Remove(path.Join(base, "songs/cover.txt")); err != nil {
+			panic(err)
+		}
+		assert.Equal(t, http.StatusOK, move("songs/echoes.txt", "songs/echoes-live.txt"))
+	})
+
+	t.Run("recursive uploads", func(t *testing.T) {
+		upload := func(file string, body io.Reader) int {
+			r := httptest.NewRequest(http.MethodPut, "/files/new", body)
+			r.Header.Set("x-file-path", file)
+			r.Header.Set("x-recursive", "true")
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			return w.Result().StatusCode
+		}
+		assertNoDir := func(dir string) {
+			_, err := os.Stat(path.Join(base, dir))
+			assert.Assert(t, os.IsNotExist(err))
+		}
+
+		// rejected uploads do not leave directories behind
+		assert.Equal(t, http.StatusUnsupportedMediaType, upload("songs/dark/side/cover.txt", strings.NewReader(pngData)))
+		assertNoDir("songs/dark")
+		assert.Equal(t, http.StatusRequestEntityTooLarge, upload("songs/dark/side/time.txt", io.MultiReader(strings.NewReader(strings.Repeat("ping", 10)))))
+		assertNoDir("songs/dark")
+
+		// new directories are new entries of their parent
+		assert.Equal(t, http.StatusOK, upload("songs/dark/side/time.txt", strings.NewReader("Ticking away")))
+		assert.Equal(t, http.StatusRequestEntityTooLarge, upload("songs/wall/time.txt", strings.NewReader("Ticking away")))
+		assertNoDir("songs/wall")
+	})
+
+	t.Run("structured errors", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPut, "/files/new", strings.NewReader(strings.Repeat("ping", 10)))
+		r.Header.Set("x-file-path", "songs/echoes.txt")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		var resp log.HTTPErrResponse
+		if err := json.NewDecoder(w.Result().Body).Decode(&resp); err != nil {
+			panic(err)
+		}
+		assert.DeepEqual(t, map[string]any{"maxFileSize": 32.0}, resp.Data)
+	})
+}
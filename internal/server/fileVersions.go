@@ -0,0 +1,398 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aigic8/gosyn/internal/config"
+	"github.com/aigic8/gosyn/internal/server/log"
+	"github.com/aigic8/gosyn/internal/server/utils"
+	"github.com/gorilla/mux"
+)
+
+const (
+	VERSIONS_DIR            = "versions"
+	VERSIONS_PURGE_INTERVAL = time.Hour
+)
+
+type (
+	// FileVersion is a replaced version of a file. VersionedAt is when it was replaced.
+	FileVersion struct {
+		ID          string    `json:"id"`
+		Hash        string    `json:"hash"`
+		Size        int64     `json:"size"`
+		LastMod     time.Time `json:"lastModification"`
+		VersionedAt time.Time `json:"versionedAt"`
+	}
+
+	FileVersionsResponse struct {
+		File     string        `json:"file"`
+		Versions []FileVersion `json:"versions"`
+	}
+)
+
+// versionStore keeps replaced versions of files in the meta directory of their
+// endpoint, as 'versions/<file path>/<unix nano>-<hash>'. Versions are hard
+// links of replaced files when possible, so keeping them is cheap.
+type versionStore struct{}
+
+// Save keeps the current content of a file as a version and prunes old
+// versions. fullPath is the resolved path of the file, so the content of
+// symlink targets is kept. It should be called right before the file is
+// replaced.
+func (store *versionStore) Save(endpointPath string, filePath string, fullPath string, hash string, retention config.VersionsConfig) error {
+	if retention.Disabled {
+		return nil
+	}
+
+	versionsDir := store.dir(endpointPath, filePath)
+	if err := os.MkdirAll(versionsDir, 0777); err != nil {
+		return err
+	}
+
+	id := fmt.Sprintf("%019d-%s", time.Now().UnixNano(), hash)
+	if err := utils.LinkOrCopy(fullPath, path.Join(versionsDir, id)); err != nil {
+		return err
+	}
+
+	return store.prune(endpointPath, filePath, retention)
+}
+
+// List returns versions of a file, newest first
+func (store *versionStore) List(endpointPath string, filePath string) ([]FileVersion, error) {
+	entries, err := os.ReadDir(store.dir(endpointPath, filePath))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return []FileVersion{}, nil
+		}
+		return nil, err
+	}
+
+	versions := make([]FileVersion, 0, len(entries))
+	for _, entry := range entries {
+		// versions of files inside a directory with the same name as this file are directories
+		if entry.IsDir() {
+			continue
+		}
+
+		version, ok := parseVersionID(entry.Name())
+		if !ok {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		version.Size, version.LastMod = info.Size(), info.ModTime()
+		versions = append(versions, version)
+	}
+
+	sort.Slice(versions, func(i, j int) bool { return versions[i].VersionedAt.After(versions[j].VersionedAt) })
+	return versions, nil
+}
+
+// Path returns the path of a version, found is false if it does not exist
+func (store *versionStore) Path(endpointPath string, filePath string, id string) (string, bool, error) {
+	if _, ok := parseVersionID(id); !ok {
+		return "", false, nil
+	}
+
+	versionPath := path.Join(store.dir(endpointPath, filePath), id)
+	stat, err := os.Stat(versionPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	if stat.IsDir() {
+		return "", false, nil
+	}
+	return versionPath, true, nil
+}
+
+// Purge prunes versions of every file of an endpoint, since versions only age
+// while their file is not replaced.
+func (store *versionStore) Purge(endpointPath string, retention config.VersionsConfig) error {
+	if retention.Disabled || (retention.MaxAge <= 0 && retention.MaxCount <= 0) {
+		return nil
+	}
+
+	versionsRoot := store.dir(endpointPath, "")
+	err := filepath.WalkDir(versionsRoot, func(dirPath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !entry.IsDir() || dirPath == versionsRoot {
+			return nil
+		}
+		filePath, err := filepath.Rel(versionsRoot, dirPath)
+		if err != nil {
+			return err
+		}
+		return store.prune(endpointPath, filepath.ToSlash(filePath), retention)
+	})
+	return err
+}
+
+func (store *versionStore) prune(endpointPath string, filePath string, retention config.VersionsConfig) error {
+	versions, err := store.List(endpointPath, filePath)
+	if err != nil {
+		return err
+	}
+
+	maxAge := time.Duration(retention.MaxAge)
+	for i, version := range versions {
+		tooMany := retention.MaxCount > 0 && i >= retention.MaxCount
+		tooOld := maxAge > 0 && time.Since(version.VersionedAt) > maxAge
+		if !tooMany && !tooOld {
+			continue
+		}
+		if err = os.Remove(path.Join(store.dir(endpointPath, filePath), version.ID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (store *versionStore) dir(endpointPath string, filePath string) string {
+	return utils.MetaPath(endpointPath, VERSIONS_DIR, filePath)
+}
+
+func parseVersionID(id string) (FileVersion, bool) {
+	rawTime, hash, found := strings.Cut(id, "-")
+	if !found || hash == "" || strings.Contains(id, "/") {
+		return FileVersion{}, false
+	}
+
+	unixNano, err := strconv.ParseInt(rawTime, 10, 64)
+	if err != nil {
+		return FileVersion{}, false
+	}
+	return FileVersion{ID: id, Hash: hash, VersionedAt: time.Unix(0, unixNano)}, true
+}
+
+// saveVersion keeps the current content of a file as a version before it is
+// replaced, or in the trash if versions of the endpoint are disabled.
+func (fHandler *fileHandler) saveVersion(endpoint string, filePath string, fullPath string) error {
+	stat, err := os.Stat(fullPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	if stat.IsDir() {
+		return nil
+	}
+
+	if fHandler.Configs[endpoint].Versions.Disabled {
+		return fHandler.trashFile(endpoint, filePath, fullPath, TrashReasonOverwritten)
+	}
+	if fHandler.Versions == nil {
+		return nil
+	}
+
+	hash, err := fHandler.Digests.FileDigest(fullPath, stat)
+	if err != nil {
+		return err
+	}
+
+	return fHandler.Versions.Save(fHandler.Endpoints[endpoint], filePath, fullPath, hash, fHandler.Configs[endpoint].Versions)
+}
+
+func (fHandler *fileHandler) ListVersions(w http.ResponseWriter, r *http.Request) {
+	errh := log.NewAPIErrHandler(fHandler.logger, r, w)
+	vars := mux.Vars(r)
+	fileVar := strings.TrimSpace(vars["file"])
+	if fileVar == "" {
+		errh.Warn(log.ErrVarNotFound("file"))
+		return
+	}
+
+	endpoint, filePath, _, ok := fHandler.resolveFile(errh, fileVar)
+	if !ok {
+		return
+	}
+
+	endpointPath := fHandler.Endpoints[endpoint]
+	versions, err := fHandler.Versions.List(endpointPath, filePath)
+	if err != nil {
+		errh.Err(log.ErrUnknown("err listing versions: " + err.Error()))
+		return
+	}
+
+	respJson, err := wrapAPIResponse(FileVersionsResponse{File: fileVar, Versions: versions})
+	if err != nil {
+		errh.Err(log.ErrUnknown("error marshaling json: " + err.Error()))
+		return
+	}
+	w.Write(respJson)
+}
+
+func (fHandler *fileHandler) GetVersion(w http.ResponseWriter, r *http.Request) {
+	errh := log.NewAPIErrHandler(fHandler.logger, r, w)
+	vars := mux.Vars(r)
+	fileVar := strings.TrimSpace(vars["file"])
+	if fileVar == "" {
+		errh.Warn(log.ErrVarNotFound("file"))
+		return
+	}
+
+	versionID := strings.TrimSpace(vars["version"])
+	if versionID == "" {
+		errh.Warn(log.ErrVarNotFound("version"))
+		return
+	}
+
+	endpoint, filePath, _, ok := fHandler.resolveFile(errh, fileVar)
+	if !ok {
+		return
+	}
+
+	versionPath, found, err := fHandler.Versions.Path(fHandler.Endpoints[endpoint], filePath, versionID)
+	if err != nil {
+		errh.Err(log.ErrUnknown("err finding version: " + err.Error()))
+		return
+	}
+	if !found {
+		errh.Warn(log.ErrVersionNotFound(fileVar, versionID))
+		return
+	}
+
+	file, err := os.Open(versionPath)
+	if err != nil {
+		errh.Err(log.ErrUnknown("err opening file: " + err.Error()))
+		return
+	}
+	defer file.Close()
+
+	version, _ := parseVersionID(versionID)
+	w.Header().Set("ETag", utils.ETag(version.Hash))
+	io.Copy(w, file)
+}
+
+// RestoreVersion makes a version the current content of the file. The current
+// content is kept as a version too, so restores can be undone.
+func (fHandler *fileHandler) RestoreVersion(w http.ResponseWriter, r *http.Request) {
+	errh := log.NewAPIErrHandler(fHandler.logger, r, w)
+	vars := mux.Vars(r)
+	fileVar := strings.TrimSpace(vars["file"])
+	if fileVar == "" {
+		errh.Warn(log.ErrVarNotFound("file"))
+		return
+	}
+
+	versionID := strings.TrimSpace(vars["version"])
+	if versionID == "" {
+		errh.Warn(log.ErrVarNotFound("version"))
+		return
+	}
+
+	endpoint, filePath, fullPath, ok := fHandler.resolveFile(errh, fileVar)
+	if !ok || !fHandler.checkMode(errh, endpoint, changeOverwrite) {
+		return
+	}
+
+	unlock := fHandler.locks.Lock(fullPath)
+	defer unlock()
+
+	meta, matched, err := fHandler.checkPreconditions(r, fileVar, fullPath)
+	if err != nil {
+		errh.Err(log.ErrUnknown("err checking preconditions: " + err.Error()))
+		return
+	}
+	if !matched {
+		errh.Warn(log.ErrPreconditionFailed(fileVar, meta))
+		return
+	}
+
+	versionPath, found, err := fHandler.Versions.Path(fHandler.Endpoints[endpoint], filePath, versionID)
+	if err != nil {
+		errh.Err(log.ErrUnknown("err finding version: " + err.Error()))
+		return
+	}
+	if !found {
+		errh.Warn(log.ErrVersionNotFound(fileVar, versionID))
+		return
+	}
+
+	if stat, err := os.Stat(fullPath); err == nil && stat.IsDir() {
+		errh.Warn(log.ErrPathIsDir(fileVar))
+		return
+	}
+
+	owner := requestOwner(r)
+	writeFilePath, newDirs, release, ok := fHandler.checkRestore(errh, endpoint, filePath, fullPath, fileVar, versionPath, owner)
+	if !ok {
+		return
+	}
+	defer release()
+	undoDirs, err := makeDirs(newDirs)
+	if err != nil {
+		errh.Err(log.ErrUnknown("err making dir: " + err.Error()))
+		return
+	}
+	restored := false
+	defer func() {
+		if !restored {
+			undoDirs()
+		}
+	}()
+
+	// the version is copied, since the restored file can be changed in place
+	tmpFile, err := os.CreateTemp(path.Dir(fullPath), utils.META_DIR+"-restore-*")
+	if err != nil {
+		errh.Err(log.ErrUnknown("error creating file: " + err.Error()))
+		return
+	}
+	tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+
+	if err = utils.CopyFile(versionPath, tmpFile.Name()); err != nil {
+		errh.Err(log.ErrUnknown("error copying version: " + err.Error()))
+		return
+	}
+
+	if err = fHandler.saveVersion(endpoint, filePath, fullPath); err != nil {
+		errh.Err(log.ErrUnknown("error saving version: " + err.Error()))
+		return
+	}
+
+	if err = os.Rename(tmpFile.Name(), fullPath); err != nil {
+		errh.Err(log.ErrUnknown("error renaming file: " + err.Error()))
+		return
+	}
+	restored = true
+	fHandler.fileChanged(endpoint, fullPath)
+	fHandler.setOwner(endpoint, writeFilePath, fileVar, owner)
+	release()
+
+	newMeta, err := fHandler.fileMeta(fileVar, fullPath)
+	if err != nil {
+		errh.Err(log.ErrUnknown("err getting file meta: " + err.Error()))
+		return
+	}
+
+	respJson, err := wrapAPIResponse(newMeta)
+	if err != nil {
+		errh.Err(log.ErrUnknown("error marshaling json: " + err.Error()))
+		return
+	}
+	w.Header().Set("ETag", utils.ETag(newMeta.Hash))
+	w.Write(respJson)
+}
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aigic8/gosyn/internal/config"
+	"github.com/aigic8/gosyn/internal/server/log"
+	"github.com/gorilla/mux"
+	"gotest.tools/v3/assert"
+)
+
+func TestFileVersions(t *testing.T) {
+	base := t.TempDir()
+	endpointPath := path.Join(base, "songs")
+	if err := mkDirs(base, []string{"songs"}); err != nil {
+		panic(err)
+	}
+
+	logger, err := log.NewLogger()
+	if err != nil {
+		panic(err)
+	}
+	fHandler := fileHandler{
+		Endpoints: map[string]string{"songs": endpointPath},
+		Configs:   map[string]config.EndpointConfig{"songs": {Path: endpointPath, Versions: config.VersionsConfig{MaxCount: 3}}},
+		Versions:  &versionStore{},
+		logger:    logger,
+	}
+
+	upload := func(data string) {
+		r := httptest.NewRequest(http.MethodPut, "/", strings.NewReader(data))
+		r.Header.Set("x-file-path", "songs/wall.txt")
+		r.Header.Set("x-force", "true")
+		w := httptest.NewRecorder()
+		fHandler.AddNew(w, r)
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	}
+
+	listVersions := func(file string) []FileVersion {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r = mux.SetURLVars(r, map[string]string{"file": file})
+		w := httptest.NewRecorder()
+		fHandler.ListVersions(w, r)
+
+		res := w.Result()
+		defer res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+
+		resData := APIResponse[FileVersionsResponse]{}
+		if err := json.NewDecoder(res.Body).Decode(&resData); err != nil {
+			panic(err)
+		}
+		return resData.Data.Versions
+	}
+
+	getVersion := func(file string, version string) (int, string) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r = mux.SetURLVars(r, map[string]string{"file": file, "version": version})
+		w := httptest.NewRecorder()
+		fHandler.GetVersion(w, r)
+
+		res := w.Result()
+		defer res.Body.Close()
+		data, err := io.ReadAll(res.Body)
+		if err != nil {
+			panic(err)
+		}
+		return res.StatusCode, string(data)
+	}
+
+	restoreVersion := func(file string, version string) int {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		r = mux.SetURLVars(r, map[string]string{"file": file, "version": version})
+		w := httptest.NewRecorder()
+		fHandler.RestoreVersion(w, r)
+		return w.Result().StatusCode
+	}
+
+	lyrics := []string{"We don't need no education", "We don't need no thought control", "No dark sarcasm in the classroom"}
+	for _, data := range lyrics {
+		upload(data)
+	}
+
+	t.Run("list", func(t *testing.T) {
+		versions := listVersions("songs/wall.txt")
+		assert.Equal(t, 2, len(versions))
+		assert.Assert(t, versions[0].VersionedAt.After(versions[1].VersionedAt))
+		assert.Equal(t, int64(len(lyrics[1])), versions[0].Size)
+
+		assert.Equal(t, 0, len(listVersions("songs/not-exist.txt")))
+	})
+
+	t.Run("get", func(t *testing.T) {
+		versions := listVersions("songs/wall.txt")
+		status, data := getVersion("songs/wall.txt", versions[1].ID)
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, lyrics[0], data)
+
+		status, _ = getVersion("songs/wall.txt", "1234-abcd")
+		assert.Equal(t, http.StatusNotFound, status)
+		status, _ = getVersion("songs/wall.txt", "../../wall.txt")
+		assert.Equal(t, http.StatusNotFound, status)
+	})
+
+	t.Run("restore", func(t *testing.T) {
+		versions := listVersions("songs/wall.txt")
+		assert.Equal(t, http.StatusOK, restoreVersion("songs/wall.txt", versions[1].ID))
+
+		data, err := os.ReadFile(path.Join(endpointPath, "wall.txt"))
+		if err != nil {
+			panic(err)
+		}
+		assert.Equal(t, lyrics[0], string(data))
+
+		versions = listVersions("songs/wall.txt")
+		assert.Equal(t, 3, len(versions))
+		_, data2 := getVersion("songs/wall.txt", versions[0].ID)
+		assert.Equal(t, lyrics[2], data2)
+
+		assert.Equal(t, http.StatusNotFound, restoreVersion("songs/wall.txt", "1234-abcd"))
+	})
+
+	t.Run("max count", func(t *testing.T) {
+		upload("Teachers leave them kids alone")
+		assert.Equal(t, 3, len(listVersions("songs/wall.txt")))
+	})
+
+	t.Run("overwrite through symlink keeps the target content", func(t *testing.T) {
+		if err := os.Symlink("wall.txt", path.Join(endpointPath, "wall-link.txt")); err != nil {
+			panic(err)
+		}
+		r := httptest.NewRequest(http.MethodPut, "/", strings.NewReader("Hey! Teachers!"))
+		r.Header.Set("x-file-path", "songs/wall-link.txt")
+		r.Header.Set("x-force", "true")
+		w := httptest.NewRecorder()
+		fHandler.AddNew(w, r)
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+		versions := listVersions("songs/wall-link.txt")
+		assert.Equal(t, 1, len(versions))
+		status, data := getVersion("songs/wall-link.txt", versions[0].ID)
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "Teachers leave them kids alone", data)
+	})
+}
+
+func TestVersionStorePurge(t *testing.T) {
+	endpointPath := t.TempDir()
+	if err := mkDirs(endpointPath, []string{"dark"}); err != nil {
+		panic(err)
+	}
+	store := &versionStore{}
+
+	for _, filePath := range []string{"time.txt", "dark/money.txt"} {
+		for _, data := range []string{"1", "12", "123"} {
+			if err := mkFiles(endpointPath, []fileInfo{{Path: filePath, Data: []byte(data)}}); err != nil {
+				panic(err)
+			}
+			if err := store.Save(endpointPath, filePath, path.Join(endpointPath, filePath), data, config.VersionsConfig{}); err != nil {
+				panic(err)
+			}
+		}
+	}
+
+	countVersions := func(filePath string) int {
+		versions, err := store.List(endpointPath, filePath)
+		if err != nil {
+			panic(err)
+		}
+		return len(versions)
+	}
+
+	err := store.Purge(endpointPath, config.VersionsConfig{MaxCount: 2})
+	assert.NilError(t, err)
+	assert.Equal(t, 2, countVersions("time.txt"))
+	assert.Equal(t, 2, countVersions("dark/money.txt"))
+
+	err = store.Purge(endpointPath, config.VersionsConfig{MaxAge: config.Duration(time.Nanosecond)})
+	assert.NilError(t, err)
+	assert.Equal(t, 0, countVersions("time.txt"))
+	assert.Equal(t, 0, countVersions("dark/money.txt"))
+
+	err = store.Purge(t.TempDir(), config.VersionsConfig{MaxCount: 2})
+	assert.NilError(t, err)
+}
@@ -0,0 +1,343 @@
+package server
+
+import (
+	"context"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aigic8/gosyn/internal/config"
+	"github.com/aigic8/gosyn/internal/server/log"
+)
+
+const (
+	// LIMIT_IDLE_TTL is how long limits of a client are kept after its last request
+	LIMIT_IDLE_TTL = 10 * time.Minute
+	// THROTTLE_CHUNK_SIZE is the most bytes read or written at once by throttled bodies
+	THROTTLE_CHUNK_SIZE = 32 * 1024
+)
+
+type limitScope int
+
+const (
+	scopeGlobal limitScope = iota
+	scopeIP
+	scopeToken
+)
+
+func (scope limitScope) String() string {
+	switch scope {
+	case scopeIP:
+		return "ip"
+	case scopeToken:
+		return "token"
+	default:
+		return "global"
+	}
+}
+
+// limitKey is who a limit applies to, id is the IP or the token ID
+type limitKey struct {
+	scope limitScope
+	id    string
+}
+
+type direction int
+
+const (
+	directionUpload direction = iota
+	directionDownload
+)
+
+// tokenBucket holds up to burst tokens and is refilled by rate tokens per
+// second. A bucket is full when first used.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (bucket *tokenBucket) refill(now time.Time, rate float64, burst float64) {
+	if bucket.last.IsZero() {
+		bucket.tokens = burst
+	} else {
+		bucket.tokens = min(burst, bucket.tokens+now.Sub(bucket.last).Seconds()*rate)
+	}
+	bucket.last = now
+}
+
+// wait is how long until the bucket has n tokens
+func (bucket *tokenBucket) wait(n float64, rate float64) time.Duration {
+	if bucket.tokens >= n {
+		return 0
+	}
+	return time.Duration((n - bucket.tokens) / rate * float64(time.Second))
+}
+
+type clientLimits struct {
+	requests tokenBucket
+	upload   tokenBucket
+	download tokenBucket
+	lastUsed time.Time
+}
+
+// rateLimiter keeps token buckets of request rate and bandwidth limits, see
+// config.LimitsConfig.
+type rateLimiter struct {
+	conf     config.LimitsConfig
+	now      func() time.Time
+	mu       sync.Mutex
+	clients  map[limitKey]*clientLimits
+	prunedAt time.Time
+}
+
+func newRateLimiter(conf config.LimitsConfig) *rateLimiter {
+	return &rateLimiter{conf: conf, now: time.Now, clients: map[limitKey]*clientLimits{}}
+}
+
+// hasLimits reports whether any limit is set in the config or its schedules
+func hasLimits(conf config.LimitsConfig) bool {
+	none := config.RateLimitConfig{}
+	if conf.Global != none || conf.PerToken != none || conf.PerIP != none {
+		return true
+	}
+	for _, schedule := range conf.Schedules {
+		if schedule.Global != none || schedule.PerToken != none || schedule.PerIP != none {
+			return true
+		}
+	}
+	return false
+}
+
+// limit returns the limit of a scope at now, which is of the first active
+// schedule if there is any.
+func (limiter *rateLimiter) limit(scope limitScope, now time.Time) config.RateLimitConfig {
+	global, perToken, perIP := limiter.conf.Global, limiter.conf.PerToken, limiter.conf.PerIP
+	for _, schedule := range limiter.conf.Schedules {
+		if schedule.Active(now) {
+			global, perToken, perIP = schedule.Global, schedule.PerToken, schedule.PerIP
+			break
+		}
+	}
+
+	switch scope {
+	case scopeIP:
+		return perIP
+	case scopeToken:
+		return perToken
+	default:
+		return global
+	}
+}
+
+// client returns the limits of a key, should be called with mu locked
+func (limiter *rateLimiter) client(key limitKey, now time.Time) *clientLimits {
+	if now.Sub(limiter.prunedAt) >= LIMIT_IDLE_TTL {
+		for oldKey, oldClient := range limiter.clients {
+			if now.Sub(oldClient.lastUsed) >= LIMIT_IDLE_TTL {
+				delete(limiter.clients, oldKey)
+			}
+		}
+		limiter.prunedAt = now
+	}
+
+	client, ok := limiter.clients[key]
+	if !ok {
+		client = &clientLimits{}
+		limiter.clients[key] = client
+	}
+	client.lastUsed = now
+	return client
+}
+
+// allowRequest takes a request token from the buckets of all keys, or none
+// if any of them is empty. If the request is not allowed the limited key
+// and how long until it is allowed are returned.
+func (limiter *rateLimiter) allowRequest(keys []limitKey) (limitKey, time.Duration) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	now := limiter.now()
+	buckets := make([]*tokenBucket, 0, len(keys))
+	for _, key := range keys {
+		limit := limiter.limit(key.scope, now)
+		if limit.RequestsPerSecond <= 0 {
+			continue
+		}
+		burst := float64(limit.Burst)
+		if burst <= 0 {
+			burst = math.Ceil(limit.RequestsPerSecond)
+		}
+
+		bucket := &limiter.client(key, now).requests
+		bucket.refill(now, limit.RequestsPerSecond, burst)
+		if wait := bucket.wait(1, limit.RequestsPerSecond); wait > 0 {
+			return key, wait
+		}
+		buckets = append(buckets, bucket)
+	}
+
+	for _, bucket := range buckets {
+		bucket.tokens--
+	}
+	return limitKey{}, 0
+}
+
+// reserveBytes takes n bytes from the bandwidth buckets of all keys, buckets
+// can go below zero. It returns how long until all buckets are paid back.
+func (limiter *rateLimiter) reserveBytes(keys []limitKey, dir direction, n int) time.Duration {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	now := limiter.now()
+	var wait time.Duration
+	for _, key := range keys {
+		limit := limiter.limit(key.scope, now)
+		rate := float64(limit.UploadBytesPerSecond)
+		if dir == directionDownload {
+			rate = float64(limit.DownloadBytesPerSecond)
+		}
+		if rate <= 0 {
+			continue
+		}
+
+		client := limiter.client(key, now)
+		bucket := &client.upload
+		if dir == directionDownload {
+			bucket = &client.download
+		}
+		bucket.refill(now, rate, rate)
+		bucket.tokens -= float64(n)
+		wait = max(wait, bucket.wait(0, rate))
+	}
+	return wait
+}
+
+// sleep waits for d or until ctx is done
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// throttledReader is a request body read at most as fast as bandwidth limits allow
+type throttledReader struct {
+	io.ReadCloser
+	ctx     context.Context
+	limiter *rateLimiter
+	keys    []limitKey
+}
+
+func (reader *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > THROTTLE_CHUNK_SIZE {
+		p = p[:THROTTLE_CHUNK_SIZE]
+	}
+	n, err := reader.ReadCloser.Read(p)
+	if n > 0 {
+		if sleepErr := sleep(reader.ctx, reader.limiter.reserveBytes(reader.keys, directionUpload, n)); sleepErr != nil {
+			return n, sleepErr
+		}
+	}
+	return n, err
+}
+
+// throttledWriter is a response written at most as fast as bandwidth limits allow
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx     context.Context
+	limiter *rateLimiter
+	keys    []limitKey
+}
+
+func (writer *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), THROTTLE_CHUNK_SIZE)]
+		if err := sleep(writer.ctx, writer.limiter.reserveBytes(writer.keys, directionDownload, len(chunk))); err != nil {
+			return written, err
+		}
+		n, err := writer.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Unwrap lets http.ResponseController reach the original writer
+func (writer *throttledWriter) Unwrap() http.ResponseWriter {
+	return writer.ResponseWriter
+}
+
+// LimitMiddleware limits the request rate and bandwidth of clients. Limits
+// of client IPs and all clients together are applied by LimitClient before
+// authentication, limits of tokens by LimitToken after it.
+type LimitMiddleware struct {
+	limiter *rateLimiter
+	logger  *log.Logger
+}
+
+func (mid *LimitMiddleware) LimitClient(h http.Handler) http.Handler {
+	return mid.limit(h, func(r *http.Request) []limitKey {
+		return []limitKey{{scope: scopeGlobal}, {scope: scopeIP, id: clientIP(r)}}
+	})
+}
+
+func (mid *LimitMiddleware) LimitToken(h http.Handler) http.Handler {
+	return mid.limit(h, func(r *http.Request) []limitKey {
+		token, ok := RequestToken(r)
+		if !ok {
+			return nil
+		}
+		// tokens without an ID (like JWTs without 'jti') are limited by their name
+		id := token.ID
+		if id == "" {
+			id = token.Name
+		}
+		return []limitKey{{scope: scopeToken, id: id}}
+	})
+}
+
+func (mid *LimitMiddleware) limit(h http.Handler, keysOf func(r *http.Request) []limitKey) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys := keysOf(r)
+		if len(keys) == 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		if key, wait := mid.limiter.allowRequest(keys); wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			log.NewAPIErrHandler(mid.logger, r, w).Warn(log.ErrTooManyRequests(key.scope.String(), key.id))
+			return
+		}
+
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = &throttledReader{ReadCloser: r.Body, ctx: r.Context(), limiter: mid.limiter, keys: keys}
+		}
+		h.ServeHTTP(&throttledWriter{ResponseWriter: w, ctx: r.Context(), limiter: mid.limiter, keys: keys}, r)
+	})
+}
+
+// clientIP is the IP of the remote address of a request, forwarding headers
+// are not trusted. Requests over the unix socket are all of one client.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/aigic8/gosyn/internal/auth"
+	"github.com/aigic8/gosyn/internal/config"
+	"github.com/aigic8/gosyn/internal/server/log"
+	"gotest.tools/v3/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	// 2022-10-17 was a monday
+	now := time.Date(2022, 10, 17, 8, 0, 0, 0, time.Local)
+	limiter := newRateLimiter(config.LimitsConfig{
+		Global: config.RateLimitConfig{RequestsPerSecond: 10},
+		PerIP:  config.RateLimitConfig{RequestsPerSecond: 2, UploadBytesPerSecond: 1000},
+		Schedules: []config.LimitScheduleConfig{{
+			Days:  []string{"mon", "tue"},
+			From:  "09:00",
+			To:    "17:00",
+			PerIP: config.RateLimitConfig{RequestsPerSecond: 1, Burst: 3},
+		}},
+	})
+	limiter.now = func() time.Time { return now }
+
+	floyd := []limitKey{{scope: scopeGlobal}, {scope: scopeIP, id: "10.0.0.1"}}
+	syd := []limitKey{{scope: scopeGlobal}, {scope: scopeIP, id: "10.0.0.2"}}
+
+	t.Run("requests", func(t *testing.T) {
+		_, wait := limiter.allowRequest(floyd)
+		assert.Equal(t, time.Duration(0), wait)
+		_, wait = limiter.allowRequest(floyd)
+		assert.Equal(t, time.Duration(0), wait)
+
+		key, wait := limiter.allowRequest(floyd)
+		assert.Equal(t, scopeIP, key.scope)
+		assert.Equal(t, 500*time.Millisecond, wait)
+
+		// others have their own limits
+		_, wait = limiter.allowRequest(syd)
+		assert.Equal(t, time.Duration(0), wait)
+
+		now = now.Add(500 * time.Millisecond)
+		_, wait = limiter.allowRequest(floyd)
+		assert.Equal(t, time.Duration(0), wait)
+	})
+
+	t.Run("bandwidth", func(t *testing.T) {
+		assert.Equal(t, time.Duration(0), limiter.reserveBytes(floyd, directionUpload, 1000))
+		assert.Equal(t, 500*time.Millisecond, limiter.reserveBytes(floyd, directionUpload, 500))
+		// downloads are not limited
+		assert.Equal(t, time.Duration(0), limiter.reserveBytes(floyd, directionDownload, 1_000_000))
+	})
+
+	t.Run("schedules", func(t *testing.T) {
+		monday := time.Date(2022, 10, 17, 10, 0, 0, 0, time.Local)
+		assert.Equal(t, 1.0, limiter.limit(scopeIP, monday).RequestsPerSecond)
+		assert.Equal(t, 0.0, limiter.limit(scopeGlobal, monday).RequestsPerSecond, "limits not set by schedules are not limited")
+		assert.Equal(t, 2.0, limiter.limit(scopeIP, monday.Add(7*time.Hour)).RequestsPerSecond)
+		assert.Equal(t, 2.0, limiter.limit(scopeIP, monday.Add(4*24*time.Hour)).RequestsPerSecond)
+
+		night := config.LimitScheduleConfig{Days: []string{"fri"}, From: "22:00", To: "06:00"}
+		friday := time.Date(2022, 10, 21, 23, 0, 0, 0, time.Local)
+		assert.Assert(t, night.Active(friday))
+		assert.Assert(t, night.Active(friday.Add(6*time.Hour)), "nights end on the next day")
+		assert.Assert(t, !night.Active(friday.Add(8*time.Hour)))
+		assert.Assert(t, !night.Active(friday.Add(-24*time.Hour)))
+	})
+}
+
+func TestServerLimits(t *testing.T) {
+	base := t.TempDir()
+	if err := mkDirs(base, []string{"songs"}); err != nil {
+		panic(err)
+	}
+	if err := mkFiles(base, []fileInfo{{Path: "songs/echoes.txt", Data: bytes.Repeat([]byte("ping"), 24*1024)}}); err != nil {
+		panic(err)
+	}
+
+	logger, err := log.NewLogger()
+	if err != nil {
+		panic(err)
+	}
+	tokens, err := auth.OpenTokenStore(path.Join(base, "tokens.json"))
+	if err != nil {
+		panic(err)
+	}
+	_, wishToken, err := tokens.Create("wish", 0, adminGrants)
+	if err != nil {
+		panic(err)
+	}
+	_, shineToken, err := tokens.Create("shine", 0, adminGrants)
+	if err != nil {
+		panic(err)
+	}
+
+	srv := NewServer("", map[string]config.EndpointConfig{"songs": {Path: path.Join(base, "songs")}}, logger)
+	srv.Tokens = tokens
+	srv.Limits = config.LimitsConfig{
+		PerToken: config.RateLimitConfig{RequestsPerSecond: 0.5, Burst: 1, DownloadBytesPerSecond: 64 * 1024},
+	}
+	handler := srv.Handler()
+
+	get := func(token string) *http.Response {
+		r := httptest.NewRequest(http.MethodGet, "/files/songs/echoes.txt", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Result()
+	}
+
+	// the first 64 KB are the burst, the other 32 KB take half a second
+	start := time.Now()
+	res := get(wishToken)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Assert(t, time.Since(start) >= 400*time.Millisecond)
+
+	res = get(wishToken)
+	assert.Equal(t, http.StatusTooManyRequests, res.StatusCode)
+	assert.Equal(t, "2", res.Header.Get("Retry-After"))
+
+	res = get(shineToken)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"strconv"
+	"time"
+
+	"github.com/aigic8/gosyn/internal/auth"
+)
+
+const (
+	// SERVER_READ_HEADER_TIMEOUT bounds reading the request headers only, the
+	// body and response are not bounded since throttled transfers and archives
+	// can take any time.
+	SERVER_READ_HEADER_TIMEOUT = 15 * time.Second
+	SERVER_IDLE_TIMEOUT        = 2 * time.Minute
+	// SD_LISTEN_FDS_START is the first file descriptor passed by systemd
+	SD_LISTEN_FDS_START = 3
+)
+
+// UnixSocketOptions serves the API on a unix socket. Who can connect is
+// decided by the file permissions of the socket, requests over it have Grants
+// without a token if set.
+type UnixSocketOptions struct {
+	Path   string
+	Mode   os.FileMode
+	Group  string
+	Grants []auth.Grant
+}
+
+type unixSocketContextKey struct{}
+
+// tcpListeners returns the sockets passed by systemd, or a listener on the
+// server address if there is none.
+func (server *Server) tcpListeners() ([]net.Listener, error) {
+	listeners, err := activatedListeners(SD_LISTEN_FDS_START)
+	if err != nil {
+		return nil, fmt.Errorf("error using systemd sockets: %w", err)
+	}
+	if len(listeners) > 0 {
+		return listeners, nil
+	}
+
+	ln, err := net.Listen("tcp", server.address)
+	if err != nil {
+		return nil, err
+	}
+	return []net.Listener{ln}, nil
+}
+
+// activatedListeners returns the listeners passed with systemd socket
+// activation ('LISTEN_PID' and 'LISTEN_FDS' env variables, see
+// sd_listen_fds(3)). The env variables are unset, so child processes do not
+// use the sockets too.
+func activatedListeners(firstFD int) ([]net.Listener, error) {
+	rawPid, rawFds := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	if rawPid == "" || rawFds == "" {
+		return nil, nil
+	}
+	if pid, err := strconv.Atoi(rawPid); err != nil || pid != os.Getpid() {
+		// the sockets are for another process
+		return nil, nil
+	}
+	fdCount, err := strconv.Atoi(rawFds)
+	if err != nil || fdCount < 0 {
+		return nil, fmt.Errorf("bad LISTEN_FDS '%s'", rawFds)
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := make([]net.Listener, 0, fdCount)
+	for fd := firstFD; fd < firstFD+fdCount; fd++ {
+		file := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		// FileListener uses a duplicate of the file descriptor
+		ln, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			for _, opened := range listeners {
+				opened.Close()
+			}
+			return nil, fmt.Errorf("file descriptor %d: %w", fd, err)
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
+
+// listenUnix listens on a unix socket and sets its permissions. A socket left
+// behind by a previous run is removed, other files are never removed.
+func listenUnix(options *UnixSocketOptions) (net.Listener, error) {
+	if stat, err := os.Lstat(options.Path); err == nil {
+		if stat.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("'%s' exists and is not a socket", options.Path)
+		}
+		if err = os.Remove(options.Path); err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	ln, err := net.Listen("unix", options.Path)
+	if err != nil {
+		return nil, err
+	}
+	if err = setSocketPermissions(options); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+func setSocketPermissions(options *UnixSocketOptions) error {
+	if options.Group != "" {
+		group, err := user.LookupGroup(options.Group)
+		if err != nil {
+			return err
+		}
+		gid, err := strconv.Atoi(group.Gid)
+		if err != nil {
+			return fmt.Errorf("group '%s' has no numeric id", options.Group)
+		}
+		if err = os.Chown(options.Path, -1, gid); err != nil {
+			return err
+		}
+	}
+	return os.Chmod(options.Path, options.Mode)
+}
+
+// withUnixSocket marks requests of the unix socket server
+func withUnixSocket(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), unixSocketContextKey{}, true)))
+	})
+}
+
+// unixSocketToken returns the token of requests over the unix socket, ok is
+// false for other requests or if the socket has no grants.
+func unixSocketToken(r *http.Request, grants []auth.Grant) (auth.Token, bool) {
+	if len(grants) == 0 {
+		return auth.Token{}, false
+	}
+	if fromSocket, _ := r.Context().Value(unixSocketContextKey{}).(bool); !fromSocket {
+		return auth.Token{}, false
+	}
+	return auth.Token{Name: "unix socket", Grants: grants}, true
+}
+
+// httpServer makes the HTTP/1.1 and HTTP/2 server of the API. HTTP/2 is
+// negotiated with ALPN over TLS, and without TLS it is only served if H2C is
+// set, for clients which know the server speaks it (prior knowledge).
+func (server *Server) httpServer(handler http.Handler, tlsConfig *tls.Config) *http.Server {
+	srv := &http.Server{
+		Handler:           handler,
+		Addr:              server.address,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: SERVER_READ_HEADER_TIMEOUT,
+		IdleTimeout:       SERVER_IDLE_TIMEOUT,
+		Protocols:         new(http.Protocols),
+	}
+
+	srv.Protocols.SetHTTP1(true)
+	if tlsConfig != nil {
+		srv.Protocols.SetHTTP2(true)
+	} else if server.H2C {
+		srv.Protocols.SetUnencryptedHTTP2(true)
+	}
+	return srv
+}
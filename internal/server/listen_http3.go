@@ -0,0 +1,36 @@
+//go:build http3
+
+package server
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// withHTTP3 makes the HTTP/3 server of the API and returns handler which
+// advertises it, serve listens on the UDP port of the server address.
+func (server *Server) withHTTP3(handler http.Handler, tlsConfig *tls.Config) (http.Handler, func() error, error) {
+	h3 := server.http3Server(handler, tlsConfig)
+	return altSvcMiddleware(h3, handler), h3.ListenAndServe, nil
+}
+
+// http3Server makes the HTTP/3 server of the API, which listens on the UDP
+// port of the server address.
+func (server *Server) http3Server(handler http.Handler, tlsConfig *tls.Config) *http3.Server {
+	return &http3.Server{
+		Addr:      server.address,
+		Handler:   handler,
+		TLSConfig: http3.ConfigureTLSConfig(tlsConfig),
+	}
+}
+
+// altSvcMiddleware advertises the HTTP/3 server in responses of the TCP
+// server, so clients can switch to it.
+func altSvcMiddleware(h3 *http3.Server, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h3.SetQUICHeaders(w.Header())
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,79 @@
+//go:build http3
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"net/http"
+	"path"
+	"testing"
+
+	"github.com/aigic8/gosyn/internal/config"
+	"github.com/aigic8/gosyn/internal/server/log"
+	"github.com/quic-go/quic-go/http3"
+	"gotest.tools/v3/assert"
+)
+
+func TestServerHTTP3(t *testing.T) {
+	base := t.TempDir()
+	if err := mkDirs(base, []string{"songs"}); err != nil {
+		panic(err)
+	}
+	if err := mkFiles(base, []fileInfo{{Path: "songs/time.txt", Data: []byte("Ticking away the moments")}}); err != nil {
+		panic(err)
+	}
+
+	ca := makeTestCert(pkix.Name{CommonName: "gosyn ca"}, nil)
+	certFile, keyFile := path.Join(base, "cert.pem"), path.Join(base, "key.pem")
+	writeTestCert(makeTestCert(pkix.Name{CommonName: "server"}, &ca), certFile, keyFile)
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(ca.Cert)
+
+	logger, err := log.NewLogger()
+	if err != nil {
+		panic(err)
+	}
+	srv := newOpenServer("127.0.0.1:0", map[string]config.EndpointConfig{"songs": {Path: path.Join(base, "songs")}}, logger)
+	srv.TLS = &TLSOptions{CertFile: certFile, KeyFile: keyFile, HTTP3: true}
+	tlsConfig, err := srv.tlsConfig()
+	if err != nil {
+		panic(err)
+	}
+
+	udpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	defer udpConn.Close()
+	handler := srv.Handler()
+	h3 := srv.http3Server(handler, tlsConfig)
+	h3.Port = udpConn.LocalAddr().(*net.UDPAddr).Port
+	go h3.Serve(udpConn)
+	defer h3.Close()
+
+	hs := srv.httpServer(altSvcMiddleware(h3, handler), tlsConfig)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	go hs.ServeTLS(ln, "", "")
+	defer hs.Close()
+
+	h2Client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: rootCAs}, ForceAttemptHTTP2: true}}
+	res, err := h2Client.Get("https://" + ln.Addr().String() + "/files/songs/time.txt")
+	assert.NilError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Assert(t, res.Header.Get("Alt-Svc") != "")
+
+	h3Transport := &http3.Transport{TLSClientConfig: &tls.Config{RootCAs: rootCAs}}
+	defer h3Transport.Close()
+	res, err = (&http.Client{Transport: h3Transport}).Get("https://" + udpConn.LocalAddr().String() + "/files/songs/time.txt")
+	assert.NilError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, 3, res.ProtoMajor)
+}
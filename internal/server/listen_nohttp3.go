@@ -0,0 +1,17 @@
+//go:build !http3
+
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+)
+
+// ErrNoHTTP3 is returned when HTTP/3 is enabled in a build without it, QUIC
+// is only built in with the 'http3' build tag
+var ErrNoHTTP3 = errors.New("HTTP/3 is not built in, build with '-tags http3'")
+
+func (server *Server) withHTTP3(handler http.Handler, tlsConfig *tls.Config) (http.Handler, func() error, error) {
+	return nil, nil, ErrNoHTTP3
+}
@@ -0,0 +1,232 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+
+	"github.com/aigic8/gosyn/internal/auth"
+	"github.com/aigic8/gosyn/internal/config"
+	"github.com/aigic8/gosyn/internal/server/log"
+	"gotest.tools/v3/assert"
+)
+
+func TestServerProtocols(t *testing.T) {
+	base := t.TempDir()
+	if err := mkDirs(base, []string{"songs"}); err != nil {
+		panic(err)
+	}
+	if err := mkFiles(base, []fileInfo{{Path: "songs/time.txt", Data: []byte("Ticking away the moments")}}); err != nil {
+		panic(err)
+	}
+
+	ca := makeTestCert(pkix.Name{CommonName: "gosyn ca"}, nil)
+	certFile, keyFile := path.Join(base, "cert.pem"), path.Join(base, "key.pem")
+	writeTestCert(makeTestCert(pkix.Name{CommonName: "server"}, &ca), certFile, keyFile)
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(ca.Cert)
+
+	logger, err := log.NewLogger()
+	if err != nil {
+		panic(err)
+	}
+	newServer := func() *Server {
+		srv := newOpenServer("127.0.0.1:0", map[string]config.EndpointConfig{"songs": {Path: path.Join(base, "songs")}}, logger)
+		return srv
+	}
+	listen := func() net.Listener {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			panic(err)
+		}
+		return ln
+	}
+	get := func(client *http.Client, target string) (*http.Response, error) {
+		res, err := client.Get(target)
+		if err != nil {
+			return nil, err
+		}
+		res.Body.Close()
+		return res, nil
+	}
+
+	h2cTransport := &http.Transport{Protocols: new(http.Protocols)}
+	h2cTransport.Protocols.SetUnencryptedHTTP2(true)
+	h2cClient := &http.Client{Transport: h2cTransport}
+
+	t.Run("h2c", func(t *testing.T) {
+		srv := newServer()
+		srv.H2C = true
+		hs := srv.httpServer(srv.Handler(), nil)
+		ln := listen()
+		go hs.Serve(ln)
+		defer hs.Close()
+
+		res, err := get(h2cClient, "http://"+ln.Addr().String()+"/files/songs/time.txt")
+		assert.NilError(t, err)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, 2, res.ProtoMajor)
+
+		res, err = get(http.DefaultClient, "http://"+ln.Addr().String()+"/files/songs/time.txt")
+		assert.NilError(t, err)
+		assert.Equal(t, 1, res.ProtoMajor)
+	})
+
+	t.Run("no h2c by default", func(t *testing.T) {
+		srv := newServer()
+		hs := srv.httpServer(srv.Handler(), nil)
+		ln := listen()
+		go hs.Serve(ln)
+		defer hs.Close()
+
+		_, err := get(h2cClient, "http://"+ln.Addr().String()+"/files/songs/time.txt")
+		assert.Assert(t, err != nil)
+	})
+
+	t.Run("http2 over tls", func(t *testing.T) {
+		srv := newServer()
+		srv.TLS = &TLSOptions{CertFile: certFile, KeyFile: keyFile}
+		tlsConfig, err := srv.tlsConfig()
+		if err != nil {
+			panic(err)
+		}
+
+		hs := srv.httpServer(srv.Handler(), tlsConfig)
+		ln := listen()
+		go hs.ServeTLS(ln, "", "")
+		defer hs.Close()
+
+		h2Transport := &http.Transport{TLSClientConfig: &tls.Config{RootCAs: rootCAs}, ForceAttemptHTTP2: true}
+		res, err := get(&http.Client{Transport: h2Transport}, "https://"+ln.Addr().String()+"/files/songs/time.txt")
+		assert.NilError(t, err)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, 2, res.ProtoMajor)
+	})
+}
+
+func TestUnixSocket(t *testing.T) {
+	base := t.TempDir()
+	if err := mkDirs(base, []string{"songs", "photos"}); err != nil {
+		panic(err)
+	}
+	if err := mkFiles(base, []fileInfo{
+		{Path: "songs/time.txt", Data: []byte("Ticking away the moments")},
+		{Path: "photos/moon.txt", Data: []byte("dark side")},
+	}); err != nil {
+		panic(err)
+	}
+
+	logger, err := log.NewLogger()
+	if err != nil {
+		panic(err)
+	}
+	tokens, err := auth.OpenTokenStore(path.Join(base, "tokens.json"))
+	if err != nil {
+		panic(err)
+	}
+	if _, _, err = tokens.Create("admin", 0, adminGrants); err != nil {
+		panic(err)
+	}
+
+	socketPath := path.Join(base, "gosyn.sock")
+	// a socket left behind by a crashed server
+	staleLn, err := net.Listen("unix", socketPath)
+	if err != nil {
+		panic(err)
+	}
+	staleLn.(*net.UnixListener).SetUnlinkOnClose(false)
+	staleLn.Close()
+
+	srv := NewServer("127.0.0.1:0", map[string]config.EndpointConfig{
+		"songs":  {Path: path.Join(base, "songs")},
+		"photos": {Path: path.Join(base, "photos")},
+	}, logger)
+	srv.Tokens = tokens
+	srv.UnixSocket = &UnixSocketOptions{
+		Path:   socketPath,
+		Mode:   0600,
+		Grants: []auth.Grant{{Endpoint: "songs", Permissions: []auth.Permission{auth.PermRead}}},
+	}
+
+	ln, err := listenUnix(srv.UnixSocket)
+	assert.NilError(t, err)
+	stat, err := os.Stat(socketPath)
+	if err != nil {
+		panic(err)
+	}
+	assert.Equal(t, os.FileMode(0600), stat.Mode().Perm())
+
+	hs := srv.httpServer(withUnixSocket(srv.Handler()), nil)
+	go hs.Serve(ln)
+	defer hs.Close()
+
+	unixClient := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+		},
+	}}
+	get := func(client *http.Client, target string) int {
+		res, err := client.Get(target)
+		if err != nil {
+			panic(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	assert.Equal(t, http.StatusOK, get(unixClient, "http://gosyn/files/songs/time.txt"))
+	assert.Equal(t, http.StatusForbidden, get(unixClient, "http://gosyn/files/photos/moon.txt"))
+
+	// the same handler without the socket needs a token
+	tcpSrv := httptest.NewServer(srv.Handler())
+	defer tcpSrv.Close()
+	assert.Equal(t, http.StatusUnauthorized, get(http.DefaultClient, tcpSrv.URL+"/files/songs/time.txt"))
+
+	t.Run("other files are not removed", func(t *testing.T) {
+		filePath := path.Join(base, "not-a-socket")
+		if err := os.WriteFile(filePath, []byte("precious"), 0600); err != nil {
+			panic(err)
+		}
+		_, err := listenUnix(&UnixSocketOptions{Path: filePath, Mode: 0600})
+		assert.ErrorContains(t, err, "not a socket")
+	})
+}
+
+func TestActivatedListeners(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	defer ln.Close()
+	file, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	t.Run("sockets of other processes", func(t *testing.T) {
+		t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+		t.Setenv("LISTEN_FDS", "1")
+		listeners, err := activatedListeners(int(file.Fd()))
+		assert.NilError(t, err)
+		assert.Equal(t, 0, len(listeners))
+	})
+
+	t.Run("passed socket", func(t *testing.T) {
+		t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+		t.Setenv("LISTEN_FDS", "1")
+		listeners, err := activatedListeners(int(file.Fd()))
+		assert.NilError(t, err)
+		assert.Equal(t, 1, len(listeners))
+		assert.Equal(t, ln.Addr().String(), listeners[0].Addr().String())
+		assert.Equal(t, "", os.Getenv("LISTEN_FDS"))
+		listeners[0].Close()
+	})
+}
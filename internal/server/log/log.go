@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
 	"go.uber.org/zap"
 )
@@ -28,8 +30,9 @@ type (
 	}
 
 	HTTPErrResponse struct {
-		OK  bool   `json:"ok"` // always false
-		Msg string `json:"message"`
+		OK   bool   `json:"ok"` // always false
+		Msg  string `json:"message"`
+		Data any    `json:"data,omitempty"`
 	}
 )
 
@@ -38,21 +41,26 @@ func NewAPIErrHandler(l *Logger, r *http.Request, w http.ResponseWriter) *APIERR
 }
 
 func (eHandler *APIERRHandler) Err(err HTTPErr) {
-	status := err.Status()
-	eHandler.W.WriteHeader(status)
-	httpErr := HTTPErrResponse{OK: false, Msg: err.RespMsg()}
-	jsonData, _ := json.Marshal(&httpErr) // TODO can throw err?
-	eHandler.W.Write(jsonData)
+	status := eHandler.write(err)
 	eHandler.L.Logger.Errorw(err.LogMsg(), "status", status, "url", eHandler.R.URL.String())
 }
 
 func (eHandler *APIERRHandler) Warn(err HTTPErr) {
+	status := eHandler.write(err)
+	eHandler.L.Logger.Warnw(err.LogMsg(), "status", status, "url", eHandler.R.URL.String())
+}
+
+func (eHandler *APIERRHandler) write(err HTTPErr) int {
 	status := err.Status()
-	eHandler.W.WriteHeader(status)
 	httpErr := HTTPErrResponse{OK: false, Msg: err.RespMsg()}
+	if dataErr, ok := err.(HTTPErrWithData); ok {
+		httpErr.Data = dataErr.RespData()
+	}
 	jsonData, _ := json.Marshal(&httpErr) // TODO can throw err?
+	eHandler.W.Header().Set("Content-Type", "application/json")
+	eHandler.W.WriteHeader(status)
 	eHandler.W.Write(jsonData)
-	eHandler.L.Logger.Warnw(err.LogMsg(), "status", status, "url", eHandler.R.URL.String())
+	return status
 }
 
 type HTTPErr interface {
@@ -61,6 +69,22 @@ type HTTPErr interface {
 	Status() int
 }
 
+// HTTPErrWithData is an HTTPErr which sends extra data to the client,
+// like the current state of a file on conflicts.
+type HTTPErrWithData interface {
+	HTTPErr
+	RespData() any
+}
+
+type DataHTTPErr struct {
+	BasicHTTPErr
+	data any
+}
+
+func (err *DataHTTPErr) RespData() any {
+	return err.data
+}
+
 type BasicHTTPErr struct {
 	respMsg string
 	logMsg  string
@@ -134,6 +158,36 @@ func ErrPathIsDir(dirPath string) HTTPErr {
 	}
 }
 
+// ErrPathIsSymlink is sent for file operations on symlinks which are synced as links
+func ErrPathIsSymlink(filePath string) HTTPErr {
+	msg := "path '" + filePath + "' is a symlink"
+	return &BasicHTTPErr{
+		status:  http.StatusBadRequest,
+		respMsg: msg,
+		logMsg:  msg,
+	}
+}
+
+// ErrLinksNotSynced is sent for symlinks uploaded to endpoints which do not sync symlinks as links
+func ErrLinksNotSynced(endpoint string) HTTPErr {
+	msg := "endpoint '" + endpoint + "' does not sync symlinks as links"
+	return &BasicHTTPErr{
+		status:  http.StatusBadRequest,
+		respMsg: msg,
+		logMsg:  msg,
+	}
+}
+
+// ErrSymlinkDenied is sent for paths going through symlinks which the endpoint does not follow
+func ErrSymlinkDenied(filePath string) HTTPErr {
+	msg := "path '" + filePath + "' goes through a symlink which is not followed"
+	return &BasicHTTPErr{
+		status:  http.StatusForbidden,
+		respMsg: msg,
+		logMsg:  msg,
+	}
+}
+
 func ErrFileTooBigToHash(filePath string, maxHashSize int64) HTTPErr {
 	msg := fmt.Sprintf("file '%s' is larger than max hash size '%d'", filePath, maxHashSize)
 	return &BasicHTTPErr{
@@ -160,12 +214,15 @@ func ErrDirNotExist(dirPath string) HTTPErr {
 	}
 }
 
-func ErrFileExist(filePath string) HTTPErr {
+func ErrFileExist(filePath string, current any) HTTPErr {
 	msg := "a file with same path '" + filePath + "' exists"
-	return &BasicHTTPErr{
-		status:  http.StatusBadRequest,
-		respMsg: msg,
-		logMsg:  msg,
+	return &DataHTTPErr{
+		BasicHTTPErr: BasicHTTPErr{
+			status:  http.StatusConflict,
+			respMsg: msg,
+			logMsg:  msg,
+		},
+		data: current,
 	}
 }
 
@@ -178,26 +235,299 @@ func ErrOutOfEndpoint(path string, endpoint string) HTTPErr {
 	}
 }
 
-func ErrBadAuth(authHeader string) HTTPErr {
+// ErrBadAuth is a malformed Authorization header. The header itself is never
+// logged, since it can contain a valid token.
+func ErrBadAuth(reason string) HTTPErr {
 	return &BasicHTTPErr{
 		status:  http.StatusBadRequest,
-		respMsg: "authentication failed",
-		logMsg:  "auth failed, auth header: " + authHeader,
+		respMsg: "bad authorization header: " + reason,
+		logMsg:  "bad authorization header: " + reason,
 	}
 }
 
-func ErrInvalidToken(token string) HTTPErr {
+func ErrInvalidToken() HTTPErr {
 	return &BasicHTTPErr{
 		status:  http.StatusUnauthorized,
 		respMsg: "token is invalid",
-		logMsg:  "invalid token: '" + token + "'",
+		logMsg:  "invalid token",
+	}
+}
+
+func ErrExpiredToken() HTTPErr {
+	return &BasicHTTPErr{
+		status:  http.StatusUnauthorized,
+		respMsg: "token is expired",
+		logMsg:  "expired token",
 	}
 }
 
 func ErrUnauthorized() HTTPErr {
 	return &BasicHTTPErr{
 		status:  http.StatusUnauthorized,
-		respMsg: "can not access content",
-		logMsg:  "user is not authorized",
+		respMsg: "authentication is required",
+		logMsg:  "request has no credentials",
+	}
+}
+
+func ErrForbidden(tokenName string) HTTPErr {
+	return &BasicHTTPErr{
+		status:  http.StatusForbidden,
+		respMsg: "token is not allowed to do this",
+		logMsg:  "token '" + tokenName + "' is not allowed to access route",
+	}
+}
+
+func ErrPathIsNotDir(filePath string) HTTPErr {
+	msg := "path '" + filePath + "' is not a directory"
+	return &BasicHTTPErr{
+		status:  http.StatusBadRequest,
+		respMsg: msg,
+		logMsg:  msg,
+	}
+}
+
+func ErrBadArchiveFormat(format string, formats []string) HTTPErr {
+	msg := "unknown archive format '" + format + "', supported formats are " + strings.Join(formats, ", ")
+	return &BasicHTTPErr{
+		status:  http.StatusBadRequest,
+		respMsg: msg,
+		logMsg:  msg,
+	}
+}
+
+func ErrPreconditionFailed(filePath string, current any) HTTPErr {
+	msg := "file '" + filePath + "' does not match the precondition"
+	return &DataHTTPErr{
+		BasicHTTPErr: BasicHTTPErr{
+			status:  http.StatusPreconditionFailed,
+			respMsg: msg,
+			logMsg:  msg,
+		},
+		data: current,
+	}
+}
+
+func ErrMoveAcrossEndpoints(from string, to string) HTTPErr {
+	msg := fmt.Sprintf("can not move '%s' to '%s', moving between endpoints is not supported", from, to)
+	return &BasicHTTPErr{
+		status:  http.StatusBadRequest,
+		respMsg: msg,
+		logMsg:  msg,
+	}
+}
+
+func ErrIgnoredPath(filePath string) HTTPErr {
+	msg := "path '" + filePath + "' is ignored by the endpoint ignore rules"
+	return &BasicHTTPErr{
+		status:  http.StatusForbidden,
+		respMsg: msg,
+		logMsg:  msg,
+	}
+}
+
+func ErrNameNotPortable(filePath string, err error) HTTPErr {
+	msg := "path '" + filePath + "' has a name which is not portable: " + err.Error()
+	return &BasicHTTPErr{
+		status:  http.StatusBadRequest,
+		respMsg: msg,
+		logMsg:  msg,
+	}
+}
+
+func ErrNameCollision(filePath string, err error) HTTPErr {
+	msg := "path '" + filePath + "' collides with an existing path: " + err.Error()
+	return &BasicHTTPErr{
+		status:  http.StatusConflict,
+		respMsg: msg,
+		logMsg:  msg,
+	}
+}
+
+func ErrReservedPath(filePath string) HTTPErr {
+	msg := "path '" + filePath + "' is reserved"
+	return &BasicHTTPErr{
+		status:  http.StatusBadRequest,
+		respMsg: msg,
+		logMsg:  msg,
+	}
+}
+
+func ErrConflictNotFound(id string) HTTPErr {
+	msg := "conflict '" + id + "' not found"
+	return &BasicHTTPErr{
+		status:  http.StatusNotFound,
+		respMsg: msg,
+		logMsg:  msg,
+	}
+}
+
+func ErrVersionNotFound(filePath string, version string) HTTPErr {
+	msg := fmt.Sprintf("version '%s' of file '%s' not found", version, filePath)
+	return &BasicHTTPErr{
+		status:  http.StatusNotFound,
+		respMsg: msg,
+		logMsg:  msg,
+	}
+}
+
+func ErrTrashItemNotFound(id string) HTTPErr {
+	msg := "trash item '" + id + "' not found"
+	return &BasicHTTPErr{
+		status:  http.StatusNotFound,
+		respMsg: msg,
+		logMsg:  msg,
+	}
+}
+
+func ErrSnapshotNotFound(name string) HTTPErr {
+	msg := "snapshot '" + name + "' not found"
+	return &BasicHTTPErr{
+		status:  http.StatusNotFound,
+		respMsg: msg,
+		logMsg:  msg,
+	}
+}
+
+func ErrSnapshotExist(name string) HTTPErr {
+	msg := "snapshot '" + name + "' already exists"
+	return &BasicHTTPErr{
+		status:  http.StatusConflict,
+		respMsg: msg,
+		logMsg:  msg,
+	}
+}
+
+func ErrBadSnapshotName(name string) HTTPErr {
+	msg := "bad snapshot name '" + name + "', only letters, digits, '.', '_' and '-' are allowed"
+	return &BasicHTTPErr{
+		status:  http.StatusBadRequest,
+		respMsg: msg,
+		logMsg:  msg,
+	}
+}
+
+func ErrInvalidShare() HTTPErr {
+	return &BasicHTTPErr{
+		status:  http.StatusNotFound,
+		respMsg: "share link is invalid",
+		logMsg:  "invalid share link",
+	}
+}
+
+// ErrShareGone is a share link which was valid, but is expired, revoked or
+// has no downloads left.
+func ErrShareGone(id string, reason string) HTTPErr {
+	return &BasicHTTPErr{
+		status:  http.StatusGone,
+		respMsg: reason,
+		logMsg:  "share link '" + id + "': " + reason,
+	}
+}
+
+func ErrSharePassword(id string) HTTPErr {
+	return &BasicHTTPErr{
+		status:  http.StatusUnauthorized,
+		respMsg: "share link password is wrong or missing",
+		logMsg:  "wrong password for share link '" + id + "'",
+	}
+}
+
+func ErrBadShareExpiry(rawExpiry string, maxAge time.Duration) HTTPErr {
+	msg := fmt.Sprintf("bad share expiry '%s', expected a duration up to %s", rawExpiry, maxAge)
+	return &BasicHTTPErr{
+		status:  http.StatusBadRequest,
+		respMsg: msg,
+		logMsg:  msg,
+	}
+}
+
+func ErrBadHeader(headerName string, value string) HTTPErr {
+	msg := fmt.Sprintf("bad value '%s' for header '%s'", value, headerName)
+	return &BasicHTTPErr{
+		status:  http.StatusBadRequest,
+		respMsg: msg,
+		logMsg:  msg,
+	}
+}
+
+// ErrXattrsNotSupported is sent for uploads with extended attributes which can not be stored
+func ErrXattrsNotSupported(filePath string) HTTPErr {
+	msg := "extended attributes of '" + filePath + "' can not be stored by the server"
+	return &BasicHTTPErr{
+		status:  http.StatusBadRequest,
+		respMsg: msg,
+		logMsg:  msg,
+	}
+}
+
+func ErrFileTooLarge(filePath string, maxSize int64) HTTPErr {
+	msg := fmt.Sprintf("file '%s' is larger than max file size '%d'", filePath, maxSize)
+	return &DataHTTPErr{
+		BasicHTTPErr: BasicHTTPErr{
+			status:  http.StatusRequestEntityTooLarge,
+			respMsg: msg,
+			logMsg:  msg,
+		},
+		data: map[string]int64{"maxFileSize": maxSize},
+	}
+}
+
+// ErrFileTypeNotAllowed is sent for uploads with a denied extension or MIME type
+func ErrFileTypeNotAllowed(filePath string, fileType string) HTTPErr {
+	msg := fmt.Sprintf("type '%s' of file '%s' is not allowed", fileType, filePath)
+	return &DataHTTPErr{
+		BasicHTTPErr: BasicHTTPErr{
+			status:  http.StatusUnsupportedMediaType,
+			respMsg: msg,
+			logMsg:  msg,
+		},
+		data: map[string]string{"type": fileType},
+	}
+}
+
+func ErrTooManyDirFiles(dir string, maxFiles int) HTTPErr {
+	msg := fmt.Sprintf("directory '%s' has the max number of files '%d'", dir, maxFiles)
+	return &DataHTTPErr{
+		BasicHTTPErr: BasicHTTPErr{
+			status:  http.StatusRequestEntityTooLarge,
+			respMsg: msg,
+			logMsg:  msg,
+		},
+		data: map[string]int{"maxDirFiles": maxFiles},
+	}
+}
+
+func ErrNotDropBox(endpoint string) HTTPErr {
+	msg := "endpoint '" + endpoint + "' is not a drop box"
+	return &BasicHTTPErr{
+		status:  http.StatusBadRequest,
+		respMsg: msg,
+		logMsg:  msg,
+	}
+}
+
+func ErrTooManyRequests(scope string, client string) HTTPErr {
+	return &BasicHTTPErr{
+		status:  http.StatusTooManyRequests,
+		respMsg: "too many requests, " + scope + " rate limit is reached",
+		logMsg:  fmt.Sprintf("%s rate limit of '%s' is reached", scope, client),
+	}
+}
+
+func ErrQuotaExceeded(filePath string, limit string) HTTPErr {
+	msg := fmt.Sprintf("file '%s' does not fit in the %s", filePath, limit)
+	return &BasicHTTPErr{
+		status:  http.StatusInsufficientStorage,
+		respMsg: msg,
+		logMsg:  msg,
+	}
+}
+
+func ErrModeForbids(endpoint string, mode string, change string) HTTPErr {
+	msg := fmt.Sprintf("endpoint '%s' is %s, %s is not allowed", endpoint, mode, change)
+	return &BasicHTTPErr{
+		status:  http.StatusForbidden,
+		respMsg: msg,
+		logMsg:  msg,
 	}
 }
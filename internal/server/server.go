@@ -1,12 +1,16 @@
 package server
 
 import (
+	"crypto/tls"
 	"encoding/json"
+	"net"
 	"net/http"
-	"strings"
 	"time"
 
+	"github.com/aigic8/gosyn/internal/auth"
+	"github.com/aigic8/gosyn/internal/config"
 	"github.com/aigic8/gosyn/internal/server/log"
+	"github.com/aigic8/gosyn/internal/server/utils"
 	"github.com/gorilla/mux"
 )
 
@@ -15,7 +19,28 @@ const DEFAULT_MAX_HASH_SIZE int64 = 50 * 1024 * 1024 // 50 MB
 type Server struct {
 	address     string
 	endpoints   map[string]string
+	configs     map[string]config.EndpointConfig
+	digests     *utils.DigestCache
+	conflicts   *conflictStore
+	versions    *versionStore
+	trash       *trashStore
+	snapshots   *snapshotStore
+	usage       *usageStore
 	MaxHashSize int64
+	Tokens      *auth.TokenStore
+	JWT         *auth.JWTVerifier
+	// AuthDisabled serves every request without authentication. Otherwise
+	// requests are denied if no way of authentication is set.
+	AuthDisabled bool
+	Shares       *auth.ShareStore // share links are disabled if nil
+	ShareMaxAge  time.Duration
+	TLS          *TLSOptions // https is disabled if nil
+	H2C          bool        // serve cleartext HTTP/2, only without TLS
+	UnixSocket   *UnixSocketOptions
+	Limits       config.LimitsConfig
+	DiskReserve  int64        // free disk space uploads can not use
+	limiter      *rateLimiter // shared by handlers of all listeners
+	logger       *log.Logger
 }
 
 type APIResponse[T any] struct {
@@ -28,80 +53,229 @@ func wrapAPIResponse[T any](data T) ([]byte, error) {
 	return json.Marshal(&resp)
 }
 
-func NewServer(addr string, endpoints map[string]string) *Server {
+func NewServer(addr string, endpoints map[string]config.EndpointConfig, logger *log.Logger) *Server {
+	endpointPaths := make(map[string]string, len(endpoints))
+	for name, endpoint := range endpoints {
+		endpointPaths[name] = endpoint.Path
+	}
+
 	return &Server{
 		address:     addr,
 		MaxHashSize: DEFAULT_MAX_HASH_SIZE,
-		endpoints:   endpoints,
+		ShareMaxAge: time.Duration(config.DEFAULT_SHARE_MAX_AGE),
+		endpoints:   endpointPaths,
+		configs:     endpoints,
+		digests:     utils.NewDigestCache(),
+		conflicts:   &conflictStore{},
+		versions:    &versionStore{},
+		trash:       &trashStore{},
+		snapshots:   &snapshotStore{},
+		usage:       &usageStore{},
+		logger:      logger,
 	}
 }
 
-func (server *Server) Start() error {
-	router := server.makeRoutes()
+// Handler returns the http handler serving the server API
+func (server *Server) Handler() http.Handler {
+	return server.makeRoutes()
+}
 
-	// TODO use quic and http2
-	srv := &http.Server{
-		Handler:      router,
-		Addr:         server.address,
-		WriteTimeout: 15 * time.Second,
-		ReadTimeout:  15 * time.Second,
+// Start serves the API until a listener fails. HTTP/2 is served over TLS,
+// or in cleartext (h2c) if H2C is set, and HTTP/3 if TLS.HTTP3 is set. If
+// systemd passed sockets (socket activation) they are served instead of the
+// server address. The unix socket is served without TLS.
+func (server *Server) Start() error {
+	var tlsConfig *tls.Config
+	if server.TLS != nil {
+		var err error
+		if tlsConfig, err = server.tlsConfig(); err != nil {
+			return err
+		}
 	}
 
-	return srv.ListenAndServe()
-}
+	// the routes are made once, listeners share their handlers and file locks
+	router := server.Handler()
+	handler := router
+	var serveHTTP3 func() error
+	if tlsConfig != nil && server.TLS.HTTP3 {
+		var err error
+		if handler, serveHTTP3, err = server.withHTTP3(handler, tlsConfig); err != nil {
+			return err
+		}
+	}
 
-func (server *Server) makeRoutes() *mux.Router {
-	r := mux.NewRouter()
+	listeners, err := server.tcpListeners()
+	if err != nil {
+		return err
+	}
+	var unixListener net.Listener
+	if server.UnixSocket != nil {
+		if unixListener, err = listenUnix(server.UnixSocket); err != nil {
+			return err
+		}
+	}
 
-	// TODO add authentication middleware
+	srv := server.httpServer(handler, tlsConfig)
 
-	eHandler := endpointHanlder{Endpoints: server.endpoints}
-	r.HandleFunc("endpoints/{endpoint}", eHandler.Get).Methods(http.MethodGet)
-	r.HandleFunc("endpoints/list", eHandler.GetAll).Methods(http.MethodGet)
+	go server.purgeTrashLoop()
+	go server.purgeVersionsLoop()
+	go server.scanUsage()
 
-	fHandler := fileHandler{Endpoints: server.endpoints, MaxHashSize: server.MaxHashSize}
-	r.HandleFunc("files/{file}/hash", fHandler.GetHash).Methods(http.MethodGet)
-	r.HandleFunc("files/{file}", fHandler.Get).Methods(http.MethodGet)
-	r.HandleFunc("files/new", fHandler.AddNew).Methods(http.MethodPut)
-	// TODO r.HandleFunc("files/{file}/smart", fHandler.SmartGet).Methods.(http.MethodGet)
+	errs := make(chan error, len(listeners)+2)
+	if serveHTTP3 != nil {
+		go func() { errs <- serveHTTP3() }()
+	}
+	if unixListener != nil {
+		unixSrv := server.httpServer(withUnixSocket(router), nil)
+		go func() { errs <- unixSrv.Serve(unixListener) }()
+	}
+	for _, ln := range listeners {
+		go func(ln net.Listener) {
+			if tlsConfig != nil {
+				// certs are served by the tls config
+				errs <- srv.ServeTLS(ln, "", "")
+				return
+			}
+			errs <- srv.Serve(ln)
+		}(ln)
+	}
+	return <-errs
+}
 
-	return r
+// purgeTrashLoop purges old items from trash of endpoints periodically, since
+// items only age while nothing is deleted.
+func (server *Server) purgeTrashLoop() {
+	ticker := time.NewTicker(TRASH_PURGE_INTERVAL)
+	defer ticker.Stop()
+	for {
+		server.purgeTrash()
+		<-ticker.C
+	}
 }
 
-// TODO add testing
-// TODO is it ok to save tokens in memory?
-type AuthMiddleware struct {
-	Tokens map[string]bool
-	logger *log.Logger
+func (server *Server) purgeTrash() {
+	for name, endpoint := range server.configs {
+		if endpoint.Trash.Disabled {
+			continue
+		}
+		if err := server.trash.Purge(endpoint.Path, endpoint.Trash); err != nil {
+			server.logger.Logger.Errorw("error purging trash", "endpoint", name, "error", err.Error())
+		}
+	}
 }
 
-func (mid *AuthMiddleware) AuthMiddleware(h http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		errh := log.NewAPIErrHandler(mid.logger, r, w)
-		authHeader := strings.TrimSpace(r.Header.Get("Authurization"))
+// purgeVersionsLoop prunes old versions of files periodically, since versions
+// are only pruned on save otherwise.
+func (server *Server) purgeVersionsLoop() {
+	ticker := time.NewTicker(VERSIONS_PURGE_INTERVAL)
+	defer ticker.Stop()
+	for {
+		server.purgeVersions()
+		<-ticker.C
+	}
+}
 
-		if authHeader == "" {
-			errh.Warn(log.ErrUnauthorized())
-			return
+func (server *Server) purgeVersions() {
+	for name, endpoint := range server.configs {
+		if err := server.versions.Purge(endpoint.Path, endpoint.Versions); err != nil {
+			server.logger.Logger.Errorw("error purging versions", "endpoint", name, "error", err.Error())
 		}
+	}
+}
 
-		headerParts := strings.SplitN(authHeader, " ", 2)
-		if len(headerParts) < 2 {
-			errh.Warn(log.ErrBadAuth(authHeader))
-			return
+// scanUsage counts files of endpoints with quotas when the server starts, so
+// their first uploads do not wait for it
+func (server *Server) scanUsage() {
+	for name, endpoint := range server.configs {
+		if endpoint.Quota.MaxSize <= 0 && endpoint.Quota.UserMaxSize <= 0 && len(endpoint.Quota.Users) == 0 {
+			continue
+		}
+		if _, err := server.usage.Usage(endpoint.Path); err != nil {
+			server.logger.Logger.Errorw("error counting usage", "endpoint", name, "error", err.Error())
 		}
+	}
+}
+
+func (server *Server) makeRoutes() *mux.Router {
+	r := mux.NewRouter()
 
-		if headerParts[0] != "Berear" {
-			errh.Warn(log.ErrBadAuth(authHeader))
-			return
+	var limitMid *LimitMiddleware
+	if hasLimits(server.Limits) {
+		if server.limiter == nil {
+			server.limiter = newRateLimiter(server.Limits)
 		}
+		limitMid = &LimitMiddleware{limiter: server.limiter, logger: server.logger}
+		r.Use(limitMid.LimitClient)
+	}
 
-		// TODO maybe use a smarter authentication like jwt?
-		if _, ok := mid.Tokens[headerParts[1]]; !ok {
-			errh.Warn(log.ErrInvalidToken(headerParts[1]))
-			return
+	if !server.AuthDisabled {
+		authMid := AuthMiddleware{Tokens: server.Tokens, JWT: server.JWT, Shares: server.Shares, Configs: server.configs, logger: server.logger}
+		if server.TLS != nil {
+			authMid.ClientGrants = server.TLS.ClientGrants
+		}
+		if server.UnixSocket != nil {
+			authMid.UnixGrants = server.UnixSocket.Grants
 		}
+		r.Use(authMid.AuthMiddleware)
+	}
+	if limitMid != nil {
+		r.Use(limitMid.LimitToken)
+	}
+
+	eHandler := endpointHanlder{Endpoints: server.endpoints, Configs: server.configs, Digests: server.digests, Snapshots: server.snapshots, logger: server.logger}
+	r.HandleFunc("/endpoints/list", eHandler.GetAll).Methods(http.MethodGet).Name(ROUTE_ENDPOINTS_LIST)
+	r.HandleFunc("/endpoints/{endpoint}/digest", eHandler.GetDigest).Methods(http.MethodGet).Name(ROUTE_ENDPOINT_DIGEST)
+	r.HandleFunc("/endpoints/{endpoint}", eHandler.Get).Methods(http.MethodGet).Name(ROUTE_ENDPOINT_GET)
+
+	cHandler := conflictHandler{Endpoints: server.endpoints, Conflicts: server.conflicts, logger: server.logger}
+	r.HandleFunc("/endpoints/{endpoint}/conflicts", cHandler.List).Methods(http.MethodGet).Name(ROUTE_CONFLICTS_LIST)
+	r.HandleFunc("/endpoints/{endpoint}/conflicts/{id}", cHandler.Resolve).Methods(http.MethodDelete).Name(ROUTE_CONFLICT_RESOLVE)
+
+	fHandler := &fileHandler{
+		Endpoints:   server.endpoints,
+		Configs:     server.configs,
+		MaxHashSize: server.MaxHashSize,
+		Digests:     server.digests,
+		Conflicts:   server.conflicts,
+		Versions:    server.versions,
+		Trash:       server.trash,
+		Snapshots:   server.snapshots,
+		Shares:      server.Shares,
+		ShareMaxAge: server.ShareMaxAge,
+		Usage:       server.usage,
+		DiskReserve: server.DiskReserve,
+		logger:      server.logger,
+	}
+	// file paths contain slashes, more specific routes should be registered first
+	r.HandleFunc("/endpoints/{endpoint}/usage", fHandler.GetUsage).Methods(http.MethodGet).Name(ROUTE_ENDPOINT_USAGE)
+	r.HandleFunc("/endpoints/{endpoint}/trash", fHandler.ListTrash).Methods(http.MethodGet).Name(ROUTE_TRASH_LIST)
+	r.HandleFunc("/endpoints/{endpoint}/trash", fHandler.EmptyTrash).Methods(http.MethodDelete).Name(ROUTE_TRASH_EMPTY)
+	r.HandleFunc("/endpoints/{endpoint}/trash/{id}/restore", fHandler.RestoreTrash).Methods(http.MethodPost).Name(ROUTE_TRASH_RESTORE)
+	r.HandleFunc("/endpoints/{endpoint}/trash/{id}", fHandler.DeleteTrash).Methods(http.MethodDelete).Name(ROUTE_TRASH_DELETE)
+	r.HandleFunc("/endpoints/{endpoint}/snapshots", fHandler.ListSnapshots).Methods(http.MethodGet).Name(ROUTE_SNAPSHOTS_LIST)
+	r.HandleFunc("/endpoints/{endpoint}/snapshots/{snapshot}/restore", fHandler.RestoreSnapshot).Methods(http.MethodPost).Name(ROUTE_SNAPSHOT_RESTORE)
+	r.HandleFunc("/endpoints/{endpoint}/snapshots/{snapshot}", fHandler.CreateSnapshot).Methods(http.MethodPut).Name(ROUTE_SNAPSHOT_CREATE)
+	r.HandleFunc("/endpoints/{endpoint}/snapshots/{snapshot}", fHandler.DeleteSnapshot).Methods(http.MethodDelete).Name(ROUTE_SNAPSHOT_DELETE)
 
-		h.ServeHTTP(w, r)
-	})
+	if server.Shares != nil {
+		r.HandleFunc("/share/{link}", fHandler.GetShare).Methods(http.MethodGet).Name(ROUTE_SHARE_GET)
+		r.HandleFunc("/share/{link}", fHandler.RevokeShare).Methods(http.MethodDelete).Name(ROUTE_SHARE_REVOKE)
+		r.HandleFunc("/endpoints/{endpoint}/upload-links", fHandler.CreateUploadLink).Methods(http.MethodPost).Name(ROUTE_UPLOAD_LINK_CREATE)
+	}
+
+	r.HandleFunc("/files/new", fHandler.AddNew).Methods(http.MethodPut).Name(ROUTE_FILE_NEW)
+	r.HandleFunc("/files/{file:.+}/hash", fHandler.GetHash).Methods(http.MethodGet).Name(ROUTE_FILE_HASH)
+	if server.Shares != nil {
+		r.HandleFunc("/files/{file:.+}/share", fHandler.CreateShare).Methods(http.MethodPost).Name(ROUTE_FILE_SHARE)
+	}
+	r.HandleFunc("/files/{file:.+}/move", fHandler.Move).Methods(http.MethodPost).Name(ROUTE_FILE_MOVE)
+	r.HandleFunc("/files/{file:.+}/versions/{version}/restore", fHandler.RestoreVersion).Methods(http.MethodPost).Name(ROUTE_FILE_VERSION_RESTORE)
+	r.HandleFunc("/files/{file:.+}/versions/{version}", fHandler.GetVersion).Methods(http.MethodGet).Name(ROUTE_FILE_VERSION_GET)
+	r.HandleFunc("/files/{file:.+}/versions", fHandler.ListVersions).Methods(http.MethodGet).Name(ROUTE_FILE_VERSIONS)
+	r.HandleFunc("/files/{file:.+}/archive", fHandler.GetArchive).Methods(http.MethodGet).Name(ROUTE_FILE_ARCHIVE)
+	r.HandleFunc("/files/{file:.+}", fHandler.Get).Methods(http.MethodGet).Name(ROUTE_FILE_GET)
+	r.HandleFunc("/files/{file:.+}", fHandler.Delete).Methods(http.MethodDelete).Name(ROUTE_FILE_DELETE)
+	// TODO r.HandleFunc("/files/{file:.+}/smart", fHandler.SmartGet).Methods.(http.MethodGet)
+
+	return r
 }
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aigic8/gosyn/internal/auth"
+	"github.com/aigic8/gosyn/internal/server/log"
+)
+
+// CERT_CHECK_INTERVAL is how often cert files are checked for changes
+const CERT_CHECK_INTERVAL = 10 * time.Second
+
+// TLSOptions enables https, see config.TLSConfig
+type TLSOptions struct {
+	CertFile string
+	KeyFile  string
+	// ClientCAs verify client certs, mutual TLS is disabled if nil
+	ClientCAs         *x509.CertPool
+	RequireClientCert bool
+	// ClientGrants are grants of client certs by their subject common name or
+	// full subject
+	ClientGrants map[string][]auth.Grant
+	// HTTP3 serves HTTP/3 over QUIC too, Start fails with ErrNoHTTP3 in builds
+	// without the 'http3' build tag
+	HTTP3 bool
+}
+
+// certReloader serves the cert of cert and key files and reloads them when
+// they change. If the new files can not be loaded (like while they are
+// being replaced) the old cert is served.
+type certReloader struct {
+	certFile  string
+	keyFile   string
+	interval  time.Duration
+	logger    *log.Logger
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+func newCertReloader(certFile string, keyFile string, logger *log.Logger) (*certReloader, error) {
+	reloader := &certReloader{certFile: certFile, keyFile: keyFile, interval: CERT_CHECK_INTERVAL, logger: logger}
+	if err := reloader.reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+func (reloader *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	reloader.mu.Lock()
+	defer reloader.mu.Unlock()
+
+	if time.Since(reloader.checkedAt) >= reloader.interval {
+		if err := reloader.reload(); err != nil {
+			reloader.logger.Logger.Errorw("error reloading tls cert, serving the old cert", "certFile", reloader.certFile, "error", err.Error())
+		}
+	}
+	return reloader.cert, nil
+}
+
+// reload loads the cert if any of its files has changed
+func (reloader *certReloader) reload() error {
+	reloader.checkedAt = time.Now()
+	modTime, err := latestModTime(reloader.certFile, reloader.keyFile)
+	if err != nil {
+		return err
+	}
+	if reloader.cert != nil && modTime.Equal(reloader.modTime) {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(reloader.certFile, reloader.keyFile)
+	if err != nil {
+		return err
+	}
+	reloader.cert, reloader.modTime = &cert, modTime
+	return nil
+}
+
+func latestModTime(filePaths ...string) (time.Time, error) {
+	latest := time.Time{}
+	for _, filePath := range filePaths {
+		stat, err := os.Stat(filePath)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if stat.ModTime().After(latest) {
+			latest = stat.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (server *Server) tlsConfig() (*tls.Config, error) {
+	reloader, err := newCertReloader(server.TLS.CertFile, server.TLS.KeyFile, server.logger)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{GetCertificate: reloader.GetCertificate, MinVersion: tls.VersionTLS12}
+	if server.TLS.ClientCAs != nil {
+		tlsConfig.ClientCAs = server.TLS.ClientCAs
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		if server.TLS.RequireClientCert {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return tlsConfig, nil
+}
+
+// clientCertToken returns the token of the verified client cert of a request,
+// ok is false if there is no cert or its subject has no grants.
+func clientCertToken(r *http.Request, clientGrants map[string][]auth.Grant) (auth.Token, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return auth.Token{}, false
+	}
+
+	cert := r.TLS.VerifiedChains[0][0]
+	subject := cert.Subject.CommonName
+	grants, ok := clientGrants[subject]
+	if !ok {
+		subject = cert.Subject.String()
+		if grants, ok = clientGrants[subject]; !ok {
+			return auth.Token{}, false
+		}
+	}
+
+	expiresAt := cert.NotAfter
+	return auth.Token{
+		ID:        cert.SerialNumber.String(),
+		Name:      "cert " + subject,
+		Grants:    grants,
+		CreatedAt: cert.NotBefore,
+		ExpiresAt: &expiresAt,
+	}, true
+}
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aigic8/gosyn/internal/auth"
+	"github.com/aigic8/gosyn/internal/config"
+	"github.com/aigic8/gosyn/internal/server/log"
+	"gotest.tools/v3/assert"
+)
+
+type testCert struct {
+	Cert *x509.Certificate
+	Key  *ecdsa.PrivateKey
+}
+
+func TestCertReloader(t *testing.T) {
+	base := t.TempDir()
+	certFile, keyFile := path.Join(base, "cert.pem"), path.Join(base, "key.pem")
+	ca := makeTestCert(pkix.Name{CommonName: "gosyn ca"}, nil)
+	writeTestCert(makeTestCert(pkix.Name{CommonName: "first"}, &ca), certFile, keyFile)
+
+	logger, err := log.NewLogger()
+	if err != nil {
+		panic(err)
+	}
+	reloader, err := newCertReloader(certFile, keyFile, logger)
+	assert.NilError(t, err)
+	reloader.interval = 0
+
+	cert, err := reloader.GetCertificate(nil)
+	assert.NilError(t, err)
+	assert.Equal(t, "first", cert.Leaf.Subject.CommonName)
+
+	t.Run("rotated cert is loaded", func(t *testing.T) {
+		writeTestCert(makeTestCert(pkix.Name{CommonName: "second"}, &ca), certFile, keyFile)
+		later := time.Now().Add(time.Minute)
+		if err := os.Chtimes(certFile, later, later); err != nil {
+			panic(err)
+		}
+
+		cert, err := reloader.GetCertificate(nil)
+		assert.NilError(t, err)
+		assert.Equal(t, "second", cert.Leaf.Subject.CommonName)
+	})
+
+	t.Run("broken cert keeps the old cert", func(t *testing.T) {
+		if err := os.WriteFile(certFile, []byte("half written"), 0600); err != nil {
+			panic(err)
+		}
+		later := time.Now().Add(2 * time.Minute)
+		if err := os.Chtimes(certFile, later, later); err != nil {
+			panic(err)
+		}
+
+		cert, err := reloader.GetCertificate(nil)
+		assert.NilError(t, err)
+		assert.Equal(t, "second", cert.Leaf.Subject.CommonName)
+	})
+}
+
+func TestServerMutualTLS(t *testing.T) {
+	base := t.TempDir()
+	if err := mkDirs(base, []string{"songs", "photos"}); err != nil {
+		panic(err)
+	}
+	if err := mkFiles(base, []fileInfo{
+		{Path: "songs/time.txt", Data: []byte("Ticking away the moments")},
+		{Path: "photos/moon.txt", Data: []byte("dark side")},
+	}); err != nil {
+		panic(err)
+	}
+
+	ca := makeTestCert(pkix.Name{CommonName: "gosyn ca"}, nil)
+	certFile, keyFile := path.Join(base, "cert.pem"), path.Join(base, "key.pem")
+	writeTestCert(makeTestCert(pkix.Name{CommonName: "server"}, &ca), certFile, keyFile)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.Cert)
+
+	logger, err := log.NewLogger()
+	if err != nil {
+		panic(err)
+	}
+	srv := NewServer("", map[string]config.EndpointConfig{
+		"songs":  {Path: path.Join(base, "songs")},
+		"photos": {Path: path.Join(base, "photos")},
+	}, logger)
+	srv.TLS = &TLSOptions{
+		CertFile:  certFile,
+		KeyFile:   keyFile,
+		ClientCAs: clientCAs,
+		ClientGrants: map[string][]auth.Grant{
+			"office":            {{Endpoint: "songs", Permissions: []auth.Permission{auth.PermRead}}},
+			"CN=lab,O=Pink Lab": {{Endpoint: "photos", Permissions: []auth.Permission{auth.PermRead}}},
+		},
+	}
+
+	tlsConfig, err := srv.tlsConfig()
+	if err != nil {
+		panic(err)
+	}
+	// StartTLS of httptest would serve its own cert
+	ts := httptest.NewUnstartedServer(srv.Handler())
+	ts.Listener = tls.NewListener(ts.Listener, tlsConfig)
+	ts.Start()
+	defer ts.Close()
+	serverURL := strings.Replace(ts.URL, "http://", "https://", 1)
+
+	client := func(subject *pkix.Name, signer *testCert) *http.Client {
+		clientTLS := &tls.Config{RootCAs: x509.NewCertPool()}
+		clientTLS.RootCAs.AddCert(ca.Cert)
+		if subject != nil {
+			clientCert := makeTestCert(*subject, signer)
+			clientTLS.Certificates = []tls.Certificate{{Certificate: [][]byte{clientCert.Cert.Raw}, PrivateKey: clientCert.Key}}
+		}
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: clientTLS}}
+	}
+	get := func(c *http.Client, target string) int {
+		res, err := c.Get(serverURL + target)
+		if err != nil {
+			panic(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	officeClient := client(&pkix.Name{CommonName: "office"}, &ca)
+	assert.Equal(t, http.StatusOK, get(officeClient, "/files/songs/time.txt"))
+	assert.Equal(t, http.StatusForbidden, get(officeClient, "/files/photos/moon.txt"))
+
+	labClient := client(&pkix.Name{CommonName: "lab", Organization: []string{"Pink Lab"}}, &ca)
+	assert.Equal(t, http.StatusOK, get(labClient, "/files/photos/moon.txt"))
+
+	assert.Equal(t, http.StatusUnauthorized, get(client(nil, nil), "/files/songs/time.txt"))
+	assert.Equal(t, http.StatusUnauthorized, get(client(&pkix.Name{CommonName: "stranger"}, &ca), "/files/songs/time.txt"))
+
+	// certs of other CAs are never trusted
+	otherCA := makeTestCert(pkix.Name{CommonName: "other ca"}, nil)
+	assert.Equal(t, http.StatusUnauthorized, get(client(&pkix.Name{CommonName: "office"}, &otherCA), "/files/songs/time.txt"))
+}
+
+// makeTestCert makes a cert for localhost signed by signer, or a self signed
+// CA cert if signer is nil.
+func makeTestCert(subject pkix.Name, signer *testCert) testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		panic(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	parent, parentKey := template, key
+	if signer == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		parent, parentKey = signer.Cert, signer.Key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		panic(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		panic(err)
+	}
+	return testCert{Cert: cert, Key: key}
+}
+
+func writeTestCert(cert testCert, certFile string, keyFile string) {
+	keyDER, err := x509.MarshalECPrivateKey(cert.Key)
+	if err != nil {
+		panic(err)
+	}
+	if err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Cert.Raw}), 0600); err != nil {
+		panic(err)
+	}
+	if err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,413 @@
+package utils
+
+import (
+	"encoding/hex"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aigic8/gosyn/internal/ignore"
+	"github.com/cespare/xxhash"
+)
+
+// DigestEntry is one child of a directory in a merkle digest listing.
+// For files Digest is the content hash, for directories it is the digest
+// of their children (see DirDigest).
+type DigestEntry struct {
+	Name   string `json:"name"`
+	IsDir  bool   `json:"isDir"`
+	Digest string `json:"digest"`
+	// Symlink is the target of symlinks synced as links, their digest is
+	// LinkDigest of the target. Followed symlinks are digested like what they
+	// point to.
+	Symlink string `json:"symlink,omitempty"`
+}
+
+// DirDigest combines the digests of the children of a directory into the
+// digest of the directory itself. The order of children does not matter.
+func DirDigest(children []DigestEntry) string {
+	sorted := make([]DigestEntry, len(children))
+	copy(sorted, children)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+
+	hashWriter := xxhash.New()
+	for _, child := range sorted {
+		kind := "f"
+		if child.IsDir {
+			kind = "d"
+		}
+		hashWriter.Write([]byte(kind + "\x00" + child.Name + "\x00" + child.Digest + "\n"))
+	}
+	return hex.EncodeToString(hashWriter.Sum(nil))
+}
+
+// fileKey tells versions of a file apart. The change time is set by the file
+// system on every write, so a modification time set by clients can not make a
+// changed file look unchanged.
+type fileKey struct {
+	inode   uint64
+	ctime   int64
+	size    int64
+	modTime int64
+}
+
+func newFileKey(info os.FileInfo) fileKey {
+	inode, ctime := fileID(info)
+	return fileKey{inode: inode, ctime: ctime, size: info.Size(), modTime: info.ModTime().UnixNano()}
+}
+
+type digestCacheItem struct {
+	key  fileKey
+	hash string
+}
+
+// dirDigestItem is a cached digest of a directory, scope is the endpoint root,
+// symlink policy and path it was digested at since those decide its entries
+type dirDigestItem struct {
+	key      fileKey
+	scope    string
+	digest   string
+	entries  []DigestEntry
+	children []digestChild
+}
+
+// digestChild is a file or directory a cached directory digest was made from,
+// real is its resolved path and key its stat at the time
+type digestChild struct {
+	real   string
+	isDir  bool
+	key    fileKey
+	digest string
+}
+
+// digestCacheDir is a directory in the tree of a DigestCache
+type digestCacheDir struct {
+	files   map[string]digestCacheItem
+	subdirs map[string]*digestCacheDir
+	digest  *dirDigestItem
+}
+
+func newDigestCacheDir() *digestCacheDir {
+	return &digestCacheDir{files: map[string]digestCacheItem{}, subdirs: map[string]*digestCacheDir{}}
+}
+
+// DigestCache keeps file hashes and directory digests keyed by inode, change
+// time, size and modification time so unchanged files are not hashed again on
+// every digest request. Entries not seen when their directory is digested are
+// dropped. A directory digest also depends on files deeper in the directory,
+// so before it is used everything below it is checked against the stats it
+// was made from, which catches changes made outside the server. Writes of the
+// server call Invalidate so digests made while they happen are not cached.
+type DigestCache struct {
+	mu   sync.Mutex
+	root *digestCacheDir
+	// dependents are directories which include the digest of a directory
+	// they are not a parent of, through followed symlinks
+	dependents map[string]map[string]bool
+	// generation changes on every Invalidate, so digests made while a write
+	// happened are not cached
+	generation uint64
+}
+
+func NewDigestCache() *DigestCache {
+	return &DigestCache{root: newDigestCacheDir(), dependents: map[string]map[string]bool{}}
+}
+
+// FileDigest returns the hash of the file, using the cache if possible.
+// A nil cache always hashes the file.
+func (cache *DigestCache) FileDigest(filePath string, info os.FileInfo) (string, error) {
+	if cache == nil {
+		return HashFile(filePath)
+	}
+
+	key := newFileKey(info)
+	dirPath, name := path.Split(path.Clean(filePath))
+	cache.mu.Lock()
+	dir := cache.dir(dirPath, false)
+	item, ok := digestCacheItem{}, false
+	if dir != nil {
+		item, ok = dir.files[name]
+	}
+	cache.mu.Unlock()
+	if ok && item.key == key {
+		return item.hash, nil
+	}
+
+	hash, err := HashFile(filePath)
+	if err != nil {
+		return "", err
+	}
+
+	cache.mu.Lock()
+	cache.dir(dirPath, true).files[name] = digestCacheItem{key: key, hash: hash}
+	cache.mu.Unlock()
+	return hash, nil
+}
+
+// Invalidate drops digests of directories which depend on fullPath, it should
+// be called after fullPath is written, removed or renamed. A nil cache does
+// nothing.
+func (cache *DigestCache) Invalidate(fullPath string) {
+	if cache == nil {
+		return
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.generation++
+	cache.invalidate(path.Clean(fullPath), map[string]bool{})
+}
+
+func (cache *DigestCache) invalidate(fullPath string, visited map[string]bool) {
+	for dirPath := fullPath; !visited[dirPath]; dirPath = path.Dir(dirPath) {
+		visited[dirPath] = true
+		if dir := cache.dir(dirPath, false); dir != nil {
+			dir.digest = nil
+		}
+		for dependent := range cache.dependents[dirPath] {
+			cache.invalidate(dependent, visited)
+		}
+		delete(cache.dependents, dirPath)
+	}
+}
+
+// dir returns the cached directory at dirPath, which is made if create is
+// true. It returns nil if the directory is not cached.
+func (cache *DigestCache) dir(dirPath string, create bool) *digestCacheDir {
+	dir := cache.root
+	for _, name := range strings.Split(path.Clean(dirPath), "/") {
+		subdir, ok := dir.subdirs[name]
+		if !ok {
+			if !create {
+				return nil
+			}
+			subdir = newDigestCacheDir()
+			dir.subdirs[name] = subdir
+		}
+		dir = subdir
+	}
+	return dir
+}
+
+func (cache *DigestCache) currentGeneration() uint64 {
+	if cache == nil {
+		return 0
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	return cache.generation
+}
+
+// dirDigest returns the cached digest of the directory at dirPath, if nothing
+// below the directory changed since it was made
+func (cache *DigestCache) dirDigest(dirPath string, info os.FileInfo, scope string) (*dirDigestItem, bool) {
+	if cache == nil {
+		return nil, false
+	}
+	item := cache.cachedDirDigest(dirPath)
+	if item == nil || item.key != newFileKey(info) || item.scope != scope || !cache.unchanged(item) {
+		return nil, false
+	}
+	return item, true
+}
+
+func (cache *DigestCache) cachedDirDigest(dirPath string) *dirDigestItem {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	dir := cache.dir(dirPath, false)
+	if dir == nil {
+		return nil
+	}
+	return dir.digest
+}
+
+// unchanged checks the children of a cached directory digest against their
+// stats, cheapest first: files before walking into subdirectories, which
+// must have an unchanged cached digest themselves
+func (cache *DigestCache) unchanged(item *dirDigestItem) bool {
+	for _, child := range item.children {
+		if child.isDir {
+			continue
+		}
+		info, err := os.Stat(child.real)
+		if err != nil || newFileKey(info) != child.key {
+			return false
+		}
+	}
+	for _, child := range item.children {
+		if !child.isDir {
+			continue
+		}
+		info, err := os.Stat(child.real)
+		if err != nil || newFileKey(info) != child.key {
+			return false
+		}
+		subitem := cache.cachedDirDigest(child.real)
+		if subitem == nil || subitem.digest != child.digest || !cache.unchanged(subitem) {
+			return false
+		}
+	}
+	return true
+}
+
+// setDirDigest caches the digest of the directory at dirPath and drops cached
+// entries of it which are not in seen, unless something was invalidated since
+// generation
+func (cache *DigestCache) setDirDigest(dirPath string, item *dirDigestItem, seen map[string]bool, generation uint64) {
+	if cache == nil {
+		return
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	dir := cache.dir(dirPath, true)
+	for name := range dir.files {
+		if !seen[name] {
+			delete(dir.files, name)
+		}
+	}
+	for name := range dir.subdirs {
+		if !seen[name] && !IsMetaName(name) {
+			delete(dir.subdirs, name)
+		}
+	}
+	if item != nil && cache.generation == generation {
+		dir.digest = item
+	}
+}
+
+// addDependent records that the digest of dependent includes the digest of
+// dirPath
+func (cache *DigestCache) addDependent(dirPath string, dependent string) {
+	if cache == nil {
+		return
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if cache.dependents[dirPath] == nil {
+		cache.dependents[dirPath] = map[string]bool{}
+	}
+	cache.dependents[dirPath][dependent] = true
+}
+
+// Visibility reports whether a path of an endpoint is listed and, for
+// directories, whether everything in them is listed too
+type Visibility func(relPath string) (visible bool, all bool)
+
+// DigestDir returns the digest of the directory at dirPath and the digests of
+// its direct children. relPath is the path of the directory in the endpoint,
+// paths ignored by matcher or not visible are left out and symlinks are
+// treated by links. A nil visible lists everything.
+func DigestDir(dirPath string, relPath string, cache *DigestCache, matcher *ignore.Matcher, links *Links, visible Visibility) (string, []DigestEntry, error) {
+	if visible != nil {
+		if _, all := visible(relPath); all {
+			visible = nil
+		}
+	}
+	digest, entries, _, err := digestDir(dirPath, relPath, cache, matcher, links, visible, map[string]bool{})
+	return digest, entries, err
+}
+
+// digestDir is DigestDir which keeps directories being digested in visiting,
+// symlink loops are digested as empty directories. Digests of directories with
+// loops depend on where they were reached from, so they are not cached and
+// cacheable is false. Digests of partly visible directories depend on who
+// they are for, they are not cached either.
+func digestDir(dirPath string, relPath string, cache *DigestCache, matcher *ignore.Matcher, links *Links, visible Visibility, visiting map[string]bool) (digest string, entries []DigestEntry, cacheable bool, err error) {
+	dirCache := cache
+	if visible != nil {
+		dirCache = nil
+	}
+	stat, err := os.Stat(dirPath)
+	if err != nil {
+		return "", nil, false, err
+	}
+	scope := links.root + "\x00" + string(links.Policy) + "\x00" + relPath
+	generation := dirCache.currentGeneration()
+	if item, ok := dirCache.dirDigest(dirPath, stat, scope); ok {
+		return item.digest, item.entries, true, nil
+	}
+
+	visiting[dirPath] = true
+	defer delete(visiting, dirPath)
+
+	children, err := os.ReadDir(dirPath)
+	if err != nil {
+		return "", nil, false, err
+	}
+
+	cacheable = true
+	seen := map[string]bool{}
+	entries = make([]DigestEntry, 0, len(children))
+	digestChildren := make([]digestChild, 0, len(children))
+	for _, child := range children {
+		if IsMetaName(child.Name()) {
+			continue
+		}
+		childPath := path.Join(dirPath, child.Name())
+		linkEntry, err := links.Entry(childPath, child)
+		if err != nil {
+			return "", nil, false, err
+		}
+		if linkEntry == nil {
+			continue
+		}
+		isDir := linkEntry.Info.IsDir()
+
+		childRelPath := path.Join(relPath, child.Name())
+		ignored, err := matcher.Ignored(childRelPath, isDir)
+		if err != nil {
+			return "", nil, false, err
+		}
+		if ignored {
+			continue
+		}
+		childVisible := visible
+		if visible != nil {
+			isVisible, all := visible(childRelPath)
+			if !isVisible {
+				continue
+			}
+			if all {
+				childVisible = nil
+			}
+		}
+		seen[child.Name()] = true
+
+		entry := DigestEntry{Name: child.Name(), IsDir: isDir}
+		switch {
+		case isDir && visiting[linkEntry.Real]:
+			entry.Digest = DirDigest(nil)
+			cacheable = false
+		case isDir:
+			var childCacheable bool
+			if entry.Digest, _, childCacheable, err = digestDir(linkEntry.Real, childRelPath, cache, matcher, links, childVisible, visiting); err != nil {
+				return "", nil, false, err
+			}
+			cacheable = cacheable && childCacheable
+			if linkEntry.Real != childPath {
+				dirCache.addDependent(linkEntry.Real, dirPath)
+			}
+			digestChildren = append(digestChildren, digestChild{real: linkEntry.Real, isDir: true, key: newFileKey(linkEntry.Info), digest: entry.Digest})
+		case linkEntry.Info.Mode()&os.ModeSymlink != 0:
+			// replacing a symlink changes the directory, which is checked itself
+			entry.Symlink = linkEntry.Target
+			entry.Digest = LinkDigest(linkEntry.Target)
+		default:
+			if entry.Digest, err = cache.FileDigest(linkEntry.Real, linkEntry.Info); err != nil {
+				return "", nil, false, err
+			}
+			digestChildren = append(digestChildren, digestChild{real: linkEntry.Real, key: newFileKey(linkEntry.Info), digest: entry.Digest})
+		}
+		entries = append(entries, entry)
+	}
+
+	digest = DirDigest(entries)
+	var item *dirDigestItem
+	if cacheable {
+		item = &dirDigestItem{key: newFileKey(stat), scope: scope, digest: digest, entries: entries, children: digestChildren}
+	}
+	dirCache.setDirDigest(dirPath, item, seen, generation)
+	return digest, entries, cacheable, nil
+}
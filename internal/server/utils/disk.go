@@ -0,0 +1,15 @@
+//go:build linux || darwin
+
+package utils
+
+import "syscall"
+
+// FreeSpace returns the disk space in bytes available to unprivileged users
+// on the file system of a path.
+func FreeSpace(dirPath string) (int64, error) {
+	stat := syscall.Statfs_t{}
+	if err := syscall.Statfs(dirPath, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
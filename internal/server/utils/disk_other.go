@@ -0,0 +1,8 @@
+//go:build !linux && !darwin
+
+package utils
+
+// FreeSpace returns -1 since free disk space is not known on this platform
+func FreeSpace(dirPath string) (int64, error) {
+	return -1, nil
+}
@@ -0,0 +1,29 @@
+package utils
+
+import "strings"
+
+// ETag makes a strong entity tag from a file hash
+func ETag(hash string) string {
+	return `"` + hash + `"`
+}
+
+// MatchETag reports whether an If-Match header value matches the hash of the
+// current file. exists should be false if the file does not exist, in which
+// case nothing (not even '*') matches.
+func MatchETag(header string, hash string, exists bool) bool {
+	if !exists {
+		return false
+	}
+
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true
+		}
+		tag = strings.TrimPrefix(tag, "W/")
+		if strings.Trim(tag, `"`) == hash {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,17 @@
+//go:build darwin
+
+package utils
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileID returns the inode and the change time of a file in nanoseconds
+func fileID(info os.FileInfo) (uint64, int64) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0
+	}
+	return stat.Ino, stat.Ctimespec.Nano()
+}
@@ -0,0 +1,178 @@
+package utils
+
+import (
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/aigic8/gosyn/internal/config"
+	"github.com/cespare/xxhash"
+)
+
+// ErrSymlinkDenied is returned for paths going through symlinks which the
+// symlink policy of the endpoint does not follow
+var ErrSymlinkDenied = errors.New("symlink is not followed by the endpoint symlink policy")
+
+// Links applies the symlink policy of an endpoint to paths in it
+type Links struct {
+	Policy   config.SymlinkPolicy
+	root     string
+	realRoot string
+}
+
+// LinkEntry is a directory entry checked against the symlink policy. Info is
+// of the link target if the entry is a followed symlink, Real is the resolved
+// path of the entry.
+type LinkEntry struct {
+	Info   fs.FileInfo
+	Target string
+	Real   string
+}
+
+// NewLinks returns the symlink policy of the endpoint at root, an empty
+// policy follows symlinks in the endpoint
+func NewLinks(root string, policy config.SymlinkPolicy) (*Links, error) {
+	if policy == "" {
+		policy = config.SymlinksFollowWithin
+	}
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		realRoot = path.Clean(root)
+	}
+	return &Links{Policy: policy, root: path.Clean(root), realRoot: realRoot}, nil
+}
+
+// Resolve returns the real path to access fullPath, a path in the endpoint,
+// with followed symlinks replaced by their resolved path. With SymlinksAsLink a
+// symlink at the end of fullPath is returned as is and isLink is true. Paths
+// which do not exist are resolved up to their missing part.
+func (links *Links) Resolve(fullPath string) (resolved string, isLink bool, err error) {
+	rel, err := filepath.Rel(links.root, fullPath)
+	if err != nil {
+		return "", false, err
+	}
+	if rel == "." {
+		return links.realRoot, false, nil
+	}
+
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	curr := links.realRoot
+	for i, part := range parts {
+		curr = path.Join(curr, part)
+		info, err := os.Lstat(curr)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return path.Join(append([]string{curr}, parts[i+1:]...)...), false, nil
+			}
+			return "", false, err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+
+		switch links.Policy {
+		case config.SymlinksIgnore:
+			return "", false, ErrSymlinkDenied
+		case config.SymlinksAsLink:
+			if i == len(parts)-1 {
+				return curr, true, nil
+			}
+			return "", false, ErrSymlinkDenied
+		}
+
+		real, ok, err := links.follow(curr)
+		if err != nil {
+			return "", false, err
+		}
+		if !ok {
+			return "", false, ErrSymlinkDenied
+		}
+		curr = real
+	}
+	return curr, false, nil
+}
+
+// Rel returns the path of resolved, a path returned by Resolve, relative to
+// the endpoint. ok is false if it is out of the endpoint.
+func (links *Links) Rel(resolved string) (relPath string, ok bool, err error) {
+	rel, err := filepath.Rel(links.realRoot, resolved)
+	if err != nil {
+		return "", false, err
+	}
+	rel = filepath.ToSlash(rel)
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", false, nil
+	}
+	if rel == "." {
+		return "", true, nil
+	}
+	return rel, true, nil
+}
+
+// Entry checks a directory entry at entryPath against the policy, nil is
+// returned if the entry is hidden
+func (links *Links) Entry(entryPath string, entry fs.DirEntry) (*LinkEntry, error) {
+	if entry.Type()&os.ModeSymlink == 0 {
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		return &LinkEntry{Info: info, Real: entryPath}, nil
+	}
+
+	if links.Policy == config.SymlinksIgnore {
+		return nil, nil
+	}
+	target, err := os.Readlink(entryPath)
+	if err != nil {
+		return nil, err
+	}
+	if links.Policy == config.SymlinksAsLink {
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		return &LinkEntry{Info: info, Target: target, Real: entryPath}, nil
+	}
+
+	real, ok, err := links.follow(entryPath)
+	if err != nil || !ok {
+		return nil, err
+	}
+	info, err := os.Stat(real)
+	if err != nil {
+		return nil, err
+	}
+	return &LinkEntry{Info: info, Target: target, Real: real}, nil
+}
+
+// follow resolves a symlink, ok is false for dangling links and links out of
+// the endpoint if the policy does not follow them
+func (links *Links) follow(linkPath string) (string, bool, error) {
+	real, err := filepath.EvalSymlinks(linkPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	if links.Policy == config.SymlinksFollowAny {
+		return real, true, nil
+	}
+	isSubPath, err := IsSubPath(links.realRoot, real)
+	return real, isSubPath, err
+}
+
+// LinkDigest is the digest of symlinks synced as links
+func LinkDigest(target string) string {
+	hashWriter := xxhash.New()
+	hashWriter.Write([]byte("symlink\x00" + target))
+	return hex.EncodeToString(hashWriter.Sum(nil))
+}
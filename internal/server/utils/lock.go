@@ -0,0 +1,41 @@
+package utils
+
+import "sync"
+
+type keyedLock struct {
+	mu      sync.Mutex
+	holders int
+}
+
+// KeyedMutex is a set of mutexes keyed by string, like file paths.
+// The zero value is ready to use.
+type KeyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+// Lock locks key and returns the function unlocking it
+func (km *KeyedMutex) Lock(key string) func() {
+	km.mu.Lock()
+	if km.locks == nil {
+		km.locks = map[string]*keyedLock{}
+	}
+	lock, ok := km.locks[key]
+	if !ok {
+		lock = &keyedLock{}
+		km.locks[key] = lock
+	}
+	lock.holders++
+	km.mu.Unlock()
+
+	lock.mu.Lock()
+	return func() {
+		lock.mu.Unlock()
+		km.mu.Lock()
+		lock.holders--
+		if lock.holders == 0 {
+			delete(km.locks, key)
+		}
+		km.mu.Unlock()
+	}
+}
@@ -0,0 +1,30 @@
+package utils
+
+import (
+	"path"
+	"strings"
+)
+
+// META_DIR is the directory inside endpoints where gosyn keeps its own data.
+// Paths containing it or temp files starting with it are never exposed to clients.
+const META_DIR = ".gosyn"
+
+// IsMetaName reports whether a file name is reserved for gosyn
+func IsMetaName(name string) bool {
+	return name == META_DIR || strings.HasPrefix(name, META_DIR+"-")
+}
+
+// HasMetaPart reports whether any part of a slash separated path is reserved for gosyn
+func HasMetaPart(filePath string) bool {
+	for _, part := range strings.Split(filePath, "/") {
+		if IsMetaName(part) {
+			return true
+		}
+	}
+	return false
+}
+
+// MetaPath returns the path of an item inside the meta directory of an endpoint
+func MetaPath(endpointPath string, elem ...string) string {
+	return path.Join(append([]string{endpointPath, META_DIR}, elem...)...)
+}
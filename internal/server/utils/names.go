@@ -0,0 +1,120 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"syscall"
+
+	"github.com/aigic8/gosyn/internal/config"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+var (
+	// ErrNameNotPortable is returned for names which break clients on other
+	// platforms, like names reserved on Windows or not in NFC form
+	ErrNameNotPortable = errors.New("name is not portable")
+	// ErrNameCollision is returned for names which differ only in case or
+	// Unicode form from an existing name in the same directory
+	ErrNameCollision = errors.New("name collides with an existing name")
+)
+
+// BAD_NAME_CHARS are characters which Windows does not allow in names
+const BAD_NAME_CHARS = `<>:"\|?*`
+
+// reservedNames are device names of Windows, they are reserved with any
+// extension
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// PortableName returns a form of name which is valid on Linux, macOS and
+// Windows. It is in NFC form, bad and control characters are replaced with
+// '_', trailing dots and spaces are removed and reserved names get a '_'
+// after their base name, so 'CON.txt' becomes 'CON_.txt'.
+func PortableName(name string) string {
+	name = norm.NFC.String(name)
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || strings.ContainsRune(BAD_NAME_CHARS, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	name = strings.TrimRight(name, ". ")
+	if name == "" {
+		return "_"
+	}
+
+	base, ext, hasExt := strings.Cut(name, ".")
+	if reservedNames[strings.ToUpper(strings.TrimRight(base, " "))] {
+		if hasExt {
+			return base + "_." + ext
+		}
+		return base + "_"
+	}
+	return name
+}
+
+// CheckNames checks new names of filePath, a clean path relative to root,
+// against the names policy of an endpoint and returns the path to use. Names
+// which already exist are kept as they are, so files made before the policy
+// stay accessible.
+func CheckNames(root string, filePath string, policy config.NamesPolicy) (string, error) {
+	if policy == "" || policy == config.NamesAllow || filePath == "" {
+		return filePath, nil
+	}
+
+	parts := strings.Split(filePath, "/")
+	dir, dirExists := root, true
+	for i, name := range parts {
+		var names []string
+		if dirExists {
+			entries, err := os.ReadDir(dir)
+			// a missing parent or a file as parent is left to the caller
+			if err != nil && !errors.Is(err, os.ErrNotExist) && !errors.Is(err, syscall.ENOTDIR) {
+				return "", err
+			}
+			for _, entry := range entries {
+				names = append(names, entry.Name())
+			}
+			dirExists = err == nil
+		}
+
+		if portable := PortableName(name); portable != name && !slices.Contains(names, name) {
+			if policy == config.NamesReject {
+				return "", fmt.Errorf("%w: '%s'", ErrNameNotPortable, name)
+			}
+			parts[i] = portable
+		}
+		if collision, ok := findCollision(names, parts[i]); ok {
+			return "", fmt.Errorf("%w: '%s' and '%s'", ErrNameCollision, parts[i], collision)
+		}
+		dir = path.Join(dir, parts[i])
+	}
+	return strings.Join(parts, "/"), nil
+}
+
+// findCollision returns a name of names which is a different name than name
+// but is the same to case insensitive or normalizing file systems
+func findCollision(names []string, name string) (string, bool) {
+	if slices.Contains(names, name) {
+		return "", false
+	}
+	folded := foldName(name)
+	for _, n := range names {
+		if foldName(n) == folded {
+			return n, true
+		}
+	}
+	return "", false
+}
+
+func foldName(name string) string {
+	return cases.Fold().String(norm.NFC.String(name))
+}
@@ -11,6 +11,8 @@ import (
 	"strings"
 	"time"
 
+	"github.com/aigic8/gosyn/internal/config"
+	"github.com/aigic8/gosyn/internal/ignore"
 	"github.com/cespare/xxhash"
 )
 
@@ -73,44 +75,155 @@ type TreePath struct {
 	Size     int64               `json:"size"`
 	LastMod  time.Time           `json:"lastModifiction"`
 	Children map[string]TreePath `json:"children"`
+	// Symlink is the target of symlinks, IsDir and Size are of the target if
+	// the symlink is followed
+	Symlink string `json:"symlink,omitempty"`
+	// Mode is the permission bits, Xattrs are extended attributes of files in
+	// XATTR_PREFIX namespace
+	Mode   config.FileMode   `json:"mode,omitempty"`
+	Xattrs map[string][]byte `json:"xattrs,omitempty"`
 }
 
-func MakeTree(base string, tree map[string]TreePath) error {
-	for key, item := range tree {
+// MakeTree fills children of the directories of tree, whose items are in
+// base. Paths ignored by matcher, relative to the tree items, are left out and
+// symlinks are treated by links.
+func MakeTree(base string, tree map[string]TreePath, matcher *ignore.Matcher, links *Links) error {
+	for _, item := range tree {
 		if !item.IsDir {
 			continue
 		}
+		dirPath, _, err := links.Resolve(path.Join(base, item.Name))
+		if err != nil {
+			return err
+		}
+		if err := fillTree(dirPath, "", item.Children, matcher, links, map[string]bool{}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// fillTree adds entries of dirPath, which is at relPath of the tree root, to
+// children and recurses into directories. Directories being filled are kept
+// in visiting so symlink loops are not followed.
+func fillTree(dirPath string, relPath string, children map[string]TreePath, matcher *ignore.Matcher, links *Links, visiting map[string]bool) error {
+	visiting[dirPath] = true
+	defer delete(visiting, dirPath)
+
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return err
+	}
 
-		curr := path.Join(base, item.Name)
-		children, err := os.ReadDir(curr)
+	for _, entry := range entries {
+		if IsMetaName(entry.Name()) {
+			continue
+		}
+		linkEntry, err := links.Entry(path.Join(dirPath, entry.Name()), entry)
+		if err != nil {
+			return fmt.Errorf("error getting fileinfo: %v", err)
+		}
+		if linkEntry == nil {
+			continue
+		}
+		isDir := linkEntry.Info.IsDir()
+
+		entryRelPath := path.Join(relPath, entry.Name())
+		ignored, err := matcher.Ignored(entryRelPath, isDir)
 		if err != nil {
 			return err
 		}
+		if ignored {
+			continue
+		}
 
-		for _, child := range children {
-			var size int64
-			var modeTime time.Time
-			if !child.IsDir() {
-				info, err := child.Info()
-				if err != nil {
-					return fmt.Errorf("error getting fileinfo: %v", err)
-				}
-				size = info.Size()
-				modeTime = info.ModTime()
-			}
-			tree[key].Children[child.Name()] = TreePath{
-				IsDir:    child.IsDir(),
-				Name:     child.Name(),
-				Size:     size,
-				LastMod:  modeTime,
-				Children: map[string]TreePath{},
+		item := TreePath{
+			IsDir:    isDir,
+			Name:     entry.Name(),
+			Children: map[string]TreePath{},
+			Symlink:  linkEntry.Target,
+		}
+		// symlinks synced as links have no metadata of their own
+		if linkEntry.Info.Mode()&os.ModeSymlink == 0 {
+			item.Mode = config.FileMode(linkEntry.Info.Mode().Perm())
+		}
+		if linkEntry.Info.Mode().IsRegular() {
+			item.Size = linkEntry.Info.Size()
+			item.LastMod = linkEntry.Info.ModTime()
+			if item.Xattrs, err = ListXattrs(linkEntry.Real); err != nil {
+				return err
 			}
 		}
+		children[entry.Name()] = item
 
-		if err = MakeTree(curr, tree[key].Children); err != nil {
-			return err
+		if isDir && !visiting[linkEntry.Real] {
+			if err = fillTree(linkEntry.Real, entryRelPath, item.Children, matcher, links, visiting); err != nil {
+				return err
+			}
 		}
 	}
 
 	return nil
 }
+
+// UniquePath returns filePath if nothing exists there, otherwise the first free
+// path made by adding a counter to the name, like 'name 2.ext'.
+func UniquePath(filePath string) (string, error) {
+	dir, name := path.Split(filePath)
+	ext := path.Ext(name)
+	if ext == name {
+		ext = ""
+	}
+	stem := strings.TrimSuffix(name, ext)
+
+	candidate := filePath
+	for i := 2; ; i++ {
+		_, err := os.Lstat(candidate)
+		if errors.Is(err, os.ErrNotExist) {
+			return candidate, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		candidate = fmt.Sprintf("%s%s %d%s", dir, stem, i, ext)
+	}
+}
+
+// LinkOrCopy makes dst a hard link of src, or a copy of it if hard links are not possible
+func LinkOrCopy(src string, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	return CopyFile(src, dst)
+}
+
+// CopyFile copies content and permissions of src to dst
+func CopyFile(src string, dst string) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	info, err := srcFile.Stat()
+	if err != nil {
+		return err
+	}
+
+	dstFile, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(dstFile, srcFile); err != nil {
+		dstFile.Close()
+		return err
+	}
+	if err = dstFile.Close(); err != nil {
+		return err
+	}
+
+	// dst may have existed with other permissions
+	return os.Chmod(dst, info.Mode().Perm())
+}
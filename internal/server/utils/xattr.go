@@ -0,0 +1,39 @@
+package utils
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// XATTR_PREFIX is the namespace of synced extended attributes, other
+// namespaces belong to the system or need privileges
+const XATTR_PREFIX = "user."
+
+// ErrXattrsNotSupported is returned when extended attributes can not be set
+// on a platform or file system
+var ErrXattrsNotSupported = errors.New("extended attributes are not supported")
+
+// EncodeXattr writes an extended attribute as 'name=base64 value' to be sent
+// in 'x-xattr' headers
+func EncodeXattr(name string, value []byte) string {
+	return name + "=" + base64.StdEncoding.EncodeToString(value)
+}
+
+// DecodeXattr reads an extended attribute written by EncodeXattr, only
+// attributes of XATTR_PREFIX namespace are accepted
+func DecodeXattr(raw string) (string, []byte, error) {
+	name, rawValue, found := strings.Cut(strings.TrimSpace(raw), "=")
+	if !found {
+		return "", nil, fmt.Errorf("extended attribute '%s' is not in form of name=value", raw)
+	}
+	if !strings.HasPrefix(name, XATTR_PREFIX) || len(name) == len(XATTR_PREFIX) {
+		return "", nil, fmt.Errorf("extended attribute '%s' is not in '%s' namespace", name, XATTR_PREFIX)
+	}
+	value, err := base64.StdEncoding.DecodeString(rawValue)
+	if err != nil {
+		return "", nil, fmt.Errorf("value of extended attribute '%s' is not base64: %v", name, err)
+	}
+	return name, value, nil
+}
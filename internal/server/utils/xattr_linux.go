@@ -0,0 +1,64 @@
+//go:build linux
+
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"syscall"
+)
+
+// ListXattrs returns extended attributes of XATTR_PREFIX namespace of a file.
+// Files on file systems without extended attributes have none.
+func ListXattrs(filePath string) (map[string][]byte, error) {
+	size, err := syscall.Listxattr(filePath, nil)
+	if err != nil {
+		if errors.Is(err, syscall.ENOTSUP) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	names := make([]byte, size)
+	if size, err = syscall.Listxattr(filePath, names); err != nil {
+		return nil, err
+	}
+
+	xattrs := map[string][]byte{}
+	for _, rawName := range bytes.Split(names[:size], []byte{0}) {
+		name := string(rawName)
+		if !strings.HasPrefix(name, XATTR_PREFIX) {
+			continue
+		}
+		size, err := syscall.Getxattr(filePath, name, nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, size)
+		if size, err = syscall.Getxattr(filePath, name, value); err != nil {
+			return nil, err
+		}
+		xattrs[name] = value[:size]
+	}
+	if len(xattrs) == 0 {
+		return nil, nil
+	}
+	return xattrs, nil
+}
+
+// SetXattrs sets extended attributes of a file, ErrXattrsNotSupported is
+// returned if the file system does not support them
+func SetXattrs(filePath string, xattrs map[string][]byte) error {
+	for name, value := range xattrs {
+		if err := syscall.Setxattr(filePath, name, value, 0); err != nil {
+			if errors.Is(err, syscall.ENOTSUP) {
+				return ErrXattrsNotSupported
+			}
+			return err
+		}
+	}
+	return nil
+}
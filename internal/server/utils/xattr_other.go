@@ -0,0 +1,17 @@
+//go:build !linux
+
+package utils
+
+// ListXattrs returns no extended attributes since they are not read on this platform
+func ListXattrs(filePath string) (map[string][]byte, error) {
+	return nil, nil
+}
+
+// SetXattrs returns ErrXattrsNotSupported if there are attributes to set,
+// they are not written on this platform
+func SetXattrs(filePath string, xattrs map[string][]byte) error {
+	if len(xattrs) > 0 {
+		return ErrXattrsNotSupported
+	}
+	return nil
+}
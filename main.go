@@ -1,7 +1,403 @@
 package main
 
-import "fmt"
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aigic8/gosyn/internal/auth"
+	"github.com/aigic8/gosyn/internal/config"
+	"github.com/aigic8/gosyn/internal/ignore"
+	"github.com/aigic8/gosyn/internal/server"
+	"github.com/aigic8/gosyn/internal/server/log"
+	gosync "github.com/aigic8/gosyn/pkg/sync"
+)
+
+const usage = `usage:
+  gosyn serve [-config gosyn.json]
+  gosyn sync [-token TOKEN] [-cert FILE -key FILE] [-ca FILE] [-h2c] [-links] [-ignore PATTERN]... <dir> <server:endpoint>
+  gosyn token create [-file gosyn-tokens.json] [-expires DURATION] [-grant endpoint:perms[:paths]]... <name>
+  gosyn token list [-file gosyn-tokens.json]
+  gosyn token revoke [-file gosyn-tokens.json] <id or name>`
 
 func main() {
-	fmt.Println("Hello there")
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "serve":
+		err = serve(os.Args[2:])
+	case "sync":
+		err = syncDir(os.Args[2:])
+	case "token":
+		err = token(os.Args[2:])
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+func serve(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	configPath := flags.String("config", "gosyn.json", "path of config file")
+	flags.Parse(args)
+
+	conf, err := config.Load(*configPath)
+	if err != nil {
+		return fmt.Errorf("error loading config: %w", err)
+	}
+
+	logger, err := log.NewLogger()
+	if err != nil {
+		return fmt.Errorf("error making logger: %w", err)
+	}
+
+	srv := server.NewServer(conf.Server.Address, conf.Server.Endpoints, logger)
+	srv.H2C = conf.Server.H2C
+	if conf.Server.MaxHashSize != 0 {
+		srv.MaxHashSize = conf.Server.MaxHashSize
+	}
+
+	tokens, err := auth.OpenTokenStore(conf.Server.TokenFile)
+	if err != nil {
+		return fmt.Errorf("error reading token file: %w", err)
+	}
+	// the token store is always set, tokens created later take effect when it reloads
+	srv.Tokens = tokens
+	srv.AuthDisabled = conf.Server.Auth.Disabled
+
+	if conf.Server.JWT != nil {
+		if srv.JWT, err = makeJWTVerifier(conf.Server.JWT); err != nil {
+			return fmt.Errorf("error loading jwt keys: %w", err)
+		}
+	}
+
+	if srv.Shares, err = auth.OpenShareStore(conf.Server.Shares.KeyFile, conf.Server.Shares.StateFile); err != nil {
+		return fmt.Errorf("error opening share links state: %w", err)
+	}
+	srv.ShareMaxAge = time.Duration(conf.Server.Shares.MaxAge)
+	srv.Limits = conf.Server.Limits
+	srv.DiskReserve = conf.Server.DiskReserve
+
+	if conf.Server.TLS != nil {
+		if srv.TLS, err = makeTLSOptions(conf.Server.TLS); err != nil {
+			return fmt.Errorf("error loading tls config: %w", err)
+		}
+	}
+
+	if unixSocket := conf.Server.UnixSocket; unixSocket != nil {
+		srv.UnixSocket = &server.UnixSocketOptions{Path: unixSocket.Path, Mode: os.FileMode(unixSocket.Mode), Group: unixSocket.Group}
+		if srv.UnixSocket.Grants, err = parseGrants(unixSocket.Grants); err != nil {
+			return fmt.Errorf("unix socket: %w", err)
+		}
+	}
+
+	tokenCount, err := tokens.Len()
+	if err != nil {
+		return fmt.Errorf("error reading token file: %w", err)
+	}
+	switch {
+	case srv.AuthDisabled:
+		logger.Logger.Warnw("authentication is disabled by config, every request is served")
+	case tokenCount == 0 && srv.JWT == nil && (srv.TLS == nil || len(srv.TLS.ClientGrants) == 0) && (srv.UnixSocket == nil || len(srv.UnixSocket.Grants) == 0):
+		logger.Logger.Warnw("no tokens are created and jwt, client certs and unix socket grants are not configured, every request is denied until a token is created", "tokenFile", conf.Server.TokenFile)
+	}
+
+	logger.Logger.Infow("starting server", "address", conf.Server.Address)
+	return srv.Start()
+}
+
+func makeTLSOptions(conf *config.TLSConfig) (*server.TLSOptions, error) {
+	options := &server.TLSOptions{
+		CertFile:          conf.CertFile,
+		KeyFile:           conf.KeyFile,
+		RequireClientCert: conf.RequireClientCert,
+		HTTP3:             conf.HTTP3,
+		ClientGrants:      make(map[string][]auth.Grant, len(conf.Clients)),
+	}
+
+	if conf.ClientCAFile != "" {
+		caData, err := os.ReadFile(conf.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		options.ClientCAs = x509.NewCertPool()
+		if !options.ClientCAs.AppendCertsFromPEM(caData) {
+			return nil, fmt.Errorf("'%s': no certs found", conf.ClientCAFile)
+		}
+	}
+
+	for subject, rawGrants := range conf.Clients {
+		grants, err := parseGrants(rawGrants)
+		if err != nil {
+			return nil, fmt.Errorf("client '%s': %w", subject, err)
+		}
+		options.ClientGrants[subject] = grants
+	}
+	return options, nil
+}
+
+func parseGrants(rawGrants []string) ([]auth.Grant, error) {
+	grants := make([]auth.Grant, 0, len(rawGrants))
+	for _, rawGrant := range rawGrants {
+		grant, err := auth.ParseGrant(rawGrant)
+		if err != nil {
+			return nil, err
+		}
+		grants = append(grants, grant)
+	}
+	return grants, nil
+}
+
+func makeJWTVerifier(conf *config.JWTConfig) (*auth.JWTVerifier, error) {
+	verifier := &auth.JWTVerifier{
+		Secret:   []byte(conf.Secret),
+		Issuer:   conf.Issuer,
+		Audience: conf.Audience,
+		Leeway:   time.Duration(conf.Leeway),
+	}
+
+	for _, keyFile := range conf.PublicKeyFiles {
+		key, err := auth.LoadPublicKeyFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("'%s': %w", keyFile, err)
+		}
+		verifier.Keys = append(verifier.Keys, auth.JWTKey{Key: key})
+	}
+
+	if conf.JWKSFile != "" {
+		keys, err := auth.LoadJWKSFile(conf.JWKSFile)
+		if err != nil {
+			return nil, fmt.Errorf("'%s': %w", conf.JWKSFile, err)
+		}
+		verifier.Keys = append(verifier.Keys, keys...)
+	}
+
+	return verifier, nil
+}
+
+func syncDir(args []string) error {
+	flags := flag.NewFlagSet("sync", flag.ExitOnError)
+	token := flags.String("token", os.Getenv("GOSYN_TOKEN"), "authentication token (defaults to $GOSYN_TOKEN)")
+	certFile := flags.String("cert", "", "client cert file for mutual TLS")
+	keyFile := flags.String("key", "", "key file of the client cert")
+	caFile := flags.String("ca", "", "CA cert file to verify the server with, instead of system CAs")
+	h2c := flags.Bool("h2c", false, "use cleartext HTTP/2 with http servers which serve it")
+	links := flags.Bool("links", false, "sync symlinks as links, the endpoint must use the sync-as-link symlink policy")
+	ignorePatterns := patternsFlag{}
+	flags.Var(&ignorePatterns, "ignore", "gitignore style pattern of files which are not synced, added to rules of .gosynignore files (repeatable)")
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		return errors.New("sync needs a directory and a remote\n" + usage)
+	}
+	dir, remote := flags.Arg(0), flags.Arg(1)
+
+	serverAddr, endpoint, err := parseRemote(remote)
+	if err != nil {
+		return err
+	}
+
+	if *h2c && (*certFile != "" || *caFile != "") {
+		return errors.New("-h2c is cleartext HTTP/2, it can not be used with -cert or -ca")
+	}
+
+	client := gosync.NewClient(serverAddr, *token)
+	if *certFile != "" || *caFile != "" {
+		if client.HTTPClient, err = makeTLSClient(*certFile, *keyFile, *caFile); err != nil {
+			return err
+		}
+	}
+	if *h2c {
+		if !strings.HasPrefix(serverAddr, "http://") {
+			return errors.New("-h2c is only for http servers, https servers negotiate HTTP/2 themselves")
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetUnencryptedHTTP2(true)
+		client.HTTPClient = &http.Client{Transport: transport}
+	}
+
+	if err = ignore.Validate(ignorePatterns); err != nil {
+		return err
+	}
+
+	syncer := gosync.NewSyncer(dir, endpoint, client)
+	syncer.Ignore = ignorePatterns
+	syncer.Links = *links
+	result, err := syncer.Run()
+	if result != nil {
+		for _, action := range result.Actions {
+			fmt.Printf("%-14s %s\n", action.Kind, action.Path)
+		}
+		for _, conflict := range result.Conflicts {
+			switch {
+			case conflict.CopyPath != "":
+				fmt.Printf("%-14s %s (kept both, yours is '%s')\n", gosync.ActionConflict, conflict.Path, conflict.CopyPath)
+			case conflict.Resolution != "":
+				fmt.Printf("%-14s %s (%s)\n", gosync.ActionConflict, conflict.Path, conflict.Resolution)
+			default:
+				fmt.Printf("%-14s %s (unresolved, left untouched)\n", gosync.ActionConflict, conflict.Path)
+			}
+		}
+	}
+	return err
+}
+
+func token(args []string) error {
+	if len(args) == 0 {
+		return errors.New("token needs a command\n" + usage)
+	}
+
+	flags := flag.NewFlagSet("token "+args[0], flag.ExitOnError)
+	tokenFile := flags.String("file", config.DEFAULT_TOKEN_FILE, "path of token file")
+	expires := flags.Duration("expires", 0, "time until the token expires, never if zero")
+	grants := grantsFlag{}
+	flags.Var(&grants, "grant", "access of the token as endpoint:perms[:paths], like 'songs:list,read:pink-floyd' (repeatable, defaults to '*:admin')\npermissions are list, read, write, delete and admin")
+	flags.Parse(args[1:])
+
+	store, err := auth.OpenTokenStore(*tokenFile)
+	if err != nil {
+		return fmt.Errorf("error reading token file: %w", err)
+	}
+
+	switch args[0] {
+	case "create":
+		if flags.NArg() != 1 {
+			return errors.New("token create needs a name\n" + usage)
+		}
+		if len(grants) == 0 {
+			grants = grantsFlag{{Endpoint: auth.ALL_ENDPOINTS, Permissions: []auth.Permission{auth.PermAdmin}}}
+		}
+		_, rawToken, err := store.Create(flags.Arg(0), *expires, grants)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(os.Stderr, "the token is only shown once, keep it somewhere safe:")
+		fmt.Println(rawToken)
+	case "list":
+		tokens, err := store.List()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tGRANTS\tCREATED\tEXPIRES\tLAST USED")
+		for _, token := range tokens {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", token.ID, token.Name, grantsFlag(token.Grants).String(), formatTime(&token.CreatedAt), formatTime(token.ExpiresAt), formatTime(token.LastUsedAt))
+		}
+		return w.Flush()
+	case "revoke":
+		if flags.NArg() != 1 {
+			return errors.New("token revoke needs an id or a name\n" + usage)
+		}
+		revoked, err := store.Revoke(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		for _, token := range revoked {
+			fmt.Printf("revoked %s (%s)\n", token.ID, token.Name)
+		}
+	default:
+		return errors.New("unknown token command '" + args[0] + "'\n" + usage)
+	}
+	return nil
+}
+
+// grantsFlag is a repeatable flag of token grants
+type grantsFlag []auth.Grant
+
+func (grants *grantsFlag) Set(raw string) error {
+	grant, err := auth.ParseGrant(raw)
+	if err != nil {
+		return err
+	}
+	*grants = append(*grants, grant)
+	return nil
+}
+
+func (grants grantsFlag) String() string {
+	strs := make([]string, 0, len(grants))
+	for _, grant := range grants {
+		strs = append(strs, grant.String())
+	}
+	return strings.Join(strs, " ")
+}
+
+// patternsFlag is a repeatable flag of ignore patterns
+type patternsFlag []string
+
+func (patterns *patternsFlag) Set(raw string) error {
+	*patterns = append(*patterns, raw)
+	return nil
+}
+
+func (patterns patternsFlag) String() string {
+	return strings.Join(patterns, " ")
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02 15:04")
+}
+
+// makeTLSClient makes an http client which authenticates with the client cert
+// if certFile is set and verifies servers with certs of caFile if it is set
+func makeTLSClient(certFile string, keyFile string, caFile string) (*http.Client, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client cert: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if caFile != "" {
+		caData, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caData) {
+			return nil, fmt.Errorf("'%s': no certs found", caFile)
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport}, nil
+}
+
+// parseRemote splits 'server:endpoint', server can contain a scheme and port
+func parseRemote(remote string) (string, string, error) {
+	sepIndex := strings.LastIndex(remote, ":")
+	if sepIndex == -1 {
+		return "", "", fmt.Errorf("remote '%s' is not in form of server:endpoint", remote)
+	}
+
+	serverAddr, endpoint := remote[:sepIndex], remote[sepIndex+1:]
+	if serverAddr == "" || endpoint == "" {
+		return "", "", fmt.Errorf("remote '%s' is not in form of server:endpoint", remote)
+	}
+
+	if !strings.HasPrefix(serverAddr, "http://") && !strings.HasPrefix(serverAddr, "https://") {
+		serverAddr = "http://" + serverAddr
+	}
+	return serverAddr, endpoint, nil
 }
@@ -0,0 +1,309 @@
+package sync
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aigic8/gosyn/internal/config"
+	"github.com/aigic8/gosyn/internal/server/utils"
+)
+
+// Client talks to a gosyn server API. Host is sent to the server to name conflict copies.
+type Client struct {
+	BaseURL    string
+	Token      string
+	Host       string
+	HTTPClient *http.Client
+}
+
+// APIError is returned when the server responds with an error
+type APIError struct {
+	Status  int
+	Message string
+	Data    json.RawMessage
+}
+
+func (err *APIError) Error() string {
+	return fmt.Sprintf("server responded with status %d: %s", err.Status, err.Message)
+}
+
+type apiResponse[T any] struct {
+	Ok      bool   `json:"ok"`
+	Message string `json:"message"`
+	Data    T      `json:"data"`
+}
+
+type (
+	// DirDigest is the merkle digest of a remote directory and its direct children
+	DirDigest struct {
+		Path     string              `json:"path"`
+		Digest   string              `json:"digest"`
+		Children []utils.DigestEntry `json:"children"`
+	}
+
+	// FileMeta is the state of a remote file, Conflict is set if the request
+	// conflicted with a concurrent change.
+	FileMeta struct {
+		File     string            `json:"file"`
+		Exists   bool              `json:"exists"`
+		Hash     string            `json:"hash"`
+		Size     int64             `json:"size"`
+		LastMod  time.Time         `json:"lastModification"`
+		Mode     config.FileMode   `json:"mode"`
+		Xattrs   map[string][]byte `json:"xattrs"`
+		Conflict *Conflict         `json:"conflict"`
+	}
+
+	// FileMetadata is metadata of a file sent with uploads and received with
+	// downloads, zero fields are not sent. Xattrs are extended attributes of
+	// utils.XATTR_PREFIX namespace.
+	FileMetadata struct {
+		ModTime time.Time
+		Mode    os.FileMode
+		Xattrs  map[string][]byte
+	}
+
+	// Conflict is how the server resolved a conflicting write by the endpoint policy.
+	// Resolution is empty if the conflict is left to the user.
+	Conflict struct {
+		ID         string    `json:"id"`
+		File       string    `json:"file"`
+		CopyFile   string    `json:"copyFile"`
+		Policy     string    `json:"policy"`
+		Resolution string    `json:"resolution"`
+		Host       string    `json:"host"`
+		Time       time.Time `json:"time"`
+	}
+)
+
+const (
+	ResolutionServerVersion = "server-version"
+	ResolutionClientVersion = "client-version"
+	ResolutionKeptBoth      = "kept-both"
+)
+
+func NewClient(baseURL string, token string) *Client {
+	host, _ := os.Hostname()
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		Token:      token,
+		Host:       host,
+		HTTPClient: http.DefaultClient,
+	}
+}
+
+// Digests returns the digests of remote directories of the endpoint in one round trip
+func (c *Client) Digests(endpoint string, dirPaths []string) ([]DirDigest, error) {
+	query := url.Values{}
+	for _, dirPath := range dirPaths {
+		query.Add("path", dirPath)
+	}
+
+	reqURL := c.BaseURL + "/endpoints/" + url.PathEscape(endpoint) + "/digest?" + query.Encode()
+	req, err := http.NewRequest(http.MethodGet, reqURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := apiResponse[struct {
+		Digests []DirDigest `json:"digests"`
+	}]{}
+	if err = c.doJSON(req, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Data.Digests, nil
+}
+
+// Download writes the content of the remote file to w and returns its metadata
+func (c *Client) Download(endpoint string, filePath string, w io.Writer) (FileMetadata, error) {
+	req, err := http.NewRequest(http.MethodGet, c.fileURL(endpoint, filePath), nil)
+	if err != nil {
+		return FileMetadata{}, err
+	}
+
+	res, err := c.do(req)
+	if err != nil {
+		return FileMetadata{}, err
+	}
+	defer res.Body.Close()
+
+	metadata, err := parseMetadata(res.Header)
+	if err != nil {
+		return FileMetadata{}, err
+	}
+	_, err = io.Copy(w, res.Body)
+	return metadata, err
+}
+
+// parseMetadata reads metadata headers of a downloaded file
+func parseMetadata(header http.Header) (FileMetadata, error) {
+	metadata := FileMetadata{}
+	if rawModTime := header.Get("x-mtime"); rawModTime != "" {
+		modTime, err := time.Parse(time.RFC3339Nano, rawModTime)
+		if err != nil {
+			return metadata, fmt.Errorf("bad modification time '%s': %w", rawModTime, err)
+		}
+		metadata.ModTime = modTime
+	}
+	if rawMode := header.Get("x-mode"); rawMode != "" {
+		mode, err := strconv.ParseUint(rawMode, 8, 32)
+		if err != nil {
+			return metadata, fmt.Errorf("bad mode '%s': %w", rawMode, err)
+		}
+		metadata.Mode = os.FileMode(mode).Perm()
+	}
+	for _, rawXattr := range header.Values("x-xattr") {
+		name, value, err := utils.DecodeXattr(rawXattr)
+		if err != nil {
+			return metadata, err
+		}
+		if metadata.Xattrs == nil {
+			metadata.Xattrs = map[string][]byte{}
+		}
+		metadata.Xattrs[name] = value
+	}
+	return metadata, nil
+}
+
+// Upload writes content of r to the remote file. baseHash is the hash of the
+// remote file the change is based on, if the remote file has changed since the
+// endpoint conflict policy decides what happens. Empty baseHash means the
+// remote file should not exist. The server applies metadata to the file, the
+// modification time is also used by the newest-wins policy.
+func (c *Client) Upload(endpoint string, filePath string, r io.Reader, baseHash string, metadata FileMetadata) (*FileMeta, error) {
+	req, err := http.NewRequest(http.MethodPut, c.BaseURL+"/files/new", r)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("x-file-path", endpoint+"/"+filePath)
+	req.Header.Set("x-recursive", "true")
+	if !metadata.ModTime.IsZero() {
+		req.Header.Set("x-mtime", metadata.ModTime.UTC().Format(time.RFC3339Nano))
+	}
+	if metadata.Mode != 0 {
+		req.Header.Set("x-mode", fmt.Sprintf("%04o", metadata.Mode.Perm()))
+	}
+	for name, value := range metadata.Xattrs {
+		req.Header.Add("x-xattr", utils.EncodeXattr(name, value))
+	}
+	if c.Host != "" {
+		req.Header.Set("x-client-host", c.Host)
+	}
+	setPrecondition(req, baseHash)
+
+	resp := apiResponse[FileMeta]{}
+	if err = c.doJSON(req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp.Data, nil
+}
+
+// UploadLink makes the remote file a symlink to target, the endpoint must sync
+// symlinks as links. baseHash is like in Upload.
+func (c *Client) UploadLink(endpoint string, filePath string, target string, baseHash string) (*FileMeta, error) {
+	req, err := http.NewRequest(http.MethodPut, c.BaseURL+"/files/new", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("x-file-path", endpoint+"/"+filePath)
+	req.Header.Set("x-symlink-target", target)
+	req.Header.Set("x-recursive", "true")
+	setPrecondition(req, baseHash)
+
+	resp := apiResponse[FileMeta]{}
+	if err = c.doJSON(req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp.Data, nil
+}
+
+// Delete removes the remote file if its hash is still baseHash
+func (c *Client) Delete(endpoint string, filePath string, baseHash string) error {
+	req, err := http.NewRequest(http.MethodDelete, c.fileURL(endpoint, filePath), nil)
+	if err != nil {
+		return err
+	}
+	if c.Host != "" {
+		req.Header.Set("x-client-host", c.Host)
+	}
+	setPrecondition(req, baseHash)
+
+	return c.doJSON(req, &apiResponse[map[string]any]{})
+}
+
+// ConflictMeta returns the current remote file sent with err if the request
+// was rejected because the remote file has changed concurrently.
+func ConflictMeta(err error) (*FileMeta, bool) {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return nil, false
+	}
+	if apiErr.Status != http.StatusPreconditionFailed && apiErr.Status != http.StatusConflict {
+		return nil, false
+	}
+
+	meta := FileMeta{}
+	if len(apiErr.Data) != 0 {
+		if err := json.Unmarshal(apiErr.Data, &meta); err != nil {
+			return nil, false
+		}
+	}
+	return &meta, true
+}
+
+func setPrecondition(req *http.Request, baseHash string) {
+	if baseHash == "" {
+		req.Header.Set("If-None-Match", "*")
+		return
+	}
+	req.Header.Set("If-Match", `"`+baseHash+`"`)
+}
+
+func (c *Client) fileURL(endpoint string, filePath string) string {
+	parts := strings.Split(endpoint+"/"+filePath, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return c.BaseURL + "/files/" + strings.Join(parts, "/")
+}
+
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	res, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		defer res.Body.Close()
+		apiErr := &APIError{Status: res.StatusCode}
+		errResp := apiResponse[json.RawMessage]{}
+		if err := json.NewDecoder(res.Body).Decode(&errResp); err == nil {
+			apiErr.Message, apiErr.Data = errResp.Message, errResp.Data
+		}
+		return nil, apiErr
+	}
+
+	return res, nil
+}
+
+func (c *Client) doJSON(req *http.Request, v any) error {
+	res, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	return json.NewDecoder(res.Body).Decode(v)
+}
@@ -0,0 +1,58 @@
+package sync
+
+import "sort"
+
+type ActionKind string
+
+const (
+	ActionUpload       ActionKind = "upload"
+	ActionDownload     ActionKind = "download"
+	ActionDeleteLocal  ActionKind = "delete-local"
+	ActionDeleteRemote ActionKind = "delete-remote"
+	ActionConflict     ActionKind = "conflict"
+)
+
+// Action is a single operation needed to bring local and remote in sync
+type Action struct {
+	Kind ActionKind `json:"kind"`
+	Path string     `json:"path"`
+}
+
+// Diff computes a three-way difference between base, local and remote file
+// hashes, keyed by file path. A missing key means the file does not exist.
+// Files changed on both sides to different contents are reported as conflicts.
+func Diff(base map[string]string, local map[string]string, remote map[string]string) []Action {
+	paths := map[string]bool{}
+	for _, files := range []map[string]string{base, local, remote} {
+		for filePath := range files {
+			paths[filePath] = true
+		}
+	}
+
+	actions := []Action{}
+	for filePath := range paths {
+		baseHash, localHash, remoteHash := base[filePath], local[filePath], remote[filePath]
+
+		switch {
+		case localHash == remoteHash:
+			continue
+		case localHash == baseHash:
+			if remoteHash == "" {
+				actions = append(actions, Action{Kind: ActionDeleteLocal, Path: filePath})
+			} else {
+				actions = append(actions, Action{Kind: ActionDownload, Path: filePath})
+			}
+		case remoteHash == baseHash:
+			if localHash == "" {
+				actions = append(actions, Action{Kind: ActionDeleteRemote, Path: filePath})
+			} else {
+				actions = append(actions, Action{Kind: ActionUpload, Path: filePath})
+			}
+		default:
+			actions = append(actions, Action{Kind: ActionConflict, Path: filePath})
+		}
+	}
+
+	sort.Slice(actions, func(i, j int) bool { return actions[i].Path < actions[j].Path })
+	return actions
+}
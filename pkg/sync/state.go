@@ -0,0 +1,120 @@
+package sync
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aigic8/gosyn/internal/server/utils"
+)
+
+// META_DIR is the directory inside a synced directory where gosyn keeps its own data
+const META_DIR = utils.META_DIR
+
+const STATE_FILE = "state.json"
+
+// FileState is the last synced version of a file
+type FileState struct {
+	Hash    string    `json:"hash"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	// Link is the target of symlinks synced as links
+	Link string `json:"link,omitempty"`
+}
+
+// State is the local state database of a synced directory. Files holds the
+// versions of files at the last successful sync, which is the base of three-way diffs.
+type State struct {
+	Server   string               `json:"server"`
+	Endpoint string               `json:"endpoint"`
+	Files    map[string]FileState `json:"files"`
+}
+
+func StatePath(root string) string {
+	return path.Join(root, META_DIR, STATE_FILE)
+}
+
+// LoadState reads the state database of root. An empty state is returned if root was never synced.
+func LoadState(root string) (*State, error) {
+	data, err := os.ReadFile(StatePath(root))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return &State{Files: map[string]FileState{}}, nil
+		}
+		return nil, err
+	}
+
+	state := State{}
+	if err = json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	if state.Files == nil {
+		state.Files = map[string]FileState{}
+	}
+	return &state, nil
+}
+
+// Save atomically writes the state database of root
+func (state *State) Save(root string) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	statePath := StatePath(root)
+	if err = os.MkdirAll(path.Dir(statePath), 0777); err != nil {
+		return err
+	}
+
+	tmpPath := statePath + ".tmp"
+	if err = os.WriteFile(tmpPath, data, 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, statePath)
+}
+
+// dirDigests computes the merkle digest of every directory of files, keyed by
+// directory path ("" for root). Digests are comparable to the ones returned by the server.
+func dirDigests(files map[string]string) map[string]string {
+	children := map[string]map[string]utils.DigestEntry{"": {}}
+
+	for filePath, hash := range files {
+		parts := strings.Split(filePath, "/")
+		dir := ""
+		for i, part := range parts {
+			if _, ok := children[dir]; !ok {
+				children[dir] = map[string]utils.DigestEntry{}
+			}
+			if i == len(parts)-1 {
+				children[dir][part] = utils.DigestEntry{Name: part, Digest: hash}
+				break
+			}
+			children[dir][part] = utils.DigestEntry{Name: part, IsDir: true}
+			dir = path.Join(dir, part)
+		}
+	}
+
+	// children should be digested before parents, longer paths first does the job
+	dirs := make([]string, 0, len(children))
+	for dir := range children {
+		dirs = append(dirs, dir)
+	}
+	sort.Slice(dirs, func(i, j int) bool { return len(dirs[i]) > len(dirs[j]) })
+
+	digests := map[string]string{}
+	for _, dir := range dirs {
+		entries := make([]utils.DigestEntry, 0, len(children[dir]))
+		for name, entry := range children[dir] {
+			if entry.IsDir {
+				entry.Digest = digests[path.Join(dir, name)]
+			}
+			entries = append(entries, entry)
+		}
+		digests[dir] = utils.DirDigest(entries)
+	}
+	return digests
+}
@@ -0,0 +1,520 @@
+package sync
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aigic8/gosyn/internal/ignore"
+	"github.com/aigic8/gosyn/internal/server/utils"
+	"github.com/cespare/xxhash"
+)
+
+// DIGEST_BATCH_SIZE is the max number of directories asked in one digest request
+const DIGEST_BATCH_SIZE = 100
+
+// Syncer syncs a local directory with a remote endpoint in both directions
+type Syncer struct {
+	Root     string
+	Endpoint string
+	Client   *Client
+	// Ignore are gitignore style patterns of files which are not synced,
+	// they win over rules of .gosynignore files
+	Ignore []string
+	// Links syncs symlinks as links, the endpoint must use the sync-as-link
+	// symlink policy. Otherwise symlinks are skipped on both sides.
+	Links bool
+}
+
+// Result is what a sync run did
+type Result struct {
+	Actions   []Action
+	Conflicts []ConflictResult
+}
+
+// ConflictResult is a file changed on both sides. Resolution is decided by the
+// conflict policy of the endpoint, if it is empty both sides are left untouched.
+// CopyPath is where the local version is kept if both versions are kept.
+type ConflictResult struct {
+	Path       string
+	Resolution string
+	CopyPath   string
+}
+
+func NewSyncer(root string, endpoint string, client *Client) *Syncer {
+	return &Syncer{Root: root, Endpoint: endpoint, Client: client}
+}
+
+// Run computes the differences between local, remote and last synced state
+// and executes the needed uploads, downloads and deletes.
+func (s *Syncer) Run() (*Result, error) {
+	state, err := LoadState(s.Root)
+	if err != nil {
+		return nil, fmt.Errorf("error loading state: %w", err)
+	}
+	if state.Endpoint != "" && (state.Endpoint != s.Endpoint || state.Server != s.Client.BaseURL) {
+		return nil, fmt.Errorf("directory is synced with endpoint '%s' of '%s'", state.Endpoint, state.Server)
+	}
+	state.Server, state.Endpoint = s.Client.BaseURL, s.Endpoint
+
+	matcher, err := ignore.NewMatcher(s.Root, s.Ignore)
+	if err != nil {
+		return nil, err
+	}
+
+	local, err := scanLocal(s.Root, state.Files, matcher, s.Links)
+	if err != nil {
+		return nil, fmt.Errorf("error scanning local files: %w", err)
+	}
+
+	remote, remoteLinks, err := s.fetchRemote(state.Files)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching remote files: %w", err)
+	}
+
+	// ignored files are left alone on both sides, even if they were synced before
+	for _, files := range []map[string]string{remote, fileHashes(state.Files)} {
+		for filePath := range files {
+			ignored, err := matcher.Ignored(filePath, false)
+			if err != nil {
+				return nil, fmt.Errorf("error matching ignore rules: %w", err)
+			}
+			if ignored {
+				delete(remote, filePath)
+				delete(state.Files, filePath)
+			}
+		}
+	}
+
+	actions := Diff(fileHashes(state.Files), fileHashes(local), remote)
+
+	// files which are same on both sides are synced, even if they were not in the base
+	for filePath, localFile := range local {
+		if remote[filePath] == localFile.Hash {
+			state.Files[filePath] = localFile
+		}
+	}
+	for filePath := range state.Files {
+		if _, ok := local[filePath]; !ok && remote[filePath] == "" {
+			delete(state.Files, filePath)
+		}
+	}
+
+	result := &Result{Actions: []Action{}, Conflicts: []ConflictResult{}}
+	for _, action := range actions {
+		conflict, err := s.apply(action, state, local, remote, remoteLinks)
+		if err != nil {
+			if saveErr := state.Save(s.Root); saveErr != nil {
+				return result, fmt.Errorf("error saving state: %v (after %s '%s' failed: %v)", saveErr, action.Kind, action.Path, err)
+			}
+			return result, fmt.Errorf("error doing %s '%s': %w", action.Kind, action.Path, err)
+		}
+
+		if conflict != nil {
+			result.Conflicts = append(result.Conflicts, *conflict)
+			continue
+		}
+		result.Actions = append(result.Actions, action)
+	}
+
+	if err = state.Save(s.Root); err != nil {
+		return result, fmt.Errorf("error saving state: %w", err)
+	}
+	return result, nil
+}
+
+// apply executes an action and updates the state. Writes to the remote are based
+// on the last known remote version, if the remote has changed since (or the
+// action is a conflict) the server resolves the conflict by the endpoint policy
+// and the returned conflict result tells what happened. remoteLinks are
+// targets of remote symlinks.
+func (s *Syncer) apply(action Action, state *State, local map[string]FileState, remote map[string]string, remoteLinks map[string]string) (*ConflictResult, error) {
+	localPath := path.Join(s.Root, action.Path)
+	_, localExists := local[action.Path]
+
+	baseHash := remote[action.Path]
+	if action.Kind == ActionConflict {
+		baseHash = state.Files[action.Path].Hash
+	}
+
+	switch {
+	case (action.Kind == ActionUpload || (action.Kind == ActionConflict && localExists)) && local[action.Path].Link != "":
+		_, err := s.Client.UploadLink(s.Endpoint, action.Path, local[action.Path].Link, baseHash)
+		if _, ok := ConflictMeta(err); ok {
+			return &ConflictResult{Path: action.Path}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		state.Files[action.Path] = local[action.Path]
+		return nil, nil
+
+	case action.Kind == ActionUpload || (action.Kind == ActionConflict && localExists):
+		file, err := os.Open(localPath)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		metadata, err := localMetadata(file, local[action.Path])
+		if err != nil {
+			return nil, err
+		}
+		meta, err := s.Client.Upload(s.Endpoint, action.Path, file, baseHash, metadata)
+		if current, ok := ConflictMeta(err); ok {
+			return s.applyRejected(action.Path, state, current)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if meta.Conflict == nil {
+			state.Files[action.Path] = local[action.Path]
+			return nil, nil
+		}
+		return s.applyResolved(action.Path, state, local, meta.Conflict)
+
+	case action.Kind == ActionDeleteRemote || action.Kind == ActionConflict:
+		err := s.Client.Delete(s.Endpoint, action.Path, baseHash)
+		if current, ok := ConflictMeta(err); ok {
+			return s.applyRejected(action.Path, state, current)
+		}
+		var apiErr *APIError
+		if err != nil && !(errors.As(err, &apiErr) && apiErr.Status == http.StatusNotFound) {
+			return nil, err
+		}
+		delete(state.Files, action.Path)
+
+		if action.Kind == ActionConflict {
+			return &ConflictResult{Path: action.Path, Resolution: ResolutionClientVersion}, nil
+		}
+		return nil, nil
+
+	case action.Kind == ActionDownload && remoteLinks[action.Path] != "":
+		fileState, err := s.makeLink(action.Path, remoteLinks[action.Path])
+		if err != nil {
+			return nil, err
+		}
+		state.Files[action.Path] = fileState
+		return nil, nil
+
+	case action.Kind == ActionDownload:
+		fileState, err := s.download(action.Path)
+		if err != nil {
+			return nil, err
+		}
+		state.Files[action.Path] = fileState
+		return nil, nil
+
+	case action.Kind == ActionDeleteLocal:
+		if err := os.Remove(localPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		delete(state.Files, action.Path)
+		return nil, nil
+	}
+
+	return nil, fmt.Errorf("unknown action '%s'", action.Kind)
+}
+
+// applyRejected handles a write rejected because the remote file has changed.
+// If the server version wins the local file is replaced with it.
+func (s *Syncer) applyRejected(filePath string, state *State, current *FileMeta) (*ConflictResult, error) {
+	if current.Conflict == nil || current.Conflict.Resolution != ResolutionServerVersion {
+		return &ConflictResult{Path: filePath}, nil
+	}
+
+	if current.Exists {
+		fileState, err := s.download(filePath)
+		if err != nil {
+			return nil, err
+		}
+		state.Files[filePath] = fileState
+	} else {
+		if err := os.Remove(path.Join(s.Root, filePath)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		delete(state.Files, filePath)
+	}
+
+	return &ConflictResult{Path: filePath, Resolution: ResolutionServerVersion}, nil
+}
+
+// applyResolved handles a conflicting write accepted by the server. If both
+// versions are kept, the local file is moved to the same conflict copy path
+// as on the server and the remote version is downloaded in its place.
+func (s *Syncer) applyResolved(filePath string, state *State, local map[string]FileState, conflict *Conflict) (*ConflictResult, error) {
+	if conflict.Resolution != ResolutionKeptBoth {
+		state.Files[filePath] = local[filePath]
+		return &ConflictResult{Path: filePath, Resolution: conflict.Resolution}, nil
+	}
+
+	if err := os.Rename(path.Join(s.Root, filePath), path.Join(s.Root, conflict.CopyFile)); err != nil {
+		return nil, err
+	}
+	state.Files[conflict.CopyFile] = local[filePath]
+
+	fileState, err := s.download(filePath)
+	if err != nil {
+		return nil, err
+	}
+	state.Files[filePath] = fileState
+
+	return &ConflictResult{Path: filePath, Resolution: conflict.Resolution, CopyPath: conflict.CopyFile}, nil
+}
+
+// download writes the remote file to a temp file first, so an interrupted
+// download never leaves a half written file in place of the local one.
+func (s *Syncer) download(filePath string) (FileState, error) {
+	localPath := path.Join(s.Root, filePath)
+	dir := path.Dir(localPath)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return FileState{}, err
+	}
+
+	tmpFile, err := os.CreateTemp(dir, META_DIR+"-download-*")
+	if err != nil {
+		return FileState{}, err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	hashWriter := xxhash.New()
+	metadata, err := s.Client.Download(s.Endpoint, filePath, io.MultiWriter(tmpFile, hashWriter))
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return FileState{}, err
+	}
+	if err = applyMetadata(tmpFile.Name(), metadata); err != nil {
+		return FileState{}, err
+	}
+
+	if err = os.Rename(tmpFile.Name(), localPath); err != nil {
+		return FileState{}, err
+	}
+
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return FileState{}, err
+	}
+	return FileState{Hash: hex.EncodeToString(hashWriter.Sum(nil)), Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+// localMetadata returns metadata of a local file to upload. Modes which do not
+// let the owner read and write are not sent, the server needs both.
+func localMetadata(file *os.File, fileState FileState) (FileMetadata, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return FileMetadata{}, err
+	}
+	xattrs, err := utils.ListXattrs(file.Name())
+	if err != nil {
+		return FileMetadata{}, err
+	}
+
+	metadata := FileMetadata{ModTime: fileState.ModTime, Xattrs: xattrs}
+	if mode := info.Mode().Perm(); mode&0600 == 0600 {
+		metadata.Mode = mode
+	}
+	return metadata, nil
+}
+
+// applyMetadata sets metadata of a downloaded file. Extended attributes are
+// skipped if the local file system does not support them.
+func applyMetadata(filePath string, metadata FileMetadata) error {
+	if metadata.Mode != 0 {
+		if err := os.Chmod(filePath, metadata.Mode); err != nil {
+			return err
+		}
+	}
+	if err := utils.SetXattrs(filePath, metadata.Xattrs); err != nil && !errors.Is(err, utils.ErrXattrsNotSupported) {
+		return err
+	}
+	if !metadata.ModTime.IsZero() {
+		return os.Chtimes(filePath, time.Time{}, metadata.ModTime)
+	}
+	return nil
+}
+
+// makeLink replaces the local file with a symlink to target
+func (s *Syncer) makeLink(filePath string, target string) (FileState, error) {
+	localPath := path.Join(s.Root, filePath)
+	dir := path.Dir(localPath)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return FileState{}, err
+	}
+
+	tmpFile, err := os.CreateTemp(dir, META_DIR+"-link-*")
+	if err != nil {
+		return FileState{}, err
+	}
+	tmpFile.Close()
+	os.Remove(tmpFile.Name())
+	if err = os.Symlink(target, tmpFile.Name()); err != nil {
+		return FileState{}, err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if err = os.Rename(tmpFile.Name(), localPath); err != nil {
+		return FileState{}, err
+	}
+	info, err := os.Lstat(localPath)
+	if err != nil {
+		return FileState{}, err
+	}
+	return FileState{Hash: utils.LinkDigest(target), Size: info.Size(), ModTime: info.ModTime(), Link: target}, nil
+}
+
+// fetchRemote returns hashes of remote files and targets of remote symlinks.
+// It walks remote digests level by level and only descends into directories
+// which differ from the base state, files of unchanged directories are taken
+// from the base.
+func (s *Syncer) fetchRemote(base map[string]FileState) (map[string]string, map[string]string, error) {
+	baseHashes := fileHashes(base)
+	baseDigests := dirDigests(baseHashes)
+	remote := map[string]string{}
+	links := map[string]string{}
+
+	copyBase := func(dir string) {
+		for filePath, hash := range baseHashes {
+			if dir == "" || strings.HasPrefix(filePath, dir+"/") {
+				remote[filePath] = hash
+			}
+		}
+	}
+
+	queue := []string{""}
+	for len(queue) > 0 {
+		batch := queue
+		if len(batch) > DIGEST_BATCH_SIZE {
+			batch = batch[:DIGEST_BATCH_SIZE]
+		}
+		queue = queue[len(batch):]
+
+		digests, err := s.Client.Digests(s.Endpoint, batch)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, dir := range digests {
+			if digest, ok := baseDigests[dir.Path]; ok && digest == dir.Digest {
+				copyBase(dir.Path)
+				continue
+			}
+
+			for _, child := range dir.Children {
+				childPath := path.Join(dir.Path, child.Name)
+				if child.Symlink != "" {
+					if s.Links {
+						remote[childPath] = child.Digest
+						links[childPath] = child.Symlink
+					}
+					continue
+				}
+				if !child.IsDir {
+					remote[childPath] = child.Digest
+					continue
+				}
+				if digest, ok := baseDigests[childPath]; ok && digest == child.Digest {
+					copyBase(childPath)
+					continue
+				}
+				queue = append(queue, childPath)
+			}
+		}
+	}
+
+	return remote, links, nil
+}
+
+// scanLocal returns the state of local regular files which are not ignored by
+// matcher, and of symlinks if links is set. Files with the same size and
+// modification time as in base are not hashed again.
+func scanLocal(root string, base map[string]FileState, matcher *ignore.Matcher, links bool) (map[string]FileState, error) {
+	files := map[string]FileState{}
+
+	err := filepath.WalkDir(root, func(walkPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(root, walkPath)
+		if err != nil {
+			return err
+		}
+		relPath = filepath.ToSlash(relPath)
+
+		if utils.IsMetaName(d.Name()) && relPath != "." {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if relPath != "." {
+			ignored, err := matcher.Ignored(relPath, d.IsDir())
+			if err != nil {
+				return err
+			}
+			if ignored {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if links && d.Type()&fs.ModeSymlink != 0 {
+			target, err := os.Readlink(walkPath)
+			if err != nil {
+				return err
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			files[relPath] = FileState{Hash: utils.LinkDigest(target), Size: info.Size(), ModTime: info.ModTime(), Link: target}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		if baseFile, ok := base[relPath]; ok && baseFile.Size == info.Size() && baseFile.ModTime.Equal(info.ModTime()) {
+			files[relPath] = baseFile
+			return nil
+		}
+
+		hash, err := utils.HashFile(walkPath)
+		if err != nil {
+			return err
+		}
+		files[relPath] = FileState{Hash: hash, Size: info.Size(), ModTime: info.ModTime()}
+		return nil
+	})
+
+	return files, err
+}
+
+func fileHashes(files map[string]FileState) map[string]string {
+	hashes := make(map[string]string, len(files))
+	for filePath, file := range files {
+		hashes[filePath] = file.Hash
+	}
+	return hashes
+}
@@ -0,0 +1,420 @@
+package sync
+
+import (
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aigic8/gosyn/internal/config"
+	"github.com/aigic8/gosyn/internal/ignore"
+	"github.com/aigic8/gosyn/internal/server"
+	"github.com/aigic8/gosyn/internal/server/log"
+	"gotest.tools/v3/assert"
+)
+
+type diffTestCase struct {
+	Name   string
+	Base   string
+	Local  string
+	Remote string
+	Kind   ActionKind // empty for no action
+}
+
+func TestDiff(t *testing.T) {
+	cases := []diffTestCase{
+		{Name: "unchanged", Base: "a", Local: "a", Remote: "a"},
+		{Name: "same change", Base: "a", Local: "b", Remote: "b"},
+		{Name: "created on both same", Local: "b", Remote: "b"},
+		{Name: "local changed", Base: "a", Local: "b", Remote: "a", Kind: ActionUpload},
+		{Name: "local created", Local: "b", Kind: ActionUpload},
+		{Name: "local deleted", Base: "a", Remote: "a", Kind: ActionDeleteRemote},
+		{Name: "remote changed", Base: "a", Local: "a", Remote: "b", Kind: ActionDownload},
+		{Name: "remote created", Remote: "b", Kind: ActionDownload},
+		{Name: "remote deleted", Base: "a", Local: "a", Kind: ActionDeleteLocal},
+		{Name: "deleted on both", Base: "a"},
+		{Name: "changed on both", Base: "a", Local: "b", Remote: "c", Kind: ActionConflict},
+		{Name: "created on both", Local: "b", Remote: "c", Kind: ActionConflict},
+		{Name: "local changed remote deleted", Base: "a", Local: "b", Kind: ActionConflict},
+	}
+
+	toMap := func(hash string) map[string]string {
+		if hash == "" {
+			return map[string]string{}
+		}
+		return map[string]string{"file": hash}
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			actions := Diff(toMap(tc.Base), toMap(tc.Local), toMap(tc.Remote))
+			if tc.Kind == "" {
+				assert.Equal(t, 0, len(actions))
+				return
+			}
+			assert.DeepEqual(t, []Action{{Kind: tc.Kind, Path: "file"}}, actions)
+		})
+	}
+}
+
+func TestSyncerRun(t *testing.T) {
+	base := t.TempDir()
+	remoteDir, aDir, bDir := path.Join(base, "remote"), path.Join(base, "a"), path.Join(base, "b")
+	for _, dir := range []string{remoteDir, aDir, bDir} {
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			panic(err)
+		}
+	}
+
+	logger, err := log.NewLogger()
+	if err != nil {
+		panic(err)
+	}
+	srv := newOpenServer("", map[string]config.EndpointConfig{"songs": {Path: remoteDir}}, logger)
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+
+	aSyncer := NewSyncer(aDir, "songs", NewClient(ts.URL, ""))
+	bSyncer := NewSyncer(bDir, "songs", NewClient(ts.URL, ""))
+
+	writeFile(aDir, "time.txt", "Ticking away the moments")
+	writeFile(aDir, "old/echoes.txt", "Overhead the albatross")
+
+	t.Run("upload new files", func(t *testing.T) {
+		result, err := aSyncer.Run()
+		assert.NilError(t, err)
+		assert.DeepEqual(t, []Action{
+			{Kind: ActionUpload, Path: "old/echoes.txt"},
+			{Kind: ActionUpload, Path: "time.txt"},
+		}, result.Actions)
+		assert.Equal(t, "Overhead the albatross", readFile(remoteDir, "old/echoes.txt"))
+	})
+
+	t.Run("download new files", func(t *testing.T) {
+		result, err := bSyncer.Run()
+		assert.NilError(t, err)
+		assert.Equal(t, 2, len(result.Actions))
+		assert.Equal(t, "Ticking away the moments", readFile(bDir, "time.txt"))
+		assert.Equal(t, "Overhead the albatross", readFile(bDir, "old/echoes.txt"))
+	})
+
+	t.Run("nothing changed", func(t *testing.T) {
+		result, err := aSyncer.Run()
+		assert.NilError(t, err)
+		assert.Equal(t, 0, len(result.Actions))
+	})
+
+	t.Run("changes on both sides", func(t *testing.T) {
+		writeFile(bDir, "time.txt", "The time is gone, the song is over")
+		if err := os.Remove(path.Join(aDir, "old/echoes.txt")); err != nil {
+			panic(err)
+		}
+		writeFile(aDir, "money.txt", "Money, it's a gas")
+
+		_, err := aSyncer.Run()
+		assert.NilError(t, err)
+
+		result, err := bSyncer.Run()
+		assert.NilError(t, err)
+		assert.DeepEqual(t, []Action{
+			{Kind: ActionDownload, Path: "money.txt"},
+			{Kind: ActionDeleteLocal, Path: "old/echoes.txt"},
+			{Kind: ActionUpload, Path: "time.txt"},
+		}, result.Actions)
+
+		result, err = aSyncer.Run()
+		assert.NilError(t, err)
+		assert.DeepEqual(t, []Action{{Kind: ActionDownload, Path: "time.txt"}}, result.Actions)
+		assert.Equal(t, "The time is gone, the song is over", readFile(aDir, "time.txt"))
+	})
+
+	t.Run("conflict", func(t *testing.T) {
+		writeFile(aDir, "money.txt", "Grab that cash with both hands")
+		writeFile(bDir, "money.txt", "Share it fairly but don't take a slice of my pie")
+
+		_, err := aSyncer.Run()
+		assert.NilError(t, err)
+
+		result, err := bSyncer.Run()
+		assert.NilError(t, err)
+		assert.DeepEqual(t, []ConflictResult{{Path: "money.txt"}}, result.Conflicts)
+		assert.Equal(t, "Share it fairly but don't take a slice of my pie", readFile(bDir, "money.txt"))
+		assert.Equal(t, "Grab that cash with both hands", readFile(remoteDir, "money.txt"))
+	})
+
+	t.Run("other endpoint", func(t *testing.T) {
+		_, err := NewSyncer(aDir, "other", NewClient(ts.URL, "")).Run()
+		assert.ErrorContains(t, err, "synced with endpoint")
+	})
+}
+
+func TestSyncerConflictPolicies(t *testing.T) {
+	base := t.TempDir()
+
+	logger, err := log.NewLogger()
+	if err != nil {
+		panic(err)
+	}
+
+	endpoints := map[string]config.EndpointConfig{}
+	for _, policy := range []config.ConflictPolicy{config.ConflictServerWins, config.ConflictClientWins, config.ConflictKeepBoth} {
+		endpoints[string(policy)] = config.EndpointConfig{Path: path.Join(base, "remote", string(policy)), ConflictPolicy: policy}
+		if err := os.MkdirAll(endpoints[string(policy)].Path, 0777); err != nil {
+			panic(err)
+		}
+	}
+	srv := newOpenServer("", endpoints, logger)
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+
+	// makeConflict makes two synced dirs with different changes to the same file, a is synced first
+	makeConflict := func(endpoint string) (*Syncer, *Syncer) {
+		aSyncer := NewSyncer(path.Join(base, endpoint, "a"), endpoint, NewClient(ts.URL, ""))
+		aSyncer.Client.Host = "a"
+		bSyncer := NewSyncer(path.Join(base, endpoint, "b"), endpoint, NewClient(ts.URL, ""))
+		bSyncer.Client.Host = "b"
+
+		writeFile(aSyncer.Root, "time.txt", "Ticking away")
+		if _, err := aSyncer.Run(); err != nil {
+			panic(err)
+		}
+		if err := os.MkdirAll(bSyncer.Root, 0777); err != nil {
+			panic(err)
+		}
+		if _, err := bSyncer.Run(); err != nil {
+			panic(err)
+		}
+
+		writeFile(aSyncer.Root, "time.txt", "Ticking away the moments")
+		writeFile(bSyncer.Root, "time.txt", "Ticking away the moments that make up a dull day")
+		if _, err := aSyncer.Run(); err != nil {
+			panic(err)
+		}
+		return aSyncer, bSyncer
+	}
+
+	t.Run("server wins", func(t *testing.T) {
+		_, bSyncer := makeConflict(string(config.ConflictServerWins))
+		result, err := bSyncer.Run()
+		assert.NilError(t, err)
+		assert.DeepEqual(t, []ConflictResult{{Path: "time.txt", Resolution: ResolutionServerVersion}}, result.Conflicts)
+		assert.Equal(t, "Ticking away the moments", readFile(bSyncer.Root, "time.txt"))
+	})
+
+	t.Run("client wins", func(t *testing.T) {
+		_, bSyncer := makeConflict(string(config.ConflictClientWins))
+		result, err := bSyncer.Run()
+		assert.NilError(t, err)
+		assert.DeepEqual(t, []ConflictResult{{Path: "time.txt", Resolution: ResolutionClientVersion}}, result.Conflicts)
+		assert.Equal(t, "Ticking away the moments that make up a dull day", readFile(endpoints[string(config.ConflictClientWins)].Path, "time.txt"))
+	})
+
+	t.Run("keep both", func(t *testing.T) {
+		aSyncer, bSyncer := makeConflict(string(config.ConflictKeepBoth))
+		result, err := bSyncer.Run()
+		assert.NilError(t, err)
+		assert.Equal(t, 1, len(result.Conflicts))
+		conflict := result.Conflicts[0]
+		assert.Equal(t, ResolutionKeptBoth, conflict.Resolution)
+		assert.Assert(t, strings.HasPrefix(conflict.CopyPath, "time (conflict from b "))
+
+		remoteDir := endpoints[string(config.ConflictKeepBoth)].Path
+		assert.Equal(t, "Ticking away the moments", readFile(bSyncer.Root, "time.txt"))
+		assert.Equal(t, "Ticking away the moments that make up a dull day", readFile(bSyncer.Root, conflict.CopyPath))
+		assert.Equal(t, "Ticking away the moments that make up a dull day", readFile(remoteDir, conflict.CopyPath))
+
+		result, err = aSyncer.Run()
+		assert.NilError(t, err)
+		assert.DeepEqual(t, []Action{{Kind: ActionDownload, Path: conflict.CopyPath}}, result.Actions)
+
+		result, err = bSyncer.Run()
+		assert.NilError(t, err)
+		assert.Equal(t, 0, len(result.Actions)+len(result.Conflicts))
+	})
+}
+
+func TestSyncerIgnore(t *testing.T) {
+	base := t.TempDir()
+	remoteDir, aDir, bDir := path.Join(base, "remote"), path.Join(base, "a"), path.Join(base, "b")
+	for _, dir := range []string{remoteDir, aDir, bDir} {
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			panic(err)
+		}
+	}
+
+	logger, err := log.NewLogger()
+	if err != nil {
+		panic(err)
+	}
+	srv := newOpenServer("", map[string]config.EndpointConfig{"songs": {Path: remoteDir}}, logger)
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+
+	aSyncer := NewSyncer(aDir, "songs", NewClient(ts.URL, ""))
+	aSyncer.Ignore = []string{"*.tmp"}
+	bSyncer := NewSyncer(bDir, "songs", NewClient(ts.URL, ""))
+
+	writeFile(aDir, ignore.FILE_NAME, "node_modules/\n")
+	writeFile(aDir, "time.txt", "Ticking away the moments")
+	writeFile(aDir, "node_modules/left-pad/index.js", "module.exports = leftPad")
+	writeFile(aDir, "time.txt.tmp", "Ticking away")
+
+	result, err := aSyncer.Run()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []Action{
+		{Kind: ActionUpload, Path: ignore.FILE_NAME},
+		{Kind: ActionUpload, Path: "time.txt"},
+	}, result.Actions)
+
+	// b has no config patterns but gets the ignore file
+	writeFile(bDir, "money.tmp", "Money, it's a gas")
+	result, err = bSyncer.Run()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []Action{
+		{Kind: ActionDownload, Path: ignore.FILE_NAME},
+		{Kind: ActionUpload, Path: "money.tmp"},
+		{Kind: ActionDownload, Path: "time.txt"},
+	}, result.Actions)
+
+	writeFile(bDir, "node_modules/is-even/index.js", "module.exports = isEven")
+	result, err = bSyncer.Run()
+	assert.NilError(t, err)
+	assert.Equal(t, 0, len(result.Actions))
+	_, err = os.Stat(path.Join(remoteDir, "node_modules"))
+	assert.Assert(t, os.IsNotExist(err))
+
+	// files ignored by a are not downloaded or deleted
+	result, err = aSyncer.Run()
+	assert.NilError(t, err)
+	assert.Equal(t, 0, len(result.Actions))
+	assert.Equal(t, "Ticking away", readFile(aDir, "time.txt.tmp"))
+	_, err = os.Stat(path.Join(aDir, "money.tmp"))
+	assert.Assert(t, os.IsNotExist(err))
+}
+
+func TestSyncerLinks(t *testing.T) {
+	base := t.TempDir()
+	remoteDir, aDir, bDir := path.Join(base, "remote"), path.Join(base, "a"), path.Join(base, "b")
+	for _, dir := range []string{remoteDir, aDir, bDir} {
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			panic(err)
+		}
+	}
+
+	logger, err := log.NewLogger()
+	if err != nil {
+		panic(err)
+	}
+	srv := newOpenServer("", map[string]config.EndpointConfig{"songs": {Path: remoteDir, Symlinks: config.SymlinksAsLink}}, logger)
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+
+	aSyncer := NewSyncer(aDir, "songs", NewClient(ts.URL, ""))
+	aSyncer.Links = true
+	bSyncer := NewSyncer(bDir, "songs", NewClient(ts.URL, ""))
+	bSyncer.Links = true
+
+	writeFile(aDir, "pink-floyd/time.txt", "Ticking away the moments")
+	if err := os.Symlink("pink-floyd/time.txt", path.Join(aDir, "time.txt")); err != nil {
+		panic(err)
+	}
+
+	result, err := aSyncer.Run()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []Action{
+		{Kind: ActionUpload, Path: "pink-floyd/time.txt"},
+		{Kind: ActionUpload, Path: "time.txt"},
+	}, result.Actions)
+	target, err := os.Readlink(path.Join(remoteDir, "time.txt"))
+	assert.NilError(t, err)
+	assert.Equal(t, "pink-floyd/time.txt", target)
+
+	result, err = bSyncer.Run()
+	assert.NilError(t, err)
+	assert.Equal(t, 2, len(result.Actions))
+	target, err = os.Readlink(path.Join(bDir, "time.txt"))
+	assert.NilError(t, err)
+	assert.Equal(t, "pink-floyd/time.txt", target)
+
+	result, err = aSyncer.Run()
+	assert.NilError(t, err)
+	assert.Equal(t, 0, len(result.Actions))
+
+	if err := os.Remove(path.Join(bDir, "time.txt")); err != nil {
+		panic(err)
+	}
+	result, err = bSyncer.Run()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []Action{{Kind: ActionDeleteRemote, Path: "time.txt"}}, result.Actions)
+	_, err = os.Lstat(path.Join(remoteDir, "time.txt"))
+	assert.Assert(t, os.IsNotExist(err))
+}
+
+func TestSyncerMetadata(t *testing.T) {
+	base := t.TempDir()
+	remoteDir, aDir, bDir := path.Join(base, "remote"), path.Join(base, "a"), path.Join(base, "b")
+	for _, dir := range []string{remoteDir, aDir, bDir} {
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			panic(err)
+		}
+	}
+
+	logger, err := log.NewLogger()
+	if err != nil {
+		panic(err)
+	}
+	srv := newOpenServer("", map[string]config.EndpointConfig{"songs": {Path: remoteDir}}, logger)
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+
+	aSyncer := NewSyncer(aDir, "songs", NewClient(ts.URL, ""))
+	bSyncer := NewSyncer(bDir, "songs", NewClient(ts.URL, ""))
+
+	modTime := time.Date(1973, 3, 1, 12, 30, 0, 0, time.UTC)
+	writeFile(aDir, "time.sh", "Ticking away the moments")
+	if err := os.Chmod(path.Join(aDir, "time.sh"), 0750); err != nil {
+		panic(err)
+	}
+	if err := os.Chtimes(path.Join(aDir, "time.sh"), time.Time{}, modTime); err != nil {
+		panic(err)
+	}
+
+	_, err = aSyncer.Run()
+	assert.NilError(t, err)
+	_, err = bSyncer.Run()
+	assert.NilError(t, err)
+
+	for _, dir := range []string{remoteDir, bDir} {
+		stat, err := os.Stat(path.Join(dir, "time.sh"))
+		assert.NilError(t, err)
+		assert.Equal(t, os.FileMode(0750), stat.Mode().Perm())
+		assert.Assert(t, stat.ModTime().Equal(modTime))
+	}
+}
+
+// newOpenServer is server.NewServer with authentication disabled
+func newOpenServer(address string, configs map[string]config.EndpointConfig, logger *log.Logger) *server.Server {
+	srv := server.NewServer(address, configs, logger)
+	srv.AuthDisabled = true
+	return srv
+}
+
+func writeFile(base string, filePath string, data string) {
+	fullPath := path.Join(base, filePath)
+	if err := os.MkdirAll(path.Dir(fullPath), 0777); err != nil {
+		panic(err)
+	}
+	if err := os.WriteFile(fullPath, []byte(data), 0666); err != nil {
+		panic(err)
+	}
+}
+
+func readFile(base string, filePath string) string {
+	data, err := os.ReadFile(path.Join(base, filePath))
+	if err != nil {
+		panic(err)
+	}
+	return string(data)
+}